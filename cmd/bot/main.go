@@ -8,7 +8,6 @@ import (
 
 	"github.com/regiwitanto/tele-anonymous-chat/internal/bot"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
-	"github.com/regiwitanto/tele-anonymous-chat/internal/database"
 )
 
 func main() {
@@ -19,13 +18,13 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
-	// Initialize database
-	db, err := database.NewDB("database.db")
+	// Initialize storage
+	db, err := bot.OpenStore(cfg, "database.db")
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to initialize %s storage: %v", cfg.StorageBackend, err)
 	}
 	defer db.Close()
-	log.Println("Database initialized")
+	log.Printf("Storage initialized (%s)", cfg.StorageBackend)
 
 	// Create bot instance
 	telegramBot, err := bot.NewBot(cfg, db)
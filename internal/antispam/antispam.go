@@ -0,0 +1,242 @@
+// Package antispam keeps users from flooding their chat partners and from
+// sending the same advertisement to everyone they are matched with. Repeated
+// abuse escalates from warnings to temporary mutes to a suspension.
+package antispam
+
+import (
+	"sync"
+	"time"
+)
+
+// Action is what to do with a message after checking it
+type Action string
+
+const (
+	// Allow relays the message
+	Allow Action = "allow"
+
+	// Drop silently discards the message, e.g. while the user is muted
+	Drop Action = "drop"
+
+	// Warn discards the message and warns the user
+	Warn Action = "warn"
+
+	// Mute discards the message and mutes the user for a while
+	Mute Action = "mute"
+
+	// Suspend discards the message; the user should be suspended
+	Suspend Action = "suspend"
+)
+
+// Reason is the kind of abuse a message was caught for
+type Reason string
+
+const (
+	// Flooding means messages were sent faster than allowed
+	Flooding Reason = "flooding"
+
+	// Duplicate means the same message was sent to too many partners
+	Duplicate Reason = "duplicate"
+)
+
+// Verdict is the decision about a message
+type Verdict struct {
+	Action Action
+	Reason Reason
+
+	// Until is when a mute ends
+	Until time.Time
+}
+
+// Config sets the limits of a Guard
+type Config struct {
+	// Burst is how many messages may be sent at once
+	Burst int
+
+	// RefillInterval is how long it takes to earn one more message
+	RefillInterval time.Duration
+
+	// StrikeCooldown is how long after a strike further violations are
+	// dropped without counting, so a single burst is one strike
+	StrikeCooldown time.Duration
+
+	// StrikeWindow is how long strikes are remembered
+	StrikeWindow time.Duration
+
+	// MuteAfterStrikes is how many strikes get a user muted
+	MuteAfterStrikes int
+
+	// MuteDuration is how long a mute lasts
+	MuteDuration time.Duration
+
+	// MuteWindow is how long mutes are remembered
+	MuteWindow time.Duration
+
+	// SuspendAfterMutes is how many mutes get a user suspended
+	SuspendAfterMutes int
+
+	// DuplicatePartners is how many different partners may get the same message
+	DuplicatePartners int
+
+	// DuplicateWindow is how long sent messages are remembered
+	DuplicateWindow time.Duration
+
+	// MinDuplicateLength is how long a message must be to count as a
+	// duplicate, so greetings can be repeated
+	MinDuplicateLength int
+}
+
+// Guard tracks what every user sends and decides which messages get through
+type Guard struct {
+	config Config
+
+	mu    sync.Mutex
+	users map[int64]*userState
+}
+
+// userState is what a Guard remembers about a user
+type userState struct {
+	tokens     float64
+	lastRefill time.Time
+
+	strikes    int
+	lastStrike time.Time
+
+	mutes      int
+	lastMute   time.Time
+	mutedUntil time.Time
+
+	sent map[string]*sentMessage
+
+	// group is the album the user sent last and whether it was let through,
+	// so its other parts get the same verdict without costing more messages
+	group        string
+	groupAllowed bool
+}
+
+// NewGuard creates a guard with the given limits
+func NewGuard(config Config) *Guard {
+	return &Guard{
+		config: config,
+		users:  make(map[int64]*userState),
+	}
+}
+
+// Check decides whether a message from the user to their partner may be
+// relayed. text is what the user wrote, empty for messages without text.
+// groupID is the media group of an album part, empty for other messages: an
+// album is sent as one message, so its parts share the first part's verdict.
+func (g *Guard) Check(userID int64, partnerID int64, text string, groupID string, now time.Time) Verdict {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	user, ok := g.users[userID]
+	if !ok {
+		user = &userState{tokens: float64(g.config.Burst), lastRefill: now}
+		g.users[userID] = user
+	}
+
+	if now.Before(user.mutedUntil) {
+		return Verdict{Action: Drop}
+	}
+
+	if groupID != "" && groupID == user.group {
+		if user.groupAllowed {
+			return Verdict{Action: Allow}
+		}
+		return Verdict{Action: Drop}
+	}
+
+	verdict := g.check(userID, user, partnerID, text, now)
+	if groupID != "" {
+		user.group = groupID
+		user.groupAllowed = verdict.Action == Allow
+	}
+
+	return verdict
+}
+
+// check takes a message from the user's bucket and looks for duplicates
+func (g *Guard) check(userID int64, user *userState, partnerID int64, text string, now time.Time) Verdict {
+	if !g.takeToken(user, now) {
+		return g.strike(userID, user, Flooding, now)
+	}
+
+	if g.isDuplicate(user, partnerID, text, now) {
+		return g.strike(userID, user, Duplicate, now)
+	}
+
+	return Verdict{Action: Allow}
+}
+
+// Prune forgets users who have nothing left to remember
+func (g *Guard) Prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for userID, user := range g.users {
+		g.pruneSent(user, now)
+
+		idle := now.Sub(user.lastRefill) >= time.Duration(g.config.Burst)*g.config.RefillInterval
+		if idle &&
+			now.After(user.mutedUntil) &&
+			now.Sub(user.lastStrike) > g.config.StrikeWindow &&
+			now.Sub(user.lastMute) > g.config.MuteWindow &&
+			len(user.sent) == 0 {
+			delete(g.users, userID)
+		}
+	}
+}
+
+// takeToken refills the user's bucket and takes a message from it. It
+// returns false if the bucket is empty.
+func (g *Guard) takeToken(user *userState, now time.Time) bool {
+	if g.config.RefillInterval > 0 {
+		earned := float64(now.Sub(user.lastRefill)) / float64(g.config.RefillInterval)
+		user.tokens += earned
+		if user.tokens > float64(g.config.Burst) {
+			user.tokens = float64(g.config.Burst)
+		}
+	}
+	user.lastRefill = now
+
+	if user.tokens < 1 {
+		return false
+	}
+
+	user.tokens--
+	return true
+}
+
+// strike counts a violation and escalates from warnings to mutes to a suspension
+func (g *Guard) strike(userID int64, user *userState, reason Reason, now time.Time) Verdict {
+	if !user.lastStrike.IsZero() && now.Sub(user.lastStrike) < g.config.StrikeCooldown {
+		return Verdict{Action: Drop, Reason: reason}
+	}
+
+	if now.Sub(user.lastStrike) > g.config.StrikeWindow {
+		user.strikes = 0
+	}
+	user.strikes++
+	user.lastStrike = now
+
+	if user.strikes < g.config.MuteAfterStrikes {
+		return Verdict{Action: Warn, Reason: reason}
+	}
+
+	user.strikes = 0
+	if now.Sub(user.lastMute) > g.config.MuteWindow {
+		user.mutes = 0
+	}
+	user.mutes++
+	user.lastMute = now
+
+	if user.mutes >= g.config.SuspendAfterMutes {
+		// The suspension takes over; start afresh once it ends
+		delete(g.users, userID)
+		return Verdict{Action: Suspend, Reason: reason}
+	}
+
+	user.mutedUntil = now.Add(g.config.MuteDuration)
+	return Verdict{Action: Mute, Reason: reason, Until: user.mutedUntil}
+}
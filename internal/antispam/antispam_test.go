@@ -0,0 +1,193 @@
+package antispam
+
+import (
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	Burst:              3,
+	RefillInterval:     time.Second,
+	StrikeCooldown:     5 * time.Second,
+	StrikeWindow:       time.Minute,
+	MuteAfterStrikes:   2,
+	MuteDuration:       time.Minute,
+	MuteWindow:         time.Hour,
+	SuspendAfterMutes:  2,
+	DuplicatePartners:  2,
+	DuplicateWindow:    time.Hour,
+	MinDuplicateLength: 10,
+}
+
+func TestTokenBucket(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+
+	for i := 0; i < testConfig.Burst; i++ {
+		if v := g.Check(1, 2, "hi", "", now); v.Action != Allow {
+			t.Fatalf("message %d: got %s, want allow", i, v.Action)
+		}
+	}
+
+	v := g.Check(1, 2, "hi", "", now)
+	if v.Action != Warn || v.Reason != Flooding {
+		t.Fatalf("got %s/%s, want warn/flooding", v.Action, v.Reason)
+	}
+
+	// Further messages in the same burst don't count as new strikes
+	if v := g.Check(1, 2, "hi", "", now.Add(time.Second/2)); v.Action != Drop {
+		t.Fatalf("got %s, want drop", v.Action)
+	}
+
+	// A token is earned back over time
+	if v := g.Check(1, 2, "hi", "", now.Add(2*time.Second)); v.Action != Allow {
+		t.Fatalf("got %s after refill, want allow", v.Action)
+	}
+
+	// Other users have their own bucket
+	if v := g.Check(3, 2, "hi", "", now); v.Action != Allow {
+		t.Fatalf("other user: got %s, want allow", v.Action)
+	}
+}
+
+func TestAlbumCostsOneMessage(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+
+	// An album of ten parts fits in a burst of three
+	for i := 0; i < 10; i++ {
+		if v := g.Check(1, 2, "", "album", now); v.Action != Allow {
+			t.Fatalf("part %d: got %s, want allow", i, v.Action)
+		}
+	}
+	for i := 1; i < testConfig.Burst; i++ {
+		if v := g.Check(1, 2, "hi", "", now); v.Action != Allow {
+			t.Fatalf("message %d after the album: got %s, want allow", i, v.Action)
+		}
+	}
+
+	// A second album over the limit is held back as a whole, with one strike
+	if v := g.Check(1, 2, "", "second", now); v.Action != Warn {
+		t.Fatalf("first part over the limit: got %s, want warn", v.Action)
+	}
+	if v := g.Check(1, 2, "", "second", now.Add(2*time.Second)); v.Action != Drop {
+		t.Fatalf("later part of a held back album: got %s, want drop", v.Action)
+	}
+}
+
+// flood sends messages until the bucket is empty and returns the verdict on
+// the first one that didn't get through
+func flood(g *Guard, userID int64, now time.Time) Verdict {
+	for i := 0; i < 100; i++ {
+		if v := g.Check(userID, 2, "hi", "", now); v.Action != Allow {
+			return v
+		}
+	}
+	return Verdict{Action: Allow}
+}
+
+func TestEscalation(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+
+	if v := flood(g, 1, now); v.Action != Warn {
+		t.Fatalf("first strike: got %s, want warn", v.Action)
+	}
+
+	now = now.Add(10 * time.Second)
+	v := flood(g, 1, now)
+	if v.Action != Mute {
+		t.Fatalf("second strike: got %s, want mute", v.Action)
+	}
+	if want := now.Add(testConfig.MuteDuration); !v.Until.Equal(want) {
+		t.Errorf("muted until %v, want %v", v.Until, want)
+	}
+
+	// Muted users' messages are dropped, even with tokens to spare
+	now = now.Add(30 * time.Second)
+	if v := g.Check(1, 2, "hi", "", now); v.Action != Drop {
+		t.Fatalf("while muted: got %s, want drop", v.Action)
+	}
+
+	now = now.Add(time.Minute)
+	if v := flood(g, 1, now); v.Action != Warn {
+		t.Fatalf("after mute: got %s, want warn", v.Action)
+	}
+
+	now = now.Add(10 * time.Second)
+	if v := flood(g, 1, now); v.Action != Suspend {
+		t.Fatalf("second mute: got %s, want suspend", v.Action)
+	}
+
+	// Suspended users start afresh
+	now = now.Add(time.Minute)
+	if v := g.Check(1, 2, "hi", "", now); v.Action != Allow {
+		t.Fatalf("after suspension: got %s, want allow", v.Action)
+	}
+}
+
+func TestStrikesExpire(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+
+	flood(g, 1, now)
+
+	now = now.Add(2 * testConfig.StrikeWindow)
+	if v := flood(g, 1, now); v.Action != Warn {
+		t.Fatalf("got %s, want warn once the first strike expired", v.Action)
+	}
+}
+
+func TestDuplicateMessages(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+	ad := "Join my channel for free stuff"
+
+	for partner := int64(10); partner < 10+int64(testConfig.DuplicatePartners); partner++ {
+		now = now.Add(time.Minute)
+		if v := g.Check(1, partner, ad, "", now); v.Action != Allow {
+			t.Fatalf("partner %d: got %s, want allow", partner, v.Action)
+		}
+		// Repeating it to the same partner is fine
+		now = now.Add(time.Minute)
+		if v := g.Check(1, partner, ad, "", now); v.Action != Allow {
+			t.Fatalf("partner %d again: got %s, want allow", partner, v.Action)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	v := g.Check(1, 99, "  JOIN my channel   for free stuff ", "", now)
+	if v.Action != Warn || v.Reason != Duplicate {
+		t.Fatalf("got %s/%s, want warn/duplicate", v.Action, v.Reason)
+	}
+
+	// Short messages like greetings may be repeated
+	for partner := int64(10); partner < 20; partner++ {
+		now = now.Add(time.Minute)
+		if v := g.Check(2, partner, "hi there", "", now); v.Action != Allow {
+			t.Fatalf("greeting to partner %d: got %s, want allow", partner, v.Action)
+		}
+	}
+
+	// Sent messages are forgotten after the window
+	now = now.Add(2 * testConfig.DuplicateWindow)
+	if v := g.Check(1, 100, ad, "", now); v.Action != Allow {
+		t.Fatalf("after window: got %s, want allow", v.Action)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	g := NewGuard(testConfig)
+	now := time.Now()
+
+	g.Check(1, 2, "hi", "", now)
+	flood(g, 3, now)
+
+	g.Prune(now.Add(30 * time.Second))
+	if _, ok := g.users[1]; ok {
+		t.Error("idle user was not pruned")
+	}
+	if _, ok := g.users[3]; !ok {
+		t.Error("user with a recent strike was pruned")
+	}
+}
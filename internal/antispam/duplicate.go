@@ -0,0 +1,52 @@
+package antispam
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sentMessage tracks which partners got a message
+type sentMessage struct {
+	partners map[int64]bool
+	lastSent time.Time
+}
+
+// isDuplicate records that the user sent text to the partner and reports
+// whether it has now reached more different partners than allowed
+func (g *Guard) isDuplicate(user *userState, partnerID int64, text string, now time.Time) bool {
+	key := normalize(text)
+	if utf8.RuneCountInString(key) < g.config.MinDuplicateLength {
+		return false
+	}
+
+	g.pruneSent(user, now)
+	if user.sent == nil {
+		user.sent = make(map[string]*sentMessage)
+	}
+
+	sent, ok := user.sent[key]
+	if !ok {
+		sent = &sentMessage{partners: make(map[int64]bool)}
+		user.sent[key] = sent
+	}
+	sent.partners[partnerID] = true
+	sent.lastSent = now
+
+	return len(sent.partners) > g.config.DuplicatePartners
+}
+
+// pruneSent forgets messages the user hasn't sent for a while
+func (g *Guard) pruneSent(user *userState, now time.Time) {
+	for key, sent := range user.sent {
+		if now.Sub(sent.lastSent) > g.config.DuplicateWindow {
+			delete(user.sent, key)
+		}
+	}
+}
+
+// normalize makes copies of a message that differ only in case and spacing
+// compare equal
+func normalize(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
@@ -2,33 +2,39 @@ package bot
 
 import (
 	"log"
+	"net/http"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
-	"github.com/regiwitanto/tele-anonymous-chat/internal/database"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/handlers"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/queue"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
 )
 
 // Bot represents the Telegram bot
 type Bot struct {
 	api      *tgbotapi.BotAPI
-	db       *database.DB
+	db       store.Store
 	msgQueue *queue.MessageQueue
 	handlers *handlers.HandlerManager
 	config   *config.Config
+	workers  *workerPool
 	stopChan chan struct{}
+
+	// server receives updates in webhook mode
+	server         *http.Server
+	webhookUpdates chan tgbotapi.Update
 }
 
 // NewBot creates a new Bot instance
-func NewBot(cfg *config.Config, db *database.DB) (*Bot, error) {
+func NewBot(cfg *config.Config, db store.Store) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
 		return nil, err
 	}
 
-	msgQueue := queue.NewMessageQueue(api)
+	msgQueue := queue.NewMessageQueue(api, db)
 
 	bot := &Bot{
 		api:      api,
@@ -38,7 +44,17 @@ func NewBot(cfg *config.Config, db *database.DB) (*Bot, error) {
 		stopChan: make(chan struct{}),
 	}
 
-	bot.handlers = handlers.NewHandlerManager(api, db, msgQueue)
+	bot.handlers = handlers.NewHandlerManager(api, db, msgQueue, cfg)
+	bot.workers = newWorkerPool(config.UpdateWorkers, config.UpdateWorkerBuffer, bot.handleUpdate)
+
+	if cfg.UseWebhook() {
+		if err := bot.newWebhookServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	// End chats with users who blocked the bot or deleted their account
+	msgQueue.SetUnreachableHandler(bot.handlers.HandleUnreachable)
 
 	return bot, nil
 }
@@ -53,31 +69,73 @@ func (b *Bot) Start() error {
 	// Start inactivity checker
 	go b.checkInactiveChats()
 
-	// Configure update channel
-	updateConfig := tgbotapi.NewUpdate(0)
-	updateConfig.Timeout = 60
+	// Start match queue processing
+	go b.processMatchQueue()
+
+	// Start reporting update worker backpressure
+	go b.reportWorkerStats()
 
-	updates := b.api.GetUpdatesChan(updateConfig)
+	// Receive updates through a webhook or by long polling
+	var updates tgbotapi.UpdatesChannel
+	var serverErrs <-chan error
+	if b.server != nil {
+		var err error
+		serverErrs, err = b.startWebhook()
+		if err != nil {
+			return err
+		}
+		updates = b.webhookUpdates
+	} else {
+		// A leftover webhook would make polling fail
+		if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+			return err
+		}
+
+		updateConfig := tgbotapi.NewUpdate(0)
+		updateConfig.Timeout = 60
+
+		updates = b.api.GetUpdatesChan(updateConfig)
+	}
 
 	// Process updates
 	for {
 		select {
-		case update := <-updates:
-			go b.handleUpdate(update)
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			if !b.workers.dispatch(update) {
+				return nil
+			}
+		case err := <-serverErrs:
+			return err
 		case <-b.stopChan:
 			return nil
 		}
 	}
 }
 
-// Stop stops the bot
+// Stop stops the bot, finishing the updates already received and giving
+// queued messages a short time to be delivered
 func (b *Bot) Stop() {
-	b.msgQueue.Stop()
-	b.stopChan <- struct{}{}
+	// Stop taking new updates first, then drain what is already in flight
+	close(b.stopChan)
+	if b.server != nil {
+		b.stopWebhook()
+	} else {
+		b.api.StopReceivingUpdates()
+	}
+	b.workers.stop()
+	b.msgQueue.Drain(config.ShutdownDrainTimeout)
 }
 
 // handleUpdate processes an incoming update
 func (b *Bot) handleUpdate(update tgbotapi.Update) {
+	// Anyone talking to the bot can receive messages again
+	if user := update.SentFrom(); user != nil {
+		b.handlers.MarkReachable(user.ID)
+	}
+
 	// Handle commands
 	if update.Message != nil && update.Message.IsCommand() {
 		b.handlers.HandleCommand(update)
@@ -95,9 +153,16 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 		b.handlers.HandleMessage(update)
 		return
 	}
+
+	// Handle edited messages
+	if update.EditedMessage != nil {
+		b.handlers.HandleEditedMessage(update)
+		return
+	}
 }
 
-// checkInactiveChats periodically checks for inactive chats
+// checkInactiveChats periodically checks for inactive chats, lifts expired
+// bans and forgets the flood control state of quiet users
 func (b *Bot) checkInactiveChats() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
@@ -108,6 +173,50 @@ func (b *Bot) checkInactiveChats() {
 			if err := b.handlers.EndInactiveChats(); err != nil {
 				log.Printf("Error ending inactive chats: %v", err)
 			}
+			if err := b.handlers.LiftExpiredBans(); err != nil {
+				log.Printf("Error lifting expired bans: %v", err)
+			}
+			b.handlers.PruneSpamState()
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// processMatchQueue periodically pairs waiting users and expires stale searches
+func (b *Bot) processMatchQueue() {
+	ticker := time.NewTicker(config.MatchQueueInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.handlers.ProcessMatchQueue(); err != nil {
+				log.Printf("Error processing match queue: %v", err)
+			}
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// reportWorkerStats periodically logs how far update handling is falling behind
+func (b *Bot) reportWorkerStats() {
+	ticker := time.NewTicker(config.WorkerStatsInterval)
+	defer ticker.Stop()
+
+	var lastBlocked int64
+	for {
+		select {
+		case <-ticker.C:
+			stats := b.workers.stats()
+			if stats.Queued == 0 && stats.Blocked == lastBlocked {
+				continue
+			}
+			lastBlocked = stats.Blocked
+
+			log.Printf("Update workers: %d queued, %d handled, receiving blocked %d times for %v in total",
+				stats.Queued, stats.Processed, stats.Blocked, stats.Waited)
 		case <-b.stopChan:
 			return
 		}
@@ -0,0 +1,26 @@
+package bot
+
+import (
+	"fmt"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/database"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/memstore"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/pgstore"
+)
+
+// OpenStore opens the storage backend selected in the configuration, with its
+// schema up to date. sqlitePath is the database file for the sqlite backend.
+func OpenStore(cfg *config.Config, sqlitePath string) (store.Store, error) {
+	switch cfg.StorageBackend {
+	case config.StorageSQLite:
+		return database.NewDB(sqlitePath)
+	case config.StorageMemory:
+		return memstore.New(), nil
+	case config.StoragePostgres:
+		return pgstore.New(cfg.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
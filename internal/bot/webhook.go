@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+)
+
+// secretTokenHeader carries the webhook secret in every request from Telegram
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// newWebhookServer creates the HTTP server that receives updates from Telegram
+func (b *Bot) newWebhookServer() error {
+	webhookURL, err := url.Parse(b.config.WebhookURL)
+	if err != nil {
+		return err
+	}
+
+	path := webhookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	b.webhookUpdates = make(chan tgbotapi.Update, b.api.Buffer)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, b.webhookHandler(b.webhookUpdates))
+
+	b.server = &http.Server{
+		Addr:    b.config.WebhookListenAddr,
+		Handler: mux,
+	}
+
+	return nil
+}
+
+// startWebhook starts the HTTP server and registers the webhook with Telegram.
+// Server failures are reported on the returned channel.
+func (b *Bot) startWebhook() (<-chan error, error) {
+	// Listen before registering, so Telegram's first request finds the server
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		if b.config.WebhookCertFile != "" {
+			err = b.server.ListenAndServeTLS(b.config.WebhookCertFile, b.config.WebhookKeyFile)
+		} else {
+			err = b.server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+
+	if err := b.setWebhook(); err != nil {
+		b.server.Close()
+		return nil, err
+	}
+
+	log.Printf("Receiving updates through webhook on %s", b.config.WebhookListenAddr)
+
+	return errs, nil
+}
+
+// setWebhook tells Telegram where to send updates, uploading the certificate
+// when one is configured
+func (b *Bot) setWebhook() error {
+	params := make(tgbotapi.Params)
+	params["url"] = b.config.WebhookURL
+	params.AddNonEmpty("secret_token", b.config.WebhookSecret)
+
+	var err error
+	if b.config.WebhookCertFile != "" {
+		_, err = b.api.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(b.config.WebhookCertFile),
+		}})
+	} else {
+		_, err = b.api.MakeRequest("setWebhook", params)
+	}
+
+	return err
+}
+
+// stopWebhook unregisters the webhook and shuts the HTTP server down
+func (b *Bot) stopWebhook() {
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Printf("Error deleting webhook: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.WebhookShutdownTimeout)
+	defer cancel()
+
+	if err := b.server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down webhook server: %v", err)
+	}
+}
+
+// webhookHandler accepts updates posted by Telegram and passes them on
+func (b *Bot) webhookHandler(updates chan<- tgbotapi.Update) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only Telegram knows the secret
+		if b.config.WebhookSecret != "" {
+			token := r.Header.Get(secretTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(b.config.WebhookSecret)) != 1 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		update, err := b.api.HandleUpdate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case updates <- *update:
+		case <-b.stopChan:
+			// Telegram will deliver it again after the next start
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+)
+
+const testUpdate = `{"update_id": 42, "message": {"message_id": 7, "from": {"id": 1}, "chat": {"id": 1}, "text": "hi"}}`
+
+func newWebhookTestBot(secret string) *Bot {
+	return &Bot{
+		api:      &tgbotapi.BotAPI{},
+		config:   &config.Config{WebhookSecret: secret},
+		stopChan: make(chan struct{}),
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		method     string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"right token", "s3cret", http.MethodPost, "s3cret", testUpdate, http.StatusOK},
+		{"missing token", "s3cret", http.MethodPost, "", testUpdate, http.StatusForbidden},
+		{"wrong token", "s3cret", http.MethodPost, "guess", testUpdate, http.StatusForbidden},
+		{"token prefix", "s3cret", http.MethodPost, "s3c", testUpdate, http.StatusForbidden},
+		{"no secret configured", "", http.MethodPost, "", testUpdate, http.StatusOK},
+		{"not a POST", "s3cret", http.MethodGet, "s3cret", "", http.StatusBadRequest},
+		{"malformed body", "s3cret", http.MethodPost, "s3cret", `{"update_id": `, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newWebhookTestBot(tt.secret)
+			updates := make(chan tgbotapi.Update, 1)
+
+			r := httptest.NewRequest(tt.method, "/webhook", strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set(secretTokenHeader, tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			b.webhookHandler(updates)(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				if len(updates) != 0 {
+					t.Error("a rejected request was passed on as an update")
+				}
+				return
+			}
+
+			select {
+			case update := <-updates:
+				if update.UpdateID != 42 || update.Message == nil || update.Message.Text != "hi" {
+					t.Errorf("passed on %+v, want update 42", update)
+				}
+			default:
+				t.Error("an accepted update was not passed on")
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerWhileStopping(t *testing.T) {
+	b := newWebhookTestBot("")
+	close(b.stopChan)
+
+	// Nobody is reading updates any more
+	updates := make(chan tgbotapi.Update)
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(testUpdate))
+	w := httptest.NewRecorder()
+	b.webhookHandler(updates)(w, r)
+
+	// Telegram retries anything but a 2xx, so the update isn't lost
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// workerPool handles updates with a fixed number of workers. Updates are
+// sharded by user, so one user's updates are handled one at a time and in
+// order while different users are handled in parallel.
+type workerPool struct {
+	shards []chan tgbotapi.Update
+	handle func(tgbotapi.Update)
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	// Backpressure metrics
+	dispatched atomic.Int64
+	processed  atomic.Int64
+	blocked    atomic.Int64 // dispatches that had to wait for a full shard
+	waited     atomic.Int64 // total time spent waiting, in nanoseconds
+}
+
+// workerStats is a snapshot of the pool's backpressure metrics
+type workerStats struct {
+	Queued     int64
+	Dispatched int64
+	Processed  int64
+	Blocked    int64
+	Waited     time.Duration
+}
+
+// newWorkerPool starts workers that each own one shard with the given buffer
+func newWorkerPool(workers int, buffer int, handle func(tgbotapi.Update)) *workerPool {
+	p := &workerPool{
+		shards: make([]chan tgbotapi.Update, workers),
+		handle: handle,
+		quit:   make(chan struct{}),
+	}
+
+	for i := range p.shards {
+		p.shards[i] = make(chan tgbotapi.Update, buffer)
+
+		p.wg.Add(1)
+		go p.work(p.shards[i])
+	}
+
+	return p
+}
+
+// dispatch hands an update to the worker of its user, waiting while that
+// worker's shard is full. It returns false if the pool was stopped first.
+func (p *workerPool) dispatch(update tgbotapi.Update) bool {
+	shard := p.shards[shardKey(update)%uint64(len(p.shards))]
+	p.dispatched.Add(1)
+
+	select {
+	case shard <- update:
+		return true
+	default:
+	}
+
+	// The shard is full, so slow the producer down
+	p.blocked.Add(1)
+	start := time.Now()
+	defer func() { p.waited.Add(int64(time.Since(start))) }()
+
+	select {
+	case shard <- update:
+		return true
+	case <-p.quit:
+		p.dispatched.Add(-1)
+		return false
+	}
+}
+
+// work handles the updates of one shard until the pool is stopped, then
+// finishes whatever is still buffered
+func (p *workerPool) work(shard chan tgbotapi.Update) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case update := <-shard:
+			p.run(update)
+		case <-p.quit:
+			for {
+				select {
+				case update := <-shard:
+					p.run(update)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// run handles a single update
+func (p *workerPool) run(update tgbotapi.Update) {
+	defer p.processed.Add(1)
+	p.handle(update)
+}
+
+// stop waits for the workers to finish the updates they were given
+func (p *workerPool) stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// stats returns the current backpressure metrics
+func (p *workerPool) stats() workerStats {
+	dispatched := p.dispatched.Load()
+	processed := p.processed.Load()
+
+	return workerStats{
+		Queued:     dispatched - processed,
+		Dispatched: dispatched,
+		Processed:  processed,
+		Blocked:    p.blocked.Load(),
+		Waited:     time.Duration(p.waited.Load()),
+	}
+}
+
+// shardKey picks the user an update belongs to, falling back to its chat
+func shardKey(update tgbotapi.Update) uint64 {
+	if user := update.SentFrom(); user != nil {
+		return uint64(user.ID)
+	}
+	if chat := update.FromChat(); chat != nil {
+		return uint64(chat.ID)
+	}
+	return 0
+}
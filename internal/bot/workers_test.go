@@ -0,0 +1,180 @@
+package bot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func messageFrom(userID int64, messageID int) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: messageID,
+		From:      &tgbotapi.User{ID: userID},
+		Chat:      &tgbotapi.Chat{ID: userID},
+	}}
+}
+
+func TestShardKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		update tgbotapi.Update
+		want   uint64
+	}{
+		{"message", messageFrom(42, 1), 42},
+		{"callback", tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			From:    &tgbotapi.User{ID: 7},
+			Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100}},
+		}}, 7},
+		{"channel post", tgbotapi.Update{ChannelPost: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 9}}}, 9},
+		{"empty", tgbotapi.Update{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shardKey(tt.update); got != tt.want {
+				t.Errorf("shardKey = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolKeepsEachUsersOrder(t *testing.T) {
+	const users, messages = 8, 50
+
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+
+	p := newWorkerPool(3, 4, func(update tgbotapi.Update) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		userID := update.Message.From.ID
+		seen[userID] = append(seen[userID], update.Message.MessageID)
+	})
+
+	for i := 0; i < messages; i++ {
+		for userID := int64(1); userID <= users; userID++ {
+			if !p.dispatch(messageFrom(userID, i)) {
+				t.Fatal("dispatch failed on a running pool")
+			}
+		}
+	}
+	p.stop()
+
+	for userID := int64(1); userID <= users; userID++ {
+		got := seen[userID]
+		if len(got) != messages {
+			t.Fatalf("user %d: handled %d updates, want %d", userID, len(got), messages)
+		}
+		for i, messageID := range got {
+			if messageID != i {
+				t.Fatalf("user %d: handled %v, want them in order", userID, got)
+			}
+		}
+	}
+
+	stats := p.stats()
+	if stats.Dispatched != users*messages || stats.Processed != users*messages || stats.Queued != 0 {
+		t.Errorf("stats = %+v, want every update dispatched and processed", stats)
+	}
+}
+
+func TestWorkerPoolHandlesUsersInParallel(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan int64, 1)
+
+	p := newWorkerPool(2, 1, func(update tgbotapi.Update) {
+		userID := update.Message.From.ID
+		if userID == 2 {
+			<-release
+		}
+		handled <- userID
+	})
+	defer p.stop()
+
+	// Users 1 and 2 land on different workers, so a slow user doesn't hold
+	// the other one up
+	p.dispatch(messageFrom(2, 1))
+	p.dispatch(messageFrom(1, 1))
+
+	select {
+	case userID := <-handled:
+		if userID != 1 {
+			t.Fatalf("handled user %d first, want 1", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("user 1 waited for user 2's worker")
+	}
+
+	close(release)
+	<-handled
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+
+	p := newWorkerPool(1, 1, func(update tgbotapi.Update) {
+		started <- struct{}{}
+		<-release
+	})
+
+	// One update is being handled and one fills the shard's buffer
+	p.dispatch(messageFrom(1, 1))
+	<-started
+	p.dispatch(messageFrom(1, 2))
+
+	done := make(chan bool)
+	go func() {
+		done <- p.dispatch(messageFrom(1, 3))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("dispatch to a full shard didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if !<-done {
+		t.Fatal("waiting dispatch failed")
+	}
+	p.stop()
+
+	stats := p.stats()
+	if stats.Blocked != 1 || stats.Waited <= 0 {
+		t.Errorf("stats = %+v, want one blocked dispatch", stats)
+	}
+	if stats.Processed != 3 {
+		t.Errorf("processed %d updates, want 3", stats.Processed)
+	}
+}
+
+func TestDispatchAfterStop(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	p := newWorkerPool(1, 0, func(update tgbotapi.Update) {
+		started <- struct{}{}
+		<-release
+	})
+
+	p.dispatch(messageFrom(1, 1))
+	<-started
+
+	// The only worker is busy and the shard has no buffer, so this waits
+	// until the pool stops
+	done := make(chan bool)
+	go func() {
+		done <- p.dispatch(messageFrom(1, 2))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	go p.stop()
+	if <-done {
+		t.Fatal("dispatch to a stopped pool succeeded")
+	}
+	close(release)
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/filter"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
 )
 
 // Constants for the application
@@ -16,13 +20,194 @@ const (
 	// MatchTimeout is the maximum duration to wait for finding a match
 	MatchTimeout = 2 * time.Minute
 
+	// RecentPartnerWindow is how long after a chat ends its partners aren't matched again
+	RecentPartnerWindow = 1 * time.Hour
+
+	// MatchQueueInterval is how often waiting users are re-checked for a match
+	MatchQueueInterval = 5 * time.Second
+
+	// ConversationTimeout is how long the bot waits for a reply to a text prompt
+	ConversationTimeout = 10 * time.Minute
+
+	// MediaGroupWindow is how long album parts are collected before relaying them together
+	MediaGroupWindow = 1 * time.Second
+
+	// DeleteWindow is how long after sending Telegram allows a message to be deleted
+	DeleteWindow = 48 * time.Hour
+
 	// MessageRateLimit is the maximum number of messages per second
 	MessageRateLimit = 30
+
+	// PerChatInterval is the minimum time between two messages to the same chat
+	PerChatInterval = 1 * time.Second
+
+	// PriorityStarvationLimit is how many messages from higher priority lanes
+	// may be sent before a waiting lower lane gets a turn
+	PriorityStarvationLimit = 5
+
+	// GlobalLimitChats is how many different chats must be rate limited within
+	// GlobalLimitWindow before the bot's global limit is taken to be hit and
+	// sending to everyone pauses; a single 429 only holds back its own chat
+	GlobalLimitChats = 3
+
+	// GlobalLimitWindow is how close together those rate limits must come
+	GlobalLimitWindow = 2 * time.Second
+
+	// MaxSendAttempts is how many times a message is tried before it is dropped
+	MaxSendAttempts = 5
+
+	// RetryBaseDelay is the first backoff after a temporary send failure
+	RetryBaseDelay = 1 * time.Second
+
+	// RetryMaxDelay caps the backoff between send attempts
+	RetryMaxDelay = 1 * time.Minute
+
+	// OutboxRetention is how long delivered and failed messages are kept in the outbox
+	OutboxRetention = 24 * time.Hour
+
+	// ShutdownDrainTimeout is how long pending messages may keep sending on shutdown
+	ShutdownDrainTimeout = 10 * time.Second
+
+	// UpdateWorkers is how many updates are handled in parallel
+	UpdateWorkers = 16
+
+	// UpdateWorkerBuffer is how many updates may wait for each worker before
+	// receiving more updates is slowed down
+	UpdateWorkerBuffer = 64
+
+	// WorkerStatsInterval is how often update worker backpressure is logged
+	WorkerStatsInterval = 1 * time.Minute
+
+	// WebhookShutdownTimeout is how long in-flight webhook requests may take on shutdown
+	WebhookShutdownTimeout = 5 * time.Second
+
+	// MaxReportDetailsLength caps the free text a user can add to a report
+	MaxReportDetailsLength = 1000
+
+	// PendingReportsPageSize is how many pending reports /reports shows at once
+	PendingReportsPageSize = 10
+
+	// WhoisHistoryLimit is how many reports, chats and admin actions /whois lists
+	WhoisHistoryLimit = 5
+
+	// StatsWindow is how far back /stats counts started chats
+	StatsWindow = 24 * time.Hour
+
+	// FloodBurst is how many messages a user may send to their partner at once
+	FloodBurst = 10
+
+	// FloodRefillInterval is how long it takes a user to earn one more message
+	FloodRefillInterval = 1 * time.Second
+
+	// FloodStrikeCooldown is how long after a warning further violations are
+	// dropped without counting as another strike
+	FloodStrikeCooldown = 5 * time.Second
+
+	// FloodStrikeWindow is how long flooding and spam strikes are remembered
+	FloodStrikeWindow = 10 * time.Minute
+
+	// FloodMuteAfterStrikes is how many strikes get a user muted
+	FloodMuteAfterStrikes = 3
+
+	// FloodMuteDuration is how long a muted user's messages are dropped
+	FloodMuteDuration = 5 * time.Minute
+
+	// FloodMuteWindow is how long mutes are remembered
+	FloodMuteWindow = 24 * time.Hour
+
+	// FloodSuspendAfterMutes is how many mutes get a user suspended automatically
+	FloodSuspendAfterMutes = 3
+
+	// AutoSuspendDuration is how long an automatic suspension lasts
+	AutoSuspendDuration = 24 * time.Hour
+
+	// DuplicatePartnerLimit is how many different partners may get the same message
+	DuplicatePartnerLimit = 5
+
+	// DuplicateWindow is how long sent messages are remembered for spam detection
+	DuplicateWindow = 1 * time.Hour
+
+	// MinDuplicateLength is how long a message must be to count as spam when
+	// repeated, so greetings aren't caught
+	MinDuplicateLength = 20
+
+	// DefaultWebhookListenAddr is where the webhook server listens unless configured
+	DefaultWebhookListenAddr = ":8080"
+)
+
+// Storage backends
+const (
+	// StorageSQLite keeps state in a local SQLite file
+	StorageSQLite = "sqlite"
+
+	// StorageMemory keeps state in memory only, losing it on restart
+	StorageMemory = "memory"
+
+	// StoragePostgres keeps state in PostgreSQL, which several replicas can share
+	StoragePostgres = "postgres"
 )
 
 // Config holds the application configuration
 type Config struct {
 	BotToken string
+
+	// AllowedMessageTypes limits which message types are relayed between
+	// partners. A nil map allows every type.
+	AllowedMessageTypes map[models.MessageType]bool
+
+	// WebhookURL is the public HTTPS address Telegram posts updates to. When
+	// empty, updates are fetched with long polling instead.
+	WebhookURL string
+
+	// WebhookListenAddr is the address the embedded HTTP server listens on
+	WebhookListenAddr string
+
+	// WebhookSecret is sent by Telegram in every webhook request and checked
+	// before an update is accepted
+	WebhookSecret string
+
+	// WebhookCertFile and WebhookKeyFile enable TLS on the embedded server. The
+	// certificate is uploaded to Telegram, so it may be self-signed.
+	WebhookCertFile string
+	WebhookKeyFile  string
+
+	// StorageBackend is where the bot keeps its state: sqlite, memory or postgres
+	StorageBackend string
+
+	// DatabaseURL is the PostgreSQL connection string for the postgres backend
+	DatabaseURL string
+
+	// AdminChatID is the chat where moderators review reports. Reports are
+	// stored but nobody is notified when it is 0.
+	AdminChatID int64
+
+	// AdminIDs are the users allowed to run admin commands
+	AdminIDs map[int64]bool
+
+	// FilterActions overrides what the content filters do with relayed text,
+	// keyed by filter name. Filters without an entry use their default action.
+	FilterActions map[string]filter.Action
+
+	// FilterWords are the words the word filter looks for
+	FilterWords []string
+}
+
+// UseWebhook reports whether updates are received through a webhook
+func (c *Config) UseWebhook() bool {
+	return c.WebhookURL != ""
+}
+
+// IsAdmin reports whether the user may run admin commands
+func (c *Config) IsAdmin(userID int64) bool {
+	return c.AdminIDs[userID]
+}
+
+// IsMessageTypeAllowed reports whether messages of the given type may be relayed
+func (c *Config) IsMessageTypeAllowed(t models.MessageType) bool {
+	if c.AllowedMessageTypes == nil {
+		return true
+	}
+	return c.AllowedMessageTypes[t]
 }
 
 // LoadConfig loads the configuration from environment variables
@@ -39,7 +224,142 @@ func LoadConfig() *Config {
 		log.Fatal("BOT_TOKEN environment variable is not set")
 	}
 
-	return &Config{
-		BotToken: botToken,
+	cfg := &Config{
+		BotToken:            botToken,
+		AllowedMessageTypes: parseMessageTypes(os.Getenv("ALLOWED_MESSAGE_TYPES")),
+		WebhookURL:          os.Getenv("WEBHOOK_URL"),
+		WebhookListenAddr:   os.Getenv("WEBHOOK_LISTEN_ADDR"),
+		WebhookSecret:       os.Getenv("WEBHOOK_SECRET"),
+		WebhookCertFile:     os.Getenv("WEBHOOK_CERT_FILE"),
+		WebhookKeyFile:      os.Getenv("WEBHOOK_KEY_FILE"),
+		StorageBackend:      strings.ToLower(os.Getenv("STORAGE_BACKEND")),
+		DatabaseURL:         os.Getenv("DATABASE_URL"),
+		AdminIDs:            parseUserIDs(os.Getenv("ADMIN_IDS")),
+		FilterActions:       parseFilterActions(),
+		FilterWords:         parseWordList(os.Getenv("FILTER_WORD_LIST")),
+	}
+
+	// Container platforms usually tell the app which port to listen on
+	if cfg.WebhookListenAddr == "" {
+		if port := os.Getenv("PORT"); port != "" {
+			cfg.WebhookListenAddr = ":" + port
+		} else {
+			cfg.WebhookListenAddr = DefaultWebhookListenAddr
+		}
+	}
+
+	if cfg.UseWebhook() && cfg.WebhookSecret == "" {
+		log.Println("Warning: WEBHOOK_SECRET is not set, webhook requests will not be authenticated")
+	}
+
+	if (cfg.WebhookCertFile == "") != (cfg.WebhookKeyFile == "") {
+		log.Fatal("WEBHOOK_CERT_FILE and WEBHOOK_KEY_FILE must be set together")
+	}
+
+	if adminChat := os.Getenv("ADMIN_CHAT_ID"); adminChat != "" {
+		cfg.AdminChatID, err = strconv.ParseInt(adminChat, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid ADMIN_CHAT_ID %q: %v", adminChat, err)
+		}
+	} else {
+		log.Println("Warning: ADMIN_CHAT_ID is not set, reports will not reach moderators")
+	}
+
+	switch cfg.StorageBackend {
+	case "":
+		cfg.StorageBackend = StorageSQLite
+	case StorageSQLite, StorageMemory:
+	case StoragePostgres:
+		if cfg.DatabaseURL == "" {
+			log.Fatal("DATABASE_URL must be set for the postgres storage backend")
+		}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected sqlite, memory or postgres", cfg.StorageBackend)
+	}
+
+	return cfg
+}
+
+// parseMessageTypes parses a comma-separated list of message type names.
+// An empty list allows every type.
+func parseMessageTypes(value string) map[models.MessageType]bool {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	allowed := make(map[models.MessageType]bool)
+	for _, name := range strings.Split(value, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		t, ok := models.ParseMessageType(name)
+		if !ok {
+			log.Printf("Warning: unknown message type %q in ALLOWED_MESSAGE_TYPES", name)
+			continue
+		}
+		allowed[t] = true
+	}
+
+	return allowed
+}
+
+// parseUserIDs parses a comma-separated list of Telegram user IDs
+func parseUserIDs(value string) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid user ID %q in ADMIN_IDS", field)
+		}
+		ids[id] = true
 	}
+
+	return ids
+}
+
+// filterSettings maps the environment variables setting a content filter's
+// action to the filter's name
+var filterSettings = map[string]string{
+	"FILTER_URLS":     filter.URLs,
+	"FILTER_MENTIONS": filter.Mentions,
+	"FILTER_PHONES":   filter.Phones,
+	"FILTER_EMAILS":   filter.Emails,
+	"FILTER_WORDS":    filter.Words,
+}
+
+// parseFilterActions reads the actions operators set for the content filters
+func parseFilterActions() map[string]filter.Action {
+	actions := make(map[string]filter.Action)
+	for env, name := range filterSettings {
+		value := os.Getenv(env)
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		action, ok := filter.ParseAction(value)
+		if !ok {
+			log.Fatalf("Invalid %s %q, expected allow, redact, block or flag", env, value)
+		}
+		actions[name] = action
+	}
+
+	return actions
+}
+
+// parseWordList parses a comma-separated list of words, ignoring empty entries
+func parseWordList(value string) []string {
+	var words []string
+	for _, word := range strings.Split(value, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, word)
+		}
+	}
+
+	return words
 }
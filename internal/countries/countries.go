@@ -0,0 +1,259 @@
+package countries
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Country is an ISO 3166-1 country or territory
+type Country struct {
+	Code    string // ISO 3166-1 alpha-2 code
+	Alpha3  string // ISO 3166-1 alpha-3 code
+	Name    string
+	Aliases []string
+}
+
+// index maps normalized codes, names and aliases to countries
+var index = buildIndex()
+
+// accentReplacer folds the accented letters used in country names to ASCII
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"ç", "c", "é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y",
+)
+
+func buildIndex() map[string]Country {
+	idx := make(map[string]Country)
+	for _, c := range all {
+		keys := append([]string{c.Code, c.Alpha3, c.Name}, c.Aliases...)
+		for _, key := range keys {
+			if n := normalize(key); n != "" {
+				idx[n] = c
+			}
+		}
+	}
+	return idx
+}
+
+// normalize lowercases the input, folds accents and reduces punctuation to single spaces
+func normalize(s string) string {
+	s = accentReplacer.Replace(strings.ToLower(strings.TrimSpace(s)))
+
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case r == '.' || r == '\'':
+			// Drop so that "U.S.A." and "Cote d'Ivoire" match their plain forms
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		default:
+			space = true
+		}
+	}
+
+	return strings.TrimPrefix(b.String(), "the ")
+}
+
+// ByCode returns the country with the given alpha-2 code
+func ByCode(code string) (Country, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, c := range all {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return Country{}, false
+}
+
+// Name returns the display name for an alpha-2 code, or the code itself if unknown
+func Name(code string) string {
+	if c, ok := ByCode(code); ok {
+		return c.Name
+	}
+	return code
+}
+
+// Find resolves free-text input to a country. It accepts alpha-2 and alpha-3
+// codes, names and common aliases, tolerating small typos and unambiguous prefixes.
+func Find(input string) (Country, bool) {
+	key := normalize(input)
+	if key == "" {
+		return Country{}, false
+	}
+
+	// Exact code, name or alias
+	if c, ok := index[key]; ok {
+		return c, true
+	}
+
+	// Unambiguous prefix of a name or alias
+	if len(key) >= 3 {
+		var found *Country
+		for k, c := range index {
+			if len(k) <= 3 || !strings.HasPrefix(k, key) {
+				continue
+			}
+			if found != nil && found.Code != c.Code {
+				found = nil
+				break
+			}
+			c := c
+			found = &c
+		}
+		if found != nil {
+			return *found, true
+		}
+	}
+
+	// Closest name or alias within a typo budget
+	matches := closest(key)
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+
+	return Country{}, false
+}
+
+// Suggest returns up to limit countries whose names resemble the input
+func Suggest(input string, limit int) []Country {
+	key := normalize(input)
+	if key == "" {
+		return nil
+	}
+
+	type candidate struct {
+		country  Country
+		distance int
+	}
+
+	// Countries are visited in list order so that equally close ones always
+	// come out the same way
+	var candidates []candidate
+	for _, c := range all {
+		distance := -1
+		for _, k := range nameKeys(c) {
+			d := levenshtein(key, k)
+			if strings.HasPrefix(k, key) {
+				d = 0
+			}
+			if distance < 0 || d < distance {
+				distance = d
+			}
+		}
+		if distance >= 0 && distance <= typoBudget(key)+2 {
+			candidates = append(candidates, candidate{c, distance})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].country.Name < candidates[j].country.Name
+	})
+
+	var result []Country
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		result = append(result, candidates[i].country)
+	}
+	return result
+}
+
+// closest returns the distinct countries at the smallest edit distance from key,
+// provided that distance is within the typo budget
+func closest(key string) []Country {
+	budget := typoBudget(key)
+	bestDistance := budget + 1
+	var matches []Country
+
+	for _, c := range all {
+		for _, k := range nameKeys(c) {
+			d := levenshtein(key, k)
+			switch {
+			case d < bestDistance:
+				bestDistance = d
+				matches = []Country{c}
+			case d == bestDistance && !containsCountry(matches, c.Code):
+				matches = append(matches, c)
+			}
+		}
+	}
+
+	return matches
+}
+
+// nameKeys returns the normalized name and aliases of a country that are long
+// enough to be matched loosely. Codes and short aliases only match exactly.
+func nameKeys(c Country) []string {
+	var keys []string
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		if k := normalize(name); len(k) > 3 {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// typoBudget is the number of edits tolerated for an input of this length
+func typoBudget(key string) int {
+	switch n := len(key); {
+	case n < 4:
+		return 0
+	case n < 7:
+		return 1
+	case n < 12:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func containsCountry(countries []Country, code string) bool {
+	for _, c := range countries {
+		if c.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package countries
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		wantOK bool
+	}{
+		// Exact codes and names
+		{"alpha-2 code", "de", "DE", true},
+		{"alpha-3 code", "DEU", "DE", true},
+		{"name", "Germany", "DE", true},
+		{"name with spaces around", "  germany ", "DE", true},
+		{"accented name", "Côte d'Ivoire", "CI", true},
+		{"name without accents", "cote divoire", "CI", true},
+		{"leading the", "the Netherlands", "NL", true},
+
+		// Aliases
+		{"alias", "Holland", "NL", true},
+		{"short alias", "UK", "GB", true},
+		{"dotted alias", "U.S.A.", "US", true},
+		{"official name", "Federal Republic of Germany", "DE", true},
+
+		// Typos
+		{"missing letter", "Germny", "DE", true},
+		{"extra letter", "Brazill", "BR", true},
+		{"swapped letters", "Swtizerland", "CH", true},
+		{"too many typos", "Grmnyy", "", false},
+		{"short input isn't fuzzy", "Gxr", "", false},
+
+		// Prefixes
+		{"unambiguous prefix", "Switz", "CH", true},
+		{"ambiguous prefix", "Nig", "", false},
+		{"prefix of two names", "Guinea-Bis", "GW", true},
+
+		{"unknown", "Atlantis", "", false},
+		{"empty", "", "", false},
+		{"only punctuation", " .,- ", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Find(tt.input)
+			if ok != tt.wantOK || got.Code != tt.want {
+				t.Errorf("Find(%q) = %q, %v, want %q, %v", tt.input, got.Code, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tests := []struct {
+		input string
+		limit int
+		want  []string
+	}{
+		{"Nig", 2, []string{"NE", "NG"}},
+		{"Guin", 2, []string{"GN", "GW"}},
+		{"Austrlia", 1, []string{"AU"}},
+		{"Zzzzzzzz", 3, nil},
+		{"", 3, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var got []string
+			for _, c := range Suggest(tt.input, tt.limit) {
+				got = append(got, c.Code)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Suggest(%q, %d) = %v, want %v", tt.input, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuggestIsDeterministic(t *testing.T) {
+	first := Suggest("ia", 10)
+	if len(first) < 2 {
+		t.Fatalf("Suggest(\"ia\") = %v, want several countries", first)
+	}
+
+	for i := 0; i < 20; i++ {
+		if got := Suggest("ia", 10); !reflect.DeepEqual(got, first) {
+			t.Fatalf("Suggest(\"ia\") returned %v, then %v", first, got)
+		}
+	}
+}
@@ -2,24 +2,18 @@ package database
 
 import (
 	"time"
-)
 
-// ActiveChat represents a chat between two users with their last activity times
-type ActiveChat struct {
-	User1ID       int64
-	User2ID       int64
-	LastActivity1 time.Time
-	LastActivity2 time.Time
-}
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
 
 // GetActiveChats retrieves all active chats from the database
-func (db *DB) GetActiveChats() ([]ActiveChat, error) {
+func (db *DB) GetActiveChats() ([]models.ActiveChat, error) {
 	query := `
-	SELECT u1.user_id, u2.user_id, u1.last_activity, u2.last_activity 
-	FROM users u1, users u2
-	WHERE u1.current_chat = u2.user_id 
-	  AND u2.current_chat = u1.user_id
-	  AND u1.user_id < u2.user_id`
+	SELECT s.id, u1.user_id, u2.user_id, u1.last_activity, u2.last_activity
+	FROM chat_sessions s
+	JOIN users u1 ON u1.user_id = s.user1_id
+	JOIN users u2 ON u2.user_id = s.user2_id
+	WHERE s.ended_at IS NULL`
 
 	rows, err := db.conn.Query(query)
 	if err != nil {
@@ -27,12 +21,12 @@ func (db *DB) GetActiveChats() ([]ActiveChat, error) {
 	}
 	defer rows.Close()
 
-	var chats []ActiveChat
+	var chats []models.ActiveChat
 	for rows.Next() {
-		var user1ID, user2ID int64
+		var sessionID, user1ID, user2ID int64
 		var lastActivity1, lastActivity2 string
 
-		if err := rows.Scan(&user1ID, &user2ID, &lastActivity1, &lastActivity2); err != nil {
+		if err := rows.Scan(&sessionID, &user1ID, &user2ID, &lastActivity1, &lastActivity2); err != nil {
 			return nil, err
 		}
 
@@ -47,7 +41,8 @@ func (db *DB) GetActiveChats() ([]ActiveChat, error) {
 			return nil, err
 		}
 
-		chat := ActiveChat{
+		chat := models.ActiveChat{
+			SessionID:     sessionID,
 			User1ID:       user1ID,
 			User2ID:       user2ID,
 			LastActivity1: t1,
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// RecordAdminAction adds an entry to the audit log within the transaction
+func (tx *Tx) RecordAdminAction(action *models.AdminAction) error {
+	query := `INSERT INTO admin_actions (admin_id, action, target_id, details, created_at) VALUES (?, ?, ?, ?, ?)`
+
+	_, err := tx.tx.Exec(query, action.AdminID, string(action.Action), action.TargetID, action.Details, formatTime(time.Now()))
+	return err
+}
+
+// GetAdminActions returns the actions taken on a user, newest first
+func (db *DB) GetAdminActions(targetID int64, limit int) ([]models.AdminAction, error) {
+	query := `
+    SELECT id, admin_id, action, details, created_at FROM admin_actions
+    WHERE target_id = ?
+    ORDER BY id DESC
+    LIMIT ?
+    `
+
+	rows, err := db.conn.Query(query, targetID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []models.AdminAction
+	for rows.Next() {
+		action := models.AdminAction{TargetID: targetID}
+		var kind, createdAtStr string
+
+		if err := rows.Scan(&action.ID, &action.AdminID, &kind, &action.Details, &createdAtStr); err != nil {
+			return nil, err
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		action.Action = models.AdminActionKind(kind)
+		action.CreatedAt = createdAt
+
+		actions = append(actions, action)
+	}
+
+	return actions, rows.Err()
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// banColumns are the columns read by scanBan
+const banColumns = `user_id, kind, reason, banned_by, created_at, expires_at`
+
+// GetBan returns the user's ban in effect, or nil if they aren't banned or
+// their ban has expired
+func (db *DB) GetBan(userID int64) (*models.Ban, error) {
+	query := `
+    SELECT ` + banColumns + ` FROM bans
+    WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)
+    `
+
+	ban, err := scanBan(db.conn.QueryRow(query, userID, formatTime(time.Now())))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return ban, err
+}
+
+// BanUser bans a user within the transaction, replacing any earlier ban
+func (tx *Tx) BanUser(ban *models.Ban) error {
+	query := `INSERT OR REPLACE INTO bans (user_id, kind, reason, banned_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+
+	var expiresAt sql.NullString
+	if ban.ExpiresAt != nil {
+		expiresAt = sql.NullString{String: formatTime(*ban.ExpiresAt), Valid: true}
+	}
+
+	_, err := tx.tx.Exec(query, ban.UserID, string(ban.Kind), ban.Reason, ban.BannedBy, formatTime(time.Now()), expiresAt)
+	return err
+}
+
+// UnbanUser lifts the user's ban within the transaction. It reports false if
+// there was none.
+func (tx *Tx) UnbanUser(userID int64) (bool, error) {
+	result, err := tx.tx.Exec(`DELETE FROM bans WHERE user_id = ?`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// ExpireBans lifts the bans that expired by the given time within the
+// transaction and returns them
+func (tx *Tx) ExpireBans(now time.Time) ([]models.Ban, error) {
+	query := `SELECT ` + banColumns + ` FROM bans WHERE expires_at <= ? ORDER BY user_id`
+
+	rows, err := tx.tx.Query(query, formatTime(now))
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []models.Ban
+	for rows.Next() {
+		ban, err := scanBan(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bans = append(bans, *ban)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.tx.Exec(`DELETE FROM bans WHERE expires_at <= ?`, formatTime(now)); err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
+
+// scanBan reads a ban selected with banColumns
+func scanBan(row rowScanner) (*models.Ban, error) {
+	var ban models.Ban
+	var kind, createdAtStr string
+	var expiresAtStr sql.NullString
+
+	if err := row.Scan(&ban.UserID, &kind, &ban.Reason, &ban.BannedBy, &createdAtStr, &expiresAtStr); err != nil {
+		return nil, err
+	}
+	ban.Kind = models.BanKind(kind)
+
+	createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+	if err != nil {
+		return nil, err
+	}
+	ban.CreatedAt = createdAt
+
+	if expiresAtStr.Valid {
+		expiresAt, err := time.Parse(time.RFC3339, expiresAtStr.String)
+		if err != nil {
+			return nil, err
+		}
+		ban.ExpiresAt = &expiresAt
+	}
+
+	return &ban, nil
+}
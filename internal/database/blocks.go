@@ -0,0 +1,21 @@
+package database
+
+import "time"
+
+// BlockUser keeps blockedID from being matched with blockerID ever again
+func (db *DB) BlockUser(blockerID int64, blockedID int64) error {
+	return blockUser(db.conn, blockerID, blockedID)
+}
+
+// BlockUser keeps blockedID from being matched with blockerID within the transaction
+func (tx *Tx) BlockUser(blockerID int64, blockedID int64) error {
+	return blockUser(tx.tx, blockerID, blockedID)
+}
+
+// blockUser records a block using the given connection or transaction
+func blockUser(e dbtx, blockerID int64, blockedID int64) error {
+	query := `INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)`
+
+	_, err := e.Exec(query, blockerID, blockedID, formatTime(time.Now()))
+	return err
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// chatSessionColumns are the columns read by scanChatSession
+const chatSessionColumns = `id, user1_id, user2_id, started_at, ended_at, end_reason, user1_messages, user2_messages`
+
+// openChatSession records the start of a chat between two users
+func openChatSession(e dbtx, user1 int64, user2 int64, startedAt time.Time) error {
+	query := `INSERT INTO chat_sessions (user1_id, user2_id, started_at) VALUES (?, ?, ?)`
+
+	_, err := e.Exec(query, user1, user2, formatTime(startedAt))
+	return err
+}
+
+// closeChatSession records the end of the user's open chat
+func closeChatSession(e dbtx, userID int64, reason models.EndReason, endedAt time.Time) error {
+	query := `
+    UPDATE chat_sessions SET ended_at = ?, end_reason = ?
+    WHERE ended_at IS NULL AND (user1_id = ? OR user2_id = ?)
+    `
+
+	_, err := e.Exec(query, formatTime(endedAt), string(reason), userID, userID)
+	return err
+}
+
+// CountChatMessage adds a message sent by the user to their open chat's count
+func (db *DB) CountChatMessage(userID int64) error {
+	query := `
+    UPDATE chat_sessions
+    SET user1_messages = user1_messages + (user1_id = ?),
+        user2_messages = user2_messages + (user2_id = ?)
+    WHERE ended_at IS NULL AND (user1_id = ? OR user2_id = ?)
+    `
+
+	_, err := db.conn.Exec(query, userID, userID, userID, userID)
+	return err
+}
+
+// GetChatSession returns a chat session by ID, or nil if there is none
+func (db *DB) GetChatSession(id int64) (*models.ChatSession, error) {
+	query := `SELECT ` + chatSessionColumns + ` FROM chat_sessions WHERE id = ?`
+
+	session, err := scanChatSession(db.conn.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// GetCurrentChatSession returns the user's open chat session, or nil if they
+// are not in a chat
+func (db *DB) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	return getCurrentChatSession(db.conn, userID)
+}
+
+// GetCurrentChatSession returns the user's open chat session within the transaction
+func (tx *Tx) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	return getCurrentChatSession(tx.tx, userID)
+}
+
+// getCurrentChatSession returns the user's open chat session using the given
+// connection or transaction
+func getCurrentChatSession(q dbtx, userID int64) (*models.ChatSession, error) {
+	query := `
+    SELECT ` + chatSessionColumns + ` FROM chat_sessions
+    WHERE ended_at IS NULL AND (user1_id = ? OR user2_id = ?)
+    ORDER BY id DESC
+    LIMIT 1
+    `
+
+	session, err := scanChatSession(q.QueryRow(query, userID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// GetChatSessions returns the user's most recent chat sessions, newest first
+func (db *DB) GetChatSessions(userID int64, limit int) ([]models.ChatSession, error) {
+	query := `
+    SELECT ` + chatSessionColumns + ` FROM chat_sessions
+    WHERE user1_id = ? OR user2_id = ?
+    ORDER BY id DESC
+    LIMIT ?
+    `
+
+	rows, err := db.conn.Query(query, userID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.ChatSession
+	for rows.Next() {
+		session, err := scanChatSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanChatSession reads a chat session selected with chatSessionColumns
+func scanChatSession(row rowScanner) (*models.ChatSession, error) {
+	var session models.ChatSession
+	var startedAtStr string
+	var endedAtStr, endReason sql.NullString
+
+	err := row.Scan(&session.ID, &session.User1ID, &session.User2ID, &startedAtStr, &endedAtStr, &endReason,
+		&session.User1Messages, &session.User2Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	startedAt, err := time.Parse(time.RFC3339, startedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	session.StartedAt = startedAt
+
+	if endedAtStr.Valid {
+		parsedTime, err := time.Parse(time.RFC3339, endedAtStr.String)
+		if err == nil {
+			session.EndedAt = &parsedTime
+		}
+	}
+
+	session.EndReason = models.EndReason(endReason.String)
+
+	return &session, nil
+}
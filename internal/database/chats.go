@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// PairUsers puts two users in a chat with each other if both are still free.
+// It reports false, changing nothing, if another pairing got there first.
+func (db *DB) PairUsers(user1 int64, user2 int64) (bool, error) {
+	var paired bool
+	err := db.runInTx(func(tx *Tx) error {
+		var err error
+		paired, err = tx.PairUsers(user1, user2)
+		return err
+	})
+	return paired, err
+}
+
+// EndChat ends the user's current chat for the given reason. It returns the
+// partner whose side of the chat was ended too, and false if the user was not
+// in a chat.
+func (db *DB) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	var partnerID int64
+	var ended bool
+	err := db.runInTx(func(tx *Tx) error {
+		var err error
+		partnerID, ended, err = tx.EndChat(userID, reason)
+		return err
+	})
+	return partnerID, ended, err
+}
+
+// PairUsers puts two users in a chat with each other within the transaction
+// if both are still free, takes them out of the match queue and opens a chat
+// session for them
+func (tx *Tx) PairUsers(user1 int64, user2 int64) (bool, error) {
+	if user1 == user2 {
+		return false, nil
+	}
+
+	// Transactions take the write lock up front, so nobody can pair either
+	// user between this check and the update
+	query := `
+    SELECT COUNT(*) FROM users
+    WHERE user_id IN (?, ?)
+      AND COALESCE(current_chat, 0) = 0
+      AND unreachable = 0
+    `
+
+	var free int
+	if err := tx.tx.QueryRow(query, user1, user2).Scan(&free); err != nil {
+		return false, err
+	}
+	if free != 2 {
+		return false, nil
+	}
+
+	update := `
+    UPDATE users
+    SET current_chat = CASE user_id WHEN ? THEN ? ELSE ? END,
+        last_activity = ?,
+        match_start_time = NULL
+    WHERE user_id IN (?, ?)
+    `
+
+	now := time.Now()
+	if _, err := tx.tx.Exec(update, user1, user2, user1, formatTime(now), user1, user2); err != nil {
+		return false, err
+	}
+
+	if err := openChatSession(tx.tx, user1, user2, now); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// EndChat ends the user's current chat within the transaction and closes its
+// session. The partner is only taken out of the chat, and returned, if they
+// were still in it.
+func (tx *Tx) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	partnerID, err := currentChat(tx.tx, userID)
+	if err != nil || partnerID == 0 {
+		return 0, false, err
+	}
+
+	if err := closeChatSession(tx.tx, userID, reason, time.Now()); err != nil {
+		return 0, false, err
+	}
+
+	partnerChat, err := currentChat(tx.tx, partnerID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if _, err := tx.tx.Exec(`UPDATE users SET current_chat = 0 WHERE user_id = ?`, userID); err != nil {
+		return 0, false, err
+	}
+
+	if partnerChat != userID {
+		return 0, true, nil
+	}
+
+	if _, err := tx.tx.Exec(`UPDATE users SET current_chat = 0 WHERE user_id = ?`, partnerID); err != nil {
+		return 0, false, err
+	}
+
+	return partnerID, true, nil
+}
+
+// TouchActivity records that the user was just active in their chat
+func (db *DB) TouchActivity(userID int64) error {
+	query := `UPDATE users SET last_activity = ? WHERE user_id = ?`
+
+	_, err := db.conn.Exec(query, formatTime(time.Now()), userID)
+	return err
+}
+
+// currentChat returns who the user is chatting with, or 0
+func currentChat(q dbtx, userID int64) (int64, error) {
+	var chat sql.NullInt64
+
+	err := q.QueryRow(`SELECT current_chat FROM users WHERE user_id = ?`, userID).Scan(&chat)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return chat.Int64, err
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// GetConversation retrieves a user's pending input state
+func (db *DB) GetConversation(userID int64) (*models.Conversation, error) {
+	query := `SELECT state, data, updated_at FROM conversations WHERE user_id = ?`
+
+	var state string
+	var data, updatedAtStr sql.NullString
+
+	err := db.conn.QueryRow(query, userID).Scan(&state, &data, &updatedAtStr)
+	if err != nil {
+		// No pending input
+		if err == sql.ErrNoRows {
+			return &models.Conversation{UserID: userID, State: models.ConversationIdle}, nil
+		}
+		return nil, err
+	}
+
+	conversation := &models.Conversation{
+		UserID: userID,
+		State:  models.ConversationState(state),
+		Data:   data.String,
+	}
+
+	if updatedAtStr.Valid {
+		parsedTime, err := time.Parse(time.RFC3339, updatedAtStr.String)
+		if err == nil {
+			conversation.UpdatedAt = parsedTime
+		}
+	}
+
+	return conversation, nil
+}
+
+// SaveConversation stores a user's pending input state
+func (db *DB) SaveConversation(conversation *models.Conversation) error {
+	query := `
+    INSERT OR REPLACE INTO conversations (user_id, state, data, updated_at)
+    VALUES (?, ?, ?, ?)
+    `
+
+	_, err := db.conn.Exec(
+		query,
+		conversation.UserID,
+		string(conversation.State),
+		conversation.Data,
+		formatTime(conversation.UpdatedAt),
+	)
+
+	return err
+}
+
+// ClearConversation removes a user's pending input state
+func (db *DB) ClearConversation(userID int64) error {
+	_, err := db.conn.Exec(`DELETE FROM conversations WHERE user_id = ?`, userID)
+	return err
+}
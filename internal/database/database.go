@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,57 +14,74 @@ type DB struct {
 	conn *sql.DB
 }
 
-// NewDB creates a new database connection
+// dbtx is implemented by both *sql.DB and *sql.Tx, so queries can run
+// either standalone or as part of a transaction
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NewDB creates a new database connection and brings the schema up to date
 func NewDB(dbPath string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", dbPath)
+	db, err := Open(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	db := &DB{conn: conn}
-	if err := db.initialize(); err != nil {
+	if err := db.Migrate(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
+// Open creates a new database connection without touching the schema
+func Open(dbPath string) (*DB, error) {
+	// Wait for concurrent writers instead of failing with "database is locked",
+	// and take the write lock when a transaction begins so it cannot deadlock later
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+
+	conn, err := sql.Open("sqlite3", dbPath+separator+"_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{conn: conn}, nil
+}
+
 // Close closes the database connection
 func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
-// initialize sets up the database tables
-func (db *DB) initialize() error {
-	query := `
-    CREATE TABLE IF NOT EXISTS users (
-        user_id INTEGER PRIMARY KEY,
-        is_active INTEGER DEFAULT 0,
-        current_chat INTEGER,
-        last_activity TEXT,
-        country TEXT,
-        language TEXT,
-        gender TEXT
-    );
-    `
-
-	_, err := db.conn.Exec(query)
-	return err
-}
-
 // GetUserState retrieves a user's state from the database
 func (db *DB) GetUserState(userID int64) (*models.UserState, error) {
-	query := `SELECT is_active, current_chat, last_activity, country, language, gender 
+	return getUserState(db.conn, userID)
+}
+
+// getUserState retrieves a user's state using the given connection or transaction
+func getUserState(q dbtx, userID int64) (*models.UserState, error) {
+	query := `SELECT is_active, current_chat, last_activity, country, language, gender, match_start_time,
+                     pref_countries, pref_languages, pref_genders, unreachable
               FROM users WHERE user_id = ?`
 
-	row := db.conn.QueryRow(query, userID)
+	row := q.QueryRow(query, userID)
 
 	var isActive int
 	var currentChat sql.NullInt64
 	var lastActivityStr sql.NullString
 	var country, language, gender sql.NullString
+	var matchStartTimeStr sql.NullString
+	var prefCountries, prefLanguages, prefGenders sql.NullString
+	var unreachable sql.NullInt64
 
-	err := row.Scan(&isActive, &currentChat, &lastActivityStr, &country, &language, &gender)
+	err := row.Scan(&isActive, &currentChat, &lastActivityStr, &country, &language, &gender, &matchStartTimeStr,
+		&prefCountries, &prefLanguages, &prefGenders, &unreachable)
 	if err != nil {
 		// If no record is found, create a new user state
 		if err == sql.ErrNoRows {
@@ -84,10 +102,18 @@ func (db *DB) GetUserState(userID int64) (*models.UserState, error) {
 		UserID:       userID,
 		IsActive:     isActive == 1,
 		LastActivity: lastActivity,
+		Unreachable:  unreachable.Int64 == 1,
 		Settings: models.UserSettings{
-			Country:  "",
-			Language: "",
-			Gender:   "",
+			Profile: models.UserProfile{
+				Country:  "",
+				Language: "",
+				Gender:   "",
+			},
+			Preferences: models.PartnerPreferences{
+				Countries: models.SplitList(prefCountries.String),
+				Languages: models.SplitList(prefLanguages.String),
+				Genders:   models.SplitList(prefGenders.String),
+			},
 		},
 	}
 
@@ -96,26 +122,52 @@ func (db *DB) GetUserState(userID int64) (*models.UserState, error) {
 	}
 
 	if country.Valid {
-		userState.Settings.Country = country.String
+		userState.Settings.Profile.Country = country.String
 	}
 
 	if language.Valid {
-		userState.Settings.Language = language.String
+		userState.Settings.Profile.Language = language.String
 	}
 
 	if gender.Valid {
-		userState.Settings.Gender = gender.String
+		userState.Settings.Profile.Gender = gender.String
+	}
+
+	if matchStartTimeStr.Valid && matchStartTimeStr.String != "" {
+		parsedTime, err := time.Parse(time.RFC3339, matchStartTimeStr.String)
+		if err == nil {
+			userState.MatchStartTime = &parsedTime
+		}
 	}
 
 	return &userState, nil
 }
 
-// SaveUserState stores a user's state in the database
+// SaveUserState stores a user's state in the database. The current chat is
+// only written for new users; use PairUsers and EndChat to change it, so a
+// stale state can't undo a pairing or a chat end.
 func (db *DB) SaveUserState(state *models.UserState) error {
+	return saveUserState(db.conn, state)
+}
+
+// saveUserState stores a user's state using the given connection or transaction
+func saveUserState(e dbtx, state *models.UserState) error {
 	query := `
-    INSERT OR REPLACE INTO users 
-    (user_id, is_active, current_chat, last_activity, country, language, gender)
-    VALUES (?, ?, ?, ?, ?, ?, ?)
+    INSERT INTO users
+    (user_id, is_active, current_chat, last_activity, country, language, gender, match_start_time,
+     pref_countries, pref_languages, pref_genders, unreachable)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT (user_id) DO UPDATE SET
+        is_active = excluded.is_active,
+        last_activity = excluded.last_activity,
+        country = excluded.country,
+        language = excluded.language,
+        gender = excluded.gender,
+        match_start_time = excluded.match_start_time,
+        pref_countries = excluded.pref_countries,
+        pref_languages = excluded.pref_languages,
+        pref_genders = excluded.pref_genders,
+        unreachable = excluded.unreachable
     `
 
 	isActive := 0
@@ -123,17 +175,32 @@ func (db *DB) SaveUserState(state *models.UserState) error {
 		isActive = 1
 	}
 
-	lastActivity := state.LastActivity.Format(time.RFC3339)
+	unreachable := 0
+	if state.Unreachable {
+		unreachable = 1
+	}
+
+	lastActivity := formatTime(state.LastActivity)
+
+	var matchStartTime sql.NullString
+	if state.MatchStartTime != nil {
+		matchStartTime = sql.NullString{String: formatTime(*state.MatchStartTime), Valid: true}
+	}
 
-	_, err := db.conn.Exec(
+	_, err := e.Exec(
 		query,
 		state.UserID,
 		isActive,
 		state.CurrentChat,
 		lastActivity,
-		state.Settings.Country,
-		state.Settings.Language,
-		state.Settings.Gender,
+		state.Settings.Profile.Country,
+		state.Settings.Profile.Language,
+		state.Settings.Profile.Gender,
+		matchStartTime,
+		models.JoinList(state.Settings.Preferences.Countries),
+		models.JoinList(state.Settings.Preferences.Languages),
+		models.JoinList(state.Settings.Preferences.Genders),
+		unreachable,
 	)
 
 	return err
@@ -141,7 +208,7 @@ func (db *DB) SaveUserState(state *models.UserState) error {
 
 // GetActiveUsers returns the count of active users
 func (db *DB) GetActiveUsers() (int, error) {
-	query := `SELECT COUNT(*) FROM users WHERE is_active = 1`
+	query := `SELECT COUNT(*) FROM users WHERE is_active = 1 AND unreachable = 0`
 
 	var count int
 	err := db.conn.QueryRow(query).Scan(&count)
@@ -149,16 +216,41 @@ func (db *DB) GetActiveUsers() (int, error) {
 	return count, err
 }
 
-// FindPotentialMatches returns potential matches for a user based on preferences
-func (db *DB) FindPotentialMatches(userID int64) ([]int64, error) {
+// FindPotentialMatches returns potential matches for a user based on preferences.
+// Users waiting in the match queue come first, longest-waiting first; the
+// remaining online users are returned in random order. Users banned outright,
+// users blocked by or blocking the user, and partners from chats that ended
+// after recentSince are left out. Shadowbanned users only meet each other.
+func (db *DB) FindPotentialMatches(userID int64, recentSince time.Time) ([]int64, error) {
 	query := `
-    SELECT user_id FROM users 
-    WHERE is_active = 1 
-      AND current_chat = 0 
+    WITH active_bans AS (
+        SELECT user_id, kind FROM bans WHERE expires_at IS NULL OR expires_at > ?
+    )
+    SELECT user_id FROM users u
+    WHERE is_active = 1
+      AND current_chat = 0
+      AND unreachable = 0
       AND user_id != ?
+      AND NOT EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = u.user_id AND b.kind != ?)
+      AND EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = u.user_id)
+        = EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = ? AND b.kind = ?)
+      AND NOT EXISTS (
+          SELECT 1 FROM user_blocks b
+          WHERE (b.blocker_id = ? AND b.blocked_id = u.user_id)
+             OR (b.blocker_id = u.user_id AND b.blocked_id = ?)
+      )
+      AND NOT EXISTS (
+          SELECT 1 FROM chat_sessions s
+          WHERE s.ended_at >= ?
+            AND ((s.user1_id = ? AND s.user2_id = u.user_id)
+              OR (s.user2_id = ? AND s.user1_id = u.user_id))
+      )
+    ORDER BY match_start_time IS NULL, match_start_time, RANDOM()
     `
 
-	rows, err := db.conn.Query(query, userID)
+	now := formatTime(time.Now())
+	shadow := string(models.BanShadow)
+	rows, err := db.conn.Query(query, now, userID, shadow, userID, shadow, userID, userID, formatTime(recentSince), userID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -175,3 +267,45 @@ func (db *DB) FindPotentialMatches(userID int64) ([]int64, error) {
 
 	return matches, nil
 }
+
+// GetWaitingUsers returns the users currently in the match queue, longest-waiting first
+func (db *DB) GetWaitingUsers() ([]int64, error) {
+	query := `
+    SELECT user_id FROM users 
+    WHERE match_start_time IS NOT NULL 
+      AND match_start_time != '' 
+      AND current_chat = 0
+      AND unreachable = 0
+    ORDER BY match_start_time
+    `
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var waiting []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		waiting = append(waiting, userID)
+	}
+
+	return waiting, nil
+}
+
+// MarkReachable clears the unreachable flag once a user talks to the bot again
+func (db *DB) MarkReachable(userID int64) error {
+	_, err := db.conn.Exec(`UPDATE users SET unreachable = 0 WHERE user_id = ? AND unreachable = 1`, userID)
+	return err
+}
+
+// formatTime formats a time for storage. Times are stored in UTC, so that
+// comparing them as strings in SQL agrees with comparing the times even when
+// the host's time zone or its offset changes.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
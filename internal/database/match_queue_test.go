@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// saveWaiting stores an online user, in the match queue since the given time
+// unless since is nil
+func saveWaiting(t *testing.T, db *DB, userID int64, since *time.Time, currentChat int64) {
+	t.Helper()
+
+	state := models.NewUserState(userID)
+	state.IsActive = true
+	state.CurrentChat = currentChat
+	state.MatchStartTime = since
+	if err := db.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState(%d): %v", userID, err)
+	}
+}
+
+func TestWaitingUsers(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	later := start.Add(30 * time.Second)
+
+	saveWaiting(t, db, 1, &later, 0)
+	saveWaiting(t, db, 2, &start, 0)
+	saveWaiting(t, db, 3, nil, 0)    // online but not searching
+	saveWaiting(t, db, 4, &start, 9) // already in a chat
+
+	waiting, err := db.GetWaitingUsers()
+	if err != nil {
+		t.Fatalf("GetWaitingUsers: %v", err)
+	}
+	if want := []int64{2, 1}; !reflect.DeepEqual(waiting, want) {
+		t.Errorf("GetWaitingUsers = %v, want %v, longest waiting first", waiting, want)
+	}
+
+	state, err := db.GetUserState(1)
+	if err != nil {
+		t.Fatalf("GetUserState: %v", err)
+	}
+	if state.MatchStartTime == nil || !state.MatchStartTime.Equal(later) {
+		t.Errorf("MatchStartTime = %v, want %v", state.MatchStartTime, later)
+	}
+	if !state.IsWaitingForMatch() {
+		t.Error("a user in the queue is not waiting for a match")
+	}
+}
+
+func TestMatchQueueColumnAddedToExistingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "existing.db")
+
+	// The users table as it was before the match queue
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`
+    CREATE TABLE users (
+        user_id INTEGER PRIMARY KEY,
+        is_active INTEGER DEFAULT 0,
+        current_chat INTEGER,
+        last_activity TEXT,
+        country TEXT,
+        language TEXT,
+        gender TEXT
+    );
+    INSERT INTO users (user_id, is_active, current_chat, last_activity) VALUES (1, 1, 0, '2024-01-01T10:00:00Z');
+    `)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB on an existing database: %v", err)
+	}
+	defer db.Close()
+
+	state, err := db.GetUserState(1)
+	if err != nil {
+		t.Fatalf("GetUserState: %v", err)
+	}
+	if !state.IsActive || state.MatchStartTime != nil {
+		t.Errorf("existing user = %+v, want online and not searching", state)
+	}
+
+	since := time.Now().Truncate(time.Second)
+	state.MatchStartTime = &since
+	if err := db.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	waiting, err := db.GetWaitingUsers()
+	if err != nil {
+		t.Fatalf("GetWaitingUsers: %v", err)
+	}
+	if !reflect.DeepEqual(waiting, []int64{1}) {
+		t.Errorf("GetWaitingUsers = %v, want [1]", waiting)
+	}
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is one versioned schema change. Its SQL is embedded from
+// migrations/NNNN_name.up.sql and migrations/NNNN_name.down.sql.
+type Migration = store.Migration
+
+// MigrationStatus tells whether a migration has been applied and when
+type MigrationStatus = store.MigrationStatus
+
+// legacyUserColumns were added to the users table before migrations existed,
+// in the order releases added them. Databases from that time may lack any
+// number of them, so each is added unless it is already there.
+var legacyUserColumns = []struct {
+	name       string
+	definition string
+}{
+	// Persistent match queue
+	{"match_start_time", "TEXT"},
+
+	// Partner preferences, kept apart from the user's own profile
+	{"pref_countries", "TEXT"},
+	{"pref_languages", "TEXT"},
+	{"pref_genders", "TEXT"},
+
+	// Users who blocked the bot
+	{"unreachable", "INTEGER DEFAULT 0"},
+}
+
+// loadMigrations reads the embedded migrations, ordered by version
+func loadMigrations() ([]Migration, error) {
+	return store.LoadMigrations(migrationFiles, "migrations")
+}
+
+// Migrate applies every migration that hasn't been applied yet
+func (db *DB) Migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return db.MigrateTo(store.LatestVersion(migrations))
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at the given
+// version. Version 0 rolls back everything.
+func (db *DB) MigrateTo(target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := db.prepareMigrations(); err != nil {
+		return err
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	plan, err := store.PlanMigrations(migrations, applied, target)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range plan.Apply {
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("applying migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	for _, m := range plan.Rollback {
+		if err := db.revertMigration(m); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.prepareMigrations(); err != nil {
+		return nil, err
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.MigrationStatuses(migrations, applied), nil
+}
+
+// prepareMigrations creates the schema_migrations table. A database from
+// before migrations existed has its users table brought up to the first
+// migration's schema, so that migration can be recorded as applied.
+func (db *DB) prepareMigrations() error {
+	tracked, err := db.tableExists("schema_migrations")
+	if err != nil {
+		return err
+	}
+	if tracked {
+		return nil
+	}
+
+	legacy, err := db.tableExists("users")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		for _, column := range legacyUserColumns {
+			if err := db.addColumnIfMissing("users", column.name, column.definition); err != nil {
+				return err
+			}
+		}
+	}
+
+	query := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TEXT NOT NULL
+    );
+    `
+
+	_, err = db.conn.Exec(query)
+	return err
+}
+
+// appliedMigrations returns when each applied migration was applied
+func (db *DB) appliedMigrations() (map[int]time.Time, error) {
+	rows, err := db.conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAtStr string
+
+		if err := rows.Scan(&version, &appliedAtStr); err != nil {
+			return nil, err
+		}
+
+		appliedAt, err := time.Parse(time.RFC3339, appliedAtStr)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it in the same transaction
+func (db *DB) applyMigration(m Migration) error {
+	return db.runInTx(func(tx *Tx) error {
+		if _, err := tx.tx.Exec(m.Up); err != nil {
+			return err
+		}
+
+		query := `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`
+		_, err := tx.tx.Exec(query, m.Version, m.Name, formatTime(time.Now()))
+		return err
+	})
+}
+
+// revertMigration rolls a migration back and forgets it in the same transaction
+func (db *DB) revertMigration(m Migration) error {
+	return db.runInTx(func(tx *Tx) error {
+		if _, err := tx.tx.Exec(m.Down); err != nil {
+			return err
+		}
+
+		_, err := tx.tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+		return err
+	})
+}
+
+// tableExists reports whether the database has a table with the given name
+func (db *DB) tableExists(name string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+
+	if err := db.conn.QueryRow(query, name).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.conn.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.conn.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
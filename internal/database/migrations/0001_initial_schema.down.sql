@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS outbox;
+DROP TABLE IF EXISTS relayed_messages;
+DROP TABLE IF EXISTS conversations;
+DROP TABLE IF EXISTS users;
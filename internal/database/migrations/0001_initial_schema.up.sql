@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS users (
+    user_id INTEGER PRIMARY KEY,
+    is_active INTEGER DEFAULT 0,
+    current_chat INTEGER,
+    last_activity TEXT,
+    country TEXT,
+    language TEXT,
+    gender TEXT,
+    match_start_time TEXT,
+    pref_countries TEXT,
+    pref_languages TEXT,
+    pref_genders TEXT,
+    unreachable INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+    user_id INTEGER PRIMARY KEY,
+    state TEXT NOT NULL,
+    data TEXT,
+    updated_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS relayed_messages (
+    sender_chat_id INTEGER NOT NULL,
+    original_message_id INTEGER NOT NULL,
+    recipient_chat_id INTEGER NOT NULL,
+    delivered_message_id INTEGER NOT NULL,
+    created_at TEXT,
+    PRIMARY KEY (sender_chat_id, original_message_id, recipient_chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_relayed_messages_delivered
+    ON relayed_messages (recipient_chat_id, delivered_message_id);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    chat_id INTEGER NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TEXT,
+    updated_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_status ON outbox (status, id);
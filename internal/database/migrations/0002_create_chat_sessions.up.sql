@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS chat_sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user1_id INTEGER NOT NULL,
+    user2_id INTEGER NOT NULL,
+    started_at TEXT NOT NULL,
+    ended_at TEXT,
+    end_reason TEXT,
+    user1_messages INTEGER NOT NULL DEFAULT 0,
+    user2_messages INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_user1 ON chat_sessions (user1_id, started_at);
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_user2 ON chat_sessions (user2_id, started_at);
+
+-- Chats started before sessions were recorded get one now
+INSERT INTO chat_sessions (user1_id, user2_id, started_at)
+SELECT u1.user_id, u2.user_id, COALESCE(u1.last_activity, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+FROM users u1, users u2
+WHERE u1.current_chat = u2.user_id
+  AND u2.current_chat = u1.user_id
+  AND u1.user_id < u2.user_id
+  AND NOT EXISTS (
+      SELECT 1 FROM chat_sessions s
+      WHERE s.ended_at IS NULL AND (s.user1_id = u1.user_id OR s.user2_id = u1.user_id)
+  );
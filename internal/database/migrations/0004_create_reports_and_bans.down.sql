@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS bans;
+DROP TABLE IF EXISTS reports;
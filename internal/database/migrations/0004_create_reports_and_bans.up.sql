@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id INTEGER NOT NULL,
+    reporter_id INTEGER NOT NULL,
+    reported_id INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TEXT NOT NULL,
+    resolved_by INTEGER NOT NULL DEFAULT 0,
+    resolved_at TEXT,
+    UNIQUE (session_id, reporter_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports (status, id);
+CREATE INDEX IF NOT EXISTS idx_reports_reported ON reports (reported_id);
+
+CREATE TABLE IF NOT EXISTS bans (
+    user_id INTEGER PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    banned_by INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL
+);
@@ -0,0 +1,5 @@
+ALTER TABLE bans ADD COLUMN kind TEXT NOT NULL DEFAULT 'permanent';
+
+UPDATE bans SET kind = 'temporary' WHERE expires_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_bans_expires_at ON bans (expires_at);
@@ -0,0 +1,3 @@
+-- UTC times are read correctly by every earlier version, so there is nothing
+-- to convert back.
+SELECT 1;
@@ -0,0 +1,45 @@
+-- Times used to be stored in the host's local time zone and are compared as
+-- strings, which only works if they all have the same offset. Convert them
+-- to UTC, the format they are stored in from now on.
+
+UPDATE users SET last_activity = strftime('%Y-%m-%dT%H:%M:%SZ', last_activity)
+WHERE last_activity LIKE '____-__-__T__:__:__%' AND last_activity NOT LIKE '%Z';
+
+UPDATE users SET match_start_time = strftime('%Y-%m-%dT%H:%M:%SZ', match_start_time)
+WHERE match_start_time LIKE '____-__-__T__:__:__%' AND match_start_time NOT LIKE '%Z';
+
+UPDATE conversations SET updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)
+WHERE updated_at LIKE '____-__-__T__:__:__%' AND updated_at NOT LIKE '%Z';
+
+UPDATE relayed_messages SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
+
+UPDATE outbox SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
+
+UPDATE outbox SET updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', updated_at)
+WHERE updated_at LIKE '____-__-__T__:__:__%' AND updated_at NOT LIKE '%Z';
+
+UPDATE chat_sessions SET started_at = strftime('%Y-%m-%dT%H:%M:%SZ', started_at)
+WHERE started_at LIKE '____-__-__T__:__:__%' AND started_at NOT LIKE '%Z';
+
+UPDATE chat_sessions SET ended_at = strftime('%Y-%m-%dT%H:%M:%SZ', ended_at)
+WHERE ended_at LIKE '____-__-__T__:__:__%' AND ended_at NOT LIKE '%Z';
+
+UPDATE user_blocks SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
+
+UPDATE reports SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
+
+UPDATE reports SET resolved_at = strftime('%Y-%m-%dT%H:%M:%SZ', resolved_at)
+WHERE resolved_at LIKE '____-__-__T__:__:__%' AND resolved_at NOT LIKE '%Z';
+
+UPDATE bans SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
+
+UPDATE bans SET expires_at = strftime('%Y-%m-%dT%H:%M:%SZ', expires_at)
+WHERE expires_at LIKE '____-__-__T__:__:__%' AND expires_at NOT LIKE '%Z';
+
+UPDATE admin_actions SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at)
+WHERE created_at LIKE '____-__-__T__:__:__%' AND created_at NOT LIKE '%Z';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_relayed_messages_media_group;
+ALTER TABLE relayed_messages DROP COLUMN media_group_id;
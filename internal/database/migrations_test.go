@@ -0,0 +1,325 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// legacySchema is the users table as created by the first release, before
+// migrations existed
+const legacySchema = `
+CREATE TABLE IF NOT EXISTS users (
+        user_id INTEGER PRIMARY KEY,
+        is_active INTEGER DEFAULT 0,
+        current_chat INTEGER,
+        last_activity TEXT,
+        country TEXT,
+        language TEXT,
+        gender TEXT
+    );
+
+INSERT INTO users (user_id, is_active, current_chat, last_activity, country)
+VALUES (1, 1, 2, '2024-01-01T10:00:00Z', 'DE'),
+       (2, 1, 1, '2024-01-01T10:05:00Z', 'FR'),
+       (3, 0, 0, '2024-01-01T11:00:00Z', '');
+`
+
+func openTestDB(t *testing.T, path string) *DB {
+	t.Helper()
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func assertAllApplied(t *testing.T, db *DB) {
+	t.Helper()
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	if len(statuses) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("migration %d_%s is not applied", status.Version, status.Name)
+		}
+	}
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "fresh.db"))
+
+	assertAllApplied(t, db)
+
+	for _, table := range []string{"users", "conversations", "relayed_messages", "outbox", "chat_sessions"} {
+		exists, err := db.tableExists(table)
+		if err != nil {
+			t.Fatalf("tableExists(%s): %v", table, err)
+		}
+		if !exists {
+			t.Errorf("table %s was not created", table)
+		}
+	}
+
+	state := models.NewUserState(42)
+	state.Settings.Preferences.Countries = []string{"DE", "FR"}
+	if err := db.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	loaded, err := db.GetUserState(42)
+	if err != nil {
+		t.Fatalf("GetUserState: %v", err)
+	}
+	if len(loaded.Settings.Preferences.Countries) != 2 {
+		t.Errorf("preferences = %v, want [DE FR]", loaded.Settings.Preferences.Countries)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := conn.Exec(legacySchema); err != nil {
+		t.Fatalf("creating legacy schema: %v", err)
+	}
+	conn.Close()
+
+	db := openTestDB(t, path)
+
+	assertAllApplied(t, db)
+
+	state, err := db.GetUserState(1)
+	if err != nil {
+		t.Fatalf("GetUserState: %v", err)
+	}
+	if state.Settings.Profile.Country != "DE" || state.CurrentChat != 2 || state.Unreachable {
+		t.Errorf("legacy user not preserved: %+v", state)
+	}
+
+	// The columns added since can be written and read back
+	now := time.Now().Truncate(time.Second)
+	state.MatchStartTime = &now
+	state.Settings.Preferences.Languages = []string{"en"}
+	if err := db.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	state, err = db.GetUserState(1)
+	if err != nil {
+		t.Fatalf("GetUserState after save: %v", err)
+	}
+	if state.MatchStartTime == nil || !state.MatchStartTime.Equal(now) || len(state.Settings.Preferences.Languages) != 1 {
+		t.Errorf("saved user not read back: %+v", state)
+	}
+
+	// The chat that was going on gets a session
+	session, err := db.GetCurrentChatSession(2)
+	if err != nil {
+		t.Fatalf("GetCurrentChatSession: %v", err)
+	}
+	if session == nil || session.Partner(2) != 1 {
+		t.Errorf("session = %+v, want an open chat between 1 and 2", session)
+	}
+
+	// Users not in a chat don't get one
+	session, err = db.GetCurrentChatSession(3)
+	if err != nil {
+		t.Fatalf("GetCurrentChatSession: %v", err)
+	}
+	if session != nil {
+		t.Errorf("session = %+v, want none", session)
+	}
+}
+
+// legacyReleaseSchemas are the tables as created by the releases that changed
+// the schema before migrations existed, each adding to the one before
+var legacyReleaseSchemas = []struct {
+	name   string
+	schema string
+}{
+	{"match queue", `
+CREATE TABLE users (
+    user_id INTEGER PRIMARY KEY, is_active INTEGER DEFAULT 0, current_chat INTEGER,
+    last_activity TEXT, country TEXT, language TEXT, gender TEXT,
+    match_start_time TEXT
+);`},
+	{"partner preferences", `
+CREATE TABLE users (
+    user_id INTEGER PRIMARY KEY, is_active INTEGER DEFAULT 0, current_chat INTEGER,
+    last_activity TEXT, country TEXT, language TEXT, gender TEXT,
+    match_start_time TEXT, pref_countries TEXT, pref_languages TEXT, pref_genders TEXT
+);`},
+	{"conversations", `
+CREATE TABLE users (
+    user_id INTEGER PRIMARY KEY, is_active INTEGER DEFAULT 0, current_chat INTEGER,
+    last_activity TEXT, country TEXT, language TEXT, gender TEXT,
+    match_start_time TEXT, pref_countries TEXT, pref_languages TEXT, pref_genders TEXT
+);
+CREATE TABLE conversations (user_id INTEGER PRIMARY KEY, state TEXT NOT NULL, data TEXT, updated_at TEXT);`},
+	{"unreachable users", `
+CREATE TABLE users (
+    user_id INTEGER PRIMARY KEY, is_active INTEGER DEFAULT 0, current_chat INTEGER,
+    last_activity TEXT, country TEXT, language TEXT, gender TEXT,
+    match_start_time TEXT, pref_countries TEXT, pref_languages TEXT, pref_genders TEXT,
+    unreachable INTEGER DEFAULT 0
+);
+CREATE TABLE conversations (user_id INTEGER PRIMARY KEY, state TEXT NOT NULL, data TEXT, updated_at TEXT);`},
+}
+
+func TestMigrateEachLegacyRelease(t *testing.T) {
+	for _, release := range legacyReleaseSchemas {
+		t.Run(release.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "release.db")
+
+			conn, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if _, err := conn.Exec(release.schema); err != nil {
+				t.Fatalf("creating schema: %v", err)
+			}
+			if _, err := conn.Exec(`INSERT INTO users (user_id, is_active, current_chat, country) VALUES (1, 1, 0, 'DE')`); err != nil {
+				t.Fatalf("inserting user: %v", err)
+			}
+			conn.Close()
+
+			db := openTestDB(t, path)
+			assertAllApplied(t, db)
+
+			state, err := db.GetUserState(1)
+			if err != nil {
+				t.Fatalf("GetUserState: %v", err)
+			}
+			if state.Settings.Profile.Country != "DE" {
+				t.Errorf("country = %q, want DE", state.Settings.Profile.Country)
+			}
+
+			now := time.Now().Truncate(time.Second)
+			state.MatchStartTime = &now
+			state.Settings.Preferences.Genders = []string{"female"}
+			if err := db.SaveUserState(state); err != nil {
+				t.Fatalf("SaveUserState: %v", err)
+			}
+
+			if err := db.SaveConversation(&models.Conversation{UserID: 1, State: models.ConversationAwaitingCountry, UpdatedAt: now}); err != nil {
+				t.Fatalf("SaveConversation: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twice.db")
+
+	db := openTestDB(t, path)
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+
+	assertAllApplied(t, db)
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "downup.db"))
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+
+	// Step down one version at a time and check only later migrations are reverted
+	for target := len(migrations) - 1; target >= 0; target-- {
+		if err := db.MigrateTo(migrations[target].Version - 1); err != nil {
+			t.Fatalf("MigrateTo(%d): %v", migrations[target].Version-1, err)
+		}
+
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			t.Fatalf("MigrationStatus: %v", err)
+		}
+		for i, status := range statuses {
+			if status.Applied != (i < target) {
+				t.Errorf("at version %d, migration %d applied = %v", migrations[target].Version-1, status.Version, status.Applied)
+			}
+		}
+	}
+
+	exists, err := db.tableExists("users")
+	if err != nil {
+		t.Fatalf("tableExists: %v", err)
+	}
+	if exists {
+		t.Error("users table still exists after migrating down to 0")
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate after down: %v", err)
+	}
+	assertAllApplied(t, db)
+}
+
+func TestMigrateConvertsTimesToUTC(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "zones.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.MigrateTo(6); err != nil {
+		t.Fatalf("MigrateTo(6): %v", err)
+	}
+
+	// A ban that ran out half an hour ago, written by a host five hours ahead
+	// of UTC. As a string it sorts after the current UTC time.
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	expired := time.Now().Add(-30 * time.Minute).In(zone).Format(time.RFC3339)
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, zone).Format(time.RFC3339)
+
+	_, err = db.conn.Exec(`INSERT INTO bans (user_id, kind, reason, banned_by, created_at, expires_at) VALUES (1, 'temporary', '', 0, ?, ?)`, created, expired)
+	if err != nil {
+		t.Fatalf("inserting ban: %v", err)
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	var createdAt string
+	if err := db.conn.QueryRow(`SELECT created_at FROM bans WHERE user_id = 1`).Scan(&createdAt); err != nil {
+		t.Fatalf("reading ban: %v", err)
+	}
+	if createdAt != "2024-03-01T07:00:00Z" {
+		t.Errorf("created_at = %q, want 2024-03-01T07:00:00Z", createdAt)
+	}
+
+	ban, err := db.GetBan(1)
+	if err != nil {
+		t.Fatalf("GetBan: %v", err)
+	}
+	if ban != nil {
+		t.Errorf("expired ban is still in effect: %+v", ban)
+	}
+}
+
+func TestTimesAreStoredInUTC(t *testing.T) {
+	zone := time.FixedZone("UTC-3", -3*60*60)
+	if got := formatTime(time.Date(2024, 3, 1, 22, 30, 0, 0, zone)); got != "2024-03-02T01:30:00Z" {
+		t.Errorf("formatTime = %q, want 2024-03-02T01:30:00Z", got)
+	}
+}
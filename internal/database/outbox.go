@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// Outbox statuses
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+// InsertOutbox adds a message to the outbox and returns its ID
+func (db *DB) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	return insertOutbox(db.conn, message)
+}
+
+// insertOutbox adds a message to the outbox using the given connection or transaction
+func insertOutbox(e dbtx, message models.QueuedMessage) (int64, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+    INSERT INTO outbox (chat_id, payload, status, attempts, created_at, updated_at)
+    VALUES (?, ?, ?, 0, ?, ?)
+    `
+
+	now := formatTime(time.Now())
+	result, err := e.Exec(query, message.ChatID, string(payload), outboxPending, now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// GetPendingOutbox returns the messages that have not been delivered yet, oldest first
+func (db *DB) GetPendingOutbox() ([]models.OutboxEntry, error) {
+	query := `
+    SELECT id, payload, attempts, created_at FROM outbox
+    WHERE status = ?
+    ORDER BY id
+    `
+
+	rows, err := db.conn.Query(query, outboxPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.OutboxEntry
+	for rows.Next() {
+		var entry models.OutboxEntry
+		var payload string
+		var createdAtStr sql.NullString
+
+		if err := rows.Scan(&entry.ID, &payload, &entry.Attempts, &createdAtStr); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(payload), &entry.Message); err != nil {
+			return nil, err
+		}
+
+		if createdAtStr.Valid {
+			parsedTime, err := time.Parse(time.RFC3339, createdAtStr.String)
+			if err == nil {
+				entry.CreatedAt = parsedTime
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// MarkOutboxSent records that a message was delivered
+func (db *DB) MarkOutboxSent(id int64) error {
+	query := `UPDATE outbox SET status = ?, updated_at = ? WHERE id = ?`
+
+	_, err := db.conn.Exec(query, outboxSent, formatTime(time.Now()), id)
+	return err
+}
+
+// MarkOutboxFailed records that a message could not be delivered and won't be retried
+func (db *DB) MarkOutboxFailed(id int64, attempts int, lastError string) error {
+	query := `UPDATE outbox SET status = ?, attempts = ?, last_error = ?, updated_at = ? WHERE id = ?`
+
+	_, err := db.conn.Exec(query, outboxFailed, attempts, lastError, formatTime(time.Now()), id)
+	return err
+}
+
+// UpdateOutboxAttempts records a failed delivery attempt that will be retried
+func (db *DB) UpdateOutboxAttempts(id int64, attempts int, lastError string) error {
+	query := `UPDATE outbox SET attempts = ?, last_error = ?, updated_at = ? WHERE id = ?`
+
+	_, err := db.conn.Exec(query, attempts, lastError, formatTime(time.Now()), id)
+	return err
+}
+
+// PurgeOutbox deletes delivered and failed messages last updated before the given time
+func (db *DB) PurgeOutbox(before time.Time) error {
+	query := `DELETE FROM outbox WHERE status != ? AND updated_at < ?`
+
+	_, err := db.conn.Exec(query, outboxPending, formatTime(before))
+	return err
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// SaveRelayedMessage records which message a relayed copy was delivered as
+func (db *DB) SaveRelayedMessage(relayed *models.RelayedMessage) error {
+	query := `
+    INSERT OR REPLACE INTO relayed_messages
+    (sender_chat_id, original_message_id, recipient_chat_id, delivered_message_id, created_at, media_group_id)
+    VALUES (?, ?, ?, ?, ?, ?)
+    `
+
+	_, err := db.conn.Exec(
+		query,
+		relayed.SenderChatID,
+		relayed.OriginalMessageID,
+		relayed.RecipientChatID,
+		relayed.DeliveredMessageID,
+		formatTime(relayed.CreatedAt),
+		relayed.MediaGroupID,
+	)
+
+	return err
+}
+
+// FindCounterpart returns the ID of the matching message in the partner's chat for
+// a message in chatID. The message may be either one the user sent, or the copy
+// of a partner's message the user received. It returns 0 if there is no mapping.
+func (db *DB) FindCounterpart(chatID int64, messageID int, partnerID int64) (int, error) {
+	query := `
+    SELECT delivered_message_id FROM relayed_messages
+    WHERE sender_chat_id = ? AND original_message_id = ? AND recipient_chat_id = ?
+    UNION ALL
+    SELECT original_message_id FROM relayed_messages
+    WHERE recipient_chat_id = ? AND delivered_message_id = ? AND sender_chat_id = ?
+    LIMIT 1
+    `
+
+	var counterpart int
+	err := db.conn.QueryRow(query, chatID, messageID, partnerID, chatID, messageID, partnerID).Scan(&counterpart)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return counterpart, err
+}
+
+// GetRelayedMessage returns the delivered copy of a message sent to recipientChatID,
+// or nil if it was never relayed there
+func (db *DB) GetRelayedMessage(senderChatID int64, originalMessageID int, recipientChatID int64) (*models.RelayedMessage, error) {
+	query := `
+    SELECT delivered_message_id, created_at FROM relayed_messages
+    WHERE sender_chat_id = ? AND original_message_id = ? AND recipient_chat_id = ?
+    `
+
+	var deliveredMessageID int
+	var createdAtStr sql.NullString
+
+	err := db.conn.QueryRow(query, senderChatID, originalMessageID, recipientChatID).Scan(&deliveredMessageID, &createdAtStr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	relayed := &models.RelayedMessage{
+		SenderChatID:       senderChatID,
+		OriginalMessageID:  originalMessageID,
+		RecipientChatID:    recipientChatID,
+		DeliveredMessageID: deliveredMessageID,
+	}
+
+	if createdAtStr.Valid {
+		parsedTime, err := time.Parse(time.RFC3339, createdAtStr.String)
+		if err == nil {
+			relayed.CreatedAt = parsedTime
+		}
+	}
+
+	return relayed, nil
+}
+
+// GetRelayedCopies returns every delivered copy of a message
+func (db *DB) GetRelayedCopies(senderChatID int64, originalMessageID int) ([]models.RelayedMessage, error) {
+	query := `
+    SELECT recipient_chat_id, delivered_message_id, created_at FROM relayed_messages
+    WHERE sender_chat_id = ? AND original_message_id = ?
+    `
+
+	rows, err := db.conn.Query(query, senderChatID, originalMessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copies []models.RelayedMessage
+	for rows.Next() {
+		relayed := models.RelayedMessage{
+			SenderChatID:      senderChatID,
+			OriginalMessageID: originalMessageID,
+		}
+		var createdAtStr sql.NullString
+
+		if err := rows.Scan(&relayed.RecipientChatID, &relayed.DeliveredMessageID, &createdAtStr); err != nil {
+			return nil, err
+		}
+
+		if createdAtStr.Valid {
+			parsedTime, err := time.Parse(time.RFC3339, createdAtStr.String)
+			if err == nil {
+				relayed.CreatedAt = parsedTime
+			}
+		}
+
+		copies = append(copies, relayed)
+	}
+
+	return copies, nil
+}
+
+// GetAlbumMessageIDs returns every message the sender relayed in the same album
+// as the given one, or nil if it wasn't relayed as part of an album
+func (db *DB) GetAlbumMessageIDs(senderChatID int64, originalMessageID int) ([]int, error) {
+	query := `
+    SELECT DISTINCT album.original_message_id
+    FROM relayed_messages AS part
+    JOIN relayed_messages AS album
+        ON album.sender_chat_id = part.sender_chat_id AND album.media_group_id = part.media_group_id
+    WHERE part.sender_chat_id = ? AND part.original_message_id = ? AND part.media_group_id != ''
+    ORDER BY album.original_message_id
+    `
+
+	rows, err := db.conn.Query(query, senderChatID, originalMessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messageIDs []int
+	for rows.Next() {
+		var messageID int
+		if err := rows.Scan(&messageID); err != nil {
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+
+	return messageIDs, rows.Err()
+}
+
+// GetLastRelayedMessageID returns the most recent message the user had relayed,
+// or 0 if there is none
+func (db *DB) GetLastRelayedMessageID(senderChatID int64) (int, error) {
+	query := `
+    SELECT original_message_id FROM relayed_messages
+    WHERE sender_chat_id = ?
+    ORDER BY original_message_id DESC
+    LIMIT 1
+    `
+
+	var originalMessageID int
+	err := db.conn.QueryRow(query, senderChatID).Scan(&originalMessageID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return originalMessageID, err
+}
+
+// IsRelayedCopy reports whether a message in chatID is a copy of someone else's message
+func (db *DB) IsRelayedCopy(chatID int64, messageID int) (bool, error) {
+	query := `SELECT COUNT(*) FROM relayed_messages WHERE recipient_chat_id = ? AND delivered_message_id = ?`
+
+	var count int
+	err := db.conn.QueryRow(query, chatID, messageID).Scan(&count)
+
+	return count > 0, err
+}
+
+// DeleteRelayedMessage forgets every delivered copy of a message
+func (db *DB) DeleteRelayedMessage(senderChatID int64, originalMessageID int) error {
+	_, err := db.conn.Exec(
+		`DELETE FROM relayed_messages WHERE sender_chat_id = ? AND original_message_id = ?`,
+		senderChatID,
+		originalMessageID,
+	)
+	return err
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// reportColumns are the columns read by scanReport
+const reportColumns = `id, session_id, reporter_id, reported_id, reason, details, status, created_at, resolved_by, resolved_at`
+
+// CreateReport stores a pending report and returns its ID. It returns false
+// if the reporter already reported this chat session.
+func (db *DB) CreateReport(report *models.Report) (int64, bool, error) {
+	query := `
+    INSERT OR IGNORE INTO reports (session_id, reporter_id, reported_id, reason, details, status, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+    `
+
+	result, err := db.conn.Exec(
+		query,
+		report.SessionID,
+		report.ReporterID,
+		report.ReportedID,
+		string(report.Reason),
+		report.Details,
+		string(models.ReportPending),
+		formatTime(time.Now()),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted == 0 {
+		return 0, false, err
+	}
+
+	id, err := result.LastInsertId()
+	return id, err == nil, err
+}
+
+// GetReport returns a report by ID, or nil if there is none
+func (db *DB) GetReport(id int64) (*models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE id = ?`
+
+	report, err := scanReport(db.conn.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return report, err
+}
+
+// GetPendingReports returns reports no moderator has acted on yet, oldest first
+func (db *DB) GetPendingReports(limit int) ([]models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE status = ? ORDER BY id LIMIT ?`
+
+	rows, err := db.conn.Query(query, string(models.ReportPending), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, rows.Err()
+}
+
+// GetReportsAbout returns the reports about a user, newest first
+func (db *DB) GetReportsAbout(userID int64, limit int) ([]models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE reported_id = ? ORDER BY id DESC LIMIT ?`
+
+	rows, err := db.conn.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, rows.Err()
+}
+
+// ResolveReport records a moderator's decision on a pending report within the
+// transaction. It reports false if the report was already resolved.
+func (tx *Tx) ResolveReport(id int64, status models.ReportStatus, moderatorID int64) (bool, error) {
+	query := `
+    UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ?
+    WHERE id = ? AND status = ?
+    `
+
+	result, err := tx.tx.Exec(query, string(status), moderatorID, formatTime(time.Now()), id, string(models.ReportPending))
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// scanReport reads a report selected with reportColumns
+func scanReport(row rowScanner) (*models.Report, error) {
+	var report models.Report
+	var reason, status, createdAtStr string
+	var resolvedAtStr sql.NullString
+
+	err := row.Scan(&report.ID, &report.SessionID, &report.ReporterID, &report.ReportedID, &reason, &report.Details,
+		&status, &createdAtStr, &report.ResolvedBy, &resolvedAtStr)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Reason = models.ReportReason(reason)
+	report.Status = models.ReportStatus(status)
+
+	createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+	if err != nil {
+		return nil, err
+	}
+	report.CreatedAt = createdAt
+
+	if resolvedAtStr.Valid {
+		parsedTime, err := time.Parse(time.RFC3339, resolvedAtStr.String)
+		if err == nil {
+			report.ResolvedAt = &parsedTime
+		}
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// GetStats counts users, chats started since the given time, pending reports
+// and bans and shadowbans in effect
+func (db *DB) GetStats(since time.Time) (*models.Stats, error) {
+	query := `
+    SELECT
+        (SELECT COUNT(*) FROM users),
+        (SELECT COUNT(*) FROM users WHERE is_active = 1 AND unreachable = 0),
+        (SELECT COUNT(*) FROM users WHERE current_chat != 0),
+        (SELECT COUNT(*) FROM users WHERE match_start_time IS NOT NULL AND current_chat = 0 AND unreachable = 0),
+        (SELECT COUNT(*) FROM chat_sessions WHERE started_at >= ?),
+        (SELECT COUNT(*) FROM reports WHERE status = ?),
+        (SELECT COUNT(*) FROM bans WHERE kind != ? AND (expires_at IS NULL OR expires_at > ?)),
+        (SELECT COUNT(*) FROM bans WHERE kind = ? AND (expires_at IS NULL OR expires_at > ?))
+    `
+
+	var stats models.Stats
+	now := formatTime(time.Now())
+	err := db.conn.QueryRow(
+		query,
+		formatTime(since),
+		string(models.ReportPending),
+		string(models.BanShadow),
+		now,
+		string(models.BanShadow),
+		now,
+	).Scan(
+		&stats.Users,
+		&stats.OnlineUsers,
+		&stats.ChattingUsers,
+		&stats.WaitingUsers,
+		&stats.ChatsStarted,
+		&stats.PendingReports,
+		&stats.BannedUsers,
+		&stats.ShadowbannedUsers,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,15 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/storetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return openTestDB(t, filepath.Join(t.TempDir(), "store.db"))
+	})
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// DB and Tx are the SQLite implementation of the store
+var (
+	_ store.Store    = (*DB)(nil)
+	_ store.Tx       = (*Tx)(nil)
+	_ store.Migrator = (*DB)(nil)
+)
+
+// Tx is a database transaction. Work that must only happen once the
+// transaction is committed can be registered with AfterCommit.
+type Tx struct {
+	tx          *sql.Tx
+	afterCommit []func()
+}
+
+// RunInTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise. AfterCommit hooks run after a successful commit.
+func (db *DB) RunInTx(fn func(tx store.Tx) error) error {
+	return db.runInTx(func(tx *Tx) error {
+		return fn(tx)
+	})
+}
+
+// runInTx is RunInTx for code in this package that needs the SQLite transaction
+func (db *DB) runInTx(fn func(tx *Tx) error) error {
+	sqlTx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{tx: sqlTx}
+	if err := fn(tx); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+
+	for _, hook := range tx.afterCommit {
+		hook()
+	}
+
+	return nil
+}
+
+// AfterCommit registers a function to run once the transaction has committed
+func (tx *Tx) AfterCommit(hook func()) {
+	tx.afterCommit = append(tx.afterCommit, hook)
+}
+
+// GetUserState retrieves a user's state within the transaction
+func (tx *Tx) GetUserState(userID int64) (*models.UserState, error) {
+	return getUserState(tx.tx, userID)
+}
+
+// SaveUserState stores a user's state within the transaction
+func (tx *Tx) SaveUserState(state *models.UserState) error {
+	return saveUserState(tx.tx, state)
+}
+
+// InsertOutbox adds a message to the outbox within the transaction
+func (tx *Tx) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	return insertOutbox(tx.tx, message)
+}
@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Names of the built-in filters, as used in operator settings
+const (
+	URLs     = "urls"
+	Mentions = "mentions"
+	Phones   = "phones"
+	Emails   = "emails"
+	Words    = "words"
+)
+
+var (
+	// urlPattern matches links with a scheme or www prefix, Telegram links
+	// and bare domains with common top-level domains
+	urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+` +
+		`|\b(?:t|telegram)\.(?:me|dog)/\S+` +
+		`|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|me|ru|info|xyz|link|app|co|ly|gg|biz|site|online|top)\b(?:/\S*)?`)
+
+	// mentionPattern matches Telegram @usernames, which are 5 to 32 characters
+	mentionPattern = regexp.MustCompile(`\B@[A-Za-z][A-Za-z0-9_]{4,31}\b`)
+
+	// phonePattern matches the shapes phone numbers are written in: spaced
+	// groups only after a country code, an area code in parentheses or a
+	// trunk 0, so unrelated numbers in a sentence aren't joined into one.
+	// Otherwise a number is a single run of digits, dots and dashes. See
+	// isPhoneNumber for what else a match must look like.
+	phonePattern = regexp.MustCompile(`\+\d[\d ().-]{5,}\d` +
+		`|\(\d{1,4}\)[ .-]?\d[\d .-]{4,}\d` +
+		`|\b0\d{2,4}(?:[ .-]\d{2,4}){2,}\b` +
+		`|\b\d[\d.-]*\d\b`)
+
+	// datePattern and groupedNumberPattern match runs of digits that are
+	// dates and amounts rather than phone numbers
+	datePattern          = regexp.MustCompile(`^(?:\d{4}[.-]\d{1,2}[.-]\d{1,2}|\d{1,2}[.-]\d{1,2}[.-]\d{4})$`)
+	groupedNumberPattern = regexp.MustCompile(`^\d{1,3}(?:\.\d{3})+$`)
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// minPhoneDigits is how many digits make a number look like a phone number
+// rather than a price or a year
+const minPhoneDigits = 7
+
+// NewURLFilter applies action to links
+func NewURLFilter(action Action) Filter {
+	return NewPatternFilter(URLs, urlPattern, action)
+}
+
+// NewMentionFilter applies action to @usernames
+func NewMentionFilter(action Action) Filter {
+	return NewPatternFilter(Mentions, mentionPattern, action)
+}
+
+// NewPhoneFilter applies action to phone numbers
+func NewPhoneFilter(action Action) Filter {
+	f := NewPatternFilter(Phones, phonePattern, action)
+	f.valid = isPhoneNumber
+	return f
+}
+
+// NewEmailFilter applies action to email addresses
+func NewEmailFilter(action Action) Filter {
+	return NewPatternFilter(Emails, emailPattern, action)
+}
+
+// NewWordFilter applies action to whole words from the list in any script,
+// ignoring case. It returns nil if the list is empty.
+func NewWordFilter(words []string, action Action) Filter {
+	var quoted []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+
+	// Longer words go first, so a word isn't passed over because a shorter
+	// one it starts with matched and turned out to be part of it
+	sort.SliceStable(quoted, func(i, j int) bool {
+		return len(quoted[i]) > len(quoted[j])
+	})
+
+	f := NewPatternFilter(Words, regexp.MustCompile(`(?i)(?:`+strings.Join(quoted, "|")+`)`), action)
+	f.wholeWords = true
+	return f
+}
+
+// DefaultActions are the actions of the built-in filters unless operators
+// configure otherwise. Contact details are hidden to keep chats anonymous.
+var DefaultActions = map[string]Action{
+	URLs:     Redact,
+	Mentions: Redact,
+	Phones:   Redact,
+	Emails:   Redact,
+	Words:    Block,
+}
+
+// NewDefaultChain builds the chain of built-in filters with the given actions,
+// falling back to DefaultActions for filters without one. Email addresses are
+// checked before @mentions and links, which would match parts of them.
+func NewDefaultChain(actions map[string]Action, words []string) *Chain {
+	action := func(name string) Action {
+		if a, ok := actions[name]; ok {
+			return a
+		}
+		return DefaultActions[name]
+	}
+
+	chain := NewChain(
+		NewEmailFilter(action(Emails)),
+		NewURLFilter(action(URLs)),
+		NewMentionFilter(action(Mentions)),
+		NewPhoneFilter(action(Phones)),
+	)
+	if f := NewWordFilter(words, action(Words)); f != nil {
+		chain.Add(f)
+	}
+
+	return chain
+}
+
+// isPhoneNumber reports whether a match has enough digits to be a phone
+// number and, if it is a single run of digits, isn't a date or an amount
+// written with thousands separators
+func isPhoneNumber(match string) bool {
+	digits := 0
+	for _, r := range match {
+		if unicode.IsDigit(r) {
+			digits++
+		}
+	}
+	if digits < minPhoneDigits {
+		return false
+	}
+
+	if strings.ContainsAny(match, " (+") {
+		return true
+	}
+	return !datePattern.MatchString(match) && !groupedNumberPattern.MatchString(match)
+}
@@ -0,0 +1,190 @@
+// Package filter checks the text users send each other before it is relayed,
+// so operators can hide contact details and keep out unwanted words.
+package filter
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Action is what happens to a message a filter matched
+type Action string
+
+const (
+	// Allow relays the message unchanged; the filter is effectively off
+	Allow Action = "allow"
+
+	// Redact relays the message with the matched parts replaced
+	Redact Action = "redact"
+
+	// Block keeps the message from being relayed at all
+	Block Action = "block"
+
+	// Flag relays the message unchanged and reports it to the moderators
+	Flag Action = "flag"
+)
+
+// RedactedText replaces the parts of a message removed by a Redact filter
+const RedactedText = "[removed]"
+
+// ParseAction returns the action with the given name
+func ParseAction(name string) (Action, bool) {
+	action := Action(strings.ToLower(strings.TrimSpace(name)))
+	switch action {
+	case Allow, Redact, Block, Flag:
+		return action, true
+	}
+	return "", false
+}
+
+// Verdict is a filter's decision about a text
+type Verdict struct {
+	Action Action
+
+	// Text is the text to pass on, with any redactions applied
+	Text string
+}
+
+// Filter decides what to do with the text of a message
+type Filter interface {
+	// Name identifies the filter in operator settings and moderator notices
+	Name() string
+
+	// Check returns the filter's verdict on the text
+	Check(text string) Verdict
+}
+
+// Result is what a chain of filters decided about a text
+type Result struct {
+	// Text is the text to relay, with redactions applied
+	Text string
+
+	// BlockedBy names the filter that blocked the text, empty if it may be relayed
+	BlockedBy string
+
+	// RedactedBy names the filters that removed parts of the text
+	RedactedBy []string
+
+	// FlaggedBy names the filters that want moderators to look at the text
+	FlaggedBy []string
+}
+
+// Blocked reports whether the text must not be relayed
+func (r Result) Blocked() bool {
+	return r.BlockedBy != ""
+}
+
+// Chain runs filters one after another, each seeing the text as redacted by
+// the ones before it
+type Chain struct {
+	filters []Filter
+}
+
+// NewChain creates a chain running the given filters in order
+func NewChain(filters ...Filter) *Chain {
+	return &Chain{filters: filters}
+}
+
+// Add appends a filter to the chain
+func (c *Chain) Add(f Filter) {
+	c.filters = append(c.filters, f)
+}
+
+// Apply runs the text through every filter, stopping at the first one that
+// blocks it
+func (c *Chain) Apply(text string) Result {
+	result := Result{Text: text}
+	if c == nil {
+		return result
+	}
+
+	for _, f := range c.filters {
+		verdict := f.Check(result.Text)
+
+		switch verdict.Action {
+		case Block:
+			result.BlockedBy = f.Name()
+			return result
+		case Redact:
+			result.Text = verdict.Text
+			result.RedactedBy = append(result.RedactedBy, f.Name())
+		case Flag:
+			result.FlaggedBy = append(result.FlaggedBy, f.Name())
+		}
+	}
+
+	return result
+}
+
+// PatternFilter matches text against a regular expression and applies its
+// action to the matches
+type PatternFilter struct {
+	name    string
+	pattern *regexp.Regexp
+	action  Action
+
+	// wholeWords rejects matches that are part of a longer word
+	wholeWords bool
+
+	// valid, if set, rejects matches that only look like what is filtered
+	valid func(match string) bool
+}
+
+// NewPatternFilter creates a filter applying action to text matching pattern
+func NewPatternFilter(name string, pattern *regexp.Regexp, action Action) *PatternFilter {
+	return &PatternFilter{name: name, pattern: pattern, action: action}
+}
+
+// Name identifies the filter
+func (f *PatternFilter) Name() string {
+	return f.name
+}
+
+// Check returns the filter's action if the text has a match, redacting the
+// matches for Redact
+func (f *PatternFilter) Check(text string) Verdict {
+	var redacted strings.Builder
+	matched := false
+	last := 0
+
+	for _, loc := range f.pattern.FindAllStringIndex(text, -1) {
+		if !f.accepts(text, loc[0], loc[1]) {
+			continue
+		}
+		matched = true
+		redacted.WriteString(text[last:loc[0]])
+		redacted.WriteString(RedactedText)
+		last = loc[1]
+	}
+	redacted.WriteString(text[last:])
+
+	if !matched || f.action == Allow {
+		return Verdict{Action: Allow, Text: text}
+	}
+	if f.action == Redact {
+		return Verdict{Action: Redact, Text: redacted.String()}
+	}
+	return Verdict{Action: f.action, Text: text}
+}
+
+// accepts reports whether the match at text[start:end] counts
+func (f *PatternFilter) accepts(text string, start int, end int) bool {
+	if f.wholeWords {
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if isWordRune(before) || isWordRune(after) {
+			return false
+		}
+	}
+
+	return f.valid == nil || f.valid(text[start:end])
+}
+
+// isWordRune reports whether r can be part of a word in any script. RE2's \b
+// only knows ASCII letters, so it can't tell where a Cyrillic or accented
+// word ends.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+}
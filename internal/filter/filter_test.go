@@ -0,0 +1,157 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultChainRedactsContactDetails(t *testing.T) {
+	chain := NewDefaultChain(nil, nil)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hi there, how are you?", "hi there, how are you?"},
+		{"add me @someone_here", "add me [removed]"},
+		{"mail me at jane.doe@example.com", "mail me at [removed]"},
+		{"join t.me/joinchat/abc123 now", "join [removed] now"},
+		{"see https://example.com/page?x=1", "see [removed]"},
+		{"visit www.example.org", "visit [removed]"},
+		{"my site is example.com", "my site is [removed]"},
+		{"call +1 (555) 123-4567", "call [removed]"},
+		{"it costs 1500 and I'm 25", "it costs 1500 and I'm 25"},
+	}
+
+	for _, tt := range tests {
+		result := chain.Apply(tt.text)
+		if result.Blocked() {
+			t.Errorf("Apply(%q) blocked by %s", tt.text, result.BlockedBy)
+		}
+		if result.Text != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.text, result.Text, tt.want)
+		}
+		if redacted := len(result.RedactedBy) > 0; redacted != (tt.text != tt.want) {
+			t.Errorf("Apply(%q) RedactedBy = %v", tt.text, result.RedactedBy)
+		}
+	}
+}
+
+func TestPhoneFilter(t *testing.T) {
+	chain := NewChain(NewPhoneFilter(Redact))
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"call +62 812 3456 7890", "call [removed]"},
+		{"call +1 (555) 123-4567 now", "call [removed] now"},
+		{"(021) 555-1234 is the office", "[removed] is the office"},
+		{"my number 0812 3456 7890", "my number [removed]"},
+		{"text 08123456789", "text [removed]"},
+		{"6281234567890", "[removed]"},
+		{"text 555-123-4567 please", "text [removed] please"},
+
+		// Years, prices, dates and counts next to each other aren't phone numbers
+		{"phone 2024 2025 and 12.50", "phone 2024 2025 and 12.50"},
+		{"born 1999, moved 2010 2015 2020", "born 1999, moved 2010 2015 2020"},
+		{"it was Rp 1.500.000 for 2 nights", "it was Rp 1.500.000 for 2 nights"},
+		{"on 2024-01-15 or 15.01.2024", "on 2024-01-15 or 15.01.2024"},
+		{"I have 1,000,000 followers", "I have 1,000,000 followers"},
+		{"scored 120 150 180 200 points", "scored 120 150 180 200 points"},
+		{"I'm 25 and 180 cm", "I'm 25 and 180 cm"},
+	}
+
+	for _, tt := range tests {
+		if result := chain.Apply(tt.text); result.Text != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.text, result.Text, tt.want)
+		}
+	}
+}
+
+func TestChainBlockStopsFiltering(t *testing.T) {
+	chain := NewDefaultChain(map[string]Action{URLs: Block}, nil)
+
+	result := chain.Apply("@someone_here see example.com")
+	if result.BlockedBy != URLs {
+		t.Fatalf("BlockedBy = %q, want %q", result.BlockedBy, URLs)
+	}
+}
+
+func TestChainFlagKeepsText(t *testing.T) {
+	chain := NewDefaultChain(map[string]Action{Mentions: Flag, Phones: Flag}, nil)
+
+	text := "text @someone_here or +1 555 123 4567"
+	result := chain.Apply(text)
+	if result.Blocked() {
+		t.Fatalf("flagged text was blocked by %s", result.BlockedBy)
+	}
+	if result.Text != text {
+		t.Errorf("Text = %q, want %q", result.Text, text)
+	}
+	if want := []string{Mentions, Phones}; !reflect.DeepEqual(result.FlaggedBy, want) {
+		t.Errorf("FlaggedBy = %v, want %v", result.FlaggedBy, want)
+	}
+}
+
+func TestAllowDisablesFilter(t *testing.T) {
+	chain := NewDefaultChain(map[string]Action{URLs: Allow}, nil)
+
+	text := "see example.com"
+	if result := chain.Apply(text); result.Text != text {
+		t.Errorf("Text = %q, want %q", result.Text, text)
+	}
+}
+
+func TestWordFilter(t *testing.T) {
+	chain := NewDefaultChain(nil, []string{"badword", "a.b"})
+
+	if result := chain.Apply("this has a BadWord in it"); result.BlockedBy != Words {
+		t.Errorf("BlockedBy = %q, want %q", result.BlockedBy, Words)
+	}
+	if result := chain.Apply("badwords and axb are fine"); result.Blocked() {
+		t.Errorf("partial match blocked by %s", result.BlockedBy)
+	}
+
+	chain = NewDefaultChain(map[string]Action{Words: Redact}, []string{"badword"})
+	if result := chain.Apply("oh badword!"); result.Text != "oh [removed]!" {
+		t.Errorf("Text = %q, want %q", result.Text, "oh [removed]!")
+	}
+}
+
+func TestWordFilterMatchesAnyScript(t *testing.T) {
+	chain := NewDefaultChain(map[string]Action{Words: Redact}, []string{"сука", "café", "anjing", "bad", "badword"})
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"ты сука", "ты [removed]"},
+		{"ТЫ СУКА!", "ТЫ [removed]!"},
+		{"nice café here", "nice [removed] here"},
+		{"dasar anjing lo", "dasar [removed] lo"},
+		{"сука, сука", "[removed], [removed]"},
+		{"what a badword", "what a [removed]"},
+
+		// Words that merely contain a listed one are left alone
+		{"сукин сын", "сукин сын"},
+		{"two cafés", "two cafés"},
+		{"anjingnya lucu", "anjingnya lucu"},
+		{"badminton", "badminton"},
+	}
+
+	for _, tt := range tests {
+		if result := chain.Apply(tt.text); result.Text != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.text, result.Text, tt.want)
+		}
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	if action, ok := ParseAction(" Redact "); !ok || action != Redact {
+		t.Errorf("ParseAction(Redact) = %q, %v", action, ok)
+	}
+	if _, ok := ParseAction("drop"); ok {
+		t.Error("ParseAction(drop) succeeded")
+	}
+}
@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/countries"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/utils"
+)
+
+// adminTimeFormat is how times are shown to admins
+const adminTimeFormat = "2006-01-02 15:04 MST"
+
+// handleAdminCommand runs an admin-only command. It returns false if the
+// command isn't one.
+func (h *HandlerManager) handleAdminCommand(update tgbotapi.Update) bool {
+	adminID := update.Message.From.ID
+	chatID := update.Message.Chat.ID
+	args := strings.Fields(update.Message.CommandArguments())
+
+	switch update.Message.Command() {
+	case "ban":
+		h.handleBanCommand(adminID, chatID, args)
+	case "shadowban":
+		h.handleShadowbanCommand(adminID, chatID, args)
+	case "unban":
+		h.handleUnbanCommand(adminID, chatID, args)
+	case "kick":
+		h.handleKickCommand(adminID, chatID, args)
+	case "whois":
+		h.handleWhoisCommand(adminID, chatID, args)
+	case "stats":
+		h.handleStatsCommand(adminID, chatID)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// handleBanCommand bans a user, for good or for a while:
+// /ban <user_id> [duration] [reason]
+func (h *HandlerManager) handleBanCommand(adminID int64, chatID int64, args []string) {
+	ban, ok := parseBanArgs(args)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, "Usage: /ban <user_id> [duration, e.g. 12h, 7d or 2w] [reason]")
+		return
+	}
+	if h.config.IsAdmin(ban.UserID) {
+		h.msgQueue.QueueTextMessage(chatID, "Admins can't be banned.")
+		return
+	}
+
+	ban.BannedBy = adminID
+	ban.Kind = models.BanPermanent
+	if ban.ExpiresAt != nil {
+		ban.Kind = models.BanTemporary
+	}
+
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		err := tx.RecordAdminAction(&models.AdminAction{
+			AdminID:  adminID,
+			Action:   models.AdminBan,
+			TargetID: ban.UserID,
+			Details:  describeBan(ban),
+		})
+		if err != nil {
+			return err
+		}
+
+		return h.banUserTx(tx, ban)
+	})
+	if err != nil {
+		log.Printf("Error banning user %d: %v", ban.UserID, err)
+		h.msgQueue.QueueTextMessage(chatID, "Error banning the user.")
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("User %d banned (%s).", ban.UserID, describeBan(ban)))
+}
+
+// handleShadowbanCommand shadowbans a user, who is not told and keeps
+// chatting, but only with other shadowbanned users from now on:
+// /shadowban <user_id> [duration] [reason]
+func (h *HandlerManager) handleShadowbanCommand(adminID int64, chatID int64, args []string) {
+	ban, ok := parseBanArgs(args)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, "Usage: /shadowban <user_id> [duration, e.g. 12h, 7d or 2w] [reason]")
+		return
+	}
+	if h.config.IsAdmin(ban.UserID) {
+		h.msgQueue.QueueTextMessage(chatID, "Admins can't be banned.")
+		return
+	}
+
+	ban.BannedBy = adminID
+	ban.Kind = models.BanShadow
+
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		err := tx.RecordAdminAction(&models.AdminAction{
+			AdminID:  adminID,
+			Action:   models.AdminShadowban,
+			TargetID: ban.UserID,
+			Details:  describeBan(ban),
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.BanUser(ban)
+	})
+	if err != nil {
+		log.Printf("Error shadowbanning user %d: %v", ban.UserID, err)
+		h.msgQueue.QueueTextMessage(chatID, "Error shadowbanning the user.")
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("User %d shadowbanned (%s).", ban.UserID, describeBan(ban)))
+}
+
+// handleUnbanCommand lifts a user's ban: /unban <user_id> [reason]
+func (h *HandlerManager) handleUnbanCommand(adminID int64, chatID int64, args []string) {
+	userID, ok := parseUserIDArg(args)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, "Usage: /unban <user_id> [reason]")
+		return
+	}
+
+	// Shadowbanned users never knew, so they aren't told either
+	current, err := h.db.GetBan(userID)
+	if err != nil {
+		log.Printf("Error getting ban: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error unbanning the user.")
+		return
+	}
+	notify := current != nil && !current.IsShadow()
+
+	var lifted bool
+	err = h.db.RunInTx(func(tx store.Tx) error {
+		var err error
+		lifted, err = tx.UnbanUser(userID)
+		if err != nil || !lifted {
+			return err
+		}
+
+		err = tx.RecordAdminAction(&models.AdminAction{
+			AdminID:  adminID,
+			Action:   models.AdminUnban,
+			TargetID: userID,
+			Details:  strings.Join(args[1:], " "),
+		})
+		if err != nil || !notify {
+			return err
+		}
+
+		return h.msgQueue.QueueTextMessageTx(tx, userID, "Your ban has been lifted. Use /start to chat again.")
+	})
+	if err != nil {
+		log.Printf("Error unbanning user %d: %v", userID, err)
+		h.msgQueue.QueueTextMessage(chatID, "Error unbanning the user.")
+		return
+	}
+
+	if !lifted {
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("User %d is not banned.", userID))
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("User %d unbanned.", userID))
+}
+
+// handleKickCommand ends a user's current chat: /kick <user_id> [reason]
+func (h *HandlerManager) handleKickCommand(adminID int64, chatID int64, args []string) {
+	userID, ok := parseUserIDArg(args)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, "Usage: /kick <user_id> [reason]")
+		return
+	}
+
+	var kicked bool
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		session, err := tx.GetCurrentChatSession(userID)
+		if err != nil {
+			return err
+		}
+
+		partnerID, ended, err := tx.EndChat(userID, models.EndReasonKicked)
+		if err != nil || !ended {
+			return err
+		}
+		kicked = true
+
+		err = tx.RecordAdminAction(&models.AdminAction{
+			AdminID:  adminID,
+			Action:   models.AdminKick,
+			TargetID: userID,
+			Details:  strings.Join(args[1:], " "),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := h.msgQueue.QueueTextMessageTx(tx, userID, "A moderator ended your chat. Please follow the rules."); err != nil {
+			return err
+		}
+
+		if partnerID == 0 {
+			return nil
+		}
+
+		return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner has ended the conversation.", sessionID(session)))
+	})
+	if err != nil {
+		log.Printf("Error kicking user %d: %v", userID, err)
+		h.msgQueue.QueueTextMessage(chatID, "Error ending the user's chat.")
+		return
+	}
+
+	if !kicked {
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("User %d is not in a chat.", userID))
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("Ended the chat of user %d.", userID))
+}
+
+// handleWhoisCommand shows a user's state, ban, reports, chats and moderation
+// history: /whois <user_id>
+func (h *HandlerManager) handleWhoisCommand(adminID int64, chatID int64, args []string) {
+	userID, ok := parseUserIDArg(args)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, "Usage: /whois <user_id>")
+		return
+	}
+
+	text, err := h.describeUser(userID)
+	if err != nil {
+		log.Printf("Error looking up user %d: %v", userID, err)
+		h.msgQueue.QueueTextMessage(chatID, "Error looking up the user.")
+		return
+	}
+
+	h.recordAdminAction(&models.AdminAction{AdminID: adminID, Action: models.AdminWhois, TargetID: userID})
+	h.msgQueue.QueueTextMessage(chatID, text)
+}
+
+// handleStatsCommand shows an overview of users, chats, reports and bans
+func (h *HandlerManager) handleStatsCommand(adminID int64, chatID int64) {
+	stats, err := h.db.GetStats(time.Now().Add(-config.StatsWindow))
+	if err != nil {
+		log.Printf("Error getting stats: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error getting stats.")
+		return
+	}
+
+	h.recordAdminAction(&models.AdminAction{AdminID: adminID, Action: models.AdminStats})
+	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf(
+		"Users: %d\nOnline: %d\nIn a chat: %d\nSearching: %d\nChats in the last %s: %d\nPending reports: %d\nBanned: %d\nShadowbanned: %d",
+		stats.Users, stats.OnlineUsers, stats.ChattingUsers, stats.WaitingUsers,
+		config.StatsWindow, stats.ChatsStarted, stats.PendingReports, stats.BannedUsers, stats.ShadowbannedUsers))
+}
+
+// describeUser puts together what /whois shows about a user
+func (h *HandlerManager) describeUser(userID int64) (string, error) {
+	state, err := h.db.GetUserState(userID)
+	if err != nil {
+		return "", err
+	}
+	ban, err := h.db.GetBan(userID)
+	if err != nil {
+		return "", err
+	}
+	reports, err := h.db.GetReportsAbout(userID, config.WhoisHistoryLimit)
+	if err != nil {
+		return "", err
+	}
+	sessions, err := h.db.GetChatSessions(userID, config.WhoisHistoryLimit)
+	if err != nil {
+		return "", err
+	}
+	actions, err := h.db.GetAdminActions(userID, config.WhoisHistoryLimit)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "User %d\n", userID)
+	fmt.Fprintf(&b, "Online: %v, reachable: %v\n", state.IsActive, !state.Unreachable)
+	if state.CurrentChat != 0 {
+		fmt.Fprintf(&b, "In a chat with %d\n", state.CurrentChat)
+	} else if state.IsWaitingForMatch() {
+		fmt.Fprintf(&b, "Searching since %s\n", formatAdminTime(*state.MatchStartTime))
+	}
+	if !state.LastActivity.IsZero() {
+		fmt.Fprintf(&b, "Last active: %s\n", formatAdminTime(state.LastActivity))
+	}
+
+	profile := state.Settings.Profile
+	fmt.Fprintf(&b, "Country: %s, language: %s, gender: %s\n",
+		valueOrNotSet(countries.Name(profile.Country)), valueOrNotSet(profile.Language), valueOrNotSet(profile.Gender))
+
+	if ban != nil {
+		fmt.Fprintf(&b, "Ban: %s\n", describeBan(ban))
+	} else {
+		b.WriteString("Not banned\n")
+	}
+
+	b.WriteString("\nReports about this user:\n")
+	if len(reports) == 0 {
+		b.WriteString("none\n")
+	}
+	for _, r := range reports {
+		fmt.Fprintf(&b, "#%d %s: %s by %d (%s)\n", r.ID, formatAdminTime(r.CreatedAt), r.Reason.Label(), r.ReporterID, r.Status)
+	}
+
+	b.WriteString("\nRecent chats:\n")
+	if len(sessions) == 0 {
+		b.WriteString("none\n")
+	}
+	for _, s := range sessions {
+		ended := "ongoing"
+		if !s.IsOpen() {
+			ended = string(s.EndReason)
+		}
+		fmt.Fprintf(&b, "#%d %s with %d, %d messages (%s)\n", s.ID, formatAdminTime(s.StartedAt), s.Partner(userID), s.User1Messages+s.User2Messages, ended)
+	}
+
+	b.WriteString("\nModeration history:\n")
+	if len(actions) == 0 {
+		b.WriteString("none\n")
+	}
+	for _, a := range actions {
+		fmt.Fprintf(&b, "%s: %s by %s", formatAdminTime(a.CreatedAt), a.Action, actorName(a.AdminID))
+		if a.Details != "" {
+			fmt.Fprintf(&b, " (%s)", a.Details)
+		}
+		b.WriteString("\n")
+	}
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// recordAdminAction adds an action that changes nothing else to the audit log
+func (h *HandlerManager) recordAdminAction(action *models.AdminAction) {
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		return tx.RecordAdminAction(action)
+	})
+	if err != nil {
+		log.Printf("Error recording admin action %s: %v", action.Action, err)
+	}
+}
+
+// parseBanArgs reads the user, the optional duration and the reason of a ban
+// command into a ban
+func parseBanArgs(args []string) (*models.Ban, bool) {
+	userID, ok := parseUserIDArg(args)
+	if !ok {
+		return nil, false
+	}
+
+	ban := &models.Ban{UserID: userID}
+	rest := args[1:]
+	if len(rest) > 0 {
+		if duration, err := utils.ParseDuration(rest[0]); err == nil {
+			expiresAt := time.Now().Add(duration)
+			ban.ExpiresAt = &expiresAt
+			rest = rest[1:]
+		}
+	}
+	ban.Reason = strings.Join(rest, " ")
+
+	return ban, true
+}
+
+// parseUserIDArg reads the user ID an admin command acts on
+func parseUserIDArg(args []string) (int64, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	return userID, err == nil && userID > 0
+}
+
+// describeBan summarizes what kind of ban it is, how long it lasts and why
+func describeBan(ban *models.Ban) string {
+	text := string(ban.Kind)
+	if ban.ExpiresAt != nil {
+		text += " until " + formatAdminTime(*ban.ExpiresAt)
+	}
+	if ban.Reason != "" {
+		text += ": " + ban.Reason
+	}
+	return text
+}
+
+// actorName shows who took an admin action; the bot itself records its
+// automatic actions with ID 0
+func actorName(adminID int64) string {
+	if adminID == 0 {
+		return "the bot"
+	}
+	return strconv.FormatInt(adminID, 10)
+}
+
+// valueOrNotSet shows an empty profile field as not set
+func valueOrNotSet(value string) string {
+	if value == "" {
+		return "not set"
+	}
+	return value
+}
+
+// formatAdminTime shows a time to admins
+func formatAdminTime(t time.Time) string {
+	return t.UTC().Format(adminTimeFormat)
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// pendingAlbum collects the parts of a media group until it is relayed
+type pendingAlbum struct {
+	senderID     int64
+	senderChatID int64
+	partnerID    int64
+	replyTo      int
+	items        []models.MediaItem
+}
+
+// bufferAlbumPart adds a media group message to its album. The album is relayed
+// a short window after its first part arrives. It returns false if the message
+// cannot be part of an album.
+func (h *HandlerManager) bufferAlbumPart(mediaGroupID string, senderID int64, relay models.QueuedMessage) bool {
+	switch relay.Type {
+	case models.PhotoMessage, models.VideoMessage, models.DocumentMessage, models.AudioMessage:
+	default:
+		return false
+	}
+
+	// Only explicit captions are kept, so the album isn't labelled on every item
+	caption := ""
+	if relay.Caption != defaultPhotoCaption {
+		caption = relay.Caption
+	}
+
+	item := models.MediaItem{
+		Type:            relay.Type,
+		FileID:          relay.FileID,
+		Caption:         caption,
+		SourceMessageID: relay.SourceMessageID,
+	}
+
+	h.albumsMutex.Lock()
+	defer h.albumsMutex.Unlock()
+
+	album, ok := h.albums[mediaGroupID]
+	if !ok {
+		album = &pendingAlbum{
+			senderID:     senderID,
+			senderChatID: relay.SourceChatID,
+			partnerID:    relay.ChatID,
+		}
+		h.albums[mediaGroupID] = album
+		time.AfterFunc(config.MediaGroupWindow, func() {
+			h.flushAlbum(mediaGroupID)
+		})
+	}
+
+	// Telegram attaches a reply to only one part of the album
+	if relay.ReplyToMessageID != 0 {
+		album.replyTo = relay.ReplyToMessageID
+	}
+
+	album.items = append(album.items, item)
+	return true
+}
+
+// flushAlbum relays a buffered media group to the sender's chat partner
+func (h *HandlerManager) flushAlbum(mediaGroupID string) {
+	h.albumsMutex.Lock()
+	album, ok := h.albums[mediaGroupID]
+	delete(h.albums, mediaGroupID)
+	h.albumsMutex.Unlock()
+
+	if !ok || len(album.items) == 0 {
+		return
+	}
+
+	// Drop the album if the chat ended while it was being collected
+	senderState, err := h.db.GetUserState(album.senderID)
+	if err != nil {
+		log.Printf("Error getting user state: %v", err)
+		return
+	}
+	if senderState.CurrentChat != album.partnerID {
+		return
+	}
+
+	// Updates may be handled concurrently, so restore the original order
+	items := album.items
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].SourceMessageID < items[j].SourceMessageID
+	})
+
+	// A single part is sent as a regular message
+	if len(items) == 1 {
+		h.msgQueue.QueueMessage(models.QueuedMessage{
+			ChatID:           album.partnerID,
+			Type:             items[0].Type,
+			FileID:           items[0].FileID,
+			Caption:          items[0].Caption,
+			SourceChatID:     album.senderChatID,
+			SourceMessageID:  items[0].SourceMessageID,
+			ReplyToMessageID: album.replyTo,
+			Priority:         models.PriorityRelay,
+		})
+		return
+	}
+
+	h.msgQueue.QueueMessage(models.QueuedMessage{
+		ChatID:           album.partnerID,
+		Type:             models.MediaGroupMessage,
+		Media:            items,
+		MediaGroupID:     mediaGroupID,
+		SourceChatID:     album.senderChatID,
+		ReplyToMessageID: album.replyTo,
+		Priority:         models.PriorityRelay,
+	})
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// pair puts two online users in a chat with each other
+func pair(t *testing.T, db store.Store, user1 int64, user2 int64) {
+	t.Helper()
+
+	for _, userID := range []int64{user1, user2} {
+		state := models.NewUserState(userID)
+		state.IsActive = true
+		if err := db.SaveUserState(state); err != nil {
+			t.Fatalf("SaveUserState(%d): %v", userID, err)
+		}
+	}
+
+	err := db.RunInTx(func(tx store.Tx) error {
+		paired, err := tx.PairUsers(user1, user2)
+		if err == nil && !paired {
+			t.Fatalf("users %d and %d were not paired", user1, user2)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PairUsers: %v", err)
+	}
+}
+
+// albumPart is a relayed photo from user 1 to user 2
+func albumPart(messageID int, caption string) models.QueuedMessage {
+	return models.QueuedMessage{
+		ChatID:          2,
+		Type:            models.PhotoMessage,
+		FileID:          fmt.Sprintf("photo%d", messageID),
+		Caption:         caption,
+		SourceChatID:    1,
+		SourceMessageID: messageID,
+		Priority:        models.PriorityRelay,
+	}
+}
+
+// queued returns the messages waiting in the outbox
+func queued(t *testing.T, db store.Store) []models.QueuedMessage {
+	t.Helper()
+
+	entries, err := db.GetPendingOutbox()
+	if err != nil {
+		t.Fatalf("GetPendingOutbox: %v", err)
+	}
+
+	var messages []models.QueuedMessage
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func TestAlbumIsRelayedAsOneMediaGroup(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	// Parts may be handled out of order, and only one carries the reply
+	reply := albumPart(12, defaultPhotoCaption)
+	reply.ReplyToMessageID = 5
+	for _, part := range []models.QueuedMessage{reply, albumPart(10, "Anonymous: look"), albumPart(11, defaultPhotoCaption)} {
+		if !h.bufferAlbumPart("album", 1, part) {
+			t.Fatalf("photo %d was not buffered", part.SourceMessageID)
+		}
+	}
+	if messages := queued(t, db); len(messages) != 0 {
+		t.Fatalf("%d messages relayed before the album was flushed", len(messages))
+	}
+
+	h.flushAlbum("album")
+
+	messages := queued(t, db)
+	if len(messages) != 1 {
+		t.Fatalf("relayed %d messages, want one media group", len(messages))
+	}
+	album := messages[0]
+	if album.Type != models.MediaGroupMessage || album.ChatID != 2 || album.MediaGroupID != "album" {
+		t.Fatalf("relayed %+v, want a media group for user 2", album)
+	}
+	if album.ReplyToMessageID != 5 {
+		t.Errorf("album replies to %d, want 5", album.ReplyToMessageID)
+	}
+
+	if len(album.Media) != 3 {
+		t.Fatalf("album has %d items, want 3", len(album.Media))
+	}
+	for i, item := range album.Media {
+		if want := 10 + i; item.SourceMessageID != want {
+			t.Errorf("item %d is message %d, want %d", i, item.SourceMessageID, want)
+		}
+	}
+
+	// Only the caption the sender wrote is kept
+	if album.Media[0].Caption != "Anonymous: look" || album.Media[1].Caption != "" || album.Media[2].Caption != "" {
+		t.Errorf("captions %q, %q, %q, want only the first", album.Media[0].Caption, album.Media[1].Caption, album.Media[2].Caption)
+	}
+
+	// A second flush finds nothing left
+	h.flushAlbum("album")
+	if messages := queued(t, db); len(messages) != 1 {
+		t.Errorf("relayed %d messages after flushing twice, want 1", len(messages))
+	}
+}
+
+func TestSingleAlbumPartIsSentAlone(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	h.bufferAlbumPart("album", 1, albumPart(10, "Anonymous: only one"))
+	h.flushAlbum("album")
+
+	messages := queued(t, db)
+	if len(messages) != 1 {
+		t.Fatalf("relayed %d messages, want 1", len(messages))
+	}
+	if msg := messages[0]; msg.Type != models.PhotoMessage || msg.FileID != albumPart(10, "").FileID || msg.Caption != "Anonymous: only one" {
+		t.Errorf("relayed %+v, want the photo on its own", msg)
+	}
+}
+
+func TestAlbumOnlyTakesMedia(t *testing.T) {
+	h, _ := newTestHandlers(t)
+
+	for _, msgType := range []models.MessageType{models.TextMessage, models.StickerMessage, models.LocationMessage} {
+		part := albumPart(10, "")
+		part.Type = msgType
+		if h.bufferAlbumPart("album", 1, part) {
+			t.Errorf("%s message was buffered as an album part", msgType)
+		}
+	}
+}
+
+func TestAlbumDroppedWhenChatEnds(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	h.bufferAlbumPart("album", 1, albumPart(10, ""))
+	h.bufferAlbumPart("album", 1, albumPart(11, ""))
+
+	err := db.RunInTx(func(tx store.Tx) error {
+		_, _, err := tx.EndChat(1, models.EndReasonUser)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+
+	h.flushAlbum("album")
+	if messages := queued(t, db); len(messages) != 0 {
+		t.Errorf("relayed %d messages to a partner who left the chat", len(messages))
+	}
+}
+
+func TestAlbumFlushedAfterWindow(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	h.bufferAlbumPart("album", 1, albumPart(10, ""))
+	h.bufferAlbumPart("album", 1, albumPart(11, ""))
+
+	deadline := time.Now().Add(config.MediaGroupWindow + 2*time.Second)
+	for len(queued(t, db)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("album not relayed within %v of its first part", config.MediaGroupWindow)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if messages := queued(t, db); len(messages) != 1 || len(messages[0].Media) != 2 {
+		t.Errorf("relayed %+v, want one album of 2", messages)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// chatBan returns the ban keeping the user from chatting, or nil if there is
+// none. Shadowbans don't count, as shadowbanned users carry on unaware.
+func (h *HandlerManager) chatBan(userID int64) (*models.Ban, error) {
+	ban, err := h.db.GetBan(userID)
+	if err != nil || ban == nil || ban.IsShadow() {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// bannedNotice tells a user they are banned, and until when
+func bannedNotice(ban *models.Ban) string {
+	notice := "🚫 You have been banned for breaking the rules and can no longer chat."
+	if ban.ExpiresAt != nil {
+		notice = fmt.Sprintf("🚫 You have been suspended for breaking the rules until %s.", formatAdminTime(*ban.ExpiresAt))
+	}
+	if ban.Reason != "" {
+		notice += "\nReason: " + ban.Reason
+	}
+	return notice
+}
+
+// banUserTx bans a user within the transaction, ending their chat, taking
+// them out of matching and telling them why
+func (h *HandlerManager) banUserTx(tx store.Tx, ban *models.Ban) error {
+	userID := ban.UserID
+
+	if err := tx.BanUser(ban); err != nil {
+		return err
+	}
+
+	session, err := tx.GetCurrentChatSession(userID)
+	if err != nil {
+		return err
+	}
+
+	partnerID, _, err := tx.EndChat(userID, models.EndReasonBanned)
+	if err != nil {
+		return err
+	}
+
+	userState, err := tx.GetUserState(userID)
+	if err != nil {
+		return err
+	}
+
+	userState.IsActive = false
+	userState.MatchStartTime = nil
+	if err := tx.SaveUserState(userState); err != nil {
+		return err
+	}
+
+	if err := h.msgQueue.QueueTextMessageTx(tx, userID, bannedNotice(ban)); err != nil {
+		return err
+	}
+
+	if partnerID == 0 {
+		return nil
+	}
+
+	return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner has ended the conversation.", sessionID(session)))
+}
+
+// LiftExpiredBans removes bans whose time is up and lets suspended users know
+// they can chat again
+func (h *HandlerManager) LiftExpiredBans() error {
+	var lifted []models.Ban
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		var err error
+		lifted, err = tx.ExpireBans(time.Now())
+		if err != nil {
+			return err
+		}
+
+		for _, ban := range lifted {
+			// Shadowbanned users never knew they were banned
+			if ban.IsShadow() {
+				continue
+			}
+			if err := h.msgQueue.QueueTextMessageTx(tx, ban.UserID, "Your suspension has ended. Use /start to chat again."); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ban := range lifted {
+		log.Printf("Lifted expired %s ban of user %d", ban.Kind, ban.UserID)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// blockCallbackPrefix starts the callback data of "Block this person" buttons,
+// followed by the ID of the chat session that ended
+const blockCallbackPrefix = "block_"
+
+// chatEndedMessage is a chat end notice with buttons to block or report the
+// partner of the given session
+func chatEndedMessage(chatID int64, text string, sessionID int64) models.QueuedMessage {
+	message := models.QueuedMessage{
+		ChatID: chatID,
+		Type:   models.TextMessage,
+		Text:   text,
+	}
+
+	if sessionID != 0 {
+		message.Buttons = []models.Button{
+			{Text: "🚫 Block this person", Data: fmt.Sprintf("%s%d", blockCallbackPrefix, sessionID)},
+			{Text: "⚠️ Report", Data: fmt.Sprintf("%s%d", reportCallbackPrefix, sessionID)},
+		}
+	}
+
+	return message
+}
+
+// sessionID returns the ID of a chat session, or 0 if there is none
+func sessionID(session *models.ChatSession) int64 {
+	if session == nil {
+		return 0
+	}
+	return session.ID
+}
+
+// handleBlockPartner ends the user's current chat and blocks the partner, who
+// is only told the chat has ended
+func (h *HandlerManager) handleBlockPartner(userID int64) {
+	var blocked bool
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		session, err := tx.GetCurrentChatSession(userID)
+		if err != nil || session == nil {
+			return err
+		}
+
+		partnerID, ended, err := tx.EndChat(userID, models.EndReasonUserBlock)
+		if err != nil || !ended {
+			return err
+		}
+
+		if err := tx.BlockUser(userID, session.Partner(userID)); err != nil {
+			return err
+		}
+		blocked = true
+
+		if err := h.msgQueue.QueueTextMessageTx(tx, userID, "Chat ended. You won't be matched with this person again."); err != nil {
+			return err
+		}
+
+		if partnerID == 0 {
+			return nil
+		}
+
+		return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner has ended the conversation.", session.ID))
+	})
+	if err != nil {
+		log.Printf("Error blocking chat partner: %v", err)
+		return
+	}
+
+	if !blocked {
+		h.msgQueue.QueueTextMessage(userID, "You are not in a chat! To block a previous partner, use the button shown when your chat ended.")
+	}
+}
+
+// handleBlockCallback blocks the partner from an ended chat session after the
+// user pressed "Block this person"
+func (h *HandlerManager) handleBlockCallback(userID int64, chatID int64, messageID int, sessionID int64) {
+	session, err := h.db.GetChatSession(sessionID)
+	if err != nil {
+		log.Printf("Error getting chat session: %v", err)
+		return
+	}
+
+	// Only the partners of a chat may block each other
+	if session == nil || (session.User1ID != userID && session.User2ID != userID) {
+		return
+	}
+
+	if session.IsOpen() {
+		h.msgQueue.QueueTextMessage(chatID, "Use /block to end your current chat and block your partner.")
+		return
+	}
+
+	if err := h.db.BlockUser(userID, session.Partner(userID)); err != nil {
+		log.Printf("Error blocking user: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error blocking this person. Please try again.")
+		return
+	}
+
+	// Remove the block button so it isn't pressed again, keeping the report one
+	removeButton := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⚠️ Report", fmt.Sprintf("%s%d", reportCallbackPrefix, sessionID)),
+		),
+	))
+	if _, err := h.bot.Send(removeButton); err != nil {
+		log.Printf("Error removing block button: %v", err)
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, "Blocked. You won't be matched with this person again.")
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/filter"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// filterRelay runs what the user wrote through the content filters and puts
+// the filtered version into the relay. Captions the bot adds itself are left
+// alone.
+func (h *HandlerManager) filterRelay(message *tgbotapi.Message, relay *models.QueuedMessage) filter.Result {
+	switch {
+	case relay.Type == models.TextMessage:
+		result := h.filters.Apply(message.Text)
+		relay.Text = anonymousPrefix + result.Text
+		return result
+	case relay.Type == models.ContactMessage:
+		// A contact card can't be sent with parts of it removed, so anything
+		// that would be redacted keeps the whole card back
+		result := h.filters.Apply(userContent(message))
+		if !result.Blocked() && len(result.RedactedBy) > 0 {
+			result.BlockedBy = result.RedactedBy[0]
+		}
+		return result
+	case message.Caption != "":
+		result := h.filters.Apply(message.Caption)
+		relay.Caption = anonymousPrefix + result.Text
+		return result
+	}
+
+	return filter.Result{}
+}
+
+// checkRelayContent filters a relayed message, telling the sender when it was
+// blocked and the moderators when it was flagged. It returns false if the
+// message must not be relayed.
+func (h *HandlerManager) checkRelayContent(message *tgbotapi.Message, relay *models.QueuedMessage) bool {
+	result := h.filterRelay(message, relay)
+
+	if result.Blocked() {
+		h.msgQueue.QueueTextMessage(message.Chat.ID, blockedContentNotice(result.BlockedBy))
+		return false
+	}
+
+	if len(result.FlaggedBy) > 0 {
+		h.notifyFlaggedMessage(message.From.ID, relay.ChatID, result.FlaggedBy, userContent(message))
+	}
+
+	return true
+}
+
+// userContent returns what the user wrote in a message: its text, its
+// caption or the details of a shared contact
+func userContent(message *tgbotapi.Message) string {
+	switch {
+	case message.Text != "":
+		return message.Text
+	case message.Contact != nil:
+		// One detail per line, so the phone filter doesn't join them up
+		return strings.TrimSpace(strings.Join([]string{
+			message.Contact.PhoneNumber,
+			message.Contact.FirstName,
+			message.Contact.LastName,
+		}, "\n"))
+	}
+	return message.Caption
+}
+
+// notifyFlaggedMessage shows the moderators a message the content filters flagged
+func (h *HandlerManager) notifyFlaggedMessage(senderID int64, partnerID int64, flaggedBy []string, text string) {
+	if h.config.AdminChatID == 0 {
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(h.config.AdminChatID, fmt.Sprintf(
+		"🚩 Flagged message (%s)\nFrom: %d\nTo: %d\n\n%s",
+		strings.Join(flaggedBy, ", "), senderID, partnerID, text))
+}
+
+// blockedContentNotice tells a user why their message wasn't relayed
+func blockedContentNotice(filterName string) string {
+	reasons := map[string]string{
+		filter.URLs:     "links",
+		filter.Mentions: "usernames",
+		filter.Phones:   "phone numbers",
+		filter.Emails:   "email addresses",
+		filter.Words:    "words that aren't allowed",
+	}
+
+	reason, ok := reasons[filterName]
+	if !ok {
+		return "Your message was not sent because of its content."
+	}
+	return fmt.Sprintf("Your message was not sent: messages with %s can't be sent to your chat partner.", reason)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/countries"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// beginConversation records that the bot is waiting for free-text input from the user
+func (h *HandlerManager) beginConversation(userID int64, state models.ConversationState, data string) error {
+	return h.db.SaveConversation(&models.Conversation{
+		UserID:    userID,
+		State:     state,
+		Data:      data,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// cancelConversation drops any pending input and reports whether there was one
+func (h *HandlerManager) cancelConversation(userID int64) bool {
+	conversation, err := h.db.GetConversation(userID)
+	if err != nil {
+		log.Printf("Error getting conversation: %v", err)
+		return false
+	}
+
+	if conversation.State == models.ConversationIdle {
+		return false
+	}
+
+	if err := h.db.ClearConversation(userID); err != nil {
+		log.Printf("Error clearing conversation: %v", err)
+	}
+
+	return true
+}
+
+// handlePendingInput routes a message to the pending conversation step, if any.
+// It returns true when the message was consumed.
+func (h *HandlerManager) handlePendingInput(update tgbotapi.Update) bool {
+	userID := update.Message.From.ID
+	chatID := update.Message.Chat.ID
+
+	conversation, err := h.db.GetConversation(userID)
+	if err != nil {
+		log.Printf("Error getting conversation: %v", err)
+		return false
+	}
+
+	if conversation.State == models.ConversationIdle {
+		return false
+	}
+
+	// Forget prompts the user has walked away from
+	if time.Since(conversation.UpdatedAt) > config.ConversationTimeout {
+		if err := h.db.ClearConversation(userID); err != nil {
+			log.Printf("Error clearing conversation: %v", err)
+		}
+		return false
+	}
+
+	text := strings.TrimSpace(update.Message.Text)
+	if text == "" {
+		h.msgQueue.QueueTextMessage(chatID, "Please reply with text, or send /cancel.")
+		return true
+	}
+
+	switch conversation.State {
+	case models.ConversationAwaitingCountry:
+		h.handleCountryInput(userID, chatID, text)
+	case models.ConversationAwaitingPartnerCountries:
+		h.handlePartnerCountriesInput(userID, chatID, text)
+	case models.ConversationAwaitingReportDetails:
+		h.handleReportDetailsInput(userID, chatID, conversation.Data, text)
+	default:
+		log.Printf("Unknown conversation state %q for user %d", conversation.State, userID)
+		if err := h.db.ClearConversation(userID); err != nil {
+			log.Printf("Error clearing conversation: %v", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// handleCountryInput validates and stores the user's own country
+func (h *HandlerManager) handleCountryInput(userID int64, chatID int64, text string) {
+	country, ok := countries.Find(text)
+	if !ok {
+		h.msgQueue.QueueTextMessage(chatID, unknownCountryMessage(text))
+		return
+	}
+
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		userState.Settings.Profile.Country = country.Code
+	})
+	if err != nil {
+		log.Printf("Error saving user state: %v", err)
+		return
+	}
+
+	if err := h.db.ClearConversation(userID); err != nil {
+		log.Printf("Error clearing conversation: %v", err)
+	}
+
+	// Show the updated settings below the user's reply
+	h.showSettingsMenu(userID, chatID, 0)
+}
+
+// handlePartnerCountriesInput validates and stores the countries the user wants to meet
+func (h *HandlerManager) handlePartnerCountriesInput(userID int64, chatID int64, text string) {
+	var codes []string
+
+	if !strings.EqualFold(text, "any") {
+		parts := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ';' || r == '\n'
+		})
+
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			country, ok := countries.Find(part)
+			if !ok {
+				h.msgQueue.QueueTextMessage(chatID, unknownCountryMessage(part))
+				return
+			}
+
+			if !containsValue(codes, country.Code) {
+				codes = append(codes, country.Code)
+			}
+		}
+	}
+
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		userState.Settings.Preferences.Countries = codes
+	})
+	if err != nil {
+		log.Printf("Error saving user state: %v", err)
+		return
+	}
+
+	if err := h.db.ClearConversation(userID); err != nil {
+		log.Printf("Error clearing conversation: %v", err)
+	}
+
+	// Show the updated preferences below the user's reply
+	h.showPreferencesMenu(userID, chatID, 0)
+}
+
+// unknownCountryMessage explains that input was not recognized and offers suggestions
+func unknownCountryMessage(input string) string {
+	msg := fmt.Sprintf("Sorry, I don't recognize the country \"%s\".", input)
+
+	if suggestions := countries.Suggest(input, 3); len(suggestions) > 0 {
+		names := make([]string, len(suggestions))
+		for i, c := range suggestions {
+			names[i] = c.Name
+		}
+		msg += " Did you mean: " + strings.Join(names, ", ") + "?"
+	}
+
+	return msg + "\nPlease try again, or send /cancel."
+}
+
+// formatCountries renders a list of country codes for display
+func formatCountries(codes []string) string {
+	names := make([]string, len(codes))
+	for i, code := range codes {
+		names[i] = countries.Name(code)
+	}
+	return formatPreference(names)
+}
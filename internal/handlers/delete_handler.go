@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// handleDeleteMessage unsends a message: the one the command replies to, or the
+// user's most recent relayed message. Both the original and every delivered
+// copy are removed; for a message sent as part of an album, that is every part
+// of the album, as the partner received them together.
+func (h *HandlerManager) handleDeleteMessage(update tgbotapi.Update) {
+	chatID := update.Message.Chat.ID
+
+	var messageID int
+	if update.Message.ReplyToMessage != nil {
+		messageID = update.Message.ReplyToMessage.MessageID
+
+		isCopy, err := h.db.IsRelayedCopy(chatID, messageID)
+		if err != nil {
+			log.Printf("Error checking relayed message: %v", err)
+			return
+		}
+		if isCopy {
+			h.msgQueue.QueueTextMessage(chatID, "You can only delete messages you sent.")
+			return
+		}
+	} else {
+		lastMessageID, err := h.db.GetLastRelayedMessageID(chatID)
+		if err != nil {
+			log.Printf("Error getting last relayed message: %v", err)
+			return
+		}
+		messageID = lastMessageID
+	}
+
+	if messageID == 0 {
+		h.msgQueue.QueueTextMessage(chatID, "There is no message to delete.")
+		return
+	}
+
+	messageIDs, err := h.db.GetAlbumMessageIDs(chatID, messageID)
+	if err != nil {
+		log.Printf("Error getting album messages: %v", err)
+		return
+	}
+	if len(messageIDs) == 0 {
+		messageIDs = []int{messageID}
+	}
+
+	var copies []models.RelayedMessage
+	for _, id := range messageIDs {
+		relayed, err := h.db.GetRelayedCopies(chatID, id)
+		if err != nil {
+			log.Printf("Error getting relayed copies: %v", err)
+			return
+		}
+		copies = append(copies, relayed...)
+	}
+
+	if len(copies) == 0 {
+		h.msgQueue.QueueTextMessage(chatID, "That message was never delivered to your chat partner, so there is nothing to delete.")
+		return
+	}
+
+	// Telegram refuses to delete messages past its deletion window
+	for _, relayed := range copies {
+		if time.Since(relayed.CreatedAt) > config.DeleteWindow {
+			h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf(
+				"Sorry, messages older than %d hours can no longer be deleted.",
+				int(config.DeleteWindow.Hours()),
+			))
+			return
+		}
+	}
+
+	for _, relayed := range copies {
+		h.msgQueue.QueueDelete(relayed.RecipientChatID, relayed.DeliveredMessageID)
+	}
+	for _, id := range messageIDs {
+		h.msgQueue.QueueDelete(chatID, id)
+	}
+
+	// Remove the command too, leaving no trace of the message
+	h.msgQueue.QueueDelete(chatID, update.Message.MessageID)
+
+	for _, id := range messageIDs {
+		if err := h.db.DeleteRelayedMessage(chatID, id); err != nil {
+			log.Printf("Error deleting relayed message: %v", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// HandleEditedMessage carries an edit over to the partner's copy of the message
+func (h *HandlerManager) HandleEditedMessage(update tgbotapi.Update) {
+	message := update.EditedMessage
+	userID := message.From.ID
+
+	userState, err := h.db.GetUserState(userID)
+	if err != nil {
+		log.Printf("Error getting user state: %v", err)
+		return
+	}
+
+	// Edits are only relayed within the current chat
+	if userState.CurrentChat == 0 {
+		return
+	}
+
+	relayed, err := h.db.GetRelayedMessage(message.Chat.ID, message.MessageID, userState.CurrentChat)
+	if err != nil {
+		log.Printf("Error getting relayed message: %v", err)
+		return
+	}
+
+	// The original was never delivered to this partner
+	if relayed == nil {
+		return
+	}
+
+	edit, ok := buildRelayMessage(message, userState.CurrentChat)
+	if !ok {
+		return
+	}
+
+	switch edit.Type {
+	case models.TextMessage, models.VoiceMessage,
+		models.PhotoMessage, models.VideoMessage, models.AnimationMessage,
+		models.DocumentMessage, models.AudioMessage:
+	default:
+		// Stickers, video notes, locations and contacts can't be edited this way
+		return
+	}
+
+	// Edits go through the same filters, so they can't sneak in what was removed
+	if !h.checkRelayContent(message, &edit) {
+		return
+	}
+
+	// Album parts keep an empty caption unless the sender wrote one
+	if message.MediaGroupID != "" && edit.Caption == defaultPhotoCaption {
+		edit.Caption = ""
+	}
+
+	edit.EditMessageID = relayed.DeliveredMessageID
+	h.msgQueue.QueueMessage(edit)
+}
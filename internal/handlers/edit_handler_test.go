@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/queue"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/memstore"
+)
+
+// edited is an edit user 1 made to message 10 in their chat with the bot
+func edited(text string) tgbotapi.Update {
+	return tgbotapi.Update{EditedMessage: &tgbotapi.Message{
+		MessageID: 10,
+		From:      &tgbotapi.User{ID: 1},
+		Chat:      &tgbotapi.Chat{ID: 1},
+		Text:      text,
+	}}
+}
+
+func TestEditGoesToThePartnersCopy(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	// Message 10 was delivered to user 2 as 100
+	saveRelayed(t, db, 1, 10, 2, 100)
+
+	h.HandleEditedMessage(edited("see you at 8"))
+
+	messages := queued(t, db)
+	if len(messages) != 1 {
+		t.Fatalf("queued %d messages, want the edit", len(messages))
+	}
+	edit := messages[0]
+	if edit.ChatID != 2 || edit.EditMessageID != 100 {
+		t.Errorf("edit goes to message %d in chat %d, want 100 in chat 2", edit.EditMessageID, edit.ChatID)
+	}
+	if edit.Type != models.TextMessage || edit.Text != anonymousPrefix+"see you at 8" {
+		t.Errorf("edit is %s %q, want the new text", edit.Type, edit.Text)
+	}
+}
+
+func TestEditIsFilteredAgain(t *testing.T) {
+	db := memstore.New()
+	h := NewHandlerManager(nil, db, queue.NewMessageQueue(nil, db), &config.Config{FilterWords: []string{"darn"}})
+	pair(t, db, 1, 2)
+	saveRelayed(t, db, 1, 10, 2, 100)
+
+	// Links are removed from edits as from new messages
+	h.HandleEditedMessage(edited("find me at https://example.com"))
+
+	messages := queued(t, db)
+	if len(messages) != 1 {
+		t.Fatalf("queued %d messages, want the edit", len(messages))
+	}
+	if strings.Contains(messages[0].Text, "example.com") {
+		t.Errorf("edit relayed with the link: %q", messages[0].Text)
+	}
+
+	// A blocked word keeps the edit back and the sender is told
+	h.HandleEditedMessage(edited("darn it"))
+
+	messages = queued(t, db)
+	if len(messages) != 2 {
+		t.Fatalf("queued %d messages, want the first edit and a notice", len(messages))
+	}
+	if notice := messages[1]; notice.ChatID != 1 || notice.EditMessageID != 0 {
+		t.Errorf("queued %+v, want a notice to the sender instead of the edit", notice)
+	}
+}
+
+func TestEditNotRelayed(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, db *countingStore)
+		edit  tgbotapi.Update
+	}{
+		{
+			name: "original never delivered",
+			setup: func(t *testing.T, db *countingStore) {
+				pair(t, db, 1, 2)
+			},
+			edit: edited("changed"),
+		},
+		{
+			name: "original delivered to an earlier partner",
+			setup: func(t *testing.T, db *countingStore) {
+				pair(t, db, 1, 2)
+				saveRelayed(t, db, 1, 10, 3, 100)
+			},
+			edit: edited("changed"),
+		},
+		{
+			name: "not in a chat",
+			setup: func(t *testing.T, db *countingStore) {
+				saveRelayed(t, db, 1, 10, 2, 100)
+			},
+			edit: edited("changed"),
+		},
+		{
+			name: "location can't be edited",
+			setup: func(t *testing.T, db *countingStore) {
+				pair(t, db, 1, 2)
+				saveRelayed(t, db, 1, 10, 2, 100)
+			},
+			edit: tgbotapi.Update{EditedMessage: &tgbotapi.Message{
+				MessageID: 10,
+				From:      &tgbotapi.User{ID: 1},
+				Chat:      &tgbotapi.Chat{ID: 1},
+				Location:  &tgbotapi.Location{Latitude: 1, Longitude: 2},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestHandlers(t)
+			tt.setup(t, db)
+
+			h.HandleEditedMessage(tt.edit)
+
+			if messages := queued(t, db); len(messages) != 0 {
+				t.Errorf("queued %+v, want nothing", messages)
+			}
+		})
+	}
+}
+
+func TestAlbumPartEditKeepsEmptyCaption(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+	saveRelayed(t, db, 1, 10, 2, 100)
+
+	// Replacing the photo of an album part that had no caption
+	h.HandleEditedMessage(tgbotapi.Update{EditedMessage: &tgbotapi.Message{
+		MessageID:    10,
+		From:         &tgbotapi.User{ID: 1},
+		Chat:         &tgbotapi.Chat{ID: 1},
+		MediaGroupID: "album",
+		Photo:        []tgbotapi.PhotoSize{{FileID: "small"}, {FileID: "large"}},
+	}})
+
+	messages := queued(t, db)
+	if len(messages) != 1 {
+		t.Fatalf("queued %d messages, want the edit", len(messages))
+	}
+	if edit := messages[0]; edit.FileID != "large" || edit.Caption != "" || edit.EditMessageID != 100 {
+		t.Errorf("edit is %+v, want the large photo without a caption", edit)
+	}
+}
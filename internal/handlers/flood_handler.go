@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/antispam"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// newSpamGuard creates the flood control and spam detection for relayed messages
+func newSpamGuard() *antispam.Guard {
+	return antispam.NewGuard(antispam.Config{
+		Burst:              config.FloodBurst,
+		RefillInterval:     config.FloodRefillInterval,
+		StrikeCooldown:     config.FloodStrikeCooldown,
+		StrikeWindow:       config.FloodStrikeWindow,
+		MuteAfterStrikes:   config.FloodMuteAfterStrikes,
+		MuteDuration:       config.FloodMuteDuration,
+		MuteWindow:         config.FloodMuteWindow,
+		SuspendAfterMutes:  config.FloodSuspendAfterMutes,
+		DuplicatePartners:  config.DuplicatePartnerLimit,
+		DuplicateWindow:    config.DuplicateWindow,
+		MinDuplicateLength: config.MinDuplicateLength,
+	})
+}
+
+// spamReasons describe what a user was caught for
+var spamReasons = map[antispam.Reason]string{
+	antispam.Flooding:  "sending messages too fast",
+	antispam.Duplicate: "sending the same message to too many people",
+}
+
+// checkFlood applies flood control and spam detection to a message for the
+// partner, warning, muting or suspending the sender as needed. It returns
+// false if the message must not be relayed.
+func (h *HandlerManager) checkFlood(message *tgbotapi.Message, partnerID int64) bool {
+	userID := message.From.ID
+	chatID := message.Chat.ID
+
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+
+	verdict := h.spamGuard.Check(userID, partnerID, text, message.MediaGroupID, time.Now())
+
+	switch verdict.Action {
+	case antispam.Allow:
+		return true
+	case antispam.Warn:
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf(
+			"⚠️ Your message was not sent: you are %s. Keep it up and you will be muted.", spamReasons[verdict.Reason]))
+	case antispam.Mute:
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf(
+			"🔇 You have been muted until %s for %s. Your messages won't reach your chat partner until then.",
+			formatAdminTime(verdict.Until), spamReasons[verdict.Reason]))
+	case antispam.Suspend:
+		h.suspendSpammer(userID, verdict.Reason)
+	}
+
+	return false
+}
+
+// suspendSpammer suspends a user who kept flooding or spamming after being
+// muted, and lets the moderators know
+func (h *HandlerManager) suspendSpammer(userID int64, reason antispam.Reason) {
+	expiresAt := time.Now().Add(config.AutoSuspendDuration)
+	ban := &models.Ban{
+		UserID:    userID,
+		Kind:      models.BanTemporary,
+		Reason:    "Automatic suspension for " + spamReasons[reason],
+		ExpiresAt: &expiresAt,
+	}
+
+	// A shadowbanned user is already dealt with and must not find out
+	existing, err := h.db.GetBan(userID)
+	if err != nil {
+		log.Printf("Error getting ban: %v", err)
+		return
+	}
+	if existing != nil {
+		return
+	}
+
+	err = h.db.RunInTx(func(tx store.Tx) error {
+		err := tx.RecordAdminAction(&models.AdminAction{
+			Action:   models.AdminBan,
+			TargetID: userID,
+			Details:  describeBan(ban),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := h.banUserTx(tx, ban); err != nil {
+			return err
+		}
+
+		if h.config.AdminChatID == 0 {
+			return nil
+		}
+		return h.msgQueue.QueueTextMessageTx(tx, h.config.AdminChatID,
+			fmt.Sprintf("🤖 User %d was suspended automatically (%s).", userID, describeBan(ban)))
+	})
+	if err != nil {
+		log.Printf("Error suspending user %d: %v", userID, err)
+		return
+	}
+
+	log.Printf("Suspended user %d for %s", userID, reason)
+}
+
+// PruneSpamState forgets the flood control state of users who have been quiet
+func (h *HandlerManager) PruneSpamState() {
+	h.spamGuard.Prune(time.Now())
+}
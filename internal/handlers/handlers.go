@@ -3,26 +3,47 @@ package handlers
 import (
 	"fmt"
 	"log"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/regiwitanto/tele-anonymous-chat/internal/database"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/antispam"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/filter"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/queue"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
 )
 
 // HandlerManager manages all the telegram update handlers
 type HandlerManager struct {
 	bot      *tgbotapi.BotAPI
-	db       *database.DB
+	db       store.Store
 	msgQueue *queue.MessageQueue
+	config   *config.Config
+
+	// Content filters applied to relayed text and captions
+	filters *filter.Chain
+
+	// Flood control and spam detection for relayed messages
+	spamGuard *antispam.Guard
+
+	// Media groups being collected before they are relayed
+	albums      map[string]*pendingAlbum
+	albumsMutex sync.Mutex
 }
 
 // NewHandlerManager creates a new handler manager
-func NewHandlerManager(bot *tgbotapi.BotAPI, db *database.DB, msgQueue *queue.MessageQueue) *HandlerManager {
+func NewHandlerManager(bot *tgbotapi.BotAPI, db store.Store, msgQueue *queue.MessageQueue, cfg *config.Config) *HandlerManager {
 	return &HandlerManager{
-		bot:      bot,
-		db:       db,
-		msgQueue: msgQueue,
+		bot:       bot,
+		db:        db,
+		msgQueue:  msgQueue,
+		config:    cfg,
+		filters:   filter.NewDefaultChain(cfg.FilterActions, cfg.FilterWords),
+		spamGuard: newSpamGuard(),
+		albums:    make(map[string]*pendingAlbum),
 	}
 }
 
@@ -31,11 +52,36 @@ func (h *HandlerManager) HandleCommand(update tgbotapi.Update) {
 	command := update.Message.Command()
 	userID := update.Message.From.ID
 
+	// Admin commands are unknown to everyone else
+	if h.config.IsAdmin(userID) && h.handleAdminCommand(update) {
+		return
+	}
+
 	switch command {
 	case "start":
+		h.cancelConversation(userID)
 		h.handleStart(update)
 	case "end":
 		h.handleEndChat(userID)
+	case "block":
+		h.handleBlockPartner(userID)
+	case "report":
+		h.cancelConversation(userID)
+		h.handleReport(userID, update.Message.Chat.ID)
+	case "reports":
+		if !h.canModerate(update.Message.Chat.ID, userID) {
+			h.msgQueue.QueueTextMessage(update.Message.Chat.ID, "Unknown command. Use /start to see available options.")
+			return
+		}
+		h.handlePendingReports(update.Message.Chat.ID)
+	case "delete":
+		h.handleDeleteMessage(update)
+	case "cancel":
+		if h.cancelConversation(userID) {
+			h.msgQueue.QueueTextMessage(update.Message.Chat.ID, "Cancelled.")
+			return
+		}
+		h.handleCancelMatch(userID, update.Message.Chat.ID)
 	default:
 		h.msgQueue.QueueTextMessage(update.Message.Chat.ID, "Unknown command. Use /start to see available options.")
 	}
@@ -46,6 +92,7 @@ func (h *HandlerManager) HandleCallback(update tgbotapi.Update) {
 	query := update.CallbackQuery
 	userID := query.From.ID
 	callbackData := query.Data
+	messageID := query.Message.MessageID
 
 	// Send an empty callback response to stop the loading animation
 	callbackConfig := tgbotapi.NewCallback(query.ID, "")
@@ -56,47 +103,125 @@ func (h *HandlerManager) HandleCallback(update tgbotapi.Update) {
 		h.handleShowActive(query.Message.Chat.ID)
 
 	case "toggle_active":
-		h.handleToggleActive(userID, query.Message.Chat.ID)
+		h.handleToggleActive(userID, query.Message.Chat.ID, messageID)
 
 	case "settings":
-		h.showSettingsMenu(userID, query.Message.Chat.ID)
+		h.showSettingsMenu(userID, query.Message.Chat.ID, messageID)
 
 	case "back_to_main":
-		h.showMainMenu(userID, query.Message.Chat.ID, false)
+		h.showMainMenu(userID, query.Message.Chat.ID, messageID)
 
 	case "find_match":
 		h.handleFindMatch(userID, query.Message.Chat.ID)
 
+	case "cancel_match":
+		h.handleCancelMatch(userID, query.Message.Chat.ID)
+
 	case "set_country":
-		h.msgQueue.QueueTextMessage(query.Message.Chat.ID, "Please enter your country (e.g., USA, UK, etc.):")
-		// We'd need to handle text input in a stateful way
+		if err := h.beginConversation(userID, models.ConversationAwaitingCountry, ""); err != nil {
+			log.Printf("Error saving conversation: %v", err)
+			return
+		}
+		h.msgQueue.QueueTextMessage(query.Message.Chat.ID, "Please enter your country (e.g., USA, UK, Germany), or send /cancel:")
 
 	case "clear_country":
-		h.handleClearSetting(userID, "country", query.Message.Chat.ID)
+		h.handleClearSetting(userID, "country", query.Message.Chat.ID, messageID)
 
 	case "set_language":
-		h.showLanguageMenu(query.Message.Chat.ID)
+		h.showLanguageMenu(query.Message.Chat.ID, messageID)
 
 	case "clear_language":
-		h.handleClearSetting(userID, "language", query.Message.Chat.ID)
+		h.handleClearSetting(userID, "language", query.Message.Chat.ID, messageID)
 
 	case "set_gender":
-		h.showGenderMenu(query.Message.Chat.ID)
+		h.showGenderMenu(query.Message.Chat.ID, messageID)
 
 	case "clear_gender":
-		h.handleClearSetting(userID, "gender", query.Message.Chat.ID)
+		h.handleClearSetting(userID, "gender", query.Message.Chat.ID, messageID)
+
+	case "preferences":
+		h.showPreferencesMenu(userID, query.Message.Chat.ID, messageID)
+
+	case "pref_country":
+		if err := h.beginConversation(userID, models.ConversationAwaitingPartnerCountries, ""); err != nil {
+			log.Printf("Error saving conversation: %v", err)
+			return
+		}
+		h.msgQueue.QueueTextMessage(query.Message.Chat.ID, "Please enter the countries you want to meet, separated by commas (or \"any\"), or send /cancel:")
+
+	case "clear_pref_country":
+		h.handleClearPreference(userID, "country", query.Message.Chat.ID, messageID)
+
+	case "pref_language":
+		h.showPreferenceLanguageMenu(userID, query.Message.Chat.ID, messageID)
+
+	case "clear_pref_language":
+		h.handleClearPreference(userID, "language", query.Message.Chat.ID, messageID)
+
+	case "pref_gender":
+		h.showPreferenceGenderMenu(userID, query.Message.Chat.ID, messageID)
+
+	case "clear_pref_gender":
+		h.handleClearPreference(userID, "gender", query.Message.Chat.ID, messageID)
+
+	case reportSubmitCallback:
+		h.handleReportSubmitCallback(userID, query.Message.Chat.ID)
 	}
 
 	// Handle language selection
 	if len(callbackData) > 5 && callbackData[:5] == "lang_" {
 		language := callbackData[5:]
-		h.handleSetSetting(userID, "language", language, query.Message.Chat.ID)
+		h.handleSetSetting(userID, "language", language, query.Message.Chat.ID, messageID)
 	}
 
 	// Handle gender selection
 	if len(callbackData) > 7 && callbackData[:7] == "gender_" {
 		gender := callbackData[7:]
-		h.handleSetSetting(userID, "gender", gender, query.Message.Chat.ID)
+		h.handleSetSetting(userID, "gender", gender, query.Message.Chat.ID, messageID)
+	}
+
+	// Handle partner language selection
+	if len(callbackData) > 6 && callbackData[:6] == "plang_" {
+		language := callbackData[6:]
+		h.handleTogglePreference(userID, "language", language, query.Message.Chat.ID, messageID)
+	}
+
+	// Handle partner gender selection
+	if len(callbackData) > 8 && callbackData[:8] == "pgender_" {
+		gender := callbackData[8:]
+		h.handleTogglePreference(userID, "gender", gender, query.Message.Chat.ID, messageID)
+	}
+
+	// Handle blocking the partner of an ended chat
+	if strings.HasPrefix(callbackData, blockCallbackPrefix) {
+		sessionID, err := strconv.ParseInt(strings.TrimPrefix(callbackData, blockCallbackPrefix), 10, 64)
+		if err == nil {
+			h.handleBlockCallback(userID, query.Message.Chat.ID, messageID, sessionID)
+		}
+	}
+
+	// Handle reporting the partner of an ended chat
+	if strings.HasPrefix(callbackData, reportCallbackPrefix) {
+		sessionID, err := strconv.ParseInt(strings.TrimPrefix(callbackData, reportCallbackPrefix), 10, 64)
+		if err == nil {
+			h.handleReportCallback(userID, query.Message.Chat.ID, sessionID)
+		}
+	}
+
+	// Handle the reason chosen for a report
+	if strings.HasPrefix(callbackData, reportReasonCallbackPrefix) {
+		sessionID, reason, ok := parseSessionReason(strings.TrimPrefix(callbackData, reportReasonCallbackPrefix), "_")
+		if ok {
+			h.handleReportReason(userID, query.Message.Chat.ID, sessionID, reason)
+		}
+	}
+
+	// Handle a moderator's decision on a report
+	if strings.HasPrefix(callbackData, moderationCallbackPrefix) {
+		action, reportID, ok := parseModerationCallback(strings.TrimPrefix(callbackData, moderationCallbackPrefix))
+		if ok {
+			h.handleModerationCallback(query, action, reportID)
+		}
 	}
 }
 
@@ -105,6 +230,16 @@ func (h *HandlerManager) HandleMessage(update tgbotapi.Update) {
 	userID := update.Message.From.ID
 	chatID := update.Message.Chat.ID
 
+	// Moderators talk among themselves in the admin chat
+	if h.isAdminChat(chatID) {
+		return
+	}
+
+	// A reply to a pending prompt takes precedence over everything else
+	if h.handlePendingInput(update) {
+		return
+	}
+
 	// Get user state
 	userState, err := h.db.GetUserState(userID)
 	if err != nil {
@@ -115,28 +250,52 @@ func (h *HandlerManager) HandleMessage(update tgbotapi.Update) {
 	// If user is in a chat, forward the message to their chat partner
 	if userState.CurrentChat > 0 {
 		// Update last activity
-		userState.LastActivity = time.Now()
-		if err := h.db.SaveUserState(userState); err != nil {
-			log.Printf("Error saving user state: %v", err)
-		}
-
-		if update.Message.Photo != nil {
-			// Handle photo messages
-			photos := update.Message.Photo
-			// Get the largest available photo
-			photoFileID := photos[len(photos)-1].FileID
-			caption := "Anonymous sent a photo"
-			if update.Message.Caption != "" {
-				caption = "Anonymous: " + update.Message.Caption
-			}
-			h.msgQueue.QueuePhotoMessage(userState.CurrentChat, photoFileID, caption)
-		} else {
-			// Handle text messages
-			h.msgQueue.QueueTextMessage(userState.CurrentChat, fmt.Sprintf("Anonymous: %s", update.Message.Text))
+		if err := h.db.TouchActivity(userID); err != nil {
+			log.Printf("Error updating last activity: %v", err)
+		}
+
+		relay, ok := buildRelayMessage(update.Message, userState.CurrentChat)
+		if !ok {
+			h.msgQueue.QueueTextMessage(chatID, "Sorry, this kind of message can't be sent to your chat partner.")
+			return
+		}
+
+		if !h.config.IsMessageTypeAllowed(relay.Type) {
+			h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("Sorry, %s messages are not allowed.", relay.Type))
+			return
+		}
+
+		// Hide contact details and keep out unwanted words
+		if !h.checkRelayContent(update.Message, &relay) {
+			return
+		}
+
+		// Flooding and spamming partners gets users warned, muted and suspended.
+		// Only messages that passed the checks above count, so rejected ones
+		// don't use up the sender's allowance.
+		if !h.checkFlood(update.Message, userState.CurrentChat) {
+			return
 		}
+
+		if err := h.db.CountChatMessage(userID); err != nil {
+			log.Printf("Error counting chat message: %v", err)
+		}
+
+		// Keep the reply context on the partner's side
+		if update.Message.ReplyToMessage != nil {
+			relay.ReplyToMessageID = h.translateReply(chatID, update.Message.ReplyToMessage.MessageID, userState.CurrentChat)
+		}
+
+		// Parts of an album are collected and relayed together
+		if update.Message.MediaGroupID != "" &&
+			h.bufferAlbumPart(update.Message.MediaGroupID, userID, relay) {
+			return
+		}
+
+		h.msgQueue.QueueMessage(relay)
 	} else {
 		// If not in a chat, show main menu
-		h.showMainMenu(userID, chatID, false)
+		h.showMainMenu(userID, chatID, 0)
 	}
 }
 
@@ -156,24 +315,39 @@ func (h *HandlerManager) handleStart(update tgbotapi.Update) {
 
 How it works:
 - This bot lets you chat anonymously with random users.
-- You can set preferences (country, language, gender) to match with similar users.
-- Only text and photo messages are allowed.
+- You can describe yourself (country, language, gender) and choose who you want to meet.
+- You are only matched with people whose preferences fit you and who fit yours.
+- Text, photos, stickers, voice notes, videos, GIFs, files and more are relayed anonymously.
 - Chats are ended automatically after 1 hour of inactivity.
 
 Commands and Features:
 /start - Show this message and the main menu.
 /end - End your current anonymous chat.
+/block - End your current chat and never be matched with this person again.
+/report - Report your current or last chat partner to the moderators.
+/delete - Unsend your last message, or reply /delete to a message you sent.
+/cancel - Stop searching for a match or cancel a pending question.
 Show Active Users - See how many users are currently online.
 Status: Online/Offline - Toggle your availability for matching.
-Settings - Set or clear your country, language, or gender preferences.
-Find Match - Start searching for a random chat partner.
+Settings - Set your own profile and the countries, languages and genders you want to meet.
+Find Match - Join the queue and get paired as soon as a partner is available.
 
 Use the menu buttons to navigate. Enjoy chatting!`
 
 	h.msgQueue.QueueTextMessage(chatID, welcomeMsg)
 
+	// Banned users are told so instead of getting the menu
+	ban, err := h.chatBan(userID)
+	if err != nil {
+		log.Printf("Error getting ban: %v", err)
+	}
+	if ban != nil {
+		h.msgQueue.QueueTextMessage(chatID, bannedNotice(ban))
+		return
+	}
+
 	// Show main menu
-	h.showMainMenu(userID, chatID, true)
+	h.showMainMenu(userID, chatID, 0)
 }
 
 // handleShowActive shows the number of active users
@@ -186,3 +360,18 @@ func (h *HandlerManager) handleShowActive(chatID int64) {
 
 	h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("Active users: %d", count))
 }
+
+// updateUserState reads the user's state, changes it and saves it in one
+// transaction, so a pairing or ban made meanwhile isn't overwritten by a
+// stale copy
+func (h *HandlerManager) updateUserState(userID int64, update func(userState *models.UserState)) error {
+	return h.db.RunInTx(func(tx store.Tx) error {
+		userState, err := tx.GetUserState(userID)
+		if err != nil {
+			return err
+		}
+
+		update(userState)
+		return tx.SaveUserState(userState)
+	})
+}
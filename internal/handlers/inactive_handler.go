@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
 )
 
 // checkAndEndInactiveChats terminates chats that have been inactive for too long
@@ -27,34 +29,26 @@ func (h *HandlerManager) checkAndEndInactiveChats() error {
 		// Check if chat is inactive
 		if now.Sub(lastActivity) > config.InactivityTimeout {
 			// End the chat due to inactivity
-			user1State, err := h.db.GetUserState(chat.User1ID)
+			err := h.db.RunInTx(func(tx store.Tx) error {
+				partnerID, ended, err := tx.EndChat(chat.User1ID, models.EndReasonInactivity)
+				if err != nil || !ended {
+					return err
+				}
+
+				// Notify users
+				if err := h.msgQueue.QueueMessageTx(tx, chatEndedMessage(chat.User1ID, "Chat ended due to inactivity!", chat.SessionID)); err != nil {
+					return err
+				}
+
+				if partnerID == 0 {
+					return nil
+				}
+
+				return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Chat ended due to inactivity!", chat.SessionID))
+			})
 			if err != nil {
-				log.Printf("Error getting user state: %v", err)
-				continue
+				log.Printf("Error ending inactive chat: %v", err)
 			}
-
-			user2State, err := h.db.GetUserState(chat.User2ID)
-			if err != nil {
-				log.Printf("Error getting user state: %v", err)
-				continue
-			}
-
-			// Clear chat states
-			user1State.CurrentChat = 0
-			user2State.CurrentChat = 0
-
-			// Save updated states
-			if err := h.db.SaveUserState(user1State); err != nil {
-				log.Printf("Error saving user state: %v", err)
-			}
-
-			if err := h.db.SaveUserState(user2State); err != nil {
-				log.Printf("Error saving user state: %v", err)
-			}
-
-			// Notify users
-			h.msgQueue.QueueTextMessage(chat.User1ID, "Chat ended due to inactivity!")
-			h.msgQueue.QueueTextMessage(chat.User2ID, "Chat ended due to inactivity!")
 		}
 	}
 
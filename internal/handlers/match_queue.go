@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/utils"
+)
+
+// matchPass is one round of matching. It reads each user's state once and
+// remembers who is settled for the round, so pairing many waiting users
+// doesn't go back to the store for every candidate of every user.
+type matchPass struct {
+	h      *HandlerManager
+	states map[int64]*models.UserState
+
+	// settled users were paired, or searched every candidate without finding
+	// a partner, in this round. Matching is symmetric, so nobody searching
+	// later in the round can be paired with them either.
+	settled map[int64]bool
+}
+
+// newMatchPass starts a round of matching
+func (h *HandlerManager) newMatchPass() *matchPass {
+	return &matchPass{
+		h:       h,
+		states:  make(map[int64]*models.UserState),
+		settled: make(map[int64]bool),
+	}
+}
+
+// state returns a user's state as read at the start of the round
+func (p *matchPass) state(userID int64) (*models.UserState, error) {
+	if state, ok := p.states[userID]; ok {
+		return state, nil
+	}
+
+	state, err := p.h.db.GetUserState(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.states[userID] = state
+	return state, nil
+}
+
+// ProcessMatchQueue pairs users waiting for a match and expires searches
+// that have exceeded the match timeout. Waiting users are served longest
+// waiting first, in a single pass.
+func (h *HandlerManager) ProcessMatchQueue() error {
+	waitingUsers, err := h.db.GetWaitingUsers()
+	if err != nil {
+		return err
+	}
+
+	pass := h.newMatchPass()
+	for _, userID := range waitingUsers {
+		// The user was paired earlier in this pass
+		if pass.settled[userID] {
+			continue
+		}
+
+		userState, err := pass.state(userID)
+		if err != nil {
+			log.Printf("Error getting user state: %v", err)
+			continue
+		}
+
+		if !userState.IsWaitingForMatch() {
+			continue
+		}
+
+		// Give up on searches that have been waiting too long
+		if utils.CheckMatchTimeout(userState, config.MatchTimeout) {
+			pass.settled[userID] = true
+
+			err := h.db.RunInTx(func(tx store.Tx) error {
+				// Read the state again, as the user may have been paired since
+				userState, err := tx.GetUserState(userID)
+				if err != nil || !userState.IsWaitingForMatch() {
+					return err
+				}
+
+				userState.MatchStartTime = nil
+				if err := tx.SaveUserState(userState); err != nil {
+					return err
+				}
+
+				return h.msgQueue.QueueTextMessageTx(tx, userID, fmt.Sprintf(
+					"No match found within %d minutes. Press Find Match to try again.",
+					int(config.MatchTimeout.Minutes()),
+				))
+			})
+			if err != nil {
+				log.Printf("Error expiring match search: %v", err)
+			}
+			continue
+		}
+
+		matched, err := pass.tryMatch(userID)
+		if err != nil {
+			log.Printf("Error finding potential matches: %v", err)
+			continue
+		}
+
+		if matched {
+			h.msgQueue.QueueTextMessage(userID, "Match found! Starting chat...")
+		}
+	}
+
+	return nil
+}
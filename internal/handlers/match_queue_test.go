@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/queue"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/memstore"
+)
+
+// countingStore counts the state reads and candidate searches made against
+// the store
+type countingStore struct {
+	store.Store
+	reads    int
+	searches int
+}
+
+func (s *countingStore) GetUserState(userID int64) (*models.UserState, error) {
+	s.reads++
+	return s.Store.GetUserState(userID)
+}
+
+func (s *countingStore) FindPotentialMatches(userID int64, recentSince time.Time) ([]int64, error) {
+	s.searches++
+	return s.Store.FindPotentialMatches(userID, recentSince)
+}
+
+func newTestHandlers(t *testing.T) (*HandlerManager, *countingStore) {
+	t.Helper()
+
+	db := &countingStore{Store: memstore.New()}
+	return NewHandlerManager(nil, db, queue.NewMessageQueue(nil, db), &config.Config{}), db
+}
+
+// waitFor puts a user in the match queue, waiting since the given time
+func waitFor(t *testing.T, db store.Store, userID int64, since time.Time, gender string) {
+	t.Helper()
+
+	state := models.NewUserState(userID)
+	state.IsActive = true
+	state.MatchStartTime = &since
+	state.Settings.Profile.Gender = gender
+	if err := db.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState(%d): %v", userID, err)
+	}
+}
+
+func TestProcessMatchQueuePairsInOnePass(t *testing.T) {
+	h, db := newTestHandlers(t)
+	start := time.Now().Add(-time.Minute)
+
+	for userID := int64(1); userID <= 6; userID++ {
+		waitFor(t, db, userID, start.Add(time.Duration(userID)*time.Second), "")
+	}
+
+	db.reads = 0
+	if err := h.ProcessMatchQueue(); err != nil {
+		t.Fatalf("ProcessMatchQueue: %v", err)
+	}
+	if db.reads > 6 {
+		t.Errorf("read %d states of 6 users, want each read once at most", db.reads)
+	}
+
+	// The longest waiting are paired first, and a user paired earlier in the
+	// pass doesn't search again
+	for _, pair := range [][2]int64{{1, 2}, {3, 4}, {5, 6}} {
+		state, err := db.GetUserState(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.CurrentChat != pair[1] {
+			t.Errorf("user %d is chatting with %d, want %d", pair[0], state.CurrentChat, pair[1])
+		}
+	}
+	if db.searches != 3 {
+		t.Errorf("searched %d times for 3 pairs, want 3", db.searches)
+	}
+}
+
+func TestProcessMatchQueueSkipsSettledUsers(t *testing.T) {
+	h, db := newTestHandlers(t)
+	start := time.Now().Add(-time.Minute)
+
+	// Nobody accepts user 1, who waited longest
+	waitFor(t, db, 1, start, "male")
+	for userID := int64(2); userID <= 3; userID++ {
+		waitFor(t, db, userID, start.Add(time.Duration(userID)*time.Second), "female")
+
+		state, err := db.GetUserState(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.Settings.Preferences.Genders = []string{"female"}
+		if err := db.SaveUserState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.ProcessMatchQueue(); err != nil {
+		t.Fatalf("ProcessMatchQueue: %v", err)
+	}
+
+	state, err := db.GetUserState(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentChat != 0 || !state.IsWaitingForMatch() {
+		t.Errorf("unwanted user 1 was paired with %d", state.CurrentChat)
+	}
+
+	state, err = db.GetUserState(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentChat != 3 {
+		t.Errorf("user 2 is chatting with %d, want 3", state.CurrentChat)
+	}
+}
@@ -1,15 +1,20 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
-	"math/rand"
+	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/countries"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
 )
 
-// showMainMenu displays the main menu
-func (h *HandlerManager) showMainMenu(userID int64, chatID int64, isMessageSend bool) {
+// showMainMenu displays the main menu in place of messageID, or as a new message when messageID is 0
+func (h *HandlerManager) showMainMenu(userID int64, chatID int64, messageID int) {
 	userState, err := h.db.GetUserState(userID)
 	if err != nil {
 		log.Printf("Error getting user state: %v", err)
@@ -35,43 +40,50 @@ func (h *HandlerManager) showMainMenu(userID int64, chatID int64, isMessageSend
 		),
 	)
 
-	msg := tgbotapi.NewMessage(chatID, "Main Menu - Use the buttons below to interact with the bot.")
-	msg.ReplyMarkup = keyboard
+	h.renderMenu(chatID, messageID, "Main Menu - Use the buttons below to interact with the bot.", keyboard)
+}
 
-	if isMessageSend {
-		h.bot.Send(msg)
-	} else {
-		// Edit existing message
-		editMsg := tgbotapi.NewEditMessageTextAndMarkup(
-			chatID,
-			0, // Will be updated in the next step
-			"Main Menu - Use the buttons below to interact with the bot.",
-			keyboard,
-		)
-		h.bot.Send(editMsg)
+// renderMenu edits the menu message in place. It sends a new message instead
+// when messageID is 0 or the original message can no longer be edited.
+func (h *HandlerManager) renderMenu(chatID int64, messageID int, text string, keyboard tgbotapi.InlineKeyboardMarkup) {
+	if messageID != 0 {
+		editMsg := tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, text, keyboard)
+		_, err := h.bot.Send(editMsg)
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			return
+		}
+		log.Printf("Error editing menu message %d, sending a new one: %v", messageID, err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = keyboard
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending menu message: %v", err)
 	}
 }
 
 // showSettingsMenu displays the settings menu
-func (h *HandlerManager) showSettingsMenu(userID int64, chatID int64) {
+func (h *HandlerManager) showSettingsMenu(userID int64, chatID int64, messageID int) {
 	userState, err := h.db.GetUserState(userID)
 	if err != nil {
 		log.Printf("Error getting user state: %v", err)
 		return
 	}
 
+	profile := userState.Settings.Profile
+
 	// Prepare settings text
-	countryText := userState.Settings.Country
+	countryText := countries.Name(profile.Country)
 	if countryText == "" {
 		countryText = "Not set"
 	}
 
-	languageText := userState.Settings.Language
+	languageText := profile.Language
 	if languageText == "" {
 		languageText = "Not set"
 	}
 
-	genderText := userState.Settings.Gender
+	genderText := profile.Gender
 	if genderText == "" {
 		genderText = "Not set"
 	}
@@ -79,325 +91,370 @@ func (h *HandlerManager) showSettingsMenu(userID int64, chatID int64) {
 	// Create keyboard
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Country: "+countryText, "set_country"),
+			tgbotapi.NewInlineKeyboardButtonData("My Country: "+countryText, "set_country"),
 			tgbotapi.NewInlineKeyboardButtonData("Clear", "clear_country"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Language: "+languageText, "set_language"),
+			tgbotapi.NewInlineKeyboardButtonData("My Language: "+languageText, "set_language"),
 			tgbotapi.NewInlineKeyboardButtonData("Clear", "clear_language"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Gender: "+genderText, "set_gender"),
+			tgbotapi.NewInlineKeyboardButtonData("My Gender: "+genderText, "set_gender"),
 			tgbotapi.NewInlineKeyboardButtonData("Clear", "clear_gender"),
 		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Who I Want to Meet", "preferences"),
+		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("Back to Main Menu", "back_to_main"),
 		),
 	)
 
-	msg := tgbotapi.NewEditMessageTextAndMarkup(
-		chatID,
-		0, // Will be updated by Telegram
-		"Settings Menu - Select an option to change or clear:",
-		keyboard,
-	)
-
-	h.bot.Send(msg)
+	h.renderMenu(chatID, messageID, "Settings Menu - Describe yourself, or choose who you want to meet:", keyboard)
 }
 
 // showLanguageMenu displays language selection menu
-func (h *HandlerManager) showLanguageMenu(chatID int64) {
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("English", "lang_english"),
-			tgbotapi.NewInlineKeyboardButtonData("Mandarin", "lang_mandarin"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Hindi", "lang_hindi"),
-			tgbotapi.NewInlineKeyboardButtonData("Spanish", "lang_spanish"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("French", "lang_french"),
-			tgbotapi.NewInlineKeyboardButtonData("Arabic", "lang_arabic"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Bengali", "lang_bengali"),
-			tgbotapi.NewInlineKeyboardButtonData("Portuguese", "lang_portuguese"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Russian", "lang_russian"),
-			tgbotapi.NewInlineKeyboardButtonData("Japanese", "lang_japanese"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Back to Settings", "settings"),
-		),
-	)
+func (h *HandlerManager) showLanguageMenu(chatID int64, messageID int) {
+	rows := buildOptionRows(languageOptions, "lang_", nil)
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Back to Settings", "settings"),
+	))
 
-	msg := tgbotapi.NewEditMessageTextAndMarkup(
-		chatID,
-		0, // Will be updated by Telegram
-		"Select your language:",
-		keyboard,
-	)
-
-	h.bot.Send(msg)
+	h.renderMenu(chatID, messageID, "Select your language:", tgbotapi.NewInlineKeyboardMarkup(rows...))
 }
 
 // showGenderMenu displays gender selection menu
-func (h *HandlerManager) showGenderMenu(chatID int64) {
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Male", "gender_male"),
-			tgbotapi.NewInlineKeyboardButtonData("Female", "gender_female"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Other", "gender_other"),
-			tgbotapi.NewInlineKeyboardButtonData("Back to Settings", "settings"),
-		),
-	)
-
-	msg := tgbotapi.NewEditMessageTextAndMarkup(
-		chatID,
-		0, // Will be updated by Telegram
-		"Select your gender:",
-		keyboard,
-	)
+func (h *HandlerManager) showGenderMenu(chatID int64, messageID int) {
+	rows := buildOptionRows(genderOptions, "gender_", nil)
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Back to Settings", "settings"),
+	))
 
-	h.bot.Send(msg)
+	h.renderMenu(chatID, messageID, "Select your gender:", tgbotapi.NewInlineKeyboardMarkup(rows...))
 }
 
 // handleToggleActive toggles a user's active status
-func (h *HandlerManager) handleToggleActive(userID int64, chatID int64) {
-	userState, err := h.db.GetUserState(userID)
+func (h *HandlerManager) handleToggleActive(userID int64, chatID int64, messageID int) {
+	ban, err := h.chatBan(userID)
 	if err != nil {
-		log.Printf("Error getting user state: %v", err)
+		log.Printf("Error getting ban: %v", err)
 		return
 	}
 
-	// Toggle active status
-	userState.IsActive = !userState.IsActive
+	var refused bool
+	err = h.db.RunInTx(func(tx store.Tx) error {
+		userState, err := tx.GetUserState(userID)
+		if err != nil {
+			return err
+		}
+
+		// Banned users can't go online
+		if !userState.IsActive && ban != nil {
+			refused = true
+			return nil
+		}
+
+		// Toggle active status
+		userState.IsActive = !userState.IsActive
 
-	// Save updated state
-	if err := h.db.SaveUserState(userState); err != nil {
+		// Going offline also leaves the match queue
+		if !userState.IsActive {
+			userState.MatchStartTime = nil
+		}
+
+		return tx.SaveUserState(userState)
+	})
+	if err != nil {
 		log.Printf("Error saving user state: %v", err)
 		return
 	}
 
+	if refused {
+		h.msgQueue.QueueTextMessage(chatID, bannedNotice(ban))
+		return
+	}
+
 	// Show updated menu
-	h.showMainMenu(userID, chatID, false)
+	h.showMainMenu(userID, chatID, messageID)
 }
 
-// handleSetSetting sets a user preference
-func (h *HandlerManager) handleSetSetting(userID int64, setting string, value string, chatID int64) {
-	userState, err := h.db.GetUserState(userID)
+// handleSetSetting sets a value of the user's own profile
+func (h *HandlerManager) handleSetSetting(userID int64, setting string, value string, chatID int64, messageID int) {
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		switch setting {
+		case "country":
+			userState.Settings.Profile.Country = value
+		case "language":
+			userState.Settings.Profile.Language = value
+		case "gender":
+			userState.Settings.Profile.Gender = value
+		}
+	})
 	if err != nil {
-		log.Printf("Error getting user state: %v", err)
+		log.Printf("Error saving user state: %v", err)
 		return
 	}
 
-	// Update setting
-	switch setting {
-	case "country":
-		userState.Settings.Country = value
-	case "language":
-		userState.Settings.Language = value
-	case "gender":
-		userState.Settings.Gender = value
-	}
+	// Show settings menu
+	h.showSettingsMenu(userID, chatID, messageID)
+}
 
-	// Save updated state
-	if err := h.db.SaveUserState(userState); err != nil {
+// handleClearSetting clears a value of the user's own profile
+func (h *HandlerManager) handleClearSetting(userID int64, setting string, chatID int64, messageID int) {
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		switch setting {
+		case "country":
+			userState.Settings.Profile.Country = ""
+		case "language":
+			userState.Settings.Profile.Language = ""
+		case "gender":
+			userState.Settings.Profile.Gender = ""
+		}
+	})
+	if err != nil {
 		log.Printf("Error saving user state: %v", err)
 		return
 	}
 
 	// Show settings menu
-	h.showSettingsMenu(userID, chatID)
+	h.showSettingsMenu(userID, chatID, messageID)
 }
 
-// handleClearSetting clears a user preference
-func (h *HandlerManager) handleClearSetting(userID int64, setting string, chatID int64) {
+// handleFindMatch puts the user in the match queue and tries to pair them right away
+func (h *HandlerManager) handleFindMatch(userID int64, chatID int64) {
 	userState, err := h.db.GetUserState(userID)
 	if err != nil {
 		log.Printf("Error getting user state: %v", err)
 		return
 	}
 
-	// Clear setting
-	switch setting {
-	case "country":
-		userState.Settings.Country = ""
-	case "language":
-		userState.Settings.Language = ""
-	case "gender":
-		userState.Settings.Gender = ""
+	ban, err := h.chatBan(userID)
+	if err != nil {
+		log.Printf("Error getting ban: %v", err)
+		return
+	}
+	if ban != nil {
+		h.msgQueue.QueueTextMessage(chatID, bannedNotice(ban))
+		return
 	}
 
-	// Save updated state
-	if err := h.db.SaveUserState(userState); err != nil {
-		log.Printf("Error saving user state: %v", err)
+	// Check if user is active
+	if !userState.IsActive {
+		h.msgQueue.QueueTextMessage(chatID, "You need to be active to find a match!")
 		return
 	}
 
-	// Show settings menu
-	h.showSettingsMenu(userID, chatID)
-}
+	// Check if user is already in a chat
+	if userState.CurrentChat != 0 {
+		h.msgQueue.QueueTextMessage(chatID, "You are already in a chat!")
+		return
+	}
 
-// checkCompatibility checks if two users are compatible based on their settings
-func (h *HandlerManager) checkCompatibility(user1 int64, user2 int64) (bool, error) {
-	user1State, err := h.db.GetUserState(user1)
-	if err != nil {
-		return false, err
+	// Check if user is already searching
+	if userState.IsWaitingForMatch() {
+		h.msgQueue.QueueTextMessage(chatID, "You are already searching for a match. Please wait...")
+		return
 	}
 
-	user2State, err := h.db.GetUserState(user2)
+	// Join the match queue. The state is read again in the transaction, so a
+	// pairing since the checks above isn't undone by saving a stale copy.
+	err = h.db.RunInTx(func(tx store.Tx) error {
+		userState, err := tx.GetUserState(userID)
+		if err != nil {
+			return err
+		}
+		if userState.CurrentChat != 0 || userState.IsWaitingForMatch() {
+			return nil
+		}
+
+		now := time.Now()
+		userState.MatchStartTime = &now
+		return tx.SaveUserState(userState)
+	})
 	if err != nil {
-		return false, err
+		log.Printf("Error saving user state: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error finding matches.")
+		return
 	}
 
-	// Check gender preference if set
-	if user1State.Settings.Gender != "" && user2State.Settings.Gender != "" &&
-		user1State.Settings.Gender != user2State.Settings.Gender {
-		return false, nil
+	matched, err := h.newMatchPass().tryMatch(userID)
+	if err != nil {
+		log.Printf("Error finding potential matches: %v", err)
 	}
-
-	// Check language preference if set
-	if user1State.Settings.Language != "" && user2State.Settings.Language != "" &&
-		user1State.Settings.Language != user2State.Settings.Language {
-		return false, nil
+	if matched {
+		h.msgQueue.QueueTextMessage(chatID, "Match found! Starting chat...")
+		return
 	}
 
-	// Check country preference if set
-	if user1State.Settings.Country != "" && user2State.Settings.Country != "" &&
-		user1State.Settings.Country != user2State.Settings.Country {
-		return false, nil
-	}
+	// No match yet, the user stays in the queue until a partner shows up
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Cancel Search", "cancel_match"),
+		),
+	)
 
-	return true, nil
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		"Searching for a match... You will be notified when a partner is found (up to %d minutes).",
+		int(config.MatchTimeout.Minutes()),
+	))
+	msg.ReplyMarkup = keyboard
+	h.bot.Send(msg)
 }
 
-// handleFindMatch tries to find a chat match
-func (h *HandlerManager) handleFindMatch(userID int64, chatID int64) {
-	userState, err := h.db.GetUserState(userID)
+// handleCancelMatch removes the user from the match queue
+func (h *HandlerManager) handleCancelMatch(userID int64, chatID int64) {
+	var cancelled bool
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		userState, err := tx.GetUserState(userID)
+		if err != nil || !userState.IsWaitingForMatch() {
+			return err
+		}
+		cancelled = true
+
+		userState.MatchStartTime = nil
+		return tx.SaveUserState(userState)
+	})
 	if err != nil {
-		log.Printf("Error getting user state: %v", err)
+		log.Printf("Error saving user state: %v", err)
 		return
 	}
 
-	// Check if user is active
-	if !userState.IsActive {
-		h.msgQueue.QueueTextMessage(chatID, "You need to be active to find a match!")
+	if !cancelled {
+		h.msgQueue.QueueTextMessage(chatID, "You are not searching for a match.")
 		return
 	}
 
-	// Check if user is already in a chat
-	if userState.CurrentChat != 0 {
-		h.msgQueue.QueueTextMessage(chatID, "You are already in a chat!")
-		return
-	}
+	h.msgQueue.QueueTextMessage(chatID, "Search cancelled.")
+}
 
+// tryMatch looks for a compatible partner for the user and starts a chat if
+// one is found. Candidates settled earlier in the pass are skipped.
+func (p *matchPass) tryMatch(userID int64) (bool, error) {
 	// Get potential matches
-	potentialMatches, err := h.db.FindPotentialMatches(userID)
+	// Blocked users and recent partners are left out
+	potentialMatches, err := p.h.db.FindPotentialMatches(userID, time.Now().Add(-config.RecentPartnerWindow))
 	if err != nil {
-		log.Printf("Error finding potential matches: %v", err)
-		h.msgQueue.QueueTextMessage(chatID, "Error finding matches.")
-		return
+		return false, err
 	}
 
-	// Shuffle potential matches
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(potentialMatches), func(i, j int) {
-		potentialMatches[i], potentialMatches[j] = potentialMatches[j], potentialMatches[i]
-	})
+	// Nobody later in the pass needs to try this user again
+	p.settled[userID] = true
+
+	userState, err := p.state(userID)
+	if err != nil {
+		return false, err
+	}
 
 	// Try to find a compatible match
 	for _, matchID := range potentialMatches {
-		compatible, err := h.checkCompatibility(userID, matchID)
+		if p.settled[matchID] {
+			continue
+		}
+
+		matchState, err := p.state(matchID)
 		if err != nil {
 			log.Printf("Error checking compatibility: %v", err)
 			continue
 		}
 
-		if compatible {
-			h.startChat(userID, matchID)
-			h.msgQueue.QueueTextMessage(chatID, "Match found! Starting chat...")
-			return
+		if !models.IsCompatible(userState, matchState) {
+			continue
+		}
+
+		started, err := p.h.startChat(userID, matchID)
+		if err != nil {
+			return false, err
 		}
+
+		// Someone else was paired with one of them first
+		if !started {
+			continue
+		}
+
+		p.settled[matchID] = true
+		return true, nil
 	}
 
-	// No match found
-	h.msgQueue.QueueTextMessage(chatID, "No matches found at the moment. Please try again later.")
+	return false, nil
 }
 
-// startChat starts a chat between two users
-func (h *HandlerManager) startChat(user1 int64, user2 int64) error {
-	user1State, err := h.db.GetUserState(user1)
-	if err != nil {
-		return err
-	}
+// startChat starts a chat between user1, who is searching for a match, and
+// user2 if both are still free. The pairing and the notifications are stored
+// together, so neither is lost on a restart.
+func (h *HandlerManager) startChat(user1 int64, user2 int64) (bool, error) {
+	var started bool
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		// The search may have been cancelled, or have expired, and the partner
+		// may have gone offline since the candidates were found. The states
+		// are read in user order, the order PairUsers locks them in.
+		first, second := user1, user2
+		if second < first {
+			first, second = second, first
+		}
 
-	user2State, err := h.db.GetUserState(user2)
-	if err != nil {
-		return err
-	}
+		states := make(map[int64]*models.UserState, 2)
+		for _, id := range []int64{first, second} {
+			state, err := tx.GetUserState(id)
+			if err != nil {
+				return err
+			}
+			states[id] = state
+		}
 
-	// Update chat states
-	user1State.CurrentChat = user2
-	user1State.LastActivity = time.Now()
-	user2State.CurrentChat = user1
-	user2State.LastActivity = time.Now()
+		if !states[user1].IsActive || !states[user1].IsWaitingForMatch() || !states[user2].IsActive {
+			return nil
+		}
 
-	// Save states
-	if err := h.db.SaveUserState(user1State); err != nil {
-		return err
-	}
+		paired, err := tx.PairUsers(user1, user2)
+		if err != nil || !paired {
+			return err
+		}
+		started = true
 
-	if err := h.db.SaveUserState(user2State); err != nil {
-		return err
-	}
+		// Notify users
+		if err := h.msgQueue.QueueTextMessageTx(tx, user1, "Chat started! You can now send messages. Use /end to end the chat."); err != nil {
+			return err
+		}
 
-	// Notify users
-	h.msgQueue.QueueTextMessage(user1, "Chat started! You can now send messages. Use /end to end the chat.")
-	h.msgQueue.QueueTextMessage(user2, "Chat started! You can now send messages. Use /end to end the chat.")
+		return h.msgQueue.QueueTextMessageTx(tx, user2, "Chat started! You can now send messages. Use /end to end the chat.")
+	})
 
-	return nil
+	return started, err
 }
 
 // handleEndChat ends a chat between two users
 func (h *HandlerManager) handleEndChat(userID int64) {
-	userState, err := h.db.GetUserState(userID)
-	if err != nil {
-		log.Printf("Error getting user state: %v", err)
-		return
-	}
+	var ended bool
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		session, err := tx.GetCurrentChatSession(userID)
+		if err != nil {
+			return err
+		}
 
-	// Check if user is in a chat
-	if userState.CurrentChat == 0 {
-		h.msgQueue.QueueTextMessage(userID, "You are not in a chat!")
-		return
-	}
+		partnerID, ok, err := tx.EndChat(userID, models.EndReasonUser)
+		if err != nil || !ok {
+			return err
+		}
+		ended = true
 
-	partnerID := userState.CurrentChat
-	partnerState, err := h.db.GetUserState(partnerID)
-	if err != nil {
-		log.Printf("Error getting partner state: %v", err)
-		return
-	}
+		// Notify users, offering to block the partner
+		if err := h.msgQueue.QueueMessageTx(tx, chatEndedMessage(userID, "Chat ended!", sessionID(session))); err != nil {
+			return err
+		}
 
-	// End chat for both users
-	userState.CurrentChat = 0
-	partnerState.CurrentChat = 0
+		if partnerID == 0 {
+			return nil
+		}
 
-	// Save states
-	if err := h.db.SaveUserState(userState); err != nil {
-		log.Printf("Error saving user state: %v", err)
+		return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner has ended the conversation.", sessionID(session)))
+	})
+	if err != nil {
+		log.Printf("Error ending chat: %v", err)
+		return
 	}
 
-	if err := h.db.SaveUserState(partnerState); err != nil {
-		log.Printf("Error saving partner state: %v", err)
+	// Check if user was in a chat
+	if !ended {
+		h.msgQueue.QueueTextMessage(userID, "You are not in a chat!")
 	}
-
-	// Notify users
-	h.msgQueue.QueueTextMessage(userID, "Chat ended!")
-	h.msgQueue.QueueTextMessage(partnerID, "Your chat partner has ended the conversation.")
 }
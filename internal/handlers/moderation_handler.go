@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// moderationCallbackPrefix starts the callback data of the buttons on report
+// cards, followed by the action, an underscore and the report ID
+const moderationCallbackPrefix = "mod_"
+
+// Actions a moderator can take on a report
+const (
+	moderationApprove = "approve"
+	moderationDismiss = "dismiss"
+	moderationBan     = "ban"
+)
+
+// moderationAction is the status an action gives a report and how it is
+// recorded in the audit log
+type moderationAction struct {
+	status models.ReportStatus
+	audit  models.AdminActionKind
+}
+
+// moderationActions maps the actions on report cards to their outcome
+var moderationActions = map[string]moderationAction{
+	moderationApprove: {models.ReportApproved, models.AdminApproveReport},
+	moderationDismiss: {models.ReportDismissed, models.AdminDismissReport},
+	moderationBan:     {models.ReportBanned, models.AdminBan},
+}
+
+// resolutionLabels describe what was done with a resolved report
+var resolutionLabels = map[models.ReportStatus]string{
+	models.ReportApproved:  "Approved, user warned",
+	models.ReportDismissed: "Dismissed",
+	models.ReportBanned:    "User banned",
+}
+
+// isAdminChat reports whether the chat is where moderators review reports
+func (h *HandlerManager) isAdminChat(chatID int64) bool {
+	return h.config.AdminChatID != 0 && chatID == h.config.AdminChatID
+}
+
+// canModerate reports whether the user may act on reports in the chat: anyone
+// in the admin chat, and admins everywhere
+func (h *HandlerManager) canModerate(chatID int64, userID int64) bool {
+	return h.isAdminChat(chatID) || h.config.IsAdmin(userID)
+}
+
+// notifyModerators posts a new report to the admin chat
+func (h *HandlerManager) notifyModerators(report *models.Report) {
+	if h.config.AdminChatID == 0 {
+		return
+	}
+
+	h.msgQueue.QueueMessage(reportCardMessage(h.config.AdminChatID, report))
+}
+
+// handlePendingReports posts the oldest reports still waiting for a moderator
+func (h *HandlerManager) handlePendingReports(chatID int64) {
+	reports, err := h.db.GetPendingReports(config.PendingReportsPageSize)
+	if err != nil {
+		log.Printf("Error getting pending reports: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error getting pending reports.")
+		return
+	}
+
+	if len(reports) == 0 {
+		h.msgQueue.QueueTextMessage(chatID, "No pending reports.")
+		return
+	}
+
+	for i := range reports {
+		h.msgQueue.QueueMessage(reportCardMessage(chatID, &reports[i]))
+	}
+}
+
+// handleModerationCallback applies a moderator's decision on a report and
+// updates its card in the admin chat
+func (h *HandlerManager) handleModerationCallback(query *tgbotapi.CallbackQuery, action string, reportID int64) {
+	chatID := query.Message.Chat.ID
+	if !h.canModerate(chatID, query.From.ID) {
+		return
+	}
+
+	outcome, ok := moderationActions[action]
+	if !ok {
+		return
+	}
+	status := outcome.status
+
+	report, err := h.db.GetReport(reportID)
+	if err != nil || report == nil {
+		log.Printf("Error getting report %d: %v", reportID, err)
+		return
+	}
+
+	moderatorID := query.From.ID
+	var resolved bool
+	err = h.db.RunInTx(func(tx store.Tx) error {
+		var err error
+		resolved, err = tx.ResolveReport(report.ID, status, moderatorID)
+		if err != nil || !resolved {
+			return err
+		}
+
+		err = tx.RecordAdminAction(&models.AdminAction{
+			AdminID:  moderatorID,
+			Action:   outcome.audit,
+			TargetID: report.ReportedID,
+			Details:  fmt.Sprintf("report #%d", report.ID),
+		})
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case models.ReportApproved:
+			return h.msgQueue.QueueTextMessageTx(tx, report.ReportedID,
+				"⚠️ You were reported by a chat partner and a moderator upheld the report. Please follow the rules, or you may be banned.")
+		case models.ReportBanned:
+			return h.banUserTx(tx, &models.Ban{
+				UserID:   report.ReportedID,
+				Kind:     models.BanPermanent,
+				Reason:   report.Reason.Label(),
+				BannedBy: moderatorID,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error resolving report %d: %v", report.ID, err)
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("Error resolving report #%d.", report.ID))
+		return
+	}
+
+	// Someone else got there first; show what they decided
+	if !resolved {
+		current, err := h.db.GetReport(report.ID)
+		if err != nil || current == nil {
+			log.Printf("Error getting report %d: %v", report.ID, err)
+			return
+		}
+		h.msgQueue.QueueMessage(models.QueuedMessage{
+			ChatID:        chatID,
+			Type:          models.TextMessage,
+			Text:          reportCardText(current) + fmt.Sprintf("\n\nAlready resolved: %s (moderator %d).", resolutionLabels[current.Status], current.ResolvedBy),
+			EditMessageID: query.Message.MessageID,
+		})
+		return
+	}
+
+	// Editing the text drops the buttons, so the report can't be resolved twice
+	h.msgQueue.QueueMessage(models.QueuedMessage{
+		ChatID:        chatID,
+		Type:          models.TextMessage,
+		Text:          reportCardText(report) + fmt.Sprintf("\n\n%s by %s.", resolutionLabels[status], moderatorName(query.From)),
+		EditMessageID: query.Message.MessageID,
+	})
+}
+
+// parseModerationCallback splits the callback data of a report card button,
+// without its prefix
+func parseModerationCallback(data string) (string, int64, bool) {
+	action, id, found := strings.Cut(data, "_")
+	if !found {
+		return "", 0, false
+	}
+
+	reportID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return action, reportID, true
+}
+
+// reportCardMessage is a report as shown to moderators, with buttons to act on it
+func reportCardMessage(chatID int64, report *models.Report) models.QueuedMessage {
+	button := func(text string, action string) models.Button {
+		return models.Button{Text: text, Data: fmt.Sprintf("%s%s_%d", moderationCallbackPrefix, action, report.ID)}
+	}
+
+	return models.QueuedMessage{
+		ChatID: chatID,
+		Type:   models.TextMessage,
+		Text:   reportCardText(report),
+		Buttons: []models.Button{
+			button("✅ Approve and warn", moderationApprove),
+			button("❌ Dismiss", moderationDismiss),
+			button("🚫 Ban", moderationBan),
+		},
+	}
+}
+
+// reportCardText describes a report for moderators
+func reportCardText(report *models.Report) string {
+	text := fmt.Sprintf("Report #%d: %s\nReported user: %d\nReporter: %d\nChat session: %d\nReported at: %s",
+		report.ID, report.Reason.Label(), report.ReportedID, report.ReporterID, report.SessionID,
+		formatAdminTime(report.CreatedAt))
+
+	if report.Details != "" {
+		text += "\n\n" + report.Details
+	}
+
+	return text
+}
+
+// moderatorName is how a moderator is named on the reports they resolved
+func moderatorName(user *tgbotapi.User) string {
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return user.FirstName
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// menuOption is a selectable value in a settings menu
+type menuOption struct {
+	Value string
+	Label string
+}
+
+// languageOptions lists the languages users can pick
+var languageOptions = []menuOption{
+	{"english", "English"},
+	{"mandarin", "Mandarin"},
+	{"hindi", "Hindi"},
+	{"spanish", "Spanish"},
+	{"french", "French"},
+	{"arabic", "Arabic"},
+	{"bengali", "Bengali"},
+	{"portuguese", "Portuguese"},
+	{"russian", "Russian"},
+	{"japanese", "Japanese"},
+}
+
+// genderOptions lists the genders users can pick
+var genderOptions = []menuOption{
+	{"male", "Male"},
+	{"female", "Female"},
+	{"other", "Other"},
+}
+
+// buildOptionRows lays out options two per row, marking the selected ones
+func buildOptionRows(options []menuOption, callbackPrefix string, selected []string) [][]tgbotapi.InlineKeyboardButton {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+
+	for _, option := range options {
+		label := option.Label
+		if containsValue(selected, option.Value) {
+			label = "✅ " + label
+		}
+
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, callbackPrefix+option.Value))
+		if len(row) == 2 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// containsValue reports whether values contains value, ignoring case
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleValue adds value to values if missing, or removes it if present
+func toggleValue(values []string, value string) []string {
+	if !containsValue(values, value) {
+		return append(values, value)
+	}
+
+	var result []string
+	for _, v := range values {
+		if !strings.EqualFold(v, value) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// formatPreference renders a preference list for display
+func formatPreference(values []string) string {
+	if len(values) == 0 {
+		return "Any"
+	}
+	return strings.Join(values, ", ")
+}
+
+// showPreferencesMenu displays the partner preferences menu
+func (h *HandlerManager) showPreferencesMenu(userID int64, chatID int64, messageID int) {
+	userState, err := h.db.GetUserState(userID)
+	if err != nil {
+		log.Printf("Error getting user state: %v", err)
+		return
+	}
+
+	prefs := userState.Settings.Preferences
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Countries: "+formatCountries(prefs.Countries), "pref_country"),
+			tgbotapi.NewInlineKeyboardButtonData("Any", "clear_pref_country"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Languages: "+formatPreference(prefs.Languages), "pref_language"),
+			tgbotapi.NewInlineKeyboardButtonData("Any", "clear_pref_language"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Genders: "+formatPreference(prefs.Genders), "pref_gender"),
+			tgbotapi.NewInlineKeyboardButtonData("Any", "clear_pref_gender"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Back to Settings", "settings"),
+		),
+	)
+
+	h.renderMenu(
+		chatID,
+		messageID,
+		"Who I Want to Meet - You will only be matched with people who fit these preferences and whose preferences fit you:",
+		keyboard,
+	)
+}
+
+// showPreferenceLanguageMenu displays the multi-select partner language menu
+func (h *HandlerManager) showPreferenceLanguageMenu(userID int64, chatID int64, messageID int) {
+	userState, err := h.db.GetUserState(userID)
+	if err != nil {
+		log.Printf("Error getting user state: %v", err)
+		return
+	}
+
+	rows := buildOptionRows(languageOptions, "plang_", userState.Settings.Preferences.Languages)
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Done", "preferences"),
+	))
+
+	h.renderMenu(chatID, messageID, "Select the languages your partner may speak (none selected means any):", tgbotapi.NewInlineKeyboardMarkup(rows...))
+}
+
+// showPreferenceGenderMenu displays the multi-select partner gender menu
+func (h *HandlerManager) showPreferenceGenderMenu(userID int64, chatID int64, messageID int) {
+	userState, err := h.db.GetUserState(userID)
+	if err != nil {
+		log.Printf("Error getting user state: %v", err)
+		return
+	}
+
+	rows := buildOptionRows(genderOptions, "pgender_", userState.Settings.Preferences.Genders)
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Done", "preferences"),
+	))
+
+	h.renderMenu(chatID, messageID, "Select the genders you want to meet (none selected means any):", tgbotapi.NewInlineKeyboardMarkup(rows...))
+}
+
+// handleTogglePreference adds or removes a value from a partner preference
+func (h *HandlerManager) handleTogglePreference(userID int64, setting string, value string, chatID int64, messageID int) {
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		prefs := &userState.Settings.Preferences
+		switch setting {
+		case "country":
+			prefs.Countries = toggleValue(prefs.Countries, value)
+		case "language":
+			prefs.Languages = toggleValue(prefs.Languages, value)
+		case "gender":
+			prefs.Genders = toggleValue(prefs.Genders, value)
+		}
+	})
+	if err != nil {
+		log.Printf("Error saving user state: %v", err)
+		return
+	}
+
+	// Stay on the selection menu so several values can be picked
+	switch setting {
+	case "language":
+		h.showPreferenceLanguageMenu(userID, chatID, messageID)
+	case "gender":
+		h.showPreferenceGenderMenu(userID, chatID, messageID)
+	default:
+		h.showPreferencesMenu(userID, chatID, messageID)
+	}
+}
+
+// handleClearPreference resets a partner preference to "any"
+func (h *HandlerManager) handleClearPreference(userID int64, setting string, chatID int64, messageID int) {
+	err := h.updateUserState(userID, func(userState *models.UserState) {
+		switch setting {
+		case "country":
+			userState.Settings.Preferences.Countries = nil
+		case "language":
+			userState.Settings.Preferences.Languages = nil
+		case "gender":
+			userState.Settings.Preferences.Genders = nil
+		}
+	})
+	if err != nil {
+		log.Printf("Error saving user state: %v", err)
+		return
+	}
+
+	h.showPreferencesMenu(userID, chatID, messageID)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// anonymousPrefix is put in front of relayed text and captions
+const anonymousPrefix = "Anonymous: "
+
+// defaultPhotoCaption labels photos that were sent without a caption
+const defaultPhotoCaption = "Anonymous sent a photo"
+
+// buildRelayMessage converts an incoming message into a queued message for the
+// chat partner. It returns false for message kinds that cannot be relayed.
+func buildRelayMessage(message *tgbotapi.Message, partnerID int64) (models.QueuedMessage, bool) {
+	relay := models.QueuedMessage{
+		ChatID:          partnerID,
+		SourceChatID:    message.Chat.ID,
+		SourceMessageID: message.MessageID,
+		Priority:        models.PriorityRelay,
+	}
+
+	switch {
+	case message.Photo != nil:
+		// Get the largest available photo
+		relay.Type = models.PhotoMessage
+		relay.FileID = message.Photo[len(message.Photo)-1].FileID
+		relay.Caption = defaultPhotoCaption
+	case message.Sticker != nil:
+		relay.Type = models.StickerMessage
+		relay.FileID = message.Sticker.FileID
+	case message.Voice != nil:
+		relay.Type = models.VoiceMessage
+		relay.FileID = message.Voice.FileID
+	case message.VideoNote != nil:
+		relay.Type = models.VideoNoteMessage
+		relay.FileID = message.VideoNote.FileID
+	case message.Animation != nil:
+		// Animations also carry a Document, so check them first
+		relay.Type = models.AnimationMessage
+		relay.FileID = message.Animation.FileID
+	case message.Video != nil:
+		relay.Type = models.VideoMessage
+		relay.FileID = message.Video.FileID
+	case message.Audio != nil:
+		relay.Type = models.AudioMessage
+		relay.FileID = message.Audio.FileID
+	case message.Document != nil:
+		relay.Type = models.DocumentMessage
+		relay.FileID = message.Document.FileID
+	case message.Venue != nil:
+		relay.Type = models.LocationMessage
+		relay.Latitude = message.Venue.Location.Latitude
+		relay.Longitude = message.Venue.Location.Longitude
+	case message.Location != nil:
+		relay.Type = models.LocationMessage
+		relay.Latitude = message.Location.Latitude
+		relay.Longitude = message.Location.Longitude
+	case message.Contact != nil:
+		relay.Type = models.ContactMessage
+		relay.PhoneNumber = message.Contact.PhoneNumber
+		relay.FirstName = message.Contact.FirstName
+		relay.LastName = message.Contact.LastName
+	case message.Text != "":
+		relay.Type = models.TextMessage
+		relay.Text = anonymousPrefix + message.Text
+		return relay, true
+	default:
+		return relay, false
+	}
+
+	if message.Caption != "" {
+		relay.Caption = anonymousPrefix + message.Caption
+	}
+
+	return relay, true
+}
+
+// translateReply finds the partner's copy of the message being replied to, or
+// returns 0 if it was never relayed
+func (h *HandlerManager) translateReply(chatID int64, replyToMessageID int, partnerID int64) int {
+	counterpart, err := h.db.FindCounterpart(chatID, replyToMessageID, partnerID)
+	if err != nil {
+		log.Printf("Error finding relayed message: %v", err)
+		return 0
+	}
+	return counterpart
+}
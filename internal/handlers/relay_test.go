@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// saveRelayed records that a message from senderChatID was delivered to
+// recipientChatID as deliveredMessageID
+func saveRelayed(t *testing.T, db store.Store, senderChatID int64, originalMessageID int, recipientChatID int64, deliveredMessageID int) {
+	t.Helper()
+
+	err := db.SaveRelayedMessage(&models.RelayedMessage{
+		SenderChatID:       senderChatID,
+		OriginalMessageID:  originalMessageID,
+		RecipientChatID:    recipientChatID,
+		DeliveredMessageID: deliveredMessageID,
+		CreatedAt:          time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("SaveRelayedMessage: %v", err)
+	}
+}
+
+func TestTranslateReply(t *testing.T) {
+	h, db := newTestHandlers(t)
+
+	// User 1 sent message 10, delivered to user 2 as 100. User 2 sent 50,
+	// delivered to user 1 as 11.
+	saveRelayed(t, db, 1, 10, 2, 100)
+	saveRelayed(t, db, 2, 50, 1, 11)
+
+	tests := []struct {
+		name      string
+		chatID    int64
+		replyTo   int
+		partnerID int64
+		want      int
+	}{
+		{"reply to own message", 1, 10, 2, 100},
+		{"reply to the partner's message", 1, 11, 2, 50},
+		{"partner replies to a received copy", 2, 100, 1, 10},
+		{"partner replies to own message", 2, 50, 1, 11},
+		{"message never relayed", 1, 12, 2, 0},
+		{"relayed to someone else", 1, 10, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.translateReply(tt.chatID, tt.replyTo, tt.partnerID); got != tt.want {
+				t.Errorf("translateReply(%d, %d, %d) = %d, want %d", tt.chatID, tt.replyTo, tt.partnerID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayedReplyKeepsItsContext(t *testing.T) {
+	h, db := newTestHandlers(t)
+	pair(t, db, 1, 2)
+
+	// User 2 sent message 50, which user 1 received as 11
+	saveRelayed(t, db, 2, 50, 1, 11)
+
+	reply := func(messageID int, replyTo int) tgbotapi.Update {
+		return tgbotapi.Update{Message: &tgbotapi.Message{
+			MessageID:      messageID,
+			From:           &tgbotapi.User{ID: 1},
+			Chat:           &tgbotapi.Chat{ID: 1},
+			Text:           "sure",
+			ReplyToMessage: &tgbotapi.Message{MessageID: replyTo},
+		}}
+	}
+
+	h.HandleMessage(reply(12, 11))
+	h.HandleMessage(reply(13, 99))
+
+	messages := queued(t, db)
+	if len(messages) != 2 {
+		t.Fatalf("relayed %d messages, want 2", len(messages))
+	}
+	if messages[0].ChatID != 2 || messages[0].SourceMessageID != 12 {
+		t.Fatalf("relayed %+v, want message 12 to user 2", messages[0])
+	}
+	if messages[0].ReplyToMessageID != 50 {
+		t.Errorf("reply points at %d in the partner's chat, want 50", messages[0].ReplyToMessageID)
+	}
+
+	// A reply to something the partner never saw is sent as a plain message
+	if messages[1].ReplyToMessageID != 0 {
+		t.Errorf("reply to an unknown message points at %d, want none", messages[1].ReplyToMessageID)
+	}
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// Callback data of the report flow. Reasons are sent as
+// reportReasonCallbackPrefix, the session ID, an underscore and the reason.
+const (
+	reportCallbackPrefix       = "report_"
+	reportReasonCallbackPrefix = "rreason_"
+	reportSubmitCallback       = "rsubmit"
+)
+
+// handleReport ends the user's current chat, or picks their last one, and asks
+// why they are reporting the partner
+func (h *HandlerManager) handleReport(userID int64, chatID int64) {
+	var session *models.ChatSession
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		var err error
+		session, err = tx.GetCurrentChatSession(userID)
+		if err != nil || session == nil {
+			return err
+		}
+
+		partnerID, ended, err := tx.EndChat(userID, models.EndReasonUserReport)
+		if err != nil || !ended {
+			return err
+		}
+
+		if err := h.msgQueue.QueueTextMessageTx(tx, userID, "Chat ended."); err != nil {
+			return err
+		}
+
+		// The partner isn't told they were reported
+		if partnerID == 0 {
+			return nil
+		}
+
+		return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner has ended the conversation.", session.ID))
+	})
+	if err != nil {
+		log.Printf("Error ending chat for a report: %v", err)
+		return
+	}
+
+	if session == nil {
+		sessions, err := h.db.GetChatSessions(userID, 1)
+		if err != nil {
+			log.Printf("Error getting chat sessions: %v", err)
+			return
+		}
+		if len(sessions) == 0 {
+			h.msgQueue.QueueTextMessage(chatID, "You haven't chatted with anyone yet, so there is nobody to report.")
+			return
+		}
+		session = &sessions[0]
+	}
+
+	h.msgQueue.QueueMessage(reportReasonsMessage(chatID, session.ID))
+}
+
+// handleReportCallback asks for a reason after the user pressed "Report" below
+// an ended chat
+func (h *HandlerManager) handleReportCallback(userID int64, chatID int64, sessionID int64) {
+	session, ok := h.reportableSession(userID, sessionID)
+	if !ok {
+		return
+	}
+
+	if session.IsOpen() {
+		h.msgQueue.QueueTextMessage(chatID, "Use /report to end your current chat and report your partner.")
+		return
+	}
+
+	h.msgQueue.QueueMessage(reportReasonsMessage(chatID, session.ID))
+}
+
+// handleReportReason remembers the chosen reason and asks for optional details
+func (h *HandlerManager) handleReportReason(userID int64, chatID int64, sessionID int64, reason models.ReportReason) {
+	if _, ok := h.reportableSession(userID, sessionID); !ok {
+		return
+	}
+
+	data := fmt.Sprintf("%d:%s", sessionID, reason)
+	if err := h.beginConversation(userID, models.ConversationAwaitingReportDetails, data); err != nil {
+		log.Printf("Error saving conversation: %v", err)
+		return
+	}
+
+	h.msgQueue.QueueMessage(models.QueuedMessage{
+		ChatID: chatID,
+		Type:   models.TextMessage,
+		Text:   "Reason: " + reason.Label() + "\nDescribe what happened, or submit the report as it is. Send /cancel to drop it.",
+		Buttons: []models.Button{
+			{Text: "Submit without details", Data: reportSubmitCallback},
+		},
+	})
+}
+
+// handleReportSubmitCallback files the pending report without details
+func (h *HandlerManager) handleReportSubmitCallback(userID int64, chatID int64) {
+	conversation, err := h.db.GetConversation(userID)
+	if err != nil {
+		log.Printf("Error getting conversation: %v", err)
+		return
+	}
+
+	if conversation.State != models.ConversationAwaitingReportDetails ||
+		time.Since(conversation.UpdatedAt) > config.ConversationTimeout {
+		h.msgQueue.QueueTextMessage(chatID, "This report has expired. Use /report to start again.")
+		return
+	}
+
+	h.submitReport(userID, chatID, conversation.Data, "")
+}
+
+// handleReportDetailsInput files the pending report with the user's description
+func (h *HandlerManager) handleReportDetailsInput(userID int64, chatID int64, data string, text string) {
+	if utf8.RuneCountInString(text) > config.MaxReportDetailsLength {
+		h.msgQueue.QueueTextMessage(chatID, fmt.Sprintf("Please keep the description under %d characters, or send /cancel.", config.MaxReportDetailsLength))
+		return
+	}
+
+	h.submitReport(userID, chatID, data, text)
+}
+
+// submitReport stores a report from the conversation data and passes it on to
+// the moderators
+func (h *HandlerManager) submitReport(userID int64, chatID int64, data string, details string) {
+	sessionID, reason, ok := parseSessionReason(data, ":")
+	if err := h.db.ClearConversation(userID); err != nil {
+		log.Printf("Error clearing conversation: %v", err)
+	}
+	if !ok {
+		log.Printf("Invalid report conversation data %q for user %d", data, userID)
+		return
+	}
+
+	session, ok := h.reportableSession(userID, sessionID)
+	if !ok {
+		return
+	}
+
+	report := &models.Report{
+		SessionID:  session.ID,
+		ReporterID: userID,
+		ReportedID: session.Partner(userID),
+		Reason:     reason,
+		Details:    details,
+	}
+
+	id, created, err := h.db.CreateReport(report)
+	if err != nil {
+		log.Printf("Error creating report: %v", err)
+		h.msgQueue.QueueTextMessage(chatID, "Error sending your report. Please try again.")
+		return
+	}
+	if !created {
+		h.msgQueue.QueueTextMessage(chatID, "You have already reported this chat. Our moderators will look into it.")
+		return
+	}
+
+	h.msgQueue.QueueTextMessage(chatID, "Thank you. Your report was sent to our moderators.")
+
+	report, err = h.db.GetReport(id)
+	if err != nil || report == nil {
+		log.Printf("Error getting report %d: %v", id, err)
+		return
+	}
+	h.notifyModerators(report)
+}
+
+// reportableSession returns the chat session if the user took part in it
+func (h *HandlerManager) reportableSession(userID int64, sessionID int64) (*models.ChatSession, bool) {
+	session, err := h.db.GetChatSession(sessionID)
+	if err != nil {
+		log.Printf("Error getting chat session: %v", err)
+		return nil, false
+	}
+
+	// Only the partners of a chat may report each other
+	if session == nil || (session.User1ID != userID && session.User2ID != userID) {
+		return nil, false
+	}
+
+	return session, true
+}
+
+// reportReasonsMessage asks which reason applies to a report about the session
+func reportReasonsMessage(chatID int64, sessionID int64) models.QueuedMessage {
+	buttons := make([]models.Button, len(models.ReportReasons))
+	for i, reason := range models.ReportReasons {
+		buttons[i] = models.Button{
+			Text: reason.Label(),
+			Data: fmt.Sprintf("%s%d_%s", reportReasonCallbackPrefix, sessionID, reason),
+		}
+	}
+
+	return models.QueuedMessage{
+		ChatID:  chatID,
+		Type:    models.TextMessage,
+		Text:    "Why are you reporting this person?",
+		Buttons: buttons,
+	}
+}
+
+// parseSessionReason splits a session ID and a report reason joined by sep,
+// as found in reason buttons and in the conversation data of a pending report
+func parseSessionReason(data string, sep string) (int64, models.ReportReason, bool) {
+	id, name, found := strings.Cut(data, sep)
+	if !found {
+		return 0, "", false
+	}
+
+	sessionID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	reason, ok := models.ParseReportReason(name)
+	return sessionID, reason, ok
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/queue"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// HandleUnreachable takes a user who can no longer receive messages out of
+// matching and ends their current chat, letting the partner know
+func (h *HandlerManager) HandleUnreachable(userID int64, kind queue.FailureKind) {
+	err := h.db.RunInTx(func(tx store.Tx) error {
+		session, err := tx.GetCurrentChatSession(userID)
+		if err != nil {
+			return err
+		}
+
+		partnerID, _, err := tx.EndChat(userID, models.EndReasonBlocked)
+		if err != nil {
+			return err
+		}
+
+		userState, err := tx.GetUserState(userID)
+		if err != nil {
+			return err
+		}
+
+		// Go offline and leave the match queue until the user comes back
+		userState.Unreachable = true
+		userState.IsActive = false
+		userState.MatchStartTime = nil
+
+		if err := tx.SaveUserState(userState); err != nil {
+			return err
+		}
+
+		// Only tell the partner if they were still in the chat
+		if partnerID == 0 {
+			return nil
+		}
+
+		return h.msgQueue.QueueMessageTx(tx, chatEndedMessage(partnerID, "Your chat partner is no longer reachable. The chat has ended.", sessionID(session)))
+	})
+	if err != nil {
+		log.Printf("Error handling unreachable user %d (%v): %v", userID, kind, err)
+		return
+	}
+
+	log.Printf("Marked user %d as unreachable (%v)", userID, kind)
+}
+
+// MarkReachable clears the unreachable flag of a user who talks to the bot again
+func (h *HandlerManager) MarkReachable(userID int64) {
+	if err := h.db.MarkReachable(userID); err != nil {
+		log.Printf("Error marking user %d as reachable: %v", userID, err)
+	}
+}
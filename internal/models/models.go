@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 )
 
@@ -12,15 +13,83 @@ type UserState struct {
 	LastActivity   time.Time
 	Settings       UserSettings
 	MatchStartTime *time.Time
+
+	// Unreachable is set when messages can't be delivered to the user,
+	// e.g. because they blocked the bot
+	Unreachable bool
 }
 
-// UserSettings contains user preferences for matching
+// UserSettings contains the user's own profile and who they want to meet
 type UserSettings struct {
+	Profile     UserProfile
+	Preferences PartnerPreferences
+}
+
+// UserProfile describes the user themselves
+type UserProfile struct {
 	Country  string
 	Language string
 	Gender   string
 }
 
+// PartnerPreferences describes who the user wants to be matched with.
+// An empty list means any value is accepted.
+type PartnerPreferences struct {
+	Countries []string
+	Languages []string
+	Genders   []string
+}
+
+// Accepts reports whether a partner with the given profile satisfies the preferences
+func (p PartnerPreferences) Accepts(profile UserProfile) bool {
+	return acceptsValue(p.Countries, profile.Country) &&
+		acceptsValue(p.Languages, profile.Language) &&
+		acceptsValue(p.Genders, profile.Gender)
+}
+
+// acceptsValue checks a single profile value against a preference list.
+// A restricted preference is not satisfied by an unset value.
+func acceptsValue(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(a, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsCompatible reports whether two users accept each other's profiles
+func IsCompatible(user1 *UserState, user2 *UserState) bool {
+	return user1.Settings.Preferences.Accepts(user2.Settings.Profile) &&
+		user2.Settings.Preferences.Accepts(user1.Settings.Profile)
+}
+
+// JoinList encodes a list of values for database storage
+func JoinList(values []string) string {
+	return strings.Join(values, ",")
+}
+
+// SplitList decodes a list of values stored with JoinList
+func SplitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
 // NewUserState creates a new UserState instance
 func NewUserState(userID int64) *UserState {
 	return &UserState{
@@ -29,9 +98,12 @@ func NewUserState(userID int64) *UserState {
 		CurrentChat:  0,
 		LastActivity: time.Now(),
 		Settings: UserSettings{
-			Country:  "",
-			Language: "",
-			Gender:   "",
+			Profile: UserProfile{
+				Country:  "",
+				Language: "",
+				Gender:   "",
+			},
+			Preferences: PartnerPreferences{},
 		},
 		MatchStartTime: nil,
 	}
@@ -41,16 +113,57 @@ func NewUserState(userID int64) *UserState {
 func (u *UserState) ToMap() map[string]interface{} {
 	lastActivity := u.LastActivity.Format(time.RFC3339)
 
+	var matchStartTime interface{}
+	if u.MatchStartTime != nil {
+		matchStartTime = u.MatchStartTime.Format(time.RFC3339)
+	}
+
 	return map[string]interface{}{
-		"is_active":     u.IsActive,
-		"current_chat":  u.CurrentChat,
-		"last_activity": lastActivity,
-		"country":       u.Settings.Country,
-		"language":      u.Settings.Language,
-		"gender":        u.Settings.Gender,
+		"is_active":        u.IsActive,
+		"current_chat":     u.CurrentChat,
+		"last_activity":    lastActivity,
+		"country":          u.Settings.Profile.Country,
+		"language":         u.Settings.Profile.Language,
+		"gender":           u.Settings.Profile.Gender,
+		"pref_countries":   JoinList(u.Settings.Preferences.Countries),
+		"pref_languages":   JoinList(u.Settings.Preferences.Languages),
+		"pref_genders":     JoinList(u.Settings.Preferences.Genders),
+		"match_start_time": matchStartTime,
+		"unreachable":      u.Unreachable,
 	}
 }
 
+// IsWaitingForMatch reports whether the user is in the matchmaking queue
+func (u *UserState) IsWaitingForMatch() bool {
+	return u.MatchStartTime != nil && u.CurrentChat == 0
+}
+
+// ConversationState is the kind of free-text input the bot is waiting for from a user
+type ConversationState string
+
+const (
+	// ConversationIdle means no input is pending
+	ConversationIdle ConversationState = ""
+
+	// ConversationAwaitingCountry waits for the user's own country
+	ConversationAwaitingCountry ConversationState = "awaiting_country"
+
+	// ConversationAwaitingPartnerCountries waits for the countries the user wants to meet
+	ConversationAwaitingPartnerCountries ConversationState = "awaiting_partner_countries"
+
+	// ConversationAwaitingReportDetails waits for the optional details of a
+	// report. Data holds the chat session and reason being reported.
+	ConversationAwaitingReportDetails ConversationState = "awaiting_report_details"
+)
+
+// Conversation holds the pending input state of a user
+type Conversation struct {
+	UserID    int64
+	State     ConversationState
+	Data      string
+	UpdatedAt time.Time
+}
+
 // MessageType represents the type of message to be sent
 type MessageType int
 
@@ -60,13 +173,402 @@ const (
 
 	// PhotoMessage is a photo with optional caption
 	PhotoMessage
+
+	// StickerMessage is a sticker
+	StickerMessage
+
+	// VoiceMessage is a voice note with optional caption
+	VoiceMessage
+
+	// VideoMessage is a video with optional caption
+	VideoMessage
+
+	// VideoNoteMessage is a round video note
+	VideoNoteMessage
+
+	// AnimationMessage is a GIF or silent video with optional caption
+	AnimationMessage
+
+	// DocumentMessage is a file with optional caption
+	DocumentMessage
+
+	// AudioMessage is a music file with optional caption
+	AudioMessage
+
+	// LocationMessage is a map location
+	LocationMessage
+
+	// ContactMessage is a shared phone contact
+	ContactMessage
+
+	// MediaGroupMessage is an album of photos, videos, documents or audio files
+	MediaGroupMessage
+)
+
+// messageTypeNames maps message types to the names used in configuration
+var messageTypeNames = map[MessageType]string{
+	TextMessage:       "text",
+	PhotoMessage:      "photo",
+	StickerMessage:    "sticker",
+	VoiceMessage:      "voice",
+	VideoMessage:      "video",
+	VideoNoteMessage:  "video_note",
+	AnimationMessage:  "animation",
+	DocumentMessage:   "document",
+	AudioMessage:      "audio",
+	LocationMessage:   "location",
+	ContactMessage:    "contact",
+	MediaGroupMessage: "media_group",
+}
+
+// String returns the configuration name of the message type
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseMessageType returns the message type with the given configuration name
+func ParseMessageType(name string) (MessageType, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for t, n := range messageTypeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// MessagePriority is the lane a queued message is sent in. Lower values are
+// served first.
+type MessagePriority int
+
+const (
+	// PriorityControl is for system notices and menu responses
+	PriorityControl MessagePriority = iota
+
+	// PriorityRelay is for messages relayed between chat partners
+	PriorityRelay
+
+	// PriorityBroadcast is for bulk announcements to many users
+	PriorityBroadcast
 )
 
 // QueuedMessage represents a message in the queue to be sent
 type QueuedMessage struct {
-	ChatID      int64
-	Type        MessageType
-	Text        string
-	PhotoFileID string
-	Caption     string
+	ChatID   int64
+	Type     MessageType
+	Text     string
+	FileID   string
+	Caption  string
+	Priority MessagePriority
+
+	// Relayed messages remember where they came from, so the delivered copy
+	// can be mapped back to the original. System messages leave these zero.
+	SourceChatID    int64
+	SourceMessageID int
+
+	// ReplyToMessageID is the message in the recipient's chat being replied to
+	ReplyToMessageID int
+
+	// EditMessageID, when set, updates this earlier delivered message in the
+	// recipient's chat instead of sending a new one
+	EditMessageID int
+
+	// DeleteMessageID, when set, removes this message from the recipient's chat
+	DeleteMessageID int
+
+	// Location messages
+	Latitude  float64
+	Longitude float64
+
+	// Contact messages
+	PhoneNumber string
+	FirstName   string
+	LastName    string
+
+	// Media group messages, and the sender's Telegram media group they came from
+	Media        []MediaItem
+	MediaGroupID string
+
+	// Buttons are shown below a text message, one per row
+	Buttons []Button
+}
+
+// Button is an inline keyboard button that sends callback data when pressed
+type Button struct {
+	Text string
+	Data string
+}
+
+// MediaItem is a single photo, video, document or audio file in an album
+type MediaItem struct {
+	Type            MessageType
+	FileID          string
+	Caption         string
+	SourceMessageID int
+}
+
+// OutboxEntry is a persisted message waiting to be delivered
+type OutboxEntry struct {
+	ID        int64
+	Message   QueuedMessage
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// RelayedMessage maps a message to the copy delivered to the chat partner
+type RelayedMessage struct {
+	SenderChatID       int64
+	OriginalMessageID  int
+	RecipientChatID    int64
+	DeliveredMessageID int
+	CreatedAt          time.Time
+
+	// MediaGroupID is the sender's media group when the message was relayed
+	// as part of an album, so the whole album can be deleted together
+	MediaGroupID string
+}
+
+// EndReason records why a chat session ended
+type EndReason string
+
+const (
+	// EndReasonUser means one of the partners ended the chat
+	EndReasonUser EndReason = "user_end"
+
+	// EndReasonInactivity means nobody wrote for too long
+	EndReasonInactivity EndReason = "inactivity"
+
+	// EndReasonBlocked means a partner blocked the bot or became unreachable
+	EndReasonBlocked EndReason = "blocked"
+
+	// EndReasonBanned means a partner was banned
+	EndReasonBanned EndReason = "banned"
+
+	// EndReasonUserBlock means one of the partners ended the chat and blocked the other
+	EndReasonUserBlock EndReason = "user_block"
+
+	// EndReasonUserReport means one of the partners ended the chat to report the other
+	EndReasonUserReport EndReason = "user_report"
+
+	// EndReasonKicked means an admin ended the chat
+	EndReasonKicked EndReason = "kicked"
+)
+
+// ChatSession is one chat between two users, from pairing until it ended
+type ChatSession struct {
+	ID            int64
+	User1ID       int64
+	User2ID       int64
+	StartedAt     time.Time
+	EndedAt       *time.Time
+	EndReason     EndReason
+	User1Messages int
+	User2Messages int
+}
+
+// ActiveChat is an ongoing chat with both partners' last activity times
+type ActiveChat struct {
+	SessionID     int64
+	User1ID       int64
+	User2ID       int64
+	LastActivity1 time.Time
+	LastActivity2 time.Time
+}
+
+// IsOpen reports whether the chat is still going on
+func (s *ChatSession) IsOpen() bool {
+	return s.EndedAt == nil
+}
+
+// Duration returns how long the chat lasted, or has lasted so far
+func (s *ChatSession) Duration() time.Duration {
+	if s.EndedAt == nil {
+		return time.Since(s.StartedAt)
+	}
+	return s.EndedAt.Sub(s.StartedAt)
+}
+
+// Partner returns the other participant of the chat
+func (s *ChatSession) Partner(userID int64) int64 {
+	if s.User1ID == userID {
+		return s.User2ID
+	}
+	return s.User1ID
+}
+
+// ReportReason is why a user reported their chat partner
+type ReportReason string
+
+const (
+	// ReportHarassment is for insults, threats and unwanted advances
+	ReportHarassment ReportReason = "harassment"
+
+	// ReportSpam is for advertising, scams and repeated junk
+	ReportSpam ReportReason = "spam"
+
+	// ReportSexualContent is for unsolicited sexual messages or media
+	ReportSexualContent ReportReason = "sexual_content"
+
+	// ReportHate is for hate speech
+	ReportHate ReportReason = "hate"
+
+	// ReportOther is for anything else
+	ReportOther ReportReason = "other"
+)
+
+// ReportReasons lists the reasons in the order they are offered to users
+var ReportReasons = []ReportReason{
+	ReportHarassment,
+	ReportSpam,
+	ReportSexualContent,
+	ReportHate,
+	ReportOther,
+}
+
+// reportReasonLabels maps report reasons to the labels shown to users
+var reportReasonLabels = map[ReportReason]string{
+	ReportHarassment:    "Harassment",
+	ReportSpam:          "Spam or scam",
+	ReportSexualContent: "Sexual content",
+	ReportHate:          "Hate speech",
+	ReportOther:         "Something else",
+}
+
+// Label returns the name of the reason shown to users
+func (r ReportReason) Label() string {
+	if label, ok := reportReasonLabels[r]; ok {
+		return label
+	}
+	return string(r)
+}
+
+// ParseReportReason returns the report reason with the given name
+func ParseReportReason(name string) (ReportReason, bool) {
+	reason := ReportReason(name)
+	_, ok := reportReasonLabels[reason]
+	return reason, ok
+}
+
+// ReportStatus is where a report is in moderator review
+type ReportStatus string
+
+const (
+	// ReportPending means no moderator has acted on the report yet
+	ReportPending ReportStatus = "pending"
+
+	// ReportApproved means a moderator upheld the report and warned the reported user
+	ReportApproved ReportStatus = "approved"
+
+	// ReportDismissed means a moderator found nothing wrong
+	ReportDismissed ReportStatus = "dismissed"
+
+	// ReportBanned means a moderator banned the reported user
+	ReportBanned ReportStatus = "banned"
+)
+
+// Report is a complaint about a chat partner, waiting for or resolved by a moderator
+type Report struct {
+	ID         int64
+	SessionID  int64
+	ReporterID int64
+	ReportedID int64
+	Reason     ReportReason
+	Details    string
+	Status     ReportStatus
+	CreatedAt  time.Time
+
+	// ResolvedBy is the moderator who acted on the report, and ResolvedAt when
+	ResolvedBy int64
+	ResolvedAt *time.Time
+}
+
+// BanKind is how a ban restricts a user
+type BanKind string
+
+const (
+	// BanPermanent keeps the user from chatting until an admin lifts the ban
+	BanPermanent BanKind = "permanent"
+
+	// BanTemporary keeps the user from chatting until the ban expires
+	BanTemporary BanKind = "temporary"
+
+	// BanShadow lets the user carry on unaware, but only ever matches them
+	// with other shadowbanned users
+	BanShadow BanKind = "shadow"
+)
+
+// Ban keeps a user from using the bot
+type Ban struct {
+	UserID    int64
+	Kind      BanKind
+	Reason    string
+	BannedBy  int64
+	CreatedAt time.Time
+
+	// ExpiresAt is when a temporary ban or shadowban ends, nil if it lasts
+	// until it is lifted
+	ExpiresAt *time.Time
+}
+
+// IsShadow reports whether the user is shadowbanned rather than banned outright
+func (b *Ban) IsShadow() bool {
+	return b.Kind == BanShadow
+}
+
+// AdminActionKind is what an admin did
+type AdminActionKind string
+
+const (
+	// AdminBan means a user was banned, by command or from a report
+	AdminBan AdminActionKind = "ban"
+
+	// AdminShadowban means a user was shadowbanned
+	AdminShadowban AdminActionKind = "shadowban"
+
+	// AdminUnban means a user's ban was lifted
+	AdminUnban AdminActionKind = "unban"
+
+	// AdminKick means a user's current chat was ended
+	AdminKick AdminActionKind = "kick"
+
+	// AdminWhois means an admin looked up a user
+	AdminWhois AdminActionKind = "whois"
+
+	// AdminStats means an admin looked at the usage statistics
+	AdminStats AdminActionKind = "stats"
+
+	// AdminApproveReport means a report was upheld and the reported user warned
+	AdminApproveReport AdminActionKind = "approve_report"
+
+	// AdminDismissReport means a report was dismissed
+	AdminDismissReport AdminActionKind = "dismiss_report"
+)
+
+// AdminAction is an entry in the audit log of admin actions
+type AdminAction struct {
+	ID int64
+
+	// AdminID is who took the action, 0 for actions the bot took on its own
+	AdminID int64
+	Action  AdminActionKind
+
+	// TargetID is the user acted on, 0 for actions without one
+	TargetID  int64
+	Details   string
+	CreatedAt time.Time
+}
+
+// Stats is an overview of the bot's users and chats
+type Stats struct {
+	Users             int
+	OnlineUsers       int
+	ChattingUsers     int
+	WaitingUsers      int
+	ChatsStarted      int
+	PendingReports    int
+	BannedUsers       int
+	ShadowbannedUsers int
 }
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func user(profile UserProfile, prefs PartnerPreferences) *UserState {
+	state := NewUserState(1)
+	state.Settings = UserSettings{Profile: profile, Preferences: prefs}
+	return state
+}
+
+func TestIsCompatible(t *testing.T) {
+	german := UserProfile{Country: "DE", Language: "de", Gender: "female"}
+	french := UserProfile{Country: "FR", Language: "fr", Gender: "male"}
+	unset := UserProfile{}
+
+	tests := []struct {
+		name  string
+		user1 *UserState
+		user2 *UserState
+		want  bool
+	}{
+		{"no preferences", user(german, PartnerPreferences{}), user(french, PartnerPreferences{}), true},
+		{"both unset profiles", user(unset, PartnerPreferences{}), user(unset, PartnerPreferences{}), true},
+
+		// Each side's preferences must accept the other
+		{"both accept", user(german, PartnerPreferences{Countries: []string{"FR"}}), user(french, PartnerPreferences{Countries: []string{"DE"}}), true},
+		{"first accepts, second doesn't", user(german, PartnerPreferences{Countries: []string{"FR"}}), user(french, PartnerPreferences{Countries: []string{"IT"}}), false},
+		{"second accepts, first doesn't", user(german, PartnerPreferences{Countries: []string{"IT"}}), user(french, PartnerPreferences{Countries: []string{"DE"}}), false},
+		{"one way, other side open", user(german, PartnerPreferences{Genders: []string{"male"}}), user(french, PartnerPreferences{}), true},
+
+		// Every restricted field must match
+		{"all fields match", user(german, PartnerPreferences{Countries: []string{"FR"}, Languages: []string{"fr"}, Genders: []string{"male"}}), user(french, PartnerPreferences{}), true},
+		{"one field doesn't", user(german, PartnerPreferences{Countries: []string{"FR"}, Languages: []string{"en"}}), user(french, PartnerPreferences{}), false},
+
+		// Any value of a list will do
+		{"second of several countries", user(german, PartnerPreferences{Countries: []string{"IT", "FR", "ES"}}), user(french, PartnerPreferences{}), true},
+		{"none of several countries", user(german, PartnerPreferences{Countries: []string{"IT", "ES"}}), user(french, PartnerPreferences{}), false},
+		{"several on both sides", user(german, PartnerPreferences{Languages: []string{"en", "fr"}}), user(french, PartnerPreferences{Languages: []string{"de", "en"}}), true},
+		{"values ignore case", user(german, PartnerPreferences{Countries: []string{"fr"}}), user(french, PartnerPreferences{Genders: []string{"FEMALE"}}), true},
+
+		// A restriction isn't met by a partner who didn't say
+		{"restricted against unset profile", user(german, PartnerPreferences{Genders: []string{"male"}}), user(unset, PartnerPreferences{}), false},
+		{"unset profile with open partner", user(unset, PartnerPreferences{Genders: []string{"female"}}), user(german, PartnerPreferences{}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCompatible(tt.user1, tt.user2); got != tt.want {
+				t.Errorf("IsCompatible = %v, want %v", got, tt.want)
+			}
+			if got := IsCompatible(tt.user2, tt.user1); got != tt.want {
+				t.Errorf("IsCompatible with the users swapped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"DE", []string{"DE"}},
+		{"DE,FR", []string{"DE", "FR"}},
+		{" DE , ,FR ", []string{"DE", "FR"}},
+	}
+
+	for _, tt := range tests {
+		if got := SplitList(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitList(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+		if got := SplitList(JoinList(tt.want)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitList(JoinList(%v)) = %v", tt.want, got)
+		}
+	}
+}
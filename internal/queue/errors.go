@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+)
+
+// FailureKind classifies why a message could not be delivered
+type FailureKind int
+
+const (
+	// FailureTemporary is a network or server error worth retrying
+	FailureTemporary FailureKind = iota
+
+	// FailureTooManyRequests means Telegram asked us to slow down
+	FailureTooManyRequests
+
+	// FailureBadRequest means this particular message was rejected
+	FailureBadRequest
+
+	// FailureBlocked means the user blocked the bot
+	FailureBlocked
+
+	// FailureDeactivated means the user deleted their account
+	FailureDeactivated
+
+	// FailureChatNotFound means the chat doesn't exist or the bot never talked to it
+	FailureChatNotFound
+)
+
+// String returns a readable name for the failure kind
+func (k FailureKind) String() string {
+	switch k {
+	case FailureTooManyRequests:
+		return "too many requests"
+	case FailureBadRequest:
+		return "bad request"
+	case FailureBlocked:
+		return "blocked"
+	case FailureDeactivated:
+		return "deactivated"
+	case FailureChatNotFound:
+		return "chat not found"
+	default:
+		return "temporary"
+	}
+}
+
+// IsRecipientUnreachable reports whether no message can reach the recipient anymore
+func (k FailureKind) IsRecipientUnreachable() bool {
+	return k == FailureBlocked || k == FailureDeactivated || k == FailureChatNotFound
+}
+
+// ClassifyError determines the kind of a send failure from the Telegram error
+func ClassifyError(err error) FailureKind {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return FailureTemporary
+	}
+
+	message := strings.ToLower(apiErr.Message)
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests || apiErr.RetryAfter > 0:
+		return FailureTooManyRequests
+	case strings.Contains(message, "user is deactivated"):
+		return FailureDeactivated
+	case apiErr.Code == http.StatusForbidden:
+		// Blocked, or the user never started the bot
+		return FailureBlocked
+	case strings.Contains(message, "chat not found"):
+		return FailureChatNotFound
+	case apiErr.Code > 0 && apiErr.Code < http.StatusInternalServerError:
+		return FailureBadRequest
+	}
+
+	return FailureTemporary
+}
+
+// retryDelay decides whether a failed send is worth retrying and how long to
+// wait first. Telegram's RetryAfter is always honored; other client errors
+// are permanent, while server and network errors back off exponentially.
+func retryDelay(err error, attempts int) (time.Duration, bool) {
+	switch ClassifyError(err) {
+	case FailureTooManyRequests:
+		var apiErr *tgbotapi.Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			return time.Duration(apiErr.RetryAfter) * time.Second, true
+		}
+	case FailureTemporary:
+	default:
+		return 0, false
+	}
+
+	if attempts >= config.MaxSendAttempts {
+		return 0, false
+	}
+
+	delay := config.RetryBaseDelay << uint(attempts-1)
+	if delay > config.RetryMaxDelay {
+		delay = config.RetryMaxDelay
+	}
+
+	return delay, true
+}
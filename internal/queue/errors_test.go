@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+)
+
+func apiError(code int, message string, retryAfter int) error {
+	return &tgbotapi.Error{
+		Code:               code,
+		Message:            message,
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: retryAfter},
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want FailureKind
+	}{
+		{"network", errors.New("connection reset by peer"), FailureTemporary},
+		{"server", apiError(502, "Bad Gateway", 0), FailureTemporary},
+		{"too many requests", apiError(429, "Too Many Requests: retry after 5", 5), FailureTooManyRequests},
+		{"retry after without 429", apiError(400, "Flood control exceeded", 3), FailureTooManyRequests},
+		{"blocked", apiError(403, "Forbidden: bot was blocked by the user", 0), FailureBlocked},
+		{"never started", apiError(403, "Forbidden: bot can't initiate conversation with a user", 0), FailureBlocked},
+		{"deactivated", apiError(403, "Forbidden: user is deactivated", 0), FailureDeactivated},
+		{"chat not found", apiError(400, "Bad Request: chat not found", 0), FailureChatNotFound},
+		{"bad request", apiError(400, "Bad Request: message text is empty", 0), FailureBadRequest},
+		{"wrapped", fmt.Errorf("sending: %w", apiError(403, "Forbidden: bot was blocked by the user", 0)), FailureBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	temporary := apiError(500, "Internal Server Error", 0)
+
+	tests := []struct {
+		name      string
+		err       error
+		attempts  int
+		wantDelay time.Duration
+		wantRetry bool
+	}{
+		{"first failure", temporary, 1, config.RetryBaseDelay, true},
+		{"second failure", temporary, 2, 2 * config.RetryBaseDelay, true},
+		{"third failure", temporary, 3, 4 * config.RetryBaseDelay, true},
+		{"out of attempts", temporary, config.MaxSendAttempts, 0, false},
+		{"retry after", apiError(429, "Too Many Requests", 7), 1, 7 * time.Second, true},
+		{"retry after past max attempts", apiError(429, "Too Many Requests", 7), config.MaxSendAttempts, 7 * time.Second, true},
+		{"429 without retry after", apiError(429, "Too Many Requests", 0), 1, config.RetryBaseDelay, true},
+		{"bad request", apiError(400, "Bad Request: message text is empty", 0), 1, 0, false},
+		{"blocked", apiError(403, "Forbidden: bot was blocked by the user", 0), 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retry := retryDelay(tt.err, tt.attempts)
+			if delay != tt.wantDelay || retry != tt.wantRetry {
+				t.Errorf("retryDelay(%v, %d) = %v, %v, want %v, %v", tt.err, tt.attempts, delay, retry, tt.wantDelay, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRetryDelayIsCapped(t *testing.T) {
+	temporary := errors.New("connection reset by peer")
+
+	var last time.Duration
+	for attempts := 1; attempts < config.MaxSendAttempts; attempts++ {
+		delay, retry := retryDelay(temporary, attempts)
+		if !retry {
+			t.Fatalf("attempt %d not retried", attempts)
+		}
+		if delay > config.RetryMaxDelay {
+			t.Errorf("attempt %d waits %v, more than RetryMaxDelay", attempts, delay)
+		}
+		if delay < last {
+			t.Errorf("attempt %d waits %v, less than the attempt before", attempts, delay)
+		}
+		last = delay
+	}
+}
@@ -1,140 +1,605 @@
 package queue
 
 import (
+	"encoding/json"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
 )
 
-// MessageQueue manages the queue of messages to be sent
+// MessageQueue manages the queue of messages to be sent. Every message is
+// written to the database outbox before it is scheduled, so messages that
+// were not delivered before a restart are sent once the queue starts again.
 type MessageQueue struct {
-	bot     *tgbotapi.BotAPI
-	queue   []models.QueuedMessage
-	mutex   sync.Mutex
-	running bool
-	done    chan struct{}
+	bot       *tgbotapi.BotAPI
+	db        store.Store
+	pending   *scheduler
+	scheduled map[int64]bool // outbox IDs currently held by the scheduler
+	mutex     sync.Mutex
+	running   bool
+	drain     chan time.Time
+	stopped   chan struct{}
+
+	// onUnreachable is told about recipients that can no longer receive messages
+	onUnreachable func(chatID int64, kind FailureKind)
 }
 
 // NewMessageQueue creates a new message queue
-func NewMessageQueue(bot *tgbotapi.BotAPI) *MessageQueue {
+func NewMessageQueue(bot *tgbotapi.BotAPI, db store.Store) *MessageQueue {
 	return &MessageQueue{
-		bot:     bot,
-		queue:   make([]models.QueuedMessage, 0),
-		running: false,
-		done:    make(chan struct{}),
+		bot:       bot,
+		db:        db,
+		pending:   newScheduler(),
+		scheduled: make(map[int64]bool),
+		running:   false,
+		drain:     make(chan time.Time),
+		stopped:   make(chan struct{}),
 	}
 }
 
-// Start begins processing the message queue
+// SetUnreachableHandler registers a function that is called when a recipient
+// turns out to be permanently unreachable, e.g. because they blocked the bot
+func (mq *MessageQueue) SetUnreachableHandler(handler func(chatID int64, kind FailureKind)) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	mq.onUnreachable = handler
+}
+
+// Start replays undelivered messages from the outbox and begins processing the queue
 func (mq *MessageQueue) Start() {
 	mq.mutex.Lock()
 	if mq.running {
 		mq.mutex.Unlock()
 		return
 	}
+
 	mq.running = true
+
+	entries, err := mq.db.GetPendingOutbox()
+	if err != nil {
+		log.Printf("Error loading outbox: %v", err)
+	}
+	for _, entry := range entries {
+		mq.schedule(pendingMessage{
+			message:  entry.Message,
+			attempts: entry.Attempts,
+			outboxID: entry.ID,
+		})
+	}
+	if len(entries) > 0 {
+		log.Printf("Replaying %d undelivered messages from the outbox", len(entries))
+	}
 	mq.mutex.Unlock()
 
 	go mq.processQueue()
 }
 
-// Stop stops processing the message queue
+// Stop stops processing the message queue right away. Undelivered messages
+// stay in the outbox.
 func (mq *MessageQueue) Stop() {
-	mq.mutex.Lock()
-	defer mq.mutex.Unlock()
+	mq.Drain(0)
+}
 
+// Drain keeps sending until the queue is empty or the timeout has passed, then
+// stops processing. Whatever is left stays in the outbox for the next start.
+func (mq *MessageQueue) Drain(timeout time.Duration) {
+	mq.mutex.Lock()
 	if !mq.running {
+		mq.mutex.Unlock()
 		return
 	}
-
 	mq.running = false
-	mq.done <- struct{}{}
+	mq.mutex.Unlock()
+
+	mq.drain <- time.Now().Add(timeout)
+	<-mq.stopped
 }
 
 // QueueTextMessage adds a text message to the queue
 func (mq *MessageQueue) QueueTextMessage(chatID int64, text string) {
+	mq.QueueMessage(models.QueuedMessage{
+		ChatID: chatID,
+		Type:   models.TextMessage,
+		Text:   text,
+	})
+}
+
+// QueuePhotoMessage adds a photo message to the queue
+func (mq *MessageQueue) QueuePhotoMessage(chatID int64, photoFileID string, caption string) {
+	mq.QueueMessage(models.QueuedMessage{
+		ChatID:  chatID,
+		Type:    models.PhotoMessage,
+		FileID:  photoFileID,
+		Caption: caption,
+	})
+}
+
+// QueueDelete adds the deletion of a relayed message to the queue
+func (mq *MessageQueue) QueueDelete(chatID int64, messageID int) {
+	mq.QueueMessage(models.QueuedMessage{
+		ChatID:          chatID,
+		DeleteMessageID: messageID,
+		Priority:        models.PriorityRelay,
+	})
+}
+
+// QueueBroadcast adds an announcement to many users to the lowest priority lane
+func (mq *MessageQueue) QueueBroadcast(chatIDs []int64, text string) {
+	for _, chatID := range chatIDs {
+		mq.QueueMessage(models.QueuedMessage{
+			ChatID:   chatID,
+			Type:     models.TextMessage,
+			Text:     text,
+			Priority: models.PriorityBroadcast,
+		})
+	}
+}
+
+// QueueMessage adds a message of any type to the queue
+func (mq *MessageQueue) QueueMessage(message models.QueuedMessage) {
+	outboxID, err := mq.db.InsertOutbox(message)
+	if err != nil {
+		// Still try to deliver it, it just won't survive a restart
+		log.Printf("Error saving message to outbox: %v", err)
+	}
+
 	mq.mutex.Lock()
 	defer mq.mutex.Unlock()
 
-	message := models.QueuedMessage{
+	mq.schedule(pendingMessage{message: message, outboxID: outboxID})
+}
+
+// QueueTextMessageTx adds a text message to the queue as part of a transaction
+func (mq *MessageQueue) QueueTextMessageTx(tx store.Tx, chatID int64, text string) error {
+	return mq.QueueMessageTx(tx, models.QueuedMessage{
 		ChatID: chatID,
 		Type:   models.TextMessage,
 		Text:   text,
+	})
+}
+
+// QueueMessageTx writes a message to the outbox as part of a transaction, so it
+// is stored together with the state change it reports. The message is
+// scheduled once the transaction commits.
+func (mq *MessageQueue) QueueMessageTx(tx store.Tx, message models.QueuedMessage) error {
+	outboxID, err := tx.InsertOutbox(message)
+	if err != nil {
+		return err
 	}
 
-	mq.queue = append(mq.queue, message)
+	tx.AfterCommit(func() {
+		mq.mutex.Lock()
+		defer mq.mutex.Unlock()
+
+		mq.schedule(pendingMessage{message: message, outboxID: outboxID})
+	})
+
+	return nil
 }
 
-// QueuePhotoMessage adds a photo message to the queue
-func (mq *MessageQueue) QueuePhotoMessage(chatID int64, photoFileID string, caption string) {
+// schedule hands a message to the scheduler unless it is already there.
+// Messages queued while the queue isn't running are left in the outbox for
+// the next replay. The caller must hold the mutex.
+func (mq *MessageQueue) schedule(item pendingMessage) {
+	if item.outboxID != 0 {
+		if !mq.running {
+			return
+		}
+		if mq.scheduled[item.outboxID] {
+			return
+		}
+		mq.scheduled[item.outboxID] = true
+	}
+
+	mq.pending.push(item)
+}
+
+// Len returns the number of messages waiting to be sent
+func (mq *MessageQueue) Len() int {
 	mq.mutex.Lock()
 	defer mq.mutex.Unlock()
 
-	message := models.QueuedMessage{
-		ChatID:      chatID,
-		Type:        models.PhotoMessage,
-		PhotoFileID: photoFileID,
-		Caption:     caption,
-	}
-
-	mq.queue = append(mq.queue, message)
+	return mq.pending.len()
 }
 
-// processQueue processes messages from the queue
+// processQueue sends messages within the global rate limit, one per tick
 func (mq *MessageQueue) processQueue() {
+	defer close(mq.stopped)
+
 	rateLimiter := time.NewTicker(time.Second / config.MessageRateLimit)
 	defer rateLimiter.Stop()
 
+	pruneTicker := time.NewTicker(time.Minute)
+	defer pruneTicker.Stop()
+
+	var drainDeadline time.Time
+	draining := false
+
 	for {
 		select {
-		case <-mq.done:
-			return
+		case deadline := <-mq.drain:
+			draining = true
+			drainDeadline = deadline
+		case now := <-pruneTicker.C:
+			mq.mutex.Lock()
+			mq.pending.prune(now)
+			mq.mutex.Unlock()
+
+			if err := mq.db.PurgeOutbox(now.Add(-config.OutboxRetention)); err != nil {
+				log.Printf("Error purging outbox: %v", err)
+			}
 		case <-rateLimiter.C:
-			// Process one message
-			msg, ok := mq.dequeue()
-			if !ok {
-				continue // Queue is empty
+		}
+
+		if draining && (mq.Len() == 0 || !time.Now().Before(drainDeadline)) {
+			if remaining := mq.Len(); remaining > 0 {
+				log.Printf("Stopping message queue with %d messages left in the outbox", remaining)
 			}
+			return
+		}
+
+		// Process one message
+		item, ok := mq.dequeue()
+		if !ok {
+			continue // Nothing can be sent right now
+		}
 
-			mq.sendMessage(msg)
+		if err := mq.sendMessage(item.message); err != nil {
+			mq.handleSendError(item, err)
+			continue
 		}
+
+		mq.complete(item)
 	}
 }
 
-// dequeue removes and returns the first message in the queue
-func (mq *MessageQueue) dequeue() (models.QueuedMessage, bool) {
+// dequeue removes and returns the next message that may be sent now
+func (mq *MessageQueue) dequeue() (pendingMessage, bool) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	return mq.pending.next(time.Now())
+}
+
+// complete marks a delivered message as sent in the outbox
+func (mq *MessageQueue) complete(item pendingMessage) {
+	mq.forget(item)
+
+	if item.outboxID == 0 {
+		return
+	}
+
+	if err := mq.db.MarkOutboxSent(item.outboxID); err != nil {
+		log.Printf("Error marking outbox message as sent: %v", err)
+	}
+}
+
+// forget releases a message that has left the scheduler for good
+func (mq *MessageQueue) forget(item pendingMessage) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	delete(mq.scheduled, item.outboxID)
+}
+
+// handleSendError puts a message that failed for a temporary reason back in
+// the queue, or drops it if it can't be delivered
+func (mq *MessageQueue) handleSendError(item pendingMessage, err error) {
+	item.attempts++
+	kind := ClassifyError(err)
+
+	// Nothing else queued for this recipient can be delivered either
+	if kind.IsRecipientUnreachable() {
+		log.Printf("Chat %d is unreachable (%v): %v", item.message.ChatID, kind, err)
+
+		mq.mutex.Lock()
+		dropped := mq.pending.removeChat(item.message.ChatID)
+		handler := mq.onUnreachable
+		mq.mutex.Unlock()
+
+		mq.fail(item, err)
+		for _, d := range dropped {
+			mq.fail(d, err)
+		}
+
+		if handler != nil {
+			handler(item.message.ChatID, kind)
+		}
+		return
+	}
+
+	delay, retry := retryDelay(err, item.attempts)
+	if !retry {
+		log.Printf("Error sending message to %d (%v), giving up after %d attempts: %v", item.message.ChatID, kind, item.attempts, err)
+		mq.fail(item, err)
+		return
+	}
+
+	log.Printf("Error sending message to %d (%v), retrying in %v: %v", item.message.ChatID, kind, delay, err)
+
+	if item.outboxID != 0 {
+		if err := mq.db.UpdateOutboxAttempts(item.outboxID, item.attempts, err.Error()); err != nil {
+			log.Printf("Error updating outbox message: %v", err)
+		}
+	}
+
 	mq.mutex.Lock()
 	defer mq.mutex.Unlock()
 
-	if len(mq.queue) == 0 {
-		return models.QueuedMessage{}, false
+	now := time.Now()
+	mq.pending.pushFront(item, now.Add(delay))
+
+	if kind == FailureTooManyRequests && mq.pending.rateLimited(item.message.ChatID, now, now.Add(delay)) {
+		log.Printf("Several chats are rate limited, pausing all sending for %v", delay)
 	}
+}
 
-	msg := mq.queue[0]
-	mq.queue = mq.queue[1:]
-	return msg, true
+// fail marks a message that will not be retried as failed in the outbox
+func (mq *MessageQueue) fail(item pendingMessage, err error) {
+	mq.forget(item)
+
+	if item.outboxID == 0 {
+		return
+	}
+
+	if err := mq.db.MarkOutboxFailed(item.outboxID, item.attempts, err.Error()); err != nil {
+		log.Printf("Error marking outbox message as failed: %v", err)
+	}
 }
 
 // sendMessage sends a message based on its type
-func (mq *MessageQueue) sendMessage(msg models.QueuedMessage) {
-	var err error
+func (mq *MessageQueue) sendMessage(msg models.QueuedMessage) error {
+	// Deletions answer with a plain boolean rather than a message
+	if msg.DeleteMessageID != 0 {
+		_, err := mq.bot.Request(tgbotapi.NewDeleteMessage(msg.ChatID, msg.DeleteMessageID))
+		return err
+	}
+
+	// Albums return several messages and need their own API call
+	if msg.Type == models.MediaGroupMessage {
+		params, err := buildMediaGroup(msg)
+		if err != nil {
+			return err
+		}
+
+		resp, err := mq.bot.MakeRequest("sendMediaGroup", params)
+		if err != nil {
+			return err
+		}
+
+		var sent []tgbotapi.Message
+		if err := json.Unmarshal(resp.Result, &sent); err != nil {
+			return err
+		}
+
+		for i, item := range msg.Media {
+			if i < len(sent) {
+				mq.recordRelayed(msg.SourceChatID, item.SourceMessageID, msg.ChatID, sent[i].MessageID, msg.MediaGroupID)
+			}
+		}
+		return nil
+	}
+
+	chattable, ok := buildChattable(msg)
+	if !ok {
+		log.Printf("Unsupported message type: %v", msg.Type)
+		return nil
+	}
+
+	sent, err := mq.bot.Send(chattable)
+	if err != nil {
+		// Re-applying an edit that changed nothing visible is not a failure
+		if msg.EditMessageID != 0 && strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		return err
+	}
+
+	// Edits keep the mapping of the message they change
+	if msg.EditMessageID == 0 {
+		mq.recordRelayed(msg.SourceChatID, msg.SourceMessageID, msg.ChatID, sent.MessageID, "")
+	}
+
+	return nil
+}
+
+// recordRelayed stores the mapping between an original message and its delivered
+// copy, along with the sender's media group if it was part of an album
+func (mq *MessageQueue) recordRelayed(senderChatID int64, originalMessageID int, recipientChatID int64, deliveredMessageID int, mediaGroupID string) {
+	// System messages have no original
+	if originalMessageID == 0 {
+		return
+	}
+
+	err := mq.db.SaveRelayedMessage(&models.RelayedMessage{
+		SenderChatID:       senderChatID,
+		OriginalMessageID:  originalMessageID,
+		RecipientChatID:    recipientChatID,
+		DeliveredMessageID: deliveredMessageID,
+		CreatedAt:          time.Now(),
+		MediaGroupID:       mediaGroupID,
+	})
+	if err != nil {
+		log.Printf("Error saving relayed message: %v", err)
+	}
+}
+
+// replyTo makes an outgoing message a reply when the original was one
+func replyTo(base *tgbotapi.BaseChat, msg models.QueuedMessage) {
+	if msg.ReplyToMessageID != 0 {
+		base.ReplyToMessageID = msg.ReplyToMessageID
+		base.AllowSendingWithoutReply = true
+	}
+}
+
+// buildKeyboard turns buttons into an inline keyboard with one button per row
+func buildKeyboard(buttons []models.Button) tgbotapi.InlineKeyboardMarkup {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(buttons))
+	for _, button := range buttons {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(button.Text, button.Data),
+		))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// buildChattable converts a queued message into the matching Telegram send config.
+// Media is re-sent by file ID, so nothing is downloaded or uploaded again.
+func buildChattable(msg models.QueuedMessage) (tgbotapi.Chattable, bool) {
+	if msg.EditMessageID != 0 {
+		return buildEdit(msg)
+	}
+
+	file := tgbotapi.FileID(msg.FileID)
 
 	switch msg.Type {
 	case models.TextMessage:
-		_, err = mq.bot.Send(tgbotapi.NewMessage(msg.ChatID, msg.Text))
+		textMsg := tgbotapi.NewMessage(msg.ChatID, msg.Text)
+		replyTo(&textMsg.BaseChat, msg)
+		if len(msg.Buttons) > 0 {
+			textMsg.ReplyMarkup = buildKeyboard(msg.Buttons)
+		}
+		return textMsg, true
 	case models.PhotoMessage:
-		photoMsg := tgbotapi.NewPhoto(msg.ChatID, tgbotapi.FileID(msg.PhotoFileID))
-		if msg.Caption != "" {
-			photoMsg.Caption = msg.Caption
+		photoMsg := tgbotapi.NewPhoto(msg.ChatID, file)
+		photoMsg.Caption = msg.Caption
+		replyTo(&photoMsg.BaseChat, msg)
+		return photoMsg, true
+	case models.StickerMessage:
+		stickerMsg := tgbotapi.NewSticker(msg.ChatID, file)
+		replyTo(&stickerMsg.BaseChat, msg)
+		return stickerMsg, true
+	case models.VoiceMessage:
+		voiceMsg := tgbotapi.NewVoice(msg.ChatID, file)
+		voiceMsg.Caption = msg.Caption
+		replyTo(&voiceMsg.BaseChat, msg)
+		return voiceMsg, true
+	case models.VideoMessage:
+		videoMsg := tgbotapi.NewVideo(msg.ChatID, file)
+		videoMsg.Caption = msg.Caption
+		replyTo(&videoMsg.BaseChat, msg)
+		return videoMsg, true
+	case models.VideoNoteMessage:
+		videoNoteMsg := tgbotapi.NewVideoNote(msg.ChatID, 0, file)
+		replyTo(&videoNoteMsg.BaseChat, msg)
+		return videoNoteMsg, true
+	case models.AnimationMessage:
+		animationMsg := tgbotapi.NewAnimation(msg.ChatID, file)
+		animationMsg.Caption = msg.Caption
+		replyTo(&animationMsg.BaseChat, msg)
+		return animationMsg, true
+	case models.DocumentMessage:
+		documentMsg := tgbotapi.NewDocument(msg.ChatID, file)
+		documentMsg.Caption = msg.Caption
+		replyTo(&documentMsg.BaseChat, msg)
+		return documentMsg, true
+	case models.AudioMessage:
+		audioMsg := tgbotapi.NewAudio(msg.ChatID, file)
+		audioMsg.Caption = msg.Caption
+		replyTo(&audioMsg.BaseChat, msg)
+		return audioMsg, true
+	case models.LocationMessage:
+		locationMsg := tgbotapi.NewLocation(msg.ChatID, msg.Latitude, msg.Longitude)
+		replyTo(&locationMsg.BaseChat, msg)
+		return locationMsg, true
+	case models.ContactMessage:
+		contactMsg := tgbotapi.NewContact(msg.ChatID, msg.PhoneNumber, msg.FirstName)
+		contactMsg.LastName = msg.LastName
+		replyTo(&contactMsg.BaseChat, msg)
+		return contactMsg, true
+	}
+
+	return nil, false
+}
+
+// buildEdit converts a queued edit into the matching Telegram edit config.
+// Media that Telegram can replace is re-sent together with its caption, so
+// both changed files and changed captions are carried over.
+func buildEdit(msg models.QueuedMessage) (tgbotapi.Chattable, bool) {
+	switch msg.Type {
+	case models.TextMessage:
+		return tgbotapi.NewEditMessageText(msg.ChatID, msg.EditMessageID, msg.Text), true
+	case models.VoiceMessage:
+		return tgbotapi.NewEditMessageCaption(msg.ChatID, msg.EditMessageID, msg.Caption), true
+	}
+
+	media, ok := buildInputMedia(models.MediaItem{
+		Type:    msg.Type,
+		FileID:  msg.FileID,
+		Caption: msg.Caption,
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return tgbotapi.EditMessageMediaConfig{
+		BaseEdit: tgbotapi.BaseEdit{
+			ChatID:    msg.ChatID,
+			MessageID: msg.EditMessageID,
+		},
+		Media: media,
+	}, true
+}
+
+// buildMediaGroup converts a queued album into the parameters of a
+// sendMediaGroup request. tgbotapi's MediaGroupConfig can't allow sending
+// without the reply, so the request is built here; album media are always
+// file IDs, so nothing has to be uploaded.
+func buildMediaGroup(msg models.QueuedMessage) (tgbotapi.Params, error) {
+	files := make([]interface{}, 0, len(msg.Media))
+
+	for _, item := range msg.Media {
+		if media, ok := buildInputMedia(item); ok {
+			files = append(files, media)
 		}
-		_, err = mq.bot.Send(photoMsg)
 	}
 
-	if err != nil {
-		log.Printf("Error sending message: %v", err)
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", msg.ChatID)
+	if msg.ReplyToMessageID != 0 {
+		// Like single messages, still deliver the album if the original is gone
+		params.AddNonZero("reply_to_message_id", msg.ReplyToMessageID)
+		params.AddBool("allow_sending_without_reply", true)
+	}
+
+	err := params.AddInterface("media", files)
+	return params, err
+}
+
+// buildInputMedia converts a media item into the matching Telegram input media
+func buildInputMedia(item models.MediaItem) (interface{}, bool) {
+	file := tgbotapi.FileID(item.FileID)
+
+	switch item.Type {
+	case models.PhotoMessage:
+		media := tgbotapi.NewInputMediaPhoto(file)
+		media.Caption = item.Caption
+		return media, true
+	case models.VideoMessage:
+		media := tgbotapi.NewInputMediaVideo(file)
+		media.Caption = item.Caption
+		return media, true
+	case models.AnimationMessage:
+		media := tgbotapi.NewInputMediaAnimation(file)
+		media.Caption = item.Caption
+		return media, true
+	case models.DocumentMessage:
+		media := tgbotapi.NewInputMediaDocument(file)
+		media.Caption = item.Caption
+		return media, true
+	case models.AudioMessage:
+		media := tgbotapi.NewInputMediaAudio(file)
+		media.Caption = item.Caption
+		return media, true
 	}
+
+	return nil, false
 }
@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/memstore"
+)
+
+func TestBuildMediaGroup(t *testing.T) {
+	msg := models.QueuedMessage{
+		ChatID:           42,
+		Type:             models.MediaGroupMessage,
+		ReplyToMessageID: 7,
+		Media: []models.MediaItem{
+			{Type: models.PhotoMessage, FileID: "photo", Caption: "look"},
+			{Type: models.VideoMessage, FileID: "video"},
+		},
+	}
+
+	params, err := buildMediaGroup(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params["chat_id"] != "42" || params["reply_to_message_id"] != "7" {
+		t.Errorf("got chat %q replying to %q, want 42 and 7", params["chat_id"], params["reply_to_message_id"])
+	}
+	if params["allow_sending_without_reply"] != "true" {
+		t.Error("an album reply fails when the original was deleted")
+	}
+
+	var media []struct {
+		Type    string `json:"type"`
+		Media   string `json:"media"`
+		Caption string `json:"caption"`
+	}
+	if err := json.Unmarshal([]byte(params["media"]), &media); err != nil {
+		t.Fatalf("media is not a JSON list: %v", err)
+	}
+	if len(media) != 2 || media[0].Type != "photo" || media[0].Media != "photo" ||
+		media[0].Caption != "look" || media[1].Type != "video" {
+		t.Errorf("got media %+v", media)
+	}
+
+	msg.ReplyToMessageID = 0
+	params, err = buildMediaGroup(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["allow_sending_without_reply"]; ok {
+		t.Error("allow_sending_without_reply set on an album that isn't a reply")
+	}
+}
+
+func TestRepliesPointAtThePartnersCopy(t *testing.T) {
+	types := []models.MessageType{
+		models.TextMessage, models.PhotoMessage, models.StickerMessage, models.VoiceMessage,
+		models.VideoMessage, models.VideoNoteMessage, models.AnimationMessage, models.DocumentMessage,
+		models.AudioMessage, models.LocationMessage, models.ContactMessage,
+	}
+
+	for _, msgType := range types {
+		t.Run(msgType.String(), func(t *testing.T) {
+			msg := models.QueuedMessage{ChatID: 42, Type: msgType, FileID: "file", Text: "hi", ReplyToMessageID: 7}
+
+			chattable, ok := buildChattable(msg)
+			if !ok {
+				t.Fatal("message not built")
+			}
+			base := reflect.ValueOf(chattable).FieldByName("BaseChat").Interface().(tgbotapi.BaseChat)
+			if base.ReplyToMessageID != 7 || !base.AllowSendingWithoutReply {
+				t.Errorf("replies to %d, without reply allowed %v, want 7 and true", base.ReplyToMessageID, base.AllowSendingWithoutReply)
+			}
+
+			msg.ReplyToMessageID = 0
+			chattable, _ = buildChattable(msg)
+			base = reflect.ValueOf(chattable).FieldByName("BaseChat").Interface().(tgbotapi.BaseChat)
+			if base.ReplyToMessageID != 0 {
+				t.Errorf("a message that isn't a reply replies to %d", base.ReplyToMessageID)
+			}
+		})
+	}
+}
+
+func TestRecordRelayed(t *testing.T) {
+	db := memstore.New()
+	mq := NewMessageQueue(nil, db)
+
+	mq.recordRelayed(1, 10, 2, 100, "")
+	mq.recordRelayed(2, 50, 1, 11, "")
+
+	// Notices from the bot have no original to map
+	mq.recordRelayed(0, 0, 2, 101, "")
+
+	counterparts := []struct {
+		chatID    int64
+		messageID int
+		partnerID int64
+		want      int
+	}{
+		{1, 10, 2, 100},
+		{2, 100, 1, 10},
+		{2, 50, 1, 11},
+		{1, 11, 2, 50},
+		{2, 101, 1, 0},
+	}
+	for _, c := range counterparts {
+		got, err := db.FindCounterpart(c.chatID, c.messageID, c.partnerID)
+		if err != nil {
+			t.Fatalf("FindCounterpart: %v", err)
+		}
+		if got != c.want {
+			t.Errorf("FindCounterpart(%d, %d, %d) = %d, want %d", c.chatID, c.messageID, c.partnerID, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// pendingMessage is a queued message together with its delivery attempts
+type pendingMessage struct {
+	message  models.QueuedMessage
+	attempts int
+	outboxID int64
+}
+
+// laneCount is the number of priority lanes
+const laneCount = int(models.PriorityBroadcast) + 1
+
+// chatQueue holds the pending messages for one recipient, one FIFO per lane.
+// All lanes share the recipient's send limit.
+type chatQueue struct {
+	messages [laneCount][]pendingMessage
+	nextSend time.Time
+}
+
+// empty reports whether nothing is pending for the recipient in any lane
+func (cq *chatQueue) empty() bool {
+	for _, messages := range cq.messages {
+		if len(messages) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// lane is the round-robin of recipients waiting in one priority class
+type lane struct {
+	order   []int64 // recipients with pending messages, next to be served first
+	size    int
+	skipped int // messages sent from higher lanes while this one was waiting
+}
+
+// scheduler serves higher priority lanes first, but lets a waiting lower lane
+// through after PriorityStarvationLimit messages so it is never starved.
+// Within a lane it keeps one FIFO per recipient and serves recipients
+// round-robin, so a chatty pair can't starve everyone else. A recipient is
+// never sent to more often than Telegram's per-chat limit allows.
+type scheduler struct {
+	chats map[int64]*chatQueue
+	lanes [laneCount]lane
+	size  int
+
+	limited     map[int64]time.Time // recipients recently rate limited, by when
+	pausedUntil time.Time           // nothing is sent before this after a global limit
+}
+
+// newScheduler creates an empty scheduler
+func newScheduler() *scheduler {
+	return &scheduler{
+		chats:   make(map[int64]*chatQueue),
+		limited: make(map[int64]time.Time),
+	}
+}
+
+// laneOf returns the lane a message is sent in
+func laneOf(item pendingMessage) int {
+	p := int(item.message.Priority)
+	if p < 0 || p >= laneCount {
+		return laneCount - 1
+	}
+	return p
+}
+
+// push adds a message to the back of its recipient's queue
+func (s *scheduler) push(item pendingMessage) {
+	l := laneOf(item)
+	cq := s.chat(item.message.ChatID, l)
+	cq.messages[l] = append(cq.messages[l], item)
+	s.lanes[l].size++
+	s.size++
+}
+
+// pushFront puts a message back at the head of its recipient's queue and holds
+// the recipient until notBefore
+func (s *scheduler) pushFront(item pendingMessage, notBefore time.Time) {
+	l := laneOf(item)
+	cq := s.chat(item.message.ChatID, l)
+	cq.messages[l] = append([]pendingMessage{item}, cq.messages[l]...)
+	if notBefore.After(cq.nextSend) {
+		cq.nextSend = notBefore
+	}
+	s.lanes[l].size++
+	s.size++
+}
+
+// rateLimited records that Telegram asked to hold off sending to a recipient
+// until the given time. Only that recipient is held back, unless several
+// recipients are limited at once: then the bot's global limit was hit and
+// everyone waits. It reports whether sending was paused for everyone.
+func (s *scheduler) rateLimited(chatID int64, now, until time.Time) bool {
+	s.limited[chatID] = now
+	for id, at := range s.limited {
+		if now.Sub(at) > config.GlobalLimitWindow {
+			delete(s.limited, id)
+		}
+	}
+
+	if len(s.limited) < config.GlobalLimitChats {
+		return false
+	}
+
+	if until.After(s.pausedUntil) {
+		s.pausedUntil = until
+	}
+	return true
+}
+
+// chat returns the queue for a recipient, scheduling it in the lane if it was
+// idle there
+func (s *scheduler) chat(chatID int64, l int) *chatQueue {
+	cq, ok := s.chats[chatID]
+	if !ok {
+		cq = &chatQueue{}
+		s.chats[chatID] = cq
+	}
+
+	if len(cq.messages[l]) == 0 {
+		s.lanes[l].order = append(s.lanes[l].order, chatID)
+	}
+
+	return cq
+}
+
+// next removes and returns the next message that may be sent at now
+func (s *scheduler) next(now time.Time) (pendingMessage, bool) {
+	if now.Before(s.pausedUntil) {
+		return pendingMessage{}, false
+	}
+
+	// A lower lane that has waited long enough goes first
+	for l := laneCount - 1; l > 0; l-- {
+		if s.lanes[l].skipped < config.PriorityStarvationLimit {
+			continue
+		}
+		if item, ok := s.nextInLane(l, now); ok {
+			s.lanes[l].skipped = 0
+			return item, true
+		}
+	}
+
+	for l := 0; l < laneCount; l++ {
+		item, ok := s.nextInLane(l, now)
+		if !ok {
+			continue
+		}
+
+		s.lanes[l].skipped = 0
+		for lower := l + 1; lower < laneCount; lower++ {
+			if s.lanes[lower].size > 0 {
+				s.lanes[lower].skipped++
+			}
+		}
+
+		return item, true
+	}
+
+	return pendingMessage{}, false
+}
+
+// nextInLane removes and returns the next message in a lane that may be sent at now
+func (s *scheduler) nextInLane(l int, now time.Time) (pendingMessage, bool) {
+	ln := &s.lanes[l]
+
+	for i, chatID := range ln.order {
+		cq := s.chats[chatID]
+		if now.Before(cq.nextSend) {
+			continue
+		}
+
+		item := cq.messages[l][0]
+		cq.messages[l] = cq.messages[l][1:]
+		cq.nextSend = now.Add(config.PerChatInterval * time.Duration(messageCount(item.message)))
+		ln.size--
+		s.size--
+
+		// Move the recipient to the back of the line
+		ln.order = append(ln.order[:i], ln.order[i+1:]...)
+		if len(cq.messages[l]) > 0 {
+			ln.order = append(ln.order, chatID)
+		}
+
+		return item, true
+	}
+
+	return pendingMessage{}, false
+}
+
+// removeChat drops and returns every pending message for a recipient
+func (s *scheduler) removeChat(chatID int64) []pendingMessage {
+	cq, ok := s.chats[chatID]
+	if !ok {
+		return nil
+	}
+
+	var removed []pendingMessage
+	for l := range cq.messages {
+		if len(cq.messages[l]) == 0 {
+			continue
+		}
+
+		removed = append(removed, cq.messages[l]...)
+		s.lanes[l].size -= len(cq.messages[l])
+		s.size -= len(cq.messages[l])
+		cq.messages[l] = nil
+
+		ln := &s.lanes[l]
+		for i, id := range ln.order {
+			if id == chatID {
+				ln.order = append(ln.order[:i], ln.order[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return removed
+}
+
+// len returns the number of pending messages
+func (s *scheduler) len() int {
+	return s.size
+}
+
+// prune forgets recipients that have nothing pending and are no longer throttled
+func (s *scheduler) prune(now time.Time) {
+	for chatID, cq := range s.chats {
+		if cq.empty() && !now.Before(cq.nextSend) {
+			delete(s.chats, chatID)
+		}
+	}
+}
+
+// messageCount is the number of Telegram messages a queued message turns into
+func messageCount(msg models.QueuedMessage) int {
+	if msg.Type == models.MediaGroupMessage && len(msg.Media) > 1 {
+		return len(msg.Media)
+	}
+	return 1
+}
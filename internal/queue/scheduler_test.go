@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+func message(chatID int64, priority models.MessagePriority) pendingMessage {
+	return pendingMessage{message: models.QueuedMessage{
+		ChatID:   chatID,
+		Type:     models.TextMessage,
+		Text:     "hi",
+		Priority: priority,
+	}}
+}
+
+func TestRateLimitHoldsOnlyThatChat(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.push(message(2, models.PriorityRelay))
+	until := now.Add(30 * time.Second)
+	s.pushFront(message(1, models.PriorityRelay), until)
+	if s.rateLimited(1, now, until) {
+		t.Fatal("one rate limited chat paused everyone")
+	}
+
+	item, ok := s.next(now)
+	if !ok || item.message.ChatID != 2 {
+		t.Fatalf("got chat %d (%v), want chat 2", item.message.ChatID, ok)
+	}
+	if _, ok := s.next(now.Add(10 * time.Second)); ok {
+		t.Fatal("rate limited chat was sent to before RetryAfter")
+	}
+	if item, ok := s.next(until); !ok || item.message.ChatID != 1 {
+		t.Fatalf("got chat %d (%v), want chat 1 after RetryAfter", item.message.ChatID, ok)
+	}
+}
+
+func TestGlobalRateLimitPausesEveryone(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	until := now.Add(5 * time.Second)
+
+	s.push(message(100, models.PriorityRelay))
+
+	paused := false
+	for chatID := int64(1); chatID <= config.GlobalLimitChats; chatID++ {
+		s.pushFront(message(chatID, models.PriorityRelay), until)
+		paused = s.rateLimited(chatID, now, until)
+	}
+	if !paused {
+		t.Fatalf("%d chats rate limited at once didn't pause sending", config.GlobalLimitChats)
+	}
+
+	if item, ok := s.next(now.Add(time.Second)); ok {
+		t.Fatalf("sent to chat %d during a global pause", item.message.ChatID)
+	}
+	if _, ok := s.next(until); !ok {
+		t.Fatal("nothing sent after the global pause")
+	}
+}
+
+func TestRateLimitsFarApartDontPause(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	for i := 0; i < config.GlobalLimitChats; i++ {
+		at := now.Add(time.Duration(i) * (config.GlobalLimitWindow + time.Second))
+		if s.rateLimited(int64(i+1), at, at.Add(time.Second)) {
+			t.Fatalf("rate limit %d paused everyone though the others had expired", i+1)
+		}
+	}
+}
+
+func TestLowerLaneIsNotStarved(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	// Every control message goes to its own chat, so only the lanes decide
+	for chatID := int64(1); chatID <= 2*config.PriorityStarvationLimit; chatID++ {
+		s.push(message(chatID, models.PriorityControl))
+	}
+	s.push(message(100, models.PriorityBroadcast))
+
+	for i := 0; i < config.PriorityStarvationLimit; i++ {
+		item, ok := s.next(now)
+		if !ok || item.message.Priority != models.PriorityControl {
+			t.Fatalf("message %d: got priority %d (%v), want control", i, item.message.Priority, ok)
+		}
+	}
+
+	item, ok := s.next(now)
+	if !ok || item.message.ChatID != 100 {
+		t.Fatalf("after %d control messages got chat %d (%v), want the broadcast", config.PriorityStarvationLimit, item.message.ChatID, ok)
+	}
+
+	item, ok = s.next(now)
+	if !ok || item.message.Priority != models.PriorityControl {
+		t.Fatalf("after the broadcast got priority %d (%v), want control again", item.message.Priority, ok)
+	}
+}
+
+func TestHigherLaneGoesFirst(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.push(message(1, models.PriorityBroadcast))
+	s.push(message(2, models.PriorityRelay))
+	s.push(message(3, models.PriorityControl))
+
+	for _, want := range []int64{3, 2, 1} {
+		item, ok := s.next(now)
+		if !ok || item.message.ChatID != want {
+			t.Fatalf("got chat %d (%v), want %d", item.message.ChatID, ok, want)
+		}
+	}
+	if s.len() != 0 {
+		t.Errorf("%d messages left, want none", s.len())
+	}
+}
+
+func TestPerChatInterval(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.push(message(1, models.PriorityRelay))
+	s.push(message(1, models.PriorityControl))
+
+	if _, ok := s.next(now); !ok {
+		t.Fatal("first message held back")
+	}
+
+	// The recipient's limit is shared by all lanes
+	if _, ok := s.next(now.Add(config.PerChatInterval - time.Millisecond)); ok {
+		t.Fatal("second message sent before PerChatInterval")
+	}
+	if _, ok := s.next(now.Add(config.PerChatInterval)); !ok {
+		t.Fatal("second message held back after PerChatInterval")
+	}
+}
+
+func TestAlbumHoldsChatPerPart(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	album := message(1, models.PriorityRelay)
+	album.message.Type = models.MediaGroupMessage
+	album.message.Media = make([]models.MediaItem, 3)
+	s.push(album)
+	s.push(message(1, models.PriorityRelay))
+
+	if _, ok := s.next(now); !ok {
+		t.Fatal("album held back")
+	}
+	if _, ok := s.next(now.Add(2 * config.PerChatInterval)); ok {
+		t.Fatal("message sent before every album part's interval passed")
+	}
+	if _, ok := s.next(now.Add(3 * config.PerChatInterval)); !ok {
+		t.Fatal("message held back after the album's interval")
+	}
+}
+
+func TestChatsAreServedRoundRobin(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		s.push(message(1, models.PriorityRelay))
+	}
+	s.push(message(2, models.PriorityRelay))
+	s.push(message(3, models.PriorityRelay))
+
+	// A chatty recipient waits its turn behind the others
+	var got []int64
+	for i := 0; i < 5; i++ {
+		item, ok := s.next(now.Add(time.Duration(i) * config.PerChatInterval))
+		if !ok {
+			t.Fatalf("message %d held back", i)
+		}
+		got = append(got, item.message.ChatID)
+	}
+
+	want := []int64{1, 2, 3, 1, 1}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("served chats %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRetryKeepsItsPlace(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	first := message(1, models.PriorityRelay)
+	first.message.Text = "first"
+	s.push(first)
+	s.push(message(1, models.PriorityRelay))
+
+	item, _ := s.next(now)
+	item.attempts++
+	s.pushFront(item, now.Add(time.Minute))
+
+	if _, ok := s.next(now.Add(30 * time.Second)); ok {
+		t.Fatal("sent to the chat before its retry delay passed")
+	}
+	item, ok := s.next(now.Add(time.Minute))
+	if !ok || item.message.Text != "first" || item.attempts != 1 {
+		t.Fatalf("got %q after %d attempts (%v), want the retried message first", item.message.Text, item.attempts, ok)
+	}
+}
+
+func TestRemoveChat(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.push(message(1, models.PriorityRelay))
+	s.push(message(1, models.PriorityControl))
+	s.push(message(2, models.PriorityRelay))
+
+	if removed := s.removeChat(1); len(removed) != 2 {
+		t.Fatalf("removed %d messages, want 2", len(removed))
+	}
+	if s.len() != 1 {
+		t.Fatalf("%d messages left, want 1", s.len())
+	}
+	if item, ok := s.next(now); !ok || item.message.ChatID != 2 {
+		t.Fatalf("got chat %d (%v), want 2", item.message.ChatID, ok)
+	}
+	if _, ok := s.next(now.Add(time.Hour)); ok {
+		t.Fatal("a removed message was still sent")
+	}
+}
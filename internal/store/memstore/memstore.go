@@ -0,0 +1,1113 @@
+// Package memstore is an in-memory store for tests and single-process trial
+// runs. Nothing survives a restart.
+package memstore
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// Outbox statuses
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+// Store and Tx are the in-memory implementation of the store
+var (
+	_ store.Store = (*Store)(nil)
+	_ store.Tx    = (*Tx)(nil)
+)
+
+// relayKey identifies a delivered copy of a message
+type relayKey struct {
+	senderChatID      int64
+	originalMessageID int
+	recipientChatID   int64
+}
+
+// blockKey is a user blocked by another
+type blockKey struct {
+	blockerID int64
+	blockedID int64
+}
+
+// outboxEntry is a message in the outbox with its delivery status
+type outboxEntry struct {
+	entry     models.OutboxEntry
+	status    string
+	lastError string
+	updatedAt time.Time
+}
+
+// data is everything the store holds. Transactions work on a copy of it.
+type data struct {
+	users         map[int64]models.UserState
+	conversations map[int64]models.Conversation
+	relayed       map[relayKey]models.RelayedMessage
+	outbox        map[int64]*outboxEntry
+	sessions      map[int64]*models.ChatSession
+	blocks        map[blockKey]time.Time
+	reports       map[int64]*models.Report
+	bans          map[int64]models.Ban
+	adminActions  []models.AdminAction
+	nextOutboxID  int64
+	nextSessionID int64
+	nextReportID  int64
+}
+
+// Store keeps all state in memory behind a single lock
+type Store struct {
+	mu sync.Mutex
+	d  *data
+}
+
+// New creates an empty in-memory store
+func New() *Store {
+	return &Store{
+		d: &data{
+			users:         make(map[int64]models.UserState),
+			conversations: make(map[int64]models.Conversation),
+			relayed:       make(map[relayKey]models.RelayedMessage),
+			outbox:        make(map[int64]*outboxEntry),
+			sessions:      make(map[int64]*models.ChatSession),
+			blocks:        make(map[blockKey]time.Time),
+			reports:       make(map[int64]*models.Report),
+			bans:          make(map[int64]models.Ban),
+		},
+	}
+}
+
+// Close does nothing, as there is nothing to release
+func (s *Store) Close() error {
+	return nil
+}
+
+// Tx is a transaction on a copy of the store's data, swapped in on commit
+type Tx struct {
+	d           *data
+	afterCommit []func()
+}
+
+// RunInTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise. AfterCommit hooks run after a successful commit.
+func (s *Store) RunInTx(fn func(tx store.Tx) error) error {
+	s.mu.Lock()
+
+	tx := &Tx{d: s.d.clone()}
+	if err := fn(tx); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.d = tx.d
+	s.mu.Unlock()
+
+	for _, hook := range tx.afterCommit {
+		hook()
+	}
+
+	return nil
+}
+
+// AfterCommit registers a function to run once the transaction has committed
+func (tx *Tx) AfterCommit(hook func()) {
+	tx.afterCommit = append(tx.afterCommit, hook)
+}
+
+// GetUserState retrieves a user's state within the transaction
+func (tx *Tx) GetUserState(userID int64) (*models.UserState, error) {
+	return tx.d.getUserState(userID), nil
+}
+
+// SaveUserState stores a user's state within the transaction
+func (tx *Tx) SaveUserState(state *models.UserState) error {
+	tx.d.saveUserState(state)
+	return nil
+}
+
+// PairUsers puts two free users in a chat within the transaction
+func (tx *Tx) PairUsers(user1 int64, user2 int64) (bool, error) {
+	return tx.d.pairUsers(user1, user2), nil
+}
+
+// EndChat ends the user's current chat within the transaction
+func (tx *Tx) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	partnerID, ended := tx.d.endChat(userID, reason)
+	return partnerID, ended, nil
+}
+
+// GetCurrentChatSession returns the user's open chat session within the transaction
+func (tx *Tx) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	return tx.d.currentChatSession(userID), nil
+}
+
+// BlockUser keeps blockedID from being matched with blockerID within the transaction
+func (tx *Tx) BlockUser(blockerID int64, blockedID int64) error {
+	tx.d.blockUser(blockerID, blockedID)
+	return nil
+}
+
+// ResolveReport records a moderator's decision on a pending report within the transaction
+func (tx *Tx) ResolveReport(id int64, status models.ReportStatus, moderatorID int64) (bool, error) {
+	report, ok := tx.d.reports[id]
+	if !ok || report.Status != models.ReportPending {
+		return false, nil
+	}
+
+	t := now()
+	report.Status = status
+	report.ResolvedBy = moderatorID
+	report.ResolvedAt = &t
+
+	return true, nil
+}
+
+// BanUser bans a user within the transaction, replacing any earlier ban
+func (tx *Tx) BanUser(ban *models.Ban) error {
+	saved := cloneBan(*ban)
+	saved.CreatedAt = now()
+	if saved.ExpiresAt != nil {
+		t := saved.ExpiresAt.Truncate(time.Second)
+		saved.ExpiresAt = &t
+	}
+	tx.d.bans[ban.UserID] = saved
+	return nil
+}
+
+// UnbanUser lifts the user's ban within the transaction
+func (tx *Tx) UnbanUser(userID int64) (bool, error) {
+	_, ok := tx.d.bans[userID]
+	delete(tx.d.bans, userID)
+	return ok, nil
+}
+
+// ExpireBans lifts the bans that expired by the given time within the transaction
+func (tx *Tx) ExpireBans(now time.Time) ([]models.Ban, error) {
+	var expired []models.Ban
+	for id, ban := range tx.d.bans {
+		if ban.ExpiresAt != nil && !ban.ExpiresAt.After(now) {
+			expired = append(expired, cloneBan(ban))
+			delete(tx.d.bans, id)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].UserID < expired[j].UserID
+	})
+
+	return expired, nil
+}
+
+// RecordAdminAction adds an entry to the audit log within the transaction
+func (tx *Tx) RecordAdminAction(action *models.AdminAction) error {
+	saved := *action
+	saved.ID = int64(len(tx.d.adminActions)) + 1
+	saved.CreatedAt = now()
+	tx.d.adminActions = append(tx.d.adminActions, saved)
+	return nil
+}
+
+// InsertOutbox adds a message to the outbox within the transaction
+func (tx *Tx) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	return tx.d.insertOutbox(message), nil
+}
+
+// GetUserState retrieves a user's state
+func (s *Store) GetUserState(userID int64) (*models.UserState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.d.getUserState(userID), nil
+}
+
+// SaveUserState stores a user's state, leaving the current chat of known users alone
+func (s *Store) SaveUserState(state *models.UserState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.d.saveUserState(state)
+	return nil
+}
+
+// GetActiveUsers returns the count of reachable online users
+func (s *Store) GetActiveUsers() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, u := range s.d.users {
+		if u.IsActive && !u.Unreachable {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// MarkReachable clears the unreachable flag once a user talks to the bot again
+func (s *Store) MarkReachable(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.d.users[userID]; ok {
+		u.Unreachable = false
+		s.d.users[userID] = u
+	}
+
+	return nil
+}
+
+// TouchActivity records that the user was just active in their chat
+func (s *Store) TouchActivity(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.d.users[userID]; ok {
+		u.LastActivity = now()
+		s.d.users[userID] = u
+	}
+
+	return nil
+}
+
+// FindPotentialMatches returns free, online users, longest waiting first,
+// leaving out banned and blocked users and recent partners. Shadowbanned
+// users only meet each other.
+func (s *Store) FindPotentialMatches(userID int64, recentSince time.Time) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shadowbanned := s.d.isShadowbanned(userID)
+
+	excluded := make(map[int64]bool)
+	for id := range s.d.bans {
+		if ban, banned := s.d.activeBan(id); banned && (!ban.IsShadow() || !shadowbanned) {
+			excluded[id] = true
+		}
+	}
+	for key := range s.d.blocks {
+		switch userID {
+		case key.blockerID:
+			excluded[key.blockedID] = true
+		case key.blockedID:
+			excluded[key.blockerID] = true
+		}
+	}
+	for _, session := range s.d.sessions {
+		if session.EndedAt == nil || session.EndedAt.Before(recentSince) {
+			continue
+		}
+		if session.User1ID == userID || session.User2ID == userID {
+			excluded[session.Partner(userID)] = true
+		}
+	}
+
+	var candidates []models.UserState
+	for _, u := range s.d.users {
+		if shadowbanned && !s.d.isShadowbanned(u.UserID) {
+			continue
+		}
+		if u.IsActive && u.CurrentChat == 0 && !u.Unreachable && u.UserID != userID && !excluded[u.UserID] {
+			candidates = append(candidates, u)
+		}
+	}
+
+	// Users who aren't searching come last, in random order
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].MatchStartTime, candidates[j].MatchStartTime
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return a.Before(*b)
+	})
+
+	matches := make([]int64, len(candidates))
+	for i, u := range candidates {
+		matches[i] = u.UserID
+	}
+
+	return matches, nil
+}
+
+// GetWaitingUsers returns the users in the match queue, longest waiting first
+func (s *Store) GetWaitingUsers() ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var waiting []models.UserState
+	for _, u := range s.d.users {
+		if u.MatchStartTime != nil && u.CurrentChat == 0 && !u.Unreachable {
+			waiting = append(waiting, u)
+		}
+	}
+
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].MatchStartTime.Before(*waiting[j].MatchStartTime)
+	})
+
+	userIDs := make([]int64, len(waiting))
+	for i, u := range waiting {
+		userIDs[i] = u.UserID
+	}
+
+	return userIDs, nil
+}
+
+// PairUsers puts two free users in a chat with each other
+func (s *Store) PairUsers(user1 int64, user2 int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.d.pairUsers(user1, user2), nil
+}
+
+// EndChat ends the user's current chat
+func (s *Store) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	partnerID, ended := s.d.endChat(userID, reason)
+	return partnerID, ended, nil
+}
+
+// BlockUser keeps blockedID from being matched with blockerID ever again
+func (s *Store) BlockUser(blockerID int64, blockedID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.d.blockUser(blockerID, blockedID)
+	return nil
+}
+
+// GetActiveChats returns every ongoing chat
+func (s *Store) GetActiveChats() ([]models.ActiveChat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var chats []models.ActiveChat
+	for _, session := range s.d.sortedSessions() {
+		if !session.IsOpen() {
+			continue
+		}
+
+		chats = append(chats, models.ActiveChat{
+			SessionID:     session.ID,
+			User1ID:       session.User1ID,
+			User2ID:       session.User2ID,
+			LastActivity1: s.d.users[session.User1ID].LastActivity,
+			LastActivity2: s.d.users[session.User2ID].LastActivity,
+		})
+	}
+
+	return chats, nil
+}
+
+// CountChatMessage adds a message sent by the user to their open chat's count
+func (s *Store) CountChatMessage(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.d.sessions {
+		if !session.IsOpen() {
+			continue
+		}
+
+		switch userID {
+		case session.User1ID:
+			session.User1Messages++
+		case session.User2ID:
+			session.User2Messages++
+		}
+	}
+
+	return nil
+}
+
+// GetChatSession returns a chat session by ID, or nil if there is none
+func (s *Store) GetChatSession(id int64) (*models.ChatSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.d.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *session
+	return &copied, nil
+}
+
+// GetCurrentChatSession returns the user's open chat session, or nil
+func (s *Store) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.d.currentChatSession(userID), nil
+}
+
+// GetChatSessions returns the user's most recent chat sessions, newest first
+func (s *Store) GetChatSessions(userID int64, limit int) ([]models.ChatSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []models.ChatSession
+	sessions := s.d.sortedSessions()
+	for i := len(sessions) - 1; i >= 0 && len(result) < limit; i-- {
+		session := sessions[i]
+		if session.User1ID == userID || session.User2ID == userID {
+			result = append(result, *session)
+		}
+	}
+
+	return result, nil
+}
+
+// GetConversation retrieves a user's pending input state
+func (s *Store) GetConversation(userID int64) (*models.Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversation, ok := s.d.conversations[userID]
+	if !ok {
+		return &models.Conversation{UserID: userID, State: models.ConversationIdle}, nil
+	}
+
+	return &conversation, nil
+}
+
+// SaveConversation stores a user's pending input state
+func (s *Store) SaveConversation(conversation *models.Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *conversation
+	saved.UpdatedAt = saved.UpdatedAt.Truncate(time.Second)
+	s.d.conversations[conversation.UserID] = saved
+	return nil
+}
+
+// ClearConversation removes a user's pending input state
+func (s *Store) ClearConversation(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.d.conversations, userID)
+	return nil
+}
+
+// SaveRelayedMessage records which message a relayed copy was delivered as
+func (s *Store) SaveRelayedMessage(relayed *models.RelayedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *relayed
+	saved.CreatedAt = saved.CreatedAt.Truncate(time.Second)
+	s.d.relayed[relayKey{relayed.SenderChatID, relayed.OriginalMessageID, relayed.RecipientChatID}] = saved
+	return nil
+}
+
+// FindCounterpart returns the matching message in the partner's chat, or 0
+func (s *Store) FindCounterpart(chatID int64, messageID int, partnerID int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if relayed, ok := s.d.relayed[relayKey{chatID, messageID, partnerID}]; ok {
+		return relayed.DeliveredMessageID, nil
+	}
+
+	for _, relayed := range s.d.relayed {
+		if relayed.RecipientChatID == chatID && relayed.DeliveredMessageID == messageID && relayed.SenderChatID == partnerID {
+			return relayed.OriginalMessageID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// GetRelayedMessage returns the copy of a message delivered to recipientChatID, or nil
+func (s *Store) GetRelayedMessage(senderChatID int64, originalMessageID int, recipientChatID int64) (*models.RelayedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	relayed, ok := s.d.relayed[relayKey{senderChatID, originalMessageID, recipientChatID}]
+	if !ok {
+		return nil, nil
+	}
+
+	return &relayed, nil
+}
+
+// GetRelayedCopies returns every delivered copy of a message
+func (s *Store) GetRelayedCopies(senderChatID int64, originalMessageID int) ([]models.RelayedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var copies []models.RelayedMessage
+	for key, relayed := range s.d.relayed {
+		if key.senderChatID == senderChatID && key.originalMessageID == originalMessageID {
+			copies = append(copies, relayed)
+		}
+	}
+
+	return copies, nil
+}
+
+// GetAlbumMessageIDs returns every message the sender relayed in the same album
+// as the given one, or nil if it wasn't part of an album
+func (s *Store) GetAlbumMessageIDs(senderChatID int64, originalMessageID int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groupID := ""
+	for key, relayed := range s.d.relayed {
+		if key.senderChatID == senderChatID && key.originalMessageID == originalMessageID && relayed.MediaGroupID != "" {
+			groupID = relayed.MediaGroupID
+			break
+		}
+	}
+	if groupID == "" {
+		return nil, nil
+	}
+
+	seen := make(map[int]bool)
+	var messageIDs []int
+	for key, relayed := range s.d.relayed {
+		if key.senderChatID == senderChatID && relayed.MediaGroupID == groupID && !seen[key.originalMessageID] {
+			seen[key.originalMessageID] = true
+			messageIDs = append(messageIDs, key.originalMessageID)
+		}
+	}
+	sort.Ints(messageIDs)
+
+	return messageIDs, nil
+}
+
+// GetLastRelayedMessageID returns the user's most recent relayed message, or 0
+func (s *Store) GetLastRelayedMessageID(senderChatID int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := 0
+	for key := range s.d.relayed {
+		if key.senderChatID == senderChatID && key.originalMessageID > last {
+			last = key.originalMessageID
+		}
+	}
+
+	return last, nil
+}
+
+// IsRelayedCopy reports whether a message in chatID is a copy of someone else's
+func (s *Store) IsRelayedCopy(chatID int64, messageID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, relayed := range s.d.relayed {
+		if relayed.RecipientChatID == chatID && relayed.DeliveredMessageID == messageID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// DeleteRelayedMessage forgets every delivered copy of a message
+func (s *Store) DeleteRelayedMessage(senderChatID int64, originalMessageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.d.relayed {
+		if key.senderChatID == senderChatID && key.originalMessageID == originalMessageID {
+			delete(s.d.relayed, key)
+		}
+	}
+
+	return nil
+}
+
+// InsertOutbox adds a message to the outbox and returns its ID
+func (s *Store) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.d.insertOutbox(message), nil
+}
+
+// GetPendingOutbox returns the messages not delivered yet, oldest first
+func (s *Store) GetPendingOutbox() ([]models.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []models.OutboxEntry
+	for _, e := range s.d.outbox {
+		if e.status == outboxPending {
+			entries = append(entries, e.entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries, nil
+}
+
+// MarkOutboxSent records that a message was delivered
+func (s *Store) MarkOutboxSent(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.d.outbox[id]; ok {
+		e.status = outboxSent
+		e.updatedAt = now()
+	}
+
+	return nil
+}
+
+// MarkOutboxFailed records that a message could not be delivered and won't be retried
+func (s *Store) MarkOutboxFailed(id int64, attempts int, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.d.outbox[id]; ok {
+		e.status = outboxFailed
+		e.entry.Attempts = attempts
+		e.lastError = lastError
+		e.updatedAt = now()
+	}
+
+	return nil
+}
+
+// UpdateOutboxAttempts records a failed delivery attempt that will be retried
+func (s *Store) UpdateOutboxAttempts(id int64, attempts int, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.d.outbox[id]; ok {
+		e.entry.Attempts = attempts
+		e.lastError = lastError
+		e.updatedAt = now()
+	}
+
+	return nil
+}
+
+// PurgeOutbox deletes delivered and failed messages last updated before the given time
+func (s *Store) PurgeOutbox(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, e := range s.d.outbox {
+		if e.status != outboxPending && e.updatedAt.Before(before) {
+			delete(s.d.outbox, id)
+		}
+	}
+
+	return nil
+}
+
+// CreateReport stores a pending report unless the reporter already reported the session
+func (s *Store) CreateReport(report *models.Report) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.d.reports {
+		if existing.SessionID == report.SessionID && existing.ReporterID == report.ReporterID {
+			return 0, false, nil
+		}
+	}
+
+	s.d.nextReportID++
+
+	saved := *report
+	saved.ID = s.d.nextReportID
+	saved.Status = models.ReportPending
+	saved.CreatedAt = now()
+	saved.ResolvedBy = 0
+	saved.ResolvedAt = nil
+	s.d.reports[saved.ID] = &saved
+
+	return saved.ID, true, nil
+}
+
+// GetReport returns a report by ID, or nil if there is none
+func (s *Store) GetReport(id int64) (*models.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.d.reports[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return cloneReport(report), nil
+}
+
+// GetPendingReports returns reports no moderator has acted on yet, oldest first
+func (s *Store) GetPendingReports(limit int) ([]models.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []models.Report
+	for _, report := range s.d.reports {
+		if report.Status == models.ReportPending {
+			reports = append(reports, *cloneReport(report))
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ID < reports[j].ID
+	})
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+
+	return reports, nil
+}
+
+// GetReportsAbout returns the reports about a user, newest first
+func (s *Store) GetReportsAbout(userID int64, limit int) ([]models.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []models.Report
+	for _, report := range s.d.reports {
+		if report.ReportedID == userID {
+			reports = append(reports, *cloneReport(report))
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ID > reports[j].ID
+	})
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+
+	return reports, nil
+}
+
+// GetBan returns the user's ban in effect, or nil if they aren't banned or
+// their ban has expired
+func (s *Store) GetBan(userID int64) (*models.Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ban, ok := s.d.activeBan(userID)
+	if !ok {
+		return nil, nil
+	}
+
+	return &ban, nil
+}
+
+// GetAdminActions returns the actions taken on a user, newest first
+func (s *Store) GetAdminActions(targetID int64, limit int) ([]models.AdminAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var actions []models.AdminAction
+	for i := len(s.d.adminActions) - 1; i >= 0 && len(actions) < limit; i-- {
+		if s.d.adminActions[i].TargetID == targetID {
+			actions = append(actions, s.d.adminActions[i])
+		}
+	}
+
+	return actions, nil
+}
+
+// GetStats counts users, chats started since the given time, pending reports
+// and bans and shadowbans in effect
+func (s *Store) GetStats(since time.Time) (*models.Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats models.Stats
+	for _, u := range s.d.users {
+		stats.Users++
+		if u.IsActive && !u.Unreachable {
+			stats.OnlineUsers++
+		}
+		if u.CurrentChat != 0 {
+			stats.ChattingUsers++
+		}
+		if u.MatchStartTime != nil && u.CurrentChat == 0 && !u.Unreachable {
+			stats.WaitingUsers++
+		}
+	}
+	for _, session := range s.d.sessions {
+		if !session.StartedAt.Before(since) {
+			stats.ChatsStarted++
+		}
+	}
+	for _, report := range s.d.reports {
+		if report.Status == models.ReportPending {
+			stats.PendingReports++
+		}
+	}
+	for id := range s.d.bans {
+		ban, banned := s.d.activeBan(id)
+		switch {
+		case !banned:
+		case ban.IsShadow():
+			stats.ShadowbannedUsers++
+		default:
+			stats.BannedUsers++
+		}
+	}
+
+	return &stats, nil
+}
+
+// activeBan returns a copy of the user's ban if it is in effect
+func (d *data) activeBan(userID int64) (models.Ban, bool) {
+	ban, ok := d.bans[userID]
+	if !ok || (ban.ExpiresAt != nil && !ban.ExpiresAt.After(time.Now())) {
+		return models.Ban{}, false
+	}
+
+	return cloneBan(ban), true
+}
+
+// isShadowbanned reports whether the user has a shadowban in effect
+func (d *data) isShadowbanned(userID int64) bool {
+	ban, ok := d.activeBan(userID)
+	return ok && ban.IsShadow()
+}
+
+// getUserState returns a copy of the user's state, or a new one for unknown users
+func (d *data) getUserState(userID int64) *models.UserState {
+	u, ok := d.users[userID]
+	if !ok {
+		return models.NewUserState(userID)
+	}
+
+	return cloneUserState(u)
+}
+
+// saveUserState stores a copy of the state, keeping the current chat of known users
+func (d *data) saveUserState(state *models.UserState) {
+	saved := *cloneUserState(*state)
+	saved.LastActivity = saved.LastActivity.Truncate(time.Second)
+
+	if existing, ok := d.users[state.UserID]; ok {
+		saved.CurrentChat = existing.CurrentChat
+	}
+
+	d.users[state.UserID] = saved
+}
+
+// pairUsers puts two free users in a chat and opens a session for them
+func (d *data) pairUsers(user1 int64, user2 int64) bool {
+	if user1 == user2 {
+		return false
+	}
+
+	u1, ok1 := d.users[user1]
+	u2, ok2 := d.users[user2]
+	if !ok1 || !ok2 {
+		return false
+	}
+	if u1.CurrentChat != 0 || u2.CurrentChat != 0 || u1.Unreachable || u2.Unreachable {
+		return false
+	}
+
+	t := now()
+	u1.CurrentChat, u1.LastActivity, u1.MatchStartTime = user2, t, nil
+	u2.CurrentChat, u2.LastActivity, u2.MatchStartTime = user1, t, nil
+	d.users[user1] = u1
+	d.users[user2] = u2
+
+	d.nextSessionID++
+	d.sessions[d.nextSessionID] = &models.ChatSession{
+		ID:        d.nextSessionID,
+		User1ID:   user1,
+		User2ID:   user2,
+		StartedAt: t,
+	}
+
+	return true
+}
+
+// endChat ends the user's chat, and the partner's side if they were still in it
+func (d *data) endChat(userID int64, reason models.EndReason) (int64, bool) {
+	u, ok := d.users[userID]
+	if !ok || u.CurrentChat == 0 {
+		return 0, false
+	}
+
+	t := now()
+	for _, session := range d.sessions {
+		if session.IsOpen() && (session.User1ID == userID || session.User2ID == userID) {
+			session.EndedAt = &t
+			session.EndReason = reason
+		}
+	}
+
+	partnerID := u.CurrentChat
+	u.CurrentChat = 0
+	d.users[userID] = u
+
+	partner, ok := d.users[partnerID]
+	if !ok || partner.CurrentChat != userID {
+		return 0, true
+	}
+
+	partner.CurrentChat = 0
+	d.users[partnerID] = partner
+
+	return partnerID, true
+}
+
+// currentChatSession returns a copy of the user's open chat session, or nil
+func (d *data) currentChatSession(userID int64) *models.ChatSession {
+	sessions := d.sortedSessions()
+	for i := len(sessions) - 1; i >= 0; i-- {
+		session := sessions[i]
+		if session.IsOpen() && (session.User1ID == userID || session.User2ID == userID) {
+			copied := *session
+			return &copied
+		}
+	}
+
+	return nil
+}
+
+// blockUser records a block unless it is already there
+func (d *data) blockUser(blockerID int64, blockedID int64) {
+	key := blockKey{blockerID, blockedID}
+	if _, ok := d.blocks[key]; !ok {
+		d.blocks[key] = now()
+	}
+}
+
+// insertOutbox adds a pending message to the outbox
+func (d *data) insertOutbox(message models.QueuedMessage) int64 {
+	d.nextOutboxID++
+
+	t := now()
+	d.outbox[d.nextOutboxID] = &outboxEntry{
+		entry: models.OutboxEntry{
+			ID:        d.nextOutboxID,
+			Message:   message,
+			CreatedAt: t,
+		},
+		status:    outboxPending,
+		updatedAt: t,
+	}
+
+	return d.nextOutboxID
+}
+
+// sortedSessions returns the sessions in the order they were opened
+func (d *data) sortedSessions() []*models.ChatSession {
+	sessions := make([]*models.ChatSession, 0, len(d.sessions))
+	for _, session := range d.sessions {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	return sessions
+}
+
+// clone makes a copy of the data a transaction can change freely
+func (d *data) clone() *data {
+	c := &data{
+		users:         make(map[int64]models.UserState, len(d.users)),
+		conversations: make(map[int64]models.Conversation, len(d.conversations)),
+		relayed:       make(map[relayKey]models.RelayedMessage, len(d.relayed)),
+		outbox:        make(map[int64]*outboxEntry, len(d.outbox)),
+		sessions:      make(map[int64]*models.ChatSession, len(d.sessions)),
+		blocks:        make(map[blockKey]time.Time, len(d.blocks)),
+		reports:       make(map[int64]*models.Report, len(d.reports)),
+		bans:          make(map[int64]models.Ban, len(d.bans)),
+		adminActions:  append([]models.AdminAction(nil), d.adminActions...),
+		nextOutboxID:  d.nextOutboxID,
+		nextSessionID: d.nextSessionID,
+		nextReportID:  d.nextReportID,
+	}
+
+	for id, u := range d.users {
+		c.users[id] = *cloneUserState(u)
+	}
+	for id, conversation := range d.conversations {
+		c.conversations[id] = conversation
+	}
+	for key, relayed := range d.relayed {
+		c.relayed[key] = relayed
+	}
+	for id, e := range d.outbox {
+		copied := *e
+		c.outbox[id] = &copied
+	}
+	for id, session := range d.sessions {
+		copied := *session
+		c.sessions[id] = &copied
+	}
+	for key, blockedAt := range d.blocks {
+		c.blocks[key] = blockedAt
+	}
+	for id, report := range d.reports {
+		c.reports[id] = cloneReport(report)
+	}
+	for id, ban := range d.bans {
+		c.bans[id] = ban
+	}
+
+	return c
+}
+
+// cloneUserState copies a user state so the copy shares nothing with the original
+func cloneUserState(u models.UserState) *models.UserState {
+	c := u
+
+	c.Settings.Preferences.Countries = append([]string(nil), u.Settings.Preferences.Countries...)
+	c.Settings.Preferences.Languages = append([]string(nil), u.Settings.Preferences.Languages...)
+	c.Settings.Preferences.Genders = append([]string(nil), u.Settings.Preferences.Genders...)
+
+	if u.MatchStartTime != nil {
+		t := *u.MatchStartTime
+		c.MatchStartTime = &t
+	}
+
+	return &c
+}
+
+// cloneReport copies a report so the copy shares nothing with the original
+func cloneReport(report *models.Report) *models.Report {
+	c := *report
+	if report.ResolvedAt != nil {
+		t := *report.ResolvedAt
+		c.ResolvedAt = &t
+	}
+	return &c
+}
+
+// cloneBan copies a ban so the copy shares nothing with the original
+func cloneBan(ban models.Ban) models.Ban {
+	if ban.ExpiresAt != nil {
+		t := *ban.ExpiresAt
+		ban.ExpiresAt = &t
+	}
+	return ban
+}
+
+// now returns the current time at the precision the other stores keep
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
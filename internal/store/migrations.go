@@ -0,0 +1,152 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is one versioned schema change, read from a pair of files named
+// NNNN_name.up.sql and NNNN_name.down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationPlan is what it takes to bring a schema to a target version
+type MigrationPlan struct {
+	Apply    []Migration // oldest first
+	Rollback []Migration // newest first
+}
+
+// LoadMigrations reads the migrations in dir, ordered by version. Every
+// migration needs both its up and its down file.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s has no name", fileName)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %s has an invalid version", fileName)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// LatestVersion returns the version of the newest migration, or 0 if there
+// are none
+func LatestVersion(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// PlanMigrations works out which migrations to apply and which to roll back
+// to go from the applied ones to the target version. It fails if a migration
+// was applied that isn't known, as the schema came from a newer build.
+func PlanMigrations(migrations []Migration, applied map[int]time.Time, target int) (MigrationPlan, error) {
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return MigrationPlan{}, fmt.Errorf("database has migration %d applied, which this build doesn't know", version)
+		}
+	}
+
+	var plan MigrationPlan
+	for _, m := range migrations {
+		_, isApplied := applied[m.Version]
+		if m.Version <= target && !isApplied {
+			plan.Apply = append(plan.Apply, m)
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		_, isApplied := applied[m.Version]
+		if m.Version > target && isApplied {
+			plan.Rollback = append(plan.Rollback, m)
+		}
+	}
+
+	return plan, nil
+}
+
+// MigrationStatuses lists every known migration and whether it was applied
+func MigrationStatuses(migrations []Migration, applied map[int]time.Time) []MigrationStatus {
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func versions(migrations []Migration) []int {
+	var out []int
+	for _, m := range migrations {
+		out = append(out, m.Version)
+	}
+	return out
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_bans.up.sql":      {Data: []byte("CREATE TABLE bans ();")},
+		"m/0002_add_bans.down.sql":    {Data: []byte("DROP TABLE bans;")},
+		"m/0001_initial.up.sql":       {Data: []byte("CREATE TABLE users ();")},
+		"m/0001_initial.down.sql":     {Data: []byte("DROP TABLE users;")},
+		"m/0010_add_reports.up.sql":   {Data: []byte("CREATE TABLE reports ();")},
+		"m/0010_add_reports.down.sql": {Data: []byte("DROP TABLE reports;")},
+	}
+
+	migrations, err := LoadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	if got := versions(migrations); !reflect.DeepEqual(got, []int{1, 2, 10}) {
+		t.Fatalf("versions = %v, want [1 2 10]", got)
+	}
+	want := Migration{Version: 2, Name: "add_bans", Up: "CREATE TABLE bans ();", Down: "DROP TABLE bans;"}
+	if migrations[1] != want {
+		t.Errorf("migration 2 = %+v, want %+v", migrations[1], want)
+	}
+	if LatestVersion(migrations) != 10 {
+		t.Errorf("LatestVersion = %d, want 10", LatestVersion(migrations))
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"not sql", []string{"0001_initial.up.sql", "0001_initial.down.sql", "README.md"}, "unexpected migration file"},
+		{"no name", []string{"0001.up.sql", "0001.down.sql"}, "has no name"},
+		{"bad version", []string{"first_initial.up.sql", "first_initial.down.sql"}, "invalid version"},
+		{"zero version", []string{"0000_initial.up.sql", "0000_initial.down.sql"}, "invalid version"},
+		{"two names", []string{"0001_initial.up.sql", "0001_first.down.sql"}, "two names"},
+		{"no down file", []string{"0001_initial.up.sql"}, "missing its up or down file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["m/"+name] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+			}
+
+			_, err := LoadMigrations(fsys, "m")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadMigrations error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	migrations := []Migration{{Version: 1}, {Version: 2}, {Version: 3}}
+	appliedAt := time.Now()
+
+	tests := []struct {
+		name         string
+		applied      []int
+		target       int
+		wantApply    []int
+		wantRollback []int
+	}{
+		{"fresh database", nil, 3, []int{1, 2, 3}, nil},
+		{"up to date", []int{1, 2, 3}, 3, nil, nil},
+		{"catch up", []int{1}, 3, []int{2, 3}, nil},
+		{"stop at target", nil, 2, []int{1, 2}, nil},
+		{"roll back newest first", []int{1, 2, 3}, 1, nil, []int{3, 2}},
+		{"roll back everything", []int{1, 2, 3}, 0, nil, []int{3, 2, 1}},
+		{"fill a gap", []int{1, 3}, 3, []int{2}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := make(map[int]time.Time)
+			for _, version := range tt.applied {
+				applied[version] = appliedAt
+			}
+
+			plan, err := PlanMigrations(migrations, applied, tt.target)
+			if err != nil {
+				t.Fatalf("PlanMigrations: %v", err)
+			}
+			if got := versions(plan.Apply); !reflect.DeepEqual(got, tt.wantApply) {
+				t.Errorf("apply %v, want %v", got, tt.wantApply)
+			}
+			if got := versions(plan.Rollback); !reflect.DeepEqual(got, tt.wantRollback) {
+				t.Errorf("roll back %v, want %v", got, tt.wantRollback)
+			}
+		})
+	}
+}
+
+func TestPlanMigrationsRejectsUnknownVersion(t *testing.T) {
+	migrations := []Migration{{Version: 1}}
+	applied := map[int]time.Time{1: time.Now(), 2: time.Now()}
+
+	if _, err := PlanMigrations(migrations, applied, 1); err == nil {
+		t.Fatal("planned migrations for a database from a newer build")
+	}
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	appliedAt := time.Now()
+	migrations := []Migration{{Version: 1, Name: "initial"}, {Version: 2, Name: "add_bans"}}
+
+	statuses := MigrationStatuses(migrations, map[int]time.Time{1: appliedAt})
+
+	want := []MigrationStatus{
+		{Version: 1, Name: "initial", Applied: true, AppliedAt: appliedAt},
+		{Version: 2, Name: "add_bans"},
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("MigrationStatuses = %+v, want %+v", statuses, want)
+	}
+}
@@ -0,0 +1,46 @@
+package pgstore
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// RecordAdminAction adds an entry to the audit log within the transaction
+func (tx *Tx) RecordAdminAction(action *models.AdminAction) error {
+	query := `INSERT INTO admin_actions (admin_id, action, target_id, details, created_at) VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := tx.tx.Exec(query, action.AdminID, string(action.Action), action.TargetID, action.Details, time.Now())
+	return err
+}
+
+// GetAdminActions returns the actions taken on a user, newest first
+func (s *Store) GetAdminActions(targetID int64, limit int) ([]models.AdminAction, error) {
+	query := `
+    SELECT id, admin_id, action, details, created_at FROM admin_actions
+    WHERE target_id = $1
+    ORDER BY id DESC
+    LIMIT $2
+    `
+
+	rows, err := s.conn.Query(query, targetID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []models.AdminAction
+	for rows.Next() {
+		action := models.AdminAction{TargetID: targetID}
+		var kind string
+
+		if err := rows.Scan(&action.ID, &action.AdminID, &kind, &action.Details, &action.CreatedAt); err != nil {
+			return nil, err
+		}
+		action.Action = models.AdminActionKind(kind)
+
+		actions = append(actions, action)
+	}
+
+	return actions, rows.Err()
+}
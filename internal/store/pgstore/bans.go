@@ -0,0 +1,101 @@
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// banColumns are the columns read by scanBan
+const banColumns = `user_id, kind, reason, banned_by, created_at, expires_at`
+
+// GetBan returns the user's ban in effect, or nil if they aren't banned or
+// their ban has expired
+func (s *Store) GetBan(userID int64) (*models.Ban, error) {
+	query := `
+    SELECT ` + banColumns + ` FROM bans
+    WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > $2)
+    `
+
+	ban, err := scanBan(s.conn.QueryRow(query, userID, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return ban, err
+}
+
+// BanUser bans a user within the transaction, replacing any earlier ban
+func (tx *Tx) BanUser(ban *models.Ban) error {
+	query := `
+    INSERT INTO bans (user_id, kind, reason, banned_by, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (user_id) DO UPDATE SET
+        kind = excluded.kind,
+        reason = excluded.reason,
+        banned_by = excluded.banned_by,
+        created_at = excluded.created_at,
+        expires_at = excluded.expires_at
+    `
+
+	var expiresAt sql.NullTime
+	if ban.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *ban.ExpiresAt, Valid: true}
+	}
+
+	_, err := tx.tx.Exec(query, ban.UserID, string(ban.Kind), ban.Reason, ban.BannedBy, time.Now(), expiresAt)
+	return err
+}
+
+// UnbanUser lifts the user's ban within the transaction. It reports false if
+// there was none.
+func (tx *Tx) UnbanUser(userID int64) (bool, error) {
+	result, err := tx.tx.Exec(`DELETE FROM bans WHERE user_id = $1`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// ExpireBans lifts the bans that expired by the given time within the
+// transaction and returns them
+func (tx *Tx) ExpireBans(now time.Time) ([]models.Ban, error) {
+	query := `DELETE FROM bans WHERE expires_at <= $1 RETURNING ` + banColumns
+
+	rows, err := tx.tx.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []models.Ban
+	for rows.Next() {
+		ban, err := scanBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, *ban)
+	}
+
+	return bans, rows.Err()
+}
+
+// scanBan reads a ban selected with banColumns
+func scanBan(row rowScanner) (*models.Ban, error) {
+	var ban models.Ban
+	var kind string
+	var expiresAt sql.NullTime
+
+	if err := row.Scan(&ban.UserID, &kind, &ban.Reason, &ban.BannedBy, &ban.CreatedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	ban.Kind = models.BanKind(kind)
+	if expiresAt.Valid {
+		ban.ExpiresAt = &expiresAt.Time
+	}
+
+	return &ban, nil
+}
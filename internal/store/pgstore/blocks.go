@@ -0,0 +1,24 @@
+package pgstore
+
+import "time"
+
+// BlockUser keeps blockedID from being matched with blockerID ever again
+func (s *Store) BlockUser(blockerID int64, blockedID int64) error {
+	return blockUser(s.conn, blockerID, blockedID)
+}
+
+// BlockUser keeps blockedID from being matched with blockerID within the transaction
+func (tx *Tx) BlockUser(blockerID int64, blockedID int64) error {
+	return blockUser(tx.tx, blockerID, blockedID)
+}
+
+// blockUser records a block using the given connection or transaction
+func blockUser(e dbtx, blockerID int64, blockedID int64) error {
+	query := `
+    INSERT INTO user_blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, $3)
+    ON CONFLICT DO NOTHING
+    `
+
+	_, err := e.Exec(query, blockerID, blockedID, time.Now())
+	return err
+}
@@ -0,0 +1,292 @@
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// chatSessionColumns are the columns read by scanChatSession
+const chatSessionColumns = `id, user1_id, user2_id, started_at, ended_at, end_reason, user1_messages, user2_messages`
+
+// PairUsers puts two users in a chat with each other if both are still free.
+// It reports false, changing nothing, if another pairing got there first.
+func (s *Store) PairUsers(user1 int64, user2 int64) (bool, error) {
+	var paired bool
+	err := s.runInTx(func(tx *Tx) error {
+		var err error
+		paired, err = tx.PairUsers(user1, user2)
+		return err
+	})
+	return paired, err
+}
+
+// EndChat ends the user's current chat for the given reason. It returns the
+// partner whose side of the chat was ended too, and false if the user was not
+// in a chat.
+func (s *Store) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	var partnerID int64
+	var ended bool
+	err := s.runInTx(func(tx *Tx) error {
+		var err error
+		partnerID, ended, err = tx.EndChat(userID, reason)
+		return err
+	})
+	return partnerID, ended, err
+}
+
+// PairUsers puts two users in a chat with each other within the transaction
+// if both are still free, takes them out of the match queue and opens a chat
+// session for them
+func (tx *Tx) PairUsers(user1 int64, user2 int64) (bool, error) {
+	if user1 == user2 {
+		return false, nil
+	}
+
+	// Lock both rows, always in the same order so two pairings can't deadlock.
+	// A row paired meanwhile no longer matches once the lock is granted.
+	query := `
+    SELECT user_id FROM users
+    WHERE user_id IN ($1, $2)
+      AND current_chat = 0
+      AND NOT unreachable
+    ORDER BY user_id
+    FOR UPDATE
+    `
+
+	free, err := queryUserIDs(tx.tx, query, user1, user2)
+	if err != nil {
+		return false, err
+	}
+	if len(free) != 2 {
+		return false, nil
+	}
+
+	update := `
+    UPDATE users
+    SET current_chat = CASE WHEN user_id = $1 THEN $2 ELSE $1 END,
+        last_activity = $3,
+        match_start_time = NULL
+    WHERE user_id IN ($1, $2)
+    `
+
+	now := time.Now()
+	if _, err := tx.tx.Exec(update, user1, user2, now); err != nil {
+		return false, err
+	}
+
+	insert := `INSERT INTO chat_sessions (user1_id, user2_id, started_at) VALUES ($1, $2, $3)`
+	if _, err := tx.tx.Exec(insert, user1, user2, now); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// EndChat ends the user's current chat within the transaction and closes its
+// session. The partner is only taken out of the chat, and returned, if they
+// were still in it.
+func (tx *Tx) EndChat(userID int64, reason models.EndReason) (int64, bool, error) {
+	partnerID, err := currentChat(tx.tx, userID)
+	if err != nil || partnerID == 0 {
+		return 0, false, err
+	}
+
+	// Lock both rows in user order, like PairUsers, then check the chat is
+	// still the one read above
+	lock := `SELECT user_id, current_chat FROM users WHERE user_id IN ($1, $2) ORDER BY user_id FOR UPDATE`
+
+	rows, err := tx.tx.Query(lock, userID, partnerID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	chats := make(map[int64]int64)
+	for rows.Next() {
+		var id, chat int64
+		if err := rows.Scan(&id, &chat); err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		chats[id] = chat
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	if chats[userID] != partnerID {
+		// The chat changed before the lock was granted
+		return tx.EndChat(userID, reason)
+	}
+
+	closeSession := `
+    UPDATE chat_sessions SET ended_at = $1, end_reason = $2
+    WHERE ended_at IS NULL AND (user1_id = $3 OR user2_id = $3)
+    `
+	if _, err := tx.tx.Exec(closeSession, time.Now(), string(reason), userID); err != nil {
+		return 0, false, err
+	}
+
+	if _, err := tx.tx.Exec(`UPDATE users SET current_chat = 0 WHERE user_id = $1`, userID); err != nil {
+		return 0, false, err
+	}
+
+	if chats[partnerID] != userID {
+		return 0, true, nil
+	}
+
+	if _, err := tx.tx.Exec(`UPDATE users SET current_chat = 0 WHERE user_id = $1`, partnerID); err != nil {
+		return 0, false, err
+	}
+
+	return partnerID, true, nil
+}
+
+// currentChat returns who the user is chatting with, or 0
+func currentChat(q dbtx, userID int64) (int64, error) {
+	var chat int64
+
+	err := q.QueryRow(`SELECT current_chat FROM users WHERE user_id = $1`, userID).Scan(&chat)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return chat, err
+}
+
+// GetActiveChats returns every ongoing chat with both partners' last activity
+func (s *Store) GetActiveChats() ([]models.ActiveChat, error) {
+	query := `
+    SELECT s.id, u1.user_id, u2.user_id, u1.last_activity, u2.last_activity
+    FROM chat_sessions s
+    JOIN users u1 ON u1.user_id = s.user1_id
+    JOIN users u2 ON u2.user_id = s.user2_id
+    WHERE s.ended_at IS NULL
+    ORDER BY s.id
+    `
+
+	rows, err := s.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []models.ActiveChat
+	for rows.Next() {
+		var chat models.ActiveChat
+		if err := rows.Scan(&chat.SessionID, &chat.User1ID, &chat.User2ID, &chat.LastActivity1, &chat.LastActivity2); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+
+	return chats, rows.Err()
+}
+
+// CountChatMessage adds a message sent by the user to their open chat's count
+func (s *Store) CountChatMessage(userID int64) error {
+	query := `
+    UPDATE chat_sessions
+    SET user1_messages = user1_messages + CASE WHEN user1_id = $1 THEN 1 ELSE 0 END,
+        user2_messages = user2_messages + CASE WHEN user2_id = $1 THEN 1 ELSE 0 END
+    WHERE ended_at IS NULL AND (user1_id = $1 OR user2_id = $1)
+    `
+
+	_, err := s.conn.Exec(query, userID)
+	return err
+}
+
+// GetChatSession returns a chat session by ID, or nil if there is none
+func (s *Store) GetChatSession(id int64) (*models.ChatSession, error) {
+	query := `SELECT ` + chatSessionColumns + ` FROM chat_sessions WHERE id = $1`
+
+	session, err := scanChatSession(s.conn.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// GetCurrentChatSession returns the user's open chat session, or nil if they
+// are not in a chat
+func (s *Store) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	return getCurrentChatSession(s.conn, userID)
+}
+
+// GetCurrentChatSession returns the user's open chat session within the transaction
+func (tx *Tx) GetCurrentChatSession(userID int64) (*models.ChatSession, error) {
+	return getCurrentChatSession(tx.tx, userID)
+}
+
+// getCurrentChatSession returns the user's open chat session using the given
+// connection or transaction
+func getCurrentChatSession(q dbtx, userID int64) (*models.ChatSession, error) {
+	query := `
+    SELECT ` + chatSessionColumns + ` FROM chat_sessions
+    WHERE ended_at IS NULL AND (user1_id = $1 OR user2_id = $1)
+    ORDER BY id DESC
+    LIMIT 1
+    `
+
+	session, err := scanChatSession(q.QueryRow(query, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// GetChatSessions returns the user's most recent chat sessions, newest first
+func (s *Store) GetChatSessions(userID int64, limit int) ([]models.ChatSession, error) {
+	query := `
+    SELECT ` + chatSessionColumns + ` FROM chat_sessions
+    WHERE user1_id = $1 OR user2_id = $1
+    ORDER BY id DESC
+    LIMIT $2
+    `
+
+	rows, err := s.conn.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.ChatSession
+	for rows.Next() {
+		session, err := scanChatSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanChatSession reads a chat session selected with chatSessionColumns
+func scanChatSession(row rowScanner) (*models.ChatSession, error) {
+	var session models.ChatSession
+	var endedAt sql.NullTime
+	var endReason string
+
+	err := row.Scan(&session.ID, &session.User1ID, &session.User2ID, &session.StartedAt, &endedAt, &endReason,
+		&session.User1Messages, &session.User2Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	session.EndReason = models.EndReason(endReason)
+
+	return &session, nil
+}
@@ -0,0 +1,56 @@
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// GetConversation retrieves a user's pending input state
+func (s *Store) GetConversation(userID int64) (*models.Conversation, error) {
+	query := `SELECT state, data, updated_at FROM conversations WHERE user_id = $1`
+
+	conversation := &models.Conversation{UserID: userID}
+	var state string
+
+	err := s.conn.QueryRow(query, userID).Scan(&state, &conversation.Data, &conversation.UpdatedAt)
+	if err != nil {
+		// No pending input
+		if err == sql.ErrNoRows {
+			return &models.Conversation{UserID: userID, State: models.ConversationIdle}, nil
+		}
+		return nil, err
+	}
+
+	conversation.State = models.ConversationState(state)
+
+	return conversation, nil
+}
+
+// SaveConversation stores a user's pending input state
+func (s *Store) SaveConversation(conversation *models.Conversation) error {
+	query := `
+    INSERT INTO conversations (user_id, state, data, updated_at)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id) DO UPDATE SET
+        state = excluded.state,
+        data = excluded.data,
+        updated_at = excluded.updated_at
+    `
+
+	_, err := s.conn.Exec(
+		query,
+		conversation.UserID,
+		string(conversation.State),
+		conversation.Data,
+		conversation.UpdatedAt,
+	)
+
+	return err
+}
+
+// ClearConversation removes a user's pending input state
+func (s *Store) ClearConversation(userID int64) error {
+	_, err := s.conn.Exec(`DELETE FROM conversations WHERE user_id = $1`, userID)
+	return err
+}
@@ -0,0 +1,156 @@
+package pgstore
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock that keeps replicas starting at the
+// same time from applying a migration twice
+const migrationLockID = 7461626
+
+// loadMigrations reads the embedded migrations, ordered by version
+func loadMigrations() ([]store.Migration, error) {
+	return store.LoadMigrations(migrationFiles, "migrations")
+}
+
+// Migrate applies every migration that hasn't been applied yet
+func (s *Store) Migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return s.MigrateTo(store.LatestVersion(migrations))
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at the given
+// version. Version 0 rolls back everything. Each migration runs in its own
+// transaction together with its schema_migrations record.
+func (s *Store) MigrateTo(target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := s.prepareMigrations(); err != nil {
+		return err
+	}
+
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	plan, err := store.PlanMigrations(migrations, applied, target)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range plan.Apply {
+		if err := s.runMigration(m, false); err != nil {
+			return fmt.Errorf("applying migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	for _, m := range plan.Rollback {
+		if err := s.runMigration(m, true); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func (s *Store) MigrationStatus() ([]store.MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.prepareMigrations(); err != nil {
+		return nil, err
+	}
+
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.MigrationStatuses(migrations, applied), nil
+}
+
+// prepareMigrations creates the schema_migrations table
+func (s *Store) prepareMigrations() error {
+	query := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    )
+    `
+
+	_, err := s.conn.Exec(query)
+	return err
+}
+
+// appliedMigrations returns when each applied migration was applied
+func (s *Store) appliedMigrations() (map[int]time.Time, error) {
+	rows, err := s.conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// runMigration applies a migration, or rolls it back if down is set, unless
+// another replica got there first since the plan was made. The advisory lock
+// is held until the migration and its record are committed.
+func (s *Store) runMigration(m store.Migration, down bool) error {
+	return s.runInTx(func(tx *Tx) error {
+		if _, err := tx.tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+
+		var applied bool
+		err := tx.tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version).Scan(&applied)
+		if err != nil || applied != down {
+			return err
+		}
+
+		if down {
+			return execMigration(tx.tx, m.Down, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+		}
+		return execMigration(tx.tx, m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+	})
+}
+
+// execMigration runs a migration's SQL and updates its record
+func execMigration(tx *sql.Tx, migrationSQL string, record string, args ...interface{}) error {
+	if _, err := tx.Exec(migrationSQL); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(record, args...)
+	return err
+}
@@ -0,0 +1,62 @@
+CREATE TABLE IF NOT EXISTS users (
+    user_id BIGINT PRIMARY KEY,
+    is_active BOOLEAN NOT NULL DEFAULT FALSE,
+    current_chat BIGINT NOT NULL DEFAULT 0,
+    last_activity TIMESTAMPTZ NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    language TEXT NOT NULL DEFAULT '',
+    gender TEXT NOT NULL DEFAULT '',
+    match_start_time TIMESTAMPTZ,
+    pref_countries TEXT NOT NULL DEFAULT '',
+    pref_languages TEXT NOT NULL DEFAULT '',
+    pref_genders TEXT NOT NULL DEFAULT '',
+    unreachable BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_waiting ON users (match_start_time) WHERE current_chat = 0;
+
+CREATE TABLE IF NOT EXISTS conversations (
+    user_id BIGINT PRIMARY KEY,
+    state TEXT NOT NULL,
+    data TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS relayed_messages (
+    sender_chat_id BIGINT NOT NULL,
+    original_message_id INTEGER NOT NULL,
+    recipient_chat_id BIGINT NOT NULL,
+    delivered_message_id INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (sender_chat_id, original_message_id, recipient_chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_relayed_messages_delivered
+    ON relayed_messages (recipient_chat_id, delivered_message_id);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    chat_id BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_status ON outbox (status, id);
+
+CREATE TABLE IF NOT EXISTS chat_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user1_id BIGINT NOT NULL,
+    user2_id BIGINT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ,
+    end_reason TEXT NOT NULL DEFAULT '',
+    user1_messages INTEGER NOT NULL DEFAULT 0,
+    user2_messages INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_user1 ON chat_sessions (user1_id, started_at);
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_user2 ON chat_sessions (user2_id, started_at);
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS reports (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL,
+    reporter_id BIGINT NOT NULL,
+    reported_id BIGINT NOT NULL,
+    reason TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL,
+    resolved_by BIGINT NOT NULL DEFAULT 0,
+    resolved_at TIMESTAMPTZ,
+    UNIQUE (session_id, reporter_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports (status, id);
+CREATE INDEX IF NOT EXISTS idx_reports_reported ON reports (reported_id);
+
+CREATE TABLE IF NOT EXISTS bans (
+    user_id BIGINT PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    banned_by BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS admin_actions;
+ALTER TABLE bans DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,12 @@
+ALTER TABLE bans ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS admin_actions (
+    id BIGSERIAL PRIMARY KEY,
+    admin_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    target_id BIGINT NOT NULL DEFAULT 0,
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_actions_target ON admin_actions (target_id, id);
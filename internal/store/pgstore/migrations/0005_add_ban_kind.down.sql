@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_bans_expires_at;
+ALTER TABLE bans DROP COLUMN IF EXISTS kind;
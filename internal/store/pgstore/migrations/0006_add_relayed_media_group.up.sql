@@ -0,0 +1,4 @@
+ALTER TABLE relayed_messages ADD COLUMN IF NOT EXISTS media_group_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_relayed_messages_media_group
+    ON relayed_messages (sender_chat_id, media_group_id);
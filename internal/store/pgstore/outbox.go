@@ -0,0 +1,104 @@
+package pgstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// Outbox statuses
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+// InsertOutbox adds a message to the outbox and returns its ID
+func (s *Store) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	return insertOutbox(s.conn, message)
+}
+
+// insertOutbox adds a message to the outbox using the given connection or transaction
+func insertOutbox(e dbtx, message models.QueuedMessage) (int64, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+    INSERT INTO outbox (chat_id, payload, status, attempts, created_at, updated_at)
+    VALUES ($1, $2, $3, 0, $4, $4)
+    RETURNING id
+    `
+
+	var id int64
+	err = e.QueryRow(query, message.ChatID, string(payload), outboxPending, time.Now()).Scan(&id)
+
+	return id, err
+}
+
+// GetPendingOutbox returns the messages that have not been delivered yet, oldest first
+func (s *Store) GetPendingOutbox() ([]models.OutboxEntry, error) {
+	query := `
+    SELECT id, payload, attempts, created_at FROM outbox
+    WHERE status = $1
+    ORDER BY id
+    `
+
+	rows, err := s.conn.Query(query, outboxPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.OutboxEntry
+	for rows.Next() {
+		var entry models.OutboxEntry
+		var payload string
+
+		if err := rows.Scan(&entry.ID, &payload, &entry.Attempts, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(payload), &entry.Message); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// MarkOutboxSent records that a message was delivered
+func (s *Store) MarkOutboxSent(id int64) error {
+	query := `UPDATE outbox SET status = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := s.conn.Exec(query, outboxSent, time.Now(), id)
+	return err
+}
+
+// MarkOutboxFailed records that a message could not be delivered and won't be retried
+func (s *Store) MarkOutboxFailed(id int64, attempts int, lastError string) error {
+	query := `UPDATE outbox SET status = $1, attempts = $2, last_error = $3, updated_at = $4 WHERE id = $5`
+
+	_, err := s.conn.Exec(query, outboxFailed, attempts, lastError, time.Now(), id)
+	return err
+}
+
+// UpdateOutboxAttempts records a failed delivery attempt that will be retried
+func (s *Store) UpdateOutboxAttempts(id int64, attempts int, lastError string) error {
+	query := `UPDATE outbox SET attempts = $1, last_error = $2, updated_at = $3 WHERE id = $4`
+
+	_, err := s.conn.Exec(query, attempts, lastError, time.Now(), id)
+	return err
+}
+
+// PurgeOutbox deletes delivered and failed messages last updated before the given time
+func (s *Store) PurgeOutbox(before time.Time) error {
+	query := `DELETE FROM outbox WHERE status != $1 AND updated_at < $2`
+
+	_, err := s.conn.Exec(query, outboxPending, before)
+	return err
+}
@@ -0,0 +1,125 @@
+// Package pgstore keeps the bot's state in PostgreSQL, so several bot
+// replicas can share it.
+package pgstore
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// Store and Tx are the PostgreSQL implementation of the store
+var (
+	_ store.Store    = (*Store)(nil)
+	_ store.Tx       = (*Tx)(nil)
+	_ store.Migrator = (*Store)(nil)
+)
+
+// Store is a PostgreSQL database
+type Store struct {
+	conn *sql.DB
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx, so queries can run
+// either standalone or as part of a transaction
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// New connects to the database at dsn and brings the schema up to date
+func New(dsn string) (*Store, error) {
+	s, err := Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Open connects to the database at dsn without touching the schema
+func Open(dsn string) (*Store, error) {
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Store{conn: conn}, nil
+}
+
+// Close closes the database connection
+func (s *Store) Close() error {
+	return s.conn.Close()
+}
+
+// Tx is a database transaction. Work that must only happen once the
+// transaction is committed can be registered with AfterCommit.
+type Tx struct {
+	tx          *sql.Tx
+	afterCommit []func()
+}
+
+// RunInTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise. AfterCommit hooks run after a successful commit.
+func (s *Store) RunInTx(fn func(tx store.Tx) error) error {
+	return s.runInTx(func(tx *Tx) error {
+		return fn(tx)
+	})
+}
+
+// runInTx is RunInTx for code in this package that needs the SQL transaction
+func (s *Store) runInTx(fn func(tx *Tx) error) error {
+	sqlTx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{tx: sqlTx}
+	if err := fn(tx); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+
+	for _, hook := range tx.afterCommit {
+		hook()
+	}
+
+	return nil
+}
+
+// AfterCommit registers a function to run once the transaction has committed
+func (tx *Tx) AfterCommit(hook func()) {
+	tx.afterCommit = append(tx.afterCommit, hook)
+}
+
+// GetUserState retrieves and locks a user's state within the transaction
+func (tx *Tx) GetUserState(userID int64) (*models.UserState, error) {
+	return getUserState(tx.tx, userID, true)
+}
+
+// SaveUserState stores a user's state within the transaction
+func (tx *Tx) SaveUserState(state *models.UserState) error {
+	return saveUserState(tx.tx, state)
+}
+
+// InsertOutbox adds a message to the outbox within the transaction
+func (tx *Tx) InsertOutbox(message models.QueuedMessage) (int64, error) {
+	return insertOutbox(tx.tx, message)
+}
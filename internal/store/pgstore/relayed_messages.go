@@ -0,0 +1,174 @@
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// SaveRelayedMessage records which message a relayed copy was delivered as
+func (s *Store) SaveRelayedMessage(relayed *models.RelayedMessage) error {
+	query := `
+    INSERT INTO relayed_messages
+    (sender_chat_id, original_message_id, recipient_chat_id, delivered_message_id, created_at, media_group_id)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (sender_chat_id, original_message_id, recipient_chat_id) DO UPDATE SET
+        delivered_message_id = excluded.delivered_message_id,
+        created_at = excluded.created_at,
+        media_group_id = excluded.media_group_id
+    `
+
+	_, err := s.conn.Exec(
+		query,
+		relayed.SenderChatID,
+		relayed.OriginalMessageID,
+		relayed.RecipientChatID,
+		relayed.DeliveredMessageID,
+		relayed.CreatedAt,
+		relayed.MediaGroupID,
+	)
+
+	return err
+}
+
+// FindCounterpart returns the ID of the matching message in the partner's chat for
+// a message in chatID. The message may be either one the user sent, or the copy
+// of a partner's message the user received. It returns 0 if there is no mapping.
+func (s *Store) FindCounterpart(chatID int64, messageID int, partnerID int64) (int, error) {
+	query := `
+    SELECT delivered_message_id FROM relayed_messages
+    WHERE sender_chat_id = $1 AND original_message_id = $2 AND recipient_chat_id = $3
+    UNION ALL
+    SELECT original_message_id FROM relayed_messages
+    WHERE recipient_chat_id = $1 AND delivered_message_id = $2 AND sender_chat_id = $3
+    LIMIT 1
+    `
+
+	var counterpart int
+	err := s.conn.QueryRow(query, chatID, messageID, partnerID).Scan(&counterpart)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return counterpart, err
+}
+
+// GetRelayedMessage returns the delivered copy of a message sent to recipientChatID,
+// or nil if it was never relayed there
+func (s *Store) GetRelayedMessage(senderChatID int64, originalMessageID int, recipientChatID int64) (*models.RelayedMessage, error) {
+	query := `
+    SELECT delivered_message_id, created_at FROM relayed_messages
+    WHERE sender_chat_id = $1 AND original_message_id = $2 AND recipient_chat_id = $3
+    `
+
+	relayed := &models.RelayedMessage{
+		SenderChatID:      senderChatID,
+		OriginalMessageID: originalMessageID,
+		RecipientChatID:   recipientChatID,
+	}
+
+	err := s.conn.QueryRow(query, senderChatID, originalMessageID, recipientChatID).Scan(&relayed.DeliveredMessageID, &relayed.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return relayed, nil
+}
+
+// GetRelayedCopies returns every delivered copy of a message
+func (s *Store) GetRelayedCopies(senderChatID int64, originalMessageID int) ([]models.RelayedMessage, error) {
+	query := `
+    SELECT recipient_chat_id, delivered_message_id, created_at FROM relayed_messages
+    WHERE sender_chat_id = $1 AND original_message_id = $2
+    `
+
+	rows, err := s.conn.Query(query, senderChatID, originalMessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copies []models.RelayedMessage
+	for rows.Next() {
+		relayed := models.RelayedMessage{
+			SenderChatID:      senderChatID,
+			OriginalMessageID: originalMessageID,
+		}
+
+		if err := rows.Scan(&relayed.RecipientChatID, &relayed.DeliveredMessageID, &relayed.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		copies = append(copies, relayed)
+	}
+
+	return copies, rows.Err()
+}
+
+// GetAlbumMessageIDs returns every message the sender relayed in the same album
+// as the given one, or nil if it wasn't relayed as part of an album
+func (s *Store) GetAlbumMessageIDs(senderChatID int64, originalMessageID int) ([]int, error) {
+	query := `
+    SELECT DISTINCT album.original_message_id
+    FROM relayed_messages AS part
+    JOIN relayed_messages AS album
+        ON album.sender_chat_id = part.sender_chat_id AND album.media_group_id = part.media_group_id
+    WHERE part.sender_chat_id = $1 AND part.original_message_id = $2 AND part.media_group_id != ''
+    ORDER BY album.original_message_id
+    `
+
+	rows, err := s.conn.Query(query, senderChatID, originalMessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messageIDs []int
+	for rows.Next() {
+		var messageID int
+		if err := rows.Scan(&messageID); err != nil {
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+
+	return messageIDs, rows.Err()
+}
+
+// GetLastRelayedMessageID returns the most recent message the user had relayed,
+// or 0 if there is none
+func (s *Store) GetLastRelayedMessageID(senderChatID int64) (int, error) {
+	query := `SELECT COALESCE(MAX(original_message_id), 0) FROM relayed_messages WHERE sender_chat_id = $1`
+
+	var originalMessageID int
+	err := s.conn.QueryRow(query, senderChatID).Scan(&originalMessageID)
+
+	return originalMessageID, err
+}
+
+// IsRelayedCopy reports whether a message in chatID is a copy of someone else's message
+func (s *Store) IsRelayedCopy(chatID int64, messageID int) (bool, error) {
+	query := `
+    SELECT EXISTS (
+        SELECT 1 FROM relayed_messages WHERE recipient_chat_id = $1 AND delivered_message_id = $2
+    )
+    `
+
+	var exists bool
+	err := s.conn.QueryRow(query, chatID, messageID).Scan(&exists)
+
+	return exists, err
+}
+
+// DeleteRelayedMessage forgets every delivered copy of a message
+func (s *Store) DeleteRelayedMessage(senderChatID int64, originalMessageID int) error {
+	_, err := s.conn.Exec(
+		`DELETE FROM relayed_messages WHERE sender_chat_id = $1 AND original_message_id = $2`,
+		senderChatID,
+		originalMessageID,
+	)
+	return err
+}
@@ -0,0 +1,136 @@
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// reportColumns are the columns read by scanReport
+const reportColumns = `id, session_id, reporter_id, reported_id, reason, details, status, created_at, resolved_by, resolved_at`
+
+// CreateReport stores a pending report and returns its ID. It returns false
+// if the reporter already reported this chat session.
+func (s *Store) CreateReport(report *models.Report) (int64, bool, error) {
+	query := `
+    INSERT INTO reports (session_id, reporter_id, reported_id, reason, details, status, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (session_id, reporter_id) DO NOTHING
+    RETURNING id
+    `
+
+	var id int64
+	err := s.conn.QueryRow(
+		query,
+		report.SessionID,
+		report.ReporterID,
+		report.ReportedID,
+		string(report.Reason),
+		report.Details,
+		string(models.ReportPending),
+		time.Now(),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+// GetReport returns a report by ID, or nil if there is none
+func (s *Store) GetReport(id int64) (*models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE id = $1`
+
+	report, err := scanReport(s.conn.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return report, err
+}
+
+// GetPendingReports returns reports no moderator has acted on yet, oldest first
+func (s *Store) GetPendingReports(limit int) ([]models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE status = $1 ORDER BY id LIMIT $2`
+
+	rows, err := s.conn.Query(query, string(models.ReportPending), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, rows.Err()
+}
+
+// GetReportsAbout returns the reports about a user, newest first
+func (s *Store) GetReportsAbout(userID int64, limit int) ([]models.Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE reported_id = $1 ORDER BY id DESC LIMIT $2`
+
+	rows, err := s.conn.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, rows.Err()
+}
+
+// ResolveReport records a moderator's decision on a pending report within the
+// transaction. It reports false if the report was already resolved.
+func (tx *Tx) ResolveReport(id int64, status models.ReportStatus, moderatorID int64) (bool, error) {
+	query := `
+    UPDATE reports SET status = $1, resolved_by = $2, resolved_at = $3
+    WHERE id = $4 AND status = $5
+    `
+
+	result, err := tx.tx.Exec(query, string(status), moderatorID, time.Now(), id, string(models.ReportPending))
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// scanReport reads a report selected with reportColumns
+func scanReport(row rowScanner) (*models.Report, error) {
+	var report models.Report
+	var reason, status string
+	var resolvedAt sql.NullTime
+
+	err := row.Scan(&report.ID, &report.SessionID, &report.ReporterID, &report.ReportedID, &reason, &report.Details,
+		&status, &report.CreatedAt, &report.ResolvedBy, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Reason = models.ReportReason(reason)
+	report.Status = models.ReportStatus(status)
+	if resolvedAt.Valid {
+		report.ResolvedAt = &resolvedAt.Time
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,40 @@
+package pgstore
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// GetStats counts users, chats started since the given time, pending reports
+// and bans and shadowbans in effect
+func (s *Store) GetStats(since time.Time) (*models.Stats, error) {
+	query := `
+    SELECT
+        (SELECT COUNT(*) FROM users),
+        (SELECT COUNT(*) FROM users WHERE is_active AND NOT unreachable),
+        (SELECT COUNT(*) FROM users WHERE current_chat != 0),
+        (SELECT COUNT(*) FROM users WHERE match_start_time IS NOT NULL AND current_chat = 0 AND NOT unreachable),
+        (SELECT COUNT(*) FROM chat_sessions WHERE started_at >= $1),
+        (SELECT COUNT(*) FROM reports WHERE status = $2),
+        (SELECT COUNT(*) FROM bans WHERE kind != $3 AND (expires_at IS NULL OR expires_at > $4)),
+        (SELECT COUNT(*) FROM bans WHERE kind = $3 AND (expires_at IS NULL OR expires_at > $4))
+    `
+
+	var stats models.Stats
+	err := s.conn.QueryRow(query, since, string(models.ReportPending), string(models.BanShadow), time.Now()).Scan(
+		&stats.Users,
+		&stats.OnlineUsers,
+		&stats.ChattingUsers,
+		&stats.WaitingUsers,
+		&stats.ChatsStarted,
+		&stats.PendingReports,
+		&stats.BannedUsers,
+		&stats.ShadowbannedUsers,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,204 @@
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// GetUserState retrieves a user's state from the database
+func (s *Store) GetUserState(userID int64) (*models.UserState, error) {
+	return getUserState(s.conn, userID, false)
+}
+
+// getUserState retrieves a user's state using the given connection or
+// transaction. In a transaction the row is locked, so the state can't change
+// before it is saved back.
+func getUserState(q dbtx, userID int64, forUpdate bool) (*models.UserState, error) {
+	query := `
+    SELECT is_active, current_chat, last_activity, country, language, gender, match_start_time,
+           pref_countries, pref_languages, pref_genders, unreachable
+    FROM users WHERE user_id = $1
+    `
+	if forUpdate {
+		query += "FOR UPDATE"
+	}
+
+	state := models.UserState{UserID: userID}
+	var matchStartTime sql.NullTime
+	var prefCountries, prefLanguages, prefGenders string
+
+	err := q.QueryRow(query, userID).Scan(
+		&state.IsActive,
+		&state.CurrentChat,
+		&state.LastActivity,
+		&state.Settings.Profile.Country,
+		&state.Settings.Profile.Language,
+		&state.Settings.Profile.Gender,
+		&matchStartTime,
+		&prefCountries,
+		&prefLanguages,
+		&prefGenders,
+		&state.Unreachable,
+	)
+	if err != nil {
+		// If no record is found, create a new user state
+		if err == sql.ErrNoRows {
+			return models.NewUserState(userID), nil
+		}
+		return nil, err
+	}
+
+	state.Settings.Preferences = models.PartnerPreferences{
+		Countries: models.SplitList(prefCountries),
+		Languages: models.SplitList(prefLanguages),
+		Genders:   models.SplitList(prefGenders),
+	}
+
+	if matchStartTime.Valid {
+		state.MatchStartTime = &matchStartTime.Time
+	}
+
+	return &state, nil
+}
+
+// SaveUserState stores a user's state in the database. The current chat is
+// only written for new users; use PairUsers and EndChat to change it.
+func (s *Store) SaveUserState(state *models.UserState) error {
+	return saveUserState(s.conn, state)
+}
+
+// saveUserState stores a user's state using the given connection or transaction
+func saveUserState(e dbtx, state *models.UserState) error {
+	query := `
+    INSERT INTO users
+    (user_id, is_active, current_chat, last_activity, country, language, gender, match_start_time,
+     pref_countries, pref_languages, pref_genders, unreachable)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    ON CONFLICT (user_id) DO UPDATE SET
+        is_active = excluded.is_active,
+        last_activity = excluded.last_activity,
+        country = excluded.country,
+        language = excluded.language,
+        gender = excluded.gender,
+        match_start_time = excluded.match_start_time,
+        pref_countries = excluded.pref_countries,
+        pref_languages = excluded.pref_languages,
+        pref_genders = excluded.pref_genders,
+        unreachable = excluded.unreachable
+    `
+
+	var matchStartTime sql.NullTime
+	if state.MatchStartTime != nil {
+		matchStartTime = sql.NullTime{Time: *state.MatchStartTime, Valid: true}
+	}
+
+	_, err := e.Exec(
+		query,
+		state.UserID,
+		state.IsActive,
+		state.CurrentChat,
+		state.LastActivity,
+		state.Settings.Profile.Country,
+		state.Settings.Profile.Language,
+		state.Settings.Profile.Gender,
+		matchStartTime,
+		models.JoinList(state.Settings.Preferences.Countries),
+		models.JoinList(state.Settings.Preferences.Languages),
+		models.JoinList(state.Settings.Preferences.Genders),
+		state.Unreachable,
+	)
+
+	return err
+}
+
+// GetActiveUsers returns the count of reachable online users
+func (s *Store) GetActiveUsers() (int, error) {
+	query := `SELECT COUNT(*) FROM users WHERE is_active AND NOT unreachable`
+
+	var count int
+	err := s.conn.QueryRow(query).Scan(&count)
+
+	return count, err
+}
+
+// MarkReachable clears the unreachable flag once a user talks to the bot again
+func (s *Store) MarkReachable(userID int64) error {
+	_, err := s.conn.Exec(`UPDATE users SET unreachable = FALSE WHERE user_id = $1 AND unreachable`, userID)
+	return err
+}
+
+// TouchActivity records that the user was just active in their chat
+func (s *Store) TouchActivity(userID int64) error {
+	_, err := s.conn.Exec(`UPDATE users SET last_activity = $1 WHERE user_id = $2`, time.Now(), userID)
+	return err
+}
+
+// FindPotentialMatches returns free, online users. Users waiting in the match
+// queue come first, longest-waiting first; the rest are in random order.
+// Users banned outright, users blocked by or blocking the user, and partners
+// from chats that ended after recentSince are left out. Shadowbanned users only
+// meet each other.
+func (s *Store) FindPotentialMatches(userID int64, recentSince time.Time) ([]int64, error) {
+	query := `
+    WITH active_bans AS (
+        SELECT user_id, kind FROM bans WHERE expires_at IS NULL OR expires_at > $3
+    )
+    SELECT user_id FROM users u
+    WHERE is_active
+      AND current_chat = 0
+      AND NOT unreachable
+      AND user_id != $1
+      AND NOT EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = u.user_id AND b.kind != $4)
+      AND EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = u.user_id)
+        = EXISTS (SELECT 1 FROM active_bans b WHERE b.user_id = $1 AND b.kind = $4)
+      AND NOT EXISTS (
+          SELECT 1 FROM user_blocks b
+          WHERE (b.blocker_id = $1 AND b.blocked_id = u.user_id)
+             OR (b.blocker_id = u.user_id AND b.blocked_id = $1)
+      )
+      AND NOT EXISTS (
+          SELECT 1 FROM chat_sessions s
+          WHERE s.ended_at >= $2
+            AND ((s.user1_id = $1 AND s.user2_id = u.user_id)
+              OR (s.user2_id = $1 AND s.user1_id = u.user_id))
+      )
+    ORDER BY match_start_time NULLS LAST, RANDOM()
+    `
+
+	return queryUserIDs(s.conn, query, userID, recentSince, time.Now(), string(models.BanShadow))
+}
+
+// GetWaitingUsers returns the users currently in the match queue, longest-waiting first
+func (s *Store) GetWaitingUsers() ([]int64, error) {
+	query := `
+    SELECT user_id FROM users
+    WHERE match_start_time IS NOT NULL
+      AND current_chat = 0
+      AND NOT unreachable
+    ORDER BY match_start_time
+    `
+
+	return queryUserIDs(s.conn, query)
+}
+
+// queryUserIDs runs a query selecting a single user_id column
+func queryUserIDs(q dbtx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
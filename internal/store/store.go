@@ -0,0 +1,248 @@
+// Package store defines the storage the bot relies on, independent of the
+// database behind it.
+package store
+
+import (
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+// Store is everything the bot keeps between updates
+type Store interface {
+	UserStore
+	MatchStore
+	ChatSessionStore
+	ConversationStore
+	RelayStore
+	OutboxStore
+	ReportStore
+	BanStore
+	AuditStore
+	StatsStore
+
+	// RunInTx runs fn in a transaction, committing if it returns nil and
+	// rolling back otherwise. AfterCommit hooks run after a successful commit.
+	RunInTx(fn func(tx Tx) error) error
+
+	// Close releases the store's resources
+	Close() error
+}
+
+// Migrator is a store whose schema version can be changed by hand
+type Migrator interface {
+	// Migrate applies every migration that hasn't been applied yet
+	Migrate() error
+
+	// MigrateTo applies or rolls back migrations until the schema is at the
+	// given version. Version 0 rolls back everything.
+	MigrateTo(version int) error
+
+	// MigrationStatus lists every known migration and whether it has been applied
+	MigrationStatus() ([]MigrationStatus, error)
+
+	Close() error
+}
+
+// MigrationStatus tells whether a migration has been applied and when
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Tx is the part of the store that can be used within a transaction
+type Tx interface {
+	// GetUserState returns the user's state, which nobody else can change
+	// until the transaction ends
+	GetUserState(userID int64) (*models.UserState, error)
+	SaveUserState(state *models.UserState) error
+
+	// PairUsers puts two users in a chat with each other if both are still
+	// free, takes them out of the match queue and opens a chat session. It
+	// reports false, changing nothing, if another pairing got there first.
+	PairUsers(user1 int64, user2 int64) (bool, error)
+
+	// EndChat ends the user's current chat and closes its session. It returns
+	// the partner whose side was ended too, or 0 if they had already left, and
+	// false if the user was not in a chat.
+	EndChat(userID int64, reason models.EndReason) (int64, bool, error)
+
+	// GetCurrentChatSession returns the user's open chat session, or nil
+	GetCurrentChatSession(userID int64) (*models.ChatSession, error)
+
+	// BlockUser keeps blockedID from being matched with blockerID ever again
+	BlockUser(blockerID int64, blockedID int64) error
+
+	// ResolveReport records a moderator's decision on a pending report. It
+	// reports false, changing nothing, if the report was already resolved.
+	ResolveReport(id int64, status models.ReportStatus, moderatorID int64) (bool, error)
+
+	// BanUser bans a user, replacing any earlier ban
+	BanUser(ban *models.Ban) error
+
+	// UnbanUser lifts the user's ban. It reports false if there was none.
+	UnbanUser(userID int64) (bool, error)
+
+	// ExpireBans lifts the bans that expired by the given time and returns them
+	ExpireBans(now time.Time) ([]models.Ban, error)
+
+	// RecordAdminAction adds an entry to the audit log
+	RecordAdminAction(action *models.AdminAction) error
+
+	InsertOutbox(message models.QueuedMessage) (int64, error)
+
+	// AfterCommit registers a function to run once the transaction has committed
+	AfterCommit(hook func())
+}
+
+// UserStore keeps user states
+type UserStore interface {
+	// GetUserState returns the user's state, or a new unsaved state if the
+	// user is unknown
+	GetUserState(userID int64) (*models.UserState, error)
+
+	// SaveUserState stores the user's state. The current chat is only written
+	// for new users; PairUsers and EndChat change it.
+	SaveUserState(state *models.UserState) error
+
+	// GetActiveUsers returns how many reachable users are online
+	GetActiveUsers() (int, error)
+
+	// MarkReachable clears the unreachable flag once a user talks to the bot again
+	MarkReachable(userID int64) error
+
+	// TouchActivity records that the user was just active in their chat
+	TouchActivity(userID int64) error
+}
+
+// MatchStore finds and pairs chat partners
+type MatchStore interface {
+	// FindPotentialMatches returns online, free and reachable users other
+	// than userID, longest waiting first. Users banned outright, users either
+	// of the two has blocked and partners from chats that ended after
+	// recentSince are left out. Shadowbanned users are only matched with each
+	// other.
+	FindPotentialMatches(userID int64, recentSince time.Time) ([]int64, error)
+
+	// GetWaitingUsers returns the users in the match queue, longest waiting first
+	GetWaitingUsers() ([]int64, error)
+
+	// PairUsers is Tx.PairUsers in a transaction of its own
+	PairUsers(user1 int64, user2 int64) (bool, error)
+
+	// EndChat is Tx.EndChat in a transaction of its own
+	EndChat(userID int64, reason models.EndReason) (int64, bool, error)
+
+	// BlockUser is Tx.BlockUser outside a transaction. Blocking someone twice
+	// changes nothing.
+	BlockUser(blockerID int64, blockedID int64) error
+}
+
+// ChatSessionStore keeps the history of chats
+type ChatSessionStore interface {
+	// GetActiveChats returns every ongoing chat
+	GetActiveChats() ([]models.ActiveChat, error)
+
+	// CountChatMessage adds a message sent by the user to their open chat's count
+	CountChatMessage(userID int64) error
+
+	// GetChatSession returns a chat session by ID, or nil if there is none
+	GetChatSession(id int64) (*models.ChatSession, error)
+
+	// GetCurrentChatSession returns the user's open chat session, or nil
+	GetCurrentChatSession(userID int64) (*models.ChatSession, error)
+
+	// GetChatSessions returns the user's most recent chat sessions, newest first
+	GetChatSessions(userID int64, limit int) ([]models.ChatSession, error)
+}
+
+// ConversationStore keeps pending answers to bot prompts
+type ConversationStore interface {
+	// GetConversation returns the user's pending input state, idle if there is none
+	GetConversation(userID int64) (*models.Conversation, error)
+	SaveConversation(conversation *models.Conversation) error
+	ClearConversation(userID int64) error
+}
+
+// RelayStore maps relayed messages to their delivered copies
+type RelayStore interface {
+	SaveRelayedMessage(relayed *models.RelayedMessage) error
+
+	// FindCounterpart returns the matching message in the partner's chat for a
+	// message in chatID, sent or received, or 0 if there is no mapping
+	FindCounterpart(chatID int64, messageID int, partnerID int64) (int, error)
+
+	// GetRelayedMessage returns the copy of a message delivered to
+	// recipientChatID, or nil if it was never relayed there
+	GetRelayedMessage(senderChatID int64, originalMessageID int, recipientChatID int64) (*models.RelayedMessage, error)
+
+	// GetRelayedCopies returns every delivered copy of a message
+	GetRelayedCopies(senderChatID int64, originalMessageID int) ([]models.RelayedMessage, error)
+
+	// GetAlbumMessageIDs returns every message the sender relayed in the same
+	// album as the given one, or nil if it wasn't relayed as part of an album
+	GetAlbumMessageIDs(senderChatID int64, originalMessageID int) ([]int, error)
+
+	// GetLastRelayedMessageID returns the user's most recent relayed message, or 0
+	GetLastRelayedMessageID(senderChatID int64) (int, error)
+
+	// IsRelayedCopy reports whether a message in chatID is a copy of someone else's
+	IsRelayedCopy(chatID int64, messageID int) (bool, error)
+
+	// DeleteRelayedMessage forgets every delivered copy of a message
+	DeleteRelayedMessage(senderChatID int64, originalMessageID int) error
+}
+
+// OutboxStore keeps messages until they are delivered
+type OutboxStore interface {
+	// InsertOutbox adds a message to the outbox and returns its ID
+	InsertOutbox(message models.QueuedMessage) (int64, error)
+
+	// GetPendingOutbox returns the messages not delivered yet, oldest first
+	GetPendingOutbox() ([]models.OutboxEntry, error)
+
+	MarkOutboxSent(id int64) error
+	MarkOutboxFailed(id int64, attempts int, lastError string) error
+	UpdateOutboxAttempts(id int64, attempts int, lastError string) error
+
+	// PurgeOutbox deletes delivered and failed messages last updated before the given time
+	PurgeOutbox(before time.Time) error
+}
+
+// ReportStore keeps reports about chat partners for moderators to review
+type ReportStore interface {
+	// CreateReport stores a pending report and returns its ID. It returns
+	// false if the reporter already reported this chat session.
+	CreateReport(report *models.Report) (int64, bool, error)
+
+	// GetReport returns a report by ID, or nil if there is none
+	GetReport(id int64) (*models.Report, error)
+
+	// GetPendingReports returns reports no moderator has acted on yet, oldest first
+	GetPendingReports(limit int) ([]models.Report, error)
+
+	// GetReportsAbout returns the reports about a user, newest first
+	GetReportsAbout(userID int64, limit int) ([]models.Report, error)
+}
+
+// BanStore keeps banned users
+type BanStore interface {
+	// GetBan returns the user's ban in effect, or nil if they aren't banned
+	// or their ban has expired
+	GetBan(userID int64) (*models.Ban, error)
+}
+
+// AuditStore keeps the log of admin actions
+type AuditStore interface {
+	// GetAdminActions returns the actions taken on a user, newest first
+	GetAdminActions(targetID int64, limit int) ([]models.AdminAction, error)
+}
+
+// StatsStore summarizes the bot's usage for admins
+type StatsStore interface {
+	// GetStats counts users, chats started since the given time, pending
+	// reports and bans and shadowbans in effect
+	GetStats(since time.Time) (*models.Stats, error)
+}
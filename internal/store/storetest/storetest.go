@@ -0,0 +1,1264 @@
+// Package storetest is a conformance suite every store implementation must pass
+package storetest
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+)
+
+// Opener returns an empty store for a single test
+type Opener func(t *testing.T) store.Store
+
+// Run runs the conformance suite against the stores returned by open
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"UserRoundTrip", testUserRoundTrip},
+		{"SaveKeepsCurrentChat", testSaveKeepsCurrentChat},
+		{"PairUsers", testPairUsers},
+		{"EndChat", testEndChat},
+		{"ChatSessions", testChatSessions},
+		{"FindPotentialMatches", testFindPotentialMatches},
+		{"BlocksAndRecentPartners", testBlocksAndRecentPartners},
+		{"WaitingAndActiveUsers", testWaitingAndActiveUsers},
+		{"Conversations", testConversations},
+		{"RelayedMessages", testRelayedMessages},
+		{"AlbumMessages", testAlbumMessages},
+		{"Outbox", testOutbox},
+		{"Reports", testReports},
+		{"Bans", testBans},
+		{"Shadowbans", testShadowbans},
+		{"ExpireBans", testExpireBans},
+		{"AdminActions", testAdminActions},
+		{"Stats", testStats},
+		{"RunInTx", testRunInTx},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+// baseTime is a fixed time at second precision, which every store keeps
+var baseTime = time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+// saveUser stores an online user, waiting for a match since the given offset
+// from baseTime unless waiting is negative
+func saveUser(t *testing.T, s store.Store, userID int64, waiting time.Duration) {
+	t.Helper()
+
+	state := models.NewUserState(userID)
+	state.IsActive = true
+	state.LastActivity = baseTime
+	if waiting >= 0 {
+		matchStart := baseTime.Add(waiting)
+		state.MatchStartTime = &matchStart
+	}
+
+	if err := s.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState(%d): %v", userID, err)
+	}
+}
+
+func getUser(t *testing.T, s store.Store, userID int64) *models.UserState {
+	t.Helper()
+
+	state, err := s.GetUserState(userID)
+	if err != nil {
+		t.Fatalf("GetUserState(%d): %v", userID, err)
+	}
+
+	return state
+}
+
+func pair(t *testing.T, s store.Store, user1, user2 int64) {
+	t.Helper()
+
+	paired, err := s.PairUsers(user1, user2)
+	if err != nil {
+		t.Fatalf("PairUsers(%d, %d): %v", user1, user2, err)
+	}
+	if !paired {
+		t.Fatalf("PairUsers(%d, %d) = false, want true", user1, user2)
+	}
+}
+
+func assertIDs(t *testing.T, what string, got, want []int64) {
+	t.Helper()
+
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func testUserRoundTrip(t *testing.T, s store.Store) {
+	unknown := getUser(t, s, 1)
+	if unknown.UserID != 1 || unknown.IsActive || unknown.CurrentChat != 0 || unknown.MatchStartTime != nil {
+		t.Errorf("unknown user = %+v, want a new state", unknown)
+	}
+
+	matchStart := baseTime.Add(time.Minute)
+	state := &models.UserState{
+		UserID:       1,
+		IsActive:     true,
+		LastActivity: baseTime,
+		Settings: models.UserSettings{
+			Profile: models.UserProfile{Country: "DE", Language: "de", Gender: "female"},
+			Preferences: models.PartnerPreferences{
+				Countries: []string{"DE", "AT"},
+				Languages: []string{"de"},
+			},
+		},
+		MatchStartTime: &matchStart,
+		Unreachable:    true,
+	}
+	if err := s.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	loaded := getUser(t, s, 1)
+	if !loaded.LastActivity.Equal(baseTime) {
+		t.Errorf("LastActivity = %v, want %v", loaded.LastActivity, baseTime)
+	}
+	if loaded.MatchStartTime == nil || !loaded.MatchStartTime.Equal(matchStart) {
+		t.Errorf("MatchStartTime = %v, want %v", loaded.MatchStartTime, matchStart)
+	}
+
+	loaded.LastActivity, loaded.MatchStartTime = state.LastActivity, state.MatchStartTime
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("loaded state = %+v, want %+v", loaded, state)
+	}
+
+	// Changing the loaded state doesn't change the stored one
+	loaded.Settings.Preferences.Countries[0] = "FR"
+	if again := getUser(t, s, 1); again.Settings.Preferences.Countries[0] != "DE" {
+		t.Errorf("stored preferences changed to %v without saving", again.Settings.Preferences.Countries)
+	}
+
+	if err := s.MarkReachable(1); err != nil {
+		t.Fatalf("MarkReachable: %v", err)
+	}
+	if getUser(t, s, 1).Unreachable {
+		t.Error("user still unreachable after MarkReachable")
+	}
+
+	// TouchActivity and MarkReachable ignore unknown users
+	if err := s.TouchActivity(99); err != nil {
+		t.Fatalf("TouchActivity: %v", err)
+	}
+	if err := s.MarkReachable(99); err != nil {
+		t.Fatalf("MarkReachable: %v", err)
+	}
+
+	if err := s.TouchActivity(1); err != nil {
+		t.Fatalf("TouchActivity: %v", err)
+	}
+	if touched := getUser(t, s, 1); !touched.LastActivity.After(baseTime) {
+		t.Errorf("LastActivity = %v after TouchActivity, want now", touched.LastActivity)
+	}
+}
+
+func testSaveKeepsCurrentChat(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, 0)
+	saveUser(t, s, 2, time.Second)
+
+	stale := getUser(t, s, 1)
+	pair(t, s, 1, 2)
+
+	// A state read before the pairing must not undo it
+	stale.Settings.Profile.Country = "FR"
+	if err := s.SaveUserState(stale); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	saved := getUser(t, s, 1)
+	if saved.CurrentChat != 2 {
+		t.Errorf("CurrentChat = %d, want 2", saved.CurrentChat)
+	}
+	if saved.Settings.Profile.Country != "FR" {
+		t.Errorf("Country = %q, want FR", saved.Settings.Profile.Country)
+	}
+
+	// New users get the current chat they are saved with
+	state := models.NewUserState(3)
+	state.CurrentChat = 4
+	if err := s.SaveUserState(state); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+	if got := getUser(t, s, 3).CurrentChat; got != 4 {
+		t.Errorf("new user CurrentChat = %d, want 4", got)
+	}
+}
+
+func testPairUsers(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, 0)
+	saveUser(t, s, 2, time.Second)
+	saveUser(t, s, 3, 2*time.Second)
+
+	pair(t, s, 1, 2)
+
+	for _, id := range []int64{1, 2} {
+		u := getUser(t, s, id)
+		if u.CurrentChat != 3-id {
+			t.Errorf("user %d CurrentChat = %d, want %d", id, u.CurrentChat, 3-id)
+		}
+		if u.MatchStartTime != nil {
+			t.Errorf("user %d is still waiting for a match", id)
+		}
+	}
+
+	session, err := s.GetCurrentChatSession(2)
+	if err != nil {
+		t.Fatalf("GetCurrentChatSession: %v", err)
+	}
+	if session == nil || session.User1ID != 1 || session.User2ID != 2 || !session.IsOpen() {
+		t.Errorf("session = %+v, want an open chat between 1 and 2", session)
+	}
+
+	// Users who are taken, unreachable, unknown or the same can't be paired
+	unreachable := getUser(t, s, 3)
+	unreachable.Unreachable = true
+	if err := s.SaveUserState(unreachable); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+	saveUser(t, s, 4, -1)
+
+	for _, p := range [][2]int64{{1, 4}, {4, 2}, {3, 4}, {4, 99}, {4, 4}} {
+		paired, err := s.PairUsers(p[0], p[1])
+		if err != nil {
+			t.Fatalf("PairUsers(%d, %d): %v", p[0], p[1], err)
+		}
+		if paired {
+			t.Errorf("PairUsers(%d, %d) = true, want false", p[0], p[1])
+		}
+	}
+
+	if got := getUser(t, s, 4).CurrentChat; got != 0 {
+		t.Errorf("user 4 CurrentChat = %d after failed pairings, want 0", got)
+	}
+}
+
+func testEndChat(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, -1)
+	saveUser(t, s, 2, -1)
+	pair(t, s, 1, 2)
+
+	partnerID, ended, err := s.EndChat(2, models.EndReasonInactivity)
+	if err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+	if !ended || partnerID != 1 {
+		t.Errorf("EndChat = (%d, %v), want (1, true)", partnerID, ended)
+	}
+
+	for _, id := range []int64{1, 2} {
+		if chat := getUser(t, s, id).CurrentChat; chat != 0 {
+			t.Errorf("user %d CurrentChat = %d, want 0", id, chat)
+		}
+	}
+
+	sessions, err := s.GetChatSessions(1, 10)
+	if err != nil {
+		t.Fatalf("GetChatSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].IsOpen() || sessions[0].EndReason != models.EndReasonInactivity {
+		t.Errorf("sessions = %+v, want one ended for inactivity", sessions)
+	}
+
+	partnerID, ended, err = s.EndChat(1, models.EndReasonUser)
+	if err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+	if ended || partnerID != 0 {
+		t.Errorf("EndChat without a chat = (%d, %v), want (0, false)", partnerID, ended)
+	}
+
+	// The users can be paired again
+	pair(t, s, 2, 1)
+}
+
+func testChatSessions(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, -1)
+	saveUser(t, s, 2, -1)
+	saveUser(t, s, 3, -1)
+
+	pair(t, s, 1, 2)
+	first, err := s.GetCurrentChatSession(1)
+	if err != nil || first == nil {
+		t.Fatalf("GetCurrentChatSession = %v, %v", first, err)
+	}
+
+	for _, id := range []int64{1, 1, 2} {
+		if err := s.CountChatMessage(id); err != nil {
+			t.Fatalf("CountChatMessage: %v", err)
+		}
+	}
+	if _, _, err := s.EndChat(1, models.EndReasonUser); err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+
+	// Messages outside a chat aren't counted anywhere
+	if err := s.CountChatMessage(1); err != nil {
+		t.Fatalf("CountChatMessage: %v", err)
+	}
+
+	pair(t, s, 3, 1)
+
+	ended, err := s.GetChatSession(first.ID)
+	if err != nil {
+		t.Fatalf("GetChatSession: %v", err)
+	}
+	if ended == nil || ended.User1Messages != 2 || ended.User2Messages != 1 {
+		t.Errorf("ended session = %+v, want 2 and 1 messages", ended)
+	}
+	if ended != nil && (ended.EndedAt == nil || ended.EndReason != models.EndReasonUser) {
+		t.Errorf("ended session = %+v, want ended by the user", ended)
+	}
+
+	missing, err := s.GetChatSession(first.ID + 1000)
+	if err != nil || missing != nil {
+		t.Errorf("GetChatSession(unknown) = %v, %v, want nil", missing, err)
+	}
+
+	sessions, err := s.GetChatSessions(1, 10)
+	if err != nil {
+		t.Fatalf("GetChatSessions: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].Partner(1) != 3 || sessions[1].ID != first.ID {
+		t.Errorf("sessions = %+v, want the chat with 3 before the chat with 2", sessions)
+	}
+
+	limited, err := s.GetChatSessions(1, 1)
+	if err != nil {
+		t.Fatalf("GetChatSessions: %v", err)
+	}
+	if len(limited) != 1 || !limited[0].IsOpen() {
+		t.Errorf("limited sessions = %+v, want only the open one", limited)
+	}
+
+	current, err := s.GetCurrentChatSession(2)
+	if err != nil || current != nil {
+		t.Errorf("GetCurrentChatSession(2) = %+v, %v, want nil", current, err)
+	}
+
+	chats, err := s.GetActiveChats()
+	if err != nil {
+		t.Fatalf("GetActiveChats: %v", err)
+	}
+	if len(chats) != 1 || chats[0].User1ID != 3 || chats[0].User2ID != 1 || chats[0].SessionID != sessions[0].ID {
+		t.Errorf("active chats = %+v, want the chat between 3 and 1", chats)
+	}
+	if len(chats) == 1 && chats[0].LastActivity1.IsZero() {
+		t.Errorf("active chat has no last activity: %+v", chats[0])
+	}
+}
+
+func testFindPotentialMatches(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, 2*time.Second)
+	saveUser(t, s, 2, 0)
+	saveUser(t, s, 3, time.Second)
+	saveUser(t, s, 4, -1)
+
+	offline := models.NewUserState(5)
+	if err := s.SaveUserState(offline); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	saveUser(t, s, 6, -1)
+	unreachable := getUser(t, s, 6)
+	unreachable.Unreachable = true
+	if err := s.SaveUserState(unreachable); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	saveUser(t, s, 7, -1)
+	saveUser(t, s, 8, -1)
+	pair(t, s, 7, 8)
+
+	matches, err := s.FindPotentialMatches(1, time.Now())
+	if err != nil {
+		t.Fatalf("FindPotentialMatches: %v", err)
+	}
+	assertIDs(t, "FindPotentialMatches(1)", matches, []int64{2, 3, 4})
+
+	matches, err = s.FindPotentialMatches(4, time.Now())
+	if err != nil {
+		t.Fatalf("FindPotentialMatches: %v", err)
+	}
+	assertIDs(t, "FindPotentialMatches(4)", matches, []int64{2, 3, 1})
+}
+
+func testBlocksAndRecentPartners(t *testing.T, s store.Store) {
+	for id := int64(1); id <= 4; id++ {
+		saveUser(t, s, id, time.Duration(id)*time.Second)
+	}
+
+	findMatches := func(userID int64, recentSince time.Time) []int64 {
+		t.Helper()
+
+		matches, err := s.FindPotentialMatches(userID, recentSince)
+		if err != nil {
+			t.Fatalf("FindPotentialMatches: %v", err)
+		}
+		return matches
+	}
+
+	// Blocks work both ways, and blocking twice is fine
+	for i := 0; i < 2; i++ {
+		if err := s.BlockUser(1, 2); err != nil {
+			t.Fatalf("BlockUser: %v", err)
+		}
+	}
+	assertIDs(t, "matches of the blocker", findMatches(1, time.Now()), []int64{3, 4})
+	assertIDs(t, "matches of the blocked user", findMatches(2, time.Now()), []int64{3, 4})
+
+	// A partner from a chat that just ended is left out until the window passes
+	pair(t, s, 1, 3)
+	if _, _, err := s.EndChat(1, models.EndReasonUser); err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+	assertIDs(t, "matches after a recent chat", findMatches(1, time.Now().Add(-time.Hour)), []int64{4})
+	assertIDs(t, "matches of the recent partner", findMatches(3, time.Now().Add(-time.Hour)), []int64{2, 4})
+	assertIDs(t, "matches after the window", findMatches(1, time.Now().Add(time.Hour)), []int64{4, 3})
+
+	// Blocks and session lookups in a transaction are rolled back with it
+	pair(t, s, 2, 4)
+	errRollback := errors.New("rollback")
+	err := s.RunInTx(func(tx store.Tx) error {
+		session, err := tx.GetCurrentChatSession(4)
+		if err != nil {
+			return err
+		}
+		if session == nil || session.Partner(4) != 2 {
+			t.Errorf("GetCurrentChatSession in tx = %+v, want the chat with 2", session)
+		}
+
+		if err := tx.BlockUser(3, 4); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("RunInTx = %v, want the function's error", err)
+	}
+
+	if _, _, err := s.EndChat(4, models.EndReasonUser); err != nil {
+		t.Fatalf("EndChat: %v", err)
+	}
+	// Nobody is waiting any more, so the order is random
+	matches := findMatches(3, time.Now().Add(time.Hour))
+	sort.Slice(matches, func(i, j int) bool { return matches[i] < matches[j] })
+	assertIDs(t, "matches after a rolled back block", matches, []int64{1, 2, 4})
+}
+
+func testWaitingAndActiveUsers(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, time.Second)
+	saveUser(t, s, 2, 0)
+	saveUser(t, s, 3, -1)
+	saveUser(t, s, 4, 2*time.Second)
+	saveUser(t, s, 5, 3*time.Second)
+
+	unreachable := getUser(t, s, 4)
+	unreachable.Unreachable = true
+	if err := s.SaveUserState(unreachable); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	offline := getUser(t, s, 3)
+	offline.IsActive = false
+	if err := s.SaveUserState(offline); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	waiting, err := s.GetWaitingUsers()
+	if err != nil {
+		t.Fatalf("GetWaitingUsers: %v", err)
+	}
+	assertIDs(t, "GetWaitingUsers", waiting, []int64{2, 1, 5})
+
+	pair(t, s, 1, 5)
+
+	waiting, err = s.GetWaitingUsers()
+	if err != nil {
+		t.Fatalf("GetWaitingUsers: %v", err)
+	}
+	assertIDs(t, "GetWaitingUsers after pairing", waiting, []int64{2})
+
+	active, err := s.GetActiveUsers()
+	if err != nil {
+		t.Fatalf("GetActiveUsers: %v", err)
+	}
+	if active != 3 {
+		t.Errorf("GetActiveUsers = %d, want 3", active)
+	}
+}
+
+func testConversations(t *testing.T, s store.Store) {
+	conversation, err := s.GetConversation(1)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if conversation.UserID != 1 || conversation.State != models.ConversationIdle {
+		t.Errorf("unknown conversation = %+v, want idle", conversation)
+	}
+
+	saved := &models.Conversation{
+		UserID:    1,
+		State:     models.ConversationAwaitingCountry,
+		Data:      "settings",
+		UpdatedAt: baseTime,
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.SaveConversation(saved); err != nil {
+			t.Fatalf("SaveConversation: %v", err)
+		}
+	}
+
+	conversation, err = s.GetConversation(1)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if conversation.State != saved.State || conversation.Data != saved.Data || !conversation.UpdatedAt.Equal(baseTime) {
+		t.Errorf("conversation = %+v, want %+v", conversation, saved)
+	}
+
+	if err := s.ClearConversation(1); err != nil {
+		t.Fatalf("ClearConversation: %v", err)
+	}
+
+	conversation, err = s.GetConversation(1)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if conversation.State != models.ConversationIdle {
+		t.Errorf("cleared conversation = %+v, want idle", conversation)
+	}
+}
+
+func testRelayedMessages(t *testing.T, s store.Store) {
+	relays := []models.RelayedMessage{
+		{SenderChatID: 1, OriginalMessageID: 10, RecipientChatID: 2, DeliveredMessageID: 100, CreatedAt: baseTime},
+		{SenderChatID: 1, OriginalMessageID: 10, RecipientChatID: 3, DeliveredMessageID: 200, CreatedAt: baseTime},
+		{SenderChatID: 1, OriginalMessageID: 12, RecipientChatID: 2, DeliveredMessageID: 102, CreatedAt: baseTime},
+		{SenderChatID: 2, OriginalMessageID: 50, RecipientChatID: 1, DeliveredMessageID: 11, CreatedAt: baseTime},
+	}
+	for i := range relays {
+		if err := s.SaveRelayedMessage(&relays[i]); err != nil {
+			t.Fatalf("SaveRelayedMessage: %v", err)
+		}
+	}
+
+	counterparts := []struct {
+		chatID    int64
+		messageID int
+		partnerID int64
+		want      int
+	}{
+		{1, 10, 2, 100}, // sent by the user
+		{1, 11, 2, 50},  // received from the partner
+		{2, 100, 1, 10}, // the partner's view of a received copy
+		{1, 10, 4, 0},   // not relayed to that partner
+		{1, 99, 2, 0},   // unknown message
+	}
+	for _, c := range counterparts {
+		got, err := s.FindCounterpart(c.chatID, c.messageID, c.partnerID)
+		if err != nil {
+			t.Fatalf("FindCounterpart: %v", err)
+		}
+		if got != c.want {
+			t.Errorf("FindCounterpart(%d, %d, %d) = %d, want %d", c.chatID, c.messageID, c.partnerID, got, c.want)
+		}
+	}
+
+	relayed, err := s.GetRelayedMessage(1, 10, 3)
+	if err != nil {
+		t.Fatalf("GetRelayedMessage: %v", err)
+	}
+	if relayed == nil || relayed.DeliveredMessageID != 200 || !relayed.CreatedAt.Equal(baseTime) {
+		t.Errorf("GetRelayedMessage = %+v, want delivered as 200", relayed)
+	}
+
+	missing, err := s.GetRelayedMessage(1, 12, 3)
+	if err != nil || missing != nil {
+		t.Errorf("GetRelayedMessage(unknown) = %+v, %v, want nil", missing, err)
+	}
+
+	copies, err := s.GetRelayedCopies(1, 10)
+	if err != nil {
+		t.Fatalf("GetRelayedCopies: %v", err)
+	}
+	if len(copies) != 2 {
+		t.Errorf("GetRelayedCopies = %+v, want 2 copies", copies)
+	}
+
+	last, err := s.GetLastRelayedMessageID(1)
+	if err != nil {
+		t.Fatalf("GetLastRelayedMessageID: %v", err)
+	}
+	if last != 12 {
+		t.Errorf("GetLastRelayedMessageID = %d, want 12", last)
+	}
+
+	last, err = s.GetLastRelayedMessageID(5)
+	if err != nil || last != 0 {
+		t.Errorf("GetLastRelayedMessageID(unknown) = %d, %v, want 0", last, err)
+	}
+
+	isCopy, err := s.IsRelayedCopy(1, 11)
+	if err != nil || !isCopy {
+		t.Errorf("IsRelayedCopy(1, 11) = %v, %v, want true", isCopy, err)
+	}
+	isCopy, err = s.IsRelayedCopy(1, 10)
+	if err != nil || isCopy {
+		t.Errorf("IsRelayedCopy(1, 10) = %v, %v, want false", isCopy, err)
+	}
+
+	// Saving again replaces the delivered copy
+	edited := relays[0]
+	edited.DeliveredMessageID = 101
+	if err := s.SaveRelayedMessage(&edited); err != nil {
+		t.Fatalf("SaveRelayedMessage: %v", err)
+	}
+	if got, _ := s.FindCounterpart(1, 10, 2); got != 101 {
+		t.Errorf("FindCounterpart after resave = %d, want 101", got)
+	}
+
+	if err := s.DeleteRelayedMessage(1, 10); err != nil {
+		t.Fatalf("DeleteRelayedMessage: %v", err)
+	}
+	copies, err = s.GetRelayedCopies(1, 10)
+	if err != nil || len(copies) != 0 {
+		t.Errorf("GetRelayedCopies after delete = %+v, %v, want none", copies, err)
+	}
+	if got, _ := s.FindCounterpart(1, 12, 2); got != 102 {
+		t.Errorf("FindCounterpart of another message = %d, want 102", got)
+	}
+}
+
+func testAlbumMessages(t *testing.T, s store.Store) {
+	relays := []models.RelayedMessage{
+		// An album of three parts, sent to two partners in turn
+		{SenderChatID: 1, OriginalMessageID: 21, RecipientChatID: 2, DeliveredMessageID: 121, CreatedAt: baseTime, MediaGroupID: "g1"},
+		{SenderChatID: 1, OriginalMessageID: 20, RecipientChatID: 2, DeliveredMessageID: 120, CreatedAt: baseTime, MediaGroupID: "g1"},
+		{SenderChatID: 1, OriginalMessageID: 22, RecipientChatID: 2, DeliveredMessageID: 122, CreatedAt: baseTime, MediaGroupID: "g1"},
+		{SenderChatID: 1, OriginalMessageID: 20, RecipientChatID: 3, DeliveredMessageID: 220, CreatedAt: baseTime, MediaGroupID: "g1"},
+		// Another album, another sender's album with the same ID, and a lone message
+		{SenderChatID: 1, OriginalMessageID: 30, RecipientChatID: 2, DeliveredMessageID: 130, CreatedAt: baseTime, MediaGroupID: "g2"},
+		{SenderChatID: 4, OriginalMessageID: 40, RecipientChatID: 1, DeliveredMessageID: 23, CreatedAt: baseTime, MediaGroupID: "g1"},
+		{SenderChatID: 1, OriginalMessageID: 31, RecipientChatID: 2, DeliveredMessageID: 131, CreatedAt: baseTime},
+	}
+	for i := range relays {
+		if err := s.SaveRelayedMessage(&relays[i]); err != nil {
+			t.Fatalf("SaveRelayedMessage: %v", err)
+		}
+	}
+
+	for _, messageID := range []int{20, 21, 22} {
+		got, err := s.GetAlbumMessageIDs(1, messageID)
+		if err != nil {
+			t.Fatalf("GetAlbumMessageIDs: %v", err)
+		}
+		if !reflect.DeepEqual(got, []int{20, 21, 22}) {
+			t.Errorf("GetAlbumMessageIDs(1, %d) = %v, want [20 21 22]", messageID, got)
+		}
+	}
+
+	for _, messageID := range []int{31, 99} {
+		got, err := s.GetAlbumMessageIDs(1, messageID)
+		if err != nil || len(got) != 0 {
+			t.Errorf("GetAlbumMessageIDs(1, %d) = %v, %v, want none", messageID, got, err)
+		}
+	}
+}
+
+func testOutbox(t *testing.T, s store.Store) {
+	messages := []models.QueuedMessage{
+		{ChatID: 1, Type: models.TextMessage, Text: "hello", Priority: models.PriorityRelay, SourceChatID: 2, SourceMessageID: 5},
+		{ChatID: 2, Type: models.MediaGroupMessage, Media: []models.MediaItem{{Type: models.PhotoMessage, FileID: "a"}}},
+		{ChatID: 3, Type: models.LocationMessage, Latitude: 1.5, Longitude: -2.25},
+	}
+
+	var ids []int64
+	for _, m := range messages {
+		id, err := s.InsertOutbox(m)
+		if err != nil {
+			t.Fatalf("InsertOutbox: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	pending, err := s.GetPendingOutbox()
+	if err != nil {
+		t.Fatalf("GetPendingOutbox: %v", err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("GetPendingOutbox returned %d entries, want 3", len(pending))
+	}
+	for i, entry := range pending {
+		if entry.ID != ids[i] || entry.Attempts != 0 || entry.CreatedAt.IsZero() {
+			t.Errorf("entry %d = %+v, want ID %d and no attempts", i, entry, ids[i])
+		}
+		if !reflect.DeepEqual(entry.Message, messages[i]) {
+			t.Errorf("entry %d message = %+v, want %+v", i, entry.Message, messages[i])
+		}
+	}
+
+	if err := s.UpdateOutboxAttempts(ids[0], 2, "timeout"); err != nil {
+		t.Fatalf("UpdateOutboxAttempts: %v", err)
+	}
+	if err := s.MarkOutboxSent(ids[1]); err != nil {
+		t.Fatalf("MarkOutboxSent: %v", err)
+	}
+	if err := s.MarkOutboxFailed(ids[2], 5, "blocked"); err != nil {
+		t.Fatalf("MarkOutboxFailed: %v", err)
+	}
+
+	pending, err = s.GetPendingOutbox()
+	if err != nil {
+		t.Fatalf("GetPendingOutbox: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != ids[0] || pending[0].Attempts != 2 {
+		t.Errorf("pending = %+v, want only the retried message with 2 attempts", pending)
+	}
+
+	// Nothing delivered long enough ago to purge yet
+	if err := s.PurgeOutbox(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("PurgeOutbox: %v", err)
+	}
+	if err := s.PurgeOutbox(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("PurgeOutbox: %v", err)
+	}
+
+	// Pending messages are never purged
+	pending, err = s.GetPendingOutbox()
+	if err != nil {
+		t.Fatalf("GetPendingOutbox: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("pending after purge = %+v, want the retried message", pending)
+	}
+
+	next, err := s.InsertOutbox(messages[0])
+	if err != nil {
+		t.Fatalf("InsertOutbox: %v", err)
+	}
+	if next <= ids[2] {
+		t.Errorf("new outbox ID %d is not after %d", next, ids[2])
+	}
+}
+
+func testReports(t *testing.T, s store.Store) {
+	reports := []models.Report{
+		{SessionID: 1, ReporterID: 1, ReportedID: 2, Reason: models.ReportSpam},
+		{SessionID: 1, ReporterID: 2, ReportedID: 1, Reason: models.ReportHarassment, Details: "rude"},
+		{SessionID: 2, ReporterID: 3, ReportedID: 2, Reason: models.ReportOther, Details: "weird"},
+	}
+
+	var ids []int64
+	for _, r := range reports {
+		id, created, err := s.CreateReport(&r)
+		if err != nil || !created {
+			t.Fatalf("CreateReport = %v, %v, want created", created, err)
+		}
+		ids = append(ids, id)
+	}
+
+	// A reporter can report a chat only once
+	duplicate := reports[0]
+	duplicate.Reason = models.ReportHate
+	if _, created, err := s.CreateReport(&duplicate); err != nil || created {
+		t.Errorf("CreateReport(duplicate) = %v, %v, want not created", created, err)
+	}
+
+	report, err := s.GetReport(ids[1])
+	if err != nil {
+		t.Fatalf("GetReport: %v", err)
+	}
+	want := reports[1]
+	if report == nil || report.ID != ids[1] || report.SessionID != want.SessionID || report.ReporterID != want.ReporterID ||
+		report.ReportedID != want.ReportedID || report.Reason != want.Reason || report.Details != want.Details ||
+		report.Status != models.ReportPending || report.CreatedAt.IsZero() || report.ResolvedAt != nil {
+		t.Errorf("GetReport = %+v, want pending %+v", report, want)
+	}
+
+	missing, err := s.GetReport(ids[2] + 1)
+	if err != nil || missing != nil {
+		t.Errorf("GetReport(unknown) = %+v, %v, want nil", missing, err)
+	}
+
+	pendingIDs := func(limit int) []int64 {
+		t.Helper()
+
+		pending, err := s.GetPendingReports(limit)
+		if err != nil {
+			t.Fatalf("GetPendingReports: %v", err)
+		}
+
+		var got []int64
+		for _, r := range pending {
+			got = append(got, r.ID)
+		}
+		return got
+	}
+	assertIDs(t, "pending reports", pendingIDs(10), ids)
+	assertIDs(t, "first pending report", pendingIDs(1), ids[:1])
+
+	// Resolving in a rolled back transaction changes nothing
+	errRollback := errors.New("rollback")
+	err = s.RunInTx(func(tx store.Tx) error {
+		if resolved, err := tx.ResolveReport(ids[0], models.ReportDismissed, 99); err != nil || !resolved {
+			t.Errorf("ResolveReport in tx = %v, %v, want true", resolved, err)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("RunInTx = %v, want the function's error", err)
+	}
+	assertIDs(t, "pending reports after rollback", pendingIDs(10), ids)
+
+	// A report is resolved only once
+	for i, wantResolved := range []bool{true, false} {
+		var resolved bool
+		err := s.RunInTx(func(tx store.Tx) error {
+			var err error
+			resolved, err = tx.ResolveReport(ids[0], models.ReportApproved, int64(99+i))
+			return err
+		})
+		if err != nil || resolved != wantResolved {
+			t.Errorf("ResolveReport attempt %d = %v, %v, want %v", i+1, resolved, err, wantResolved)
+		}
+	}
+
+	report, err = s.GetReport(ids[0])
+	if err != nil {
+		t.Fatalf("GetReport: %v", err)
+	}
+	if report.Status != models.ReportApproved || report.ResolvedBy != 99 || report.ResolvedAt == nil {
+		t.Errorf("resolved report = %+v, want approved by 99", report)
+	}
+	assertIDs(t, "pending reports after resolving", pendingIDs(10), ids[1:])
+
+	about, err := s.GetReportsAbout(2, 10)
+	if err != nil {
+		t.Fatalf("GetReportsAbout: %v", err)
+	}
+	var aboutIDs []int64
+	for _, r := range about {
+		aboutIDs = append(aboutIDs, r.ID)
+	}
+	assertIDs(t, "reports about user 2", aboutIDs, []int64{ids[2], ids[0]})
+}
+
+func testBans(t *testing.T, s store.Store) {
+	for id := int64(1); id <= 3; id++ {
+		saveUser(t, s, id, time.Duration(id)*time.Second)
+	}
+
+	ban, err := s.GetBan(2)
+	if err != nil || ban != nil {
+		t.Errorf("GetBan before banning = %+v, %v, want nil", ban, err)
+	}
+
+	banUser := func(ban models.Ban) {
+		t.Helper()
+
+		if err := s.RunInTx(func(tx store.Tx) error { return tx.BanUser(&ban) }); err != nil {
+			t.Fatalf("BanUser: %v", err)
+		}
+	}
+
+	banUser(models.Ban{UserID: 2, Kind: models.BanShadow, Reason: "spam", BannedBy: 99})
+	banUser(models.Ban{UserID: 2, Kind: models.BanPermanent, Reason: "harassment", BannedBy: 98})
+
+	// Banning again replaces the ban
+	ban, err = s.GetBan(2)
+	if err != nil {
+		t.Fatalf("GetBan: %v", err)
+	}
+	if ban == nil || ban.UserID != 2 || ban.Kind != models.BanPermanent || ban.Reason != "harassment" || ban.BannedBy != 98 ||
+		ban.CreatedAt.IsZero() || ban.ExpiresAt != nil {
+		t.Errorf("GetBan = %+v, want the latest ban by 98", ban)
+	}
+
+	matches, err := s.FindPotentialMatches(1, time.Now())
+	if err != nil {
+		t.Fatalf("FindPotentialMatches: %v", err)
+	}
+	assertIDs(t, "matches with a banned user", matches, []int64{3})
+
+	// An expired ban no longer counts
+	expired := time.Now().Add(-time.Minute)
+	banUser(models.Ban{UserID: 3, Kind: models.BanTemporary, Reason: "spam", BannedBy: 99, ExpiresAt: &expired})
+	if ban, err := s.GetBan(3); err != nil || ban != nil {
+		t.Errorf("GetBan(expired) = %+v, %v, want nil", ban, err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	banUser(models.Ban{UserID: 1, Kind: models.BanTemporary, Reason: "spam", BannedBy: 99, ExpiresAt: &expires})
+	ban, err = s.GetBan(1)
+	if err != nil {
+		t.Fatalf("GetBan: %v", err)
+	}
+	if ban == nil || ban.Kind != models.BanTemporary || ban.ExpiresAt == nil || !ban.ExpiresAt.Equal(expires) {
+		t.Errorf("GetBan(temporary) = %+v, want a ban until %v", ban, expires)
+	}
+
+	matches, err = s.FindPotentialMatches(2, time.Now())
+	if err != nil {
+		t.Fatalf("FindPotentialMatches: %v", err)
+	}
+	assertIDs(t, "matches with a temporary and an expired ban", matches, []int64{3})
+
+	// Unbanning is rolled back with its transaction
+	errRollback := errors.New("rollback")
+	err = s.RunInTx(func(tx store.Tx) error {
+		if lifted, err := tx.UnbanUser(2); err != nil || !lifted {
+			t.Errorf("UnbanUser in tx = %v, %v, want true", lifted, err)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("RunInTx = %v, want the function's error", err)
+	}
+	if ban, _ := s.GetBan(2); ban == nil {
+		t.Error("ban lifted by a rolled back transaction")
+	}
+
+	for i, wantLifted := range []bool{true, false} {
+		var lifted bool
+		err := s.RunInTx(func(tx store.Tx) error {
+			var err error
+			lifted, err = tx.UnbanUser(2)
+			return err
+		})
+		if err != nil || lifted != wantLifted {
+			t.Errorf("UnbanUser attempt %d = %v, %v, want %v", i+1, lifted, err, wantLifted)
+		}
+	}
+	if ban, err := s.GetBan(2); err != nil || ban != nil {
+		t.Errorf("GetBan after unbanning = %+v, %v, want nil", ban, err)
+	}
+}
+
+func testShadowbans(t *testing.T, s store.Store) {
+	for id := int64(1); id <= 5; id++ {
+		saveUser(t, s, id, time.Duration(id)*time.Second)
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	later := time.Now().Add(time.Hour)
+	bans := []models.Ban{
+		{UserID: 2, Kind: models.BanShadow},
+		{UserID: 3, Kind: models.BanShadow, ExpiresAt: &later},
+		{UserID: 4, Kind: models.BanShadow, ExpiresAt: &expired},
+		{UserID: 5, Kind: models.BanPermanent},
+	}
+	err := s.RunInTx(func(tx store.Tx) error {
+		for i := range bans {
+			if err := tx.BanUser(&bans[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("BanUser: %v", err)
+	}
+
+	findMatches := func(userID int64) []int64 {
+		t.Helper()
+
+		matches, err := s.FindPotentialMatches(userID, time.Now())
+		if err != nil {
+			t.Fatalf("FindPotentialMatches: %v", err)
+		}
+		return matches
+	}
+
+	// Shadowbanned users only meet each other; an expired shadowban no longer counts
+	assertIDs(t, "matches of a user in good standing", findMatches(1), []int64{4})
+	assertIDs(t, "matches of a shadowbanned user", findMatches(2), []int64{3})
+	assertIDs(t, "matches of a temporarily shadowbanned user", findMatches(3), []int64{2})
+	assertIDs(t, "matches of a user whose shadowban expired", findMatches(4), []int64{1})
+
+	ban, err := s.GetBan(2)
+	if err != nil || ban == nil || !ban.IsShadow() {
+		t.Errorf("GetBan(shadowbanned) = %+v, %v, want a shadowban", ban, err)
+	}
+}
+
+func testExpireBans(t *testing.T, s store.Store) {
+	expired := time.Now().Add(-time.Minute)
+	later := time.Now().Add(time.Hour)
+	bans := []models.Ban{
+		{UserID: 1, Kind: models.BanTemporary, Reason: "spam", ExpiresAt: &expired},
+		{UserID: 2, Kind: models.BanTemporary, ExpiresAt: &later},
+		{UserID: 3, Kind: models.BanShadow, ExpiresAt: &expired},
+		{UserID: 4, Kind: models.BanPermanent},
+	}
+	err := s.RunInTx(func(tx store.Tx) error {
+		for i := range bans {
+			if err := tx.BanUser(&bans[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("BanUser: %v", err)
+	}
+
+	expire := func() []models.Ban {
+		t.Helper()
+
+		var lifted []models.Ban
+		err := s.RunInTx(func(tx store.Tx) error {
+			var err error
+			lifted, err = tx.ExpireBans(time.Now())
+			return err
+		})
+		if err != nil {
+			t.Fatalf("ExpireBans: %v", err)
+		}
+
+		sort.Slice(lifted, func(i, j int) bool { return lifted[i].UserID < lifted[j].UserID })
+		return lifted
+	}
+
+	lifted := expire()
+	if len(lifted) != 2 || lifted[0].UserID != 1 || lifted[0].Kind != models.BanTemporary || lifted[0].Reason != "spam" ||
+		lifted[1].UserID != 3 || lifted[1].Kind != models.BanShadow {
+		t.Errorf("ExpireBans = %+v, want the bans of users 1 and 3", lifted)
+	}
+
+	// Expired bans are gone, so nothing is lifted twice
+	if lifted := expire(); len(lifted) != 0 {
+		t.Errorf("ExpireBans again = %+v, want none", lifted)
+	}
+
+	for _, userID := range []int64{2, 4} {
+		if ban, err := s.GetBan(userID); err != nil || ban == nil {
+			t.Errorf("GetBan(%d) = %+v, %v, want the ban kept", userID, ban, err)
+		}
+	}
+}
+
+func testAdminActions(t *testing.T, s store.Store) {
+	actions := []models.AdminAction{
+		{AdminID: 99, Action: models.AdminBan, TargetID: 1, Details: "spam"},
+		{AdminID: 99, Action: models.AdminStats},
+		{AdminID: 98, Action: models.AdminUnban, TargetID: 1, Details: "appeal"},
+		{AdminID: 98, Action: models.AdminKick, TargetID: 2},
+	}
+	for i := range actions {
+		err := s.RunInTx(func(tx store.Tx) error { return tx.RecordAdminAction(&actions[i]) })
+		if err != nil {
+			t.Fatalf("RecordAdminAction: %v", err)
+		}
+	}
+
+	// Actions are rolled back with their transaction
+	errRollback := errors.New("rollback")
+	err := s.RunInTx(func(tx store.Tx) error {
+		if err := tx.RecordAdminAction(&models.AdminAction{AdminID: 97, Action: models.AdminKick, TargetID: 1}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("RunInTx = %v, want the function's error", err)
+	}
+
+	got, err := s.GetAdminActions(1, 10)
+	if err != nil {
+		t.Fatalf("GetAdminActions: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("GetAdminActions = %+v, want 2 actions", got)
+	}
+	want := []models.AdminAction{actions[2], actions[0]}
+	for i, action := range got {
+		if action.ID == 0 || action.AdminID != want[i].AdminID || action.Action != want[i].Action ||
+			action.TargetID != 1 || action.Details != want[i].Details || action.CreatedAt.IsZero() {
+			t.Errorf("action %d = %+v, want %+v", i, action, want[i])
+		}
+	}
+	if got[0].ID <= got[1].ID {
+		t.Errorf("action IDs %d, %d are not newest first", got[0].ID, got[1].ID)
+	}
+
+	got, err = s.GetAdminActions(1, 1)
+	if err != nil || len(got) != 1 || got[0].Action != models.AdminUnban {
+		t.Errorf("GetAdminActions(limit 1) = %+v, %v, want the unban", got, err)
+	}
+}
+
+func testStats(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, time.Second)
+	saveUser(t, s, 2, 2*time.Second)
+	saveUser(t, s, 3, -1)
+	saveUser(t, s, 4, -1)
+	pair(t, s, 3, 4)
+
+	offline := models.NewUserState(5)
+	offline.LastActivity = baseTime
+	if err := s.SaveUserState(offline); err != nil {
+		t.Fatalf("SaveUserState: %v", err)
+	}
+
+	if _, _, err := s.CreateReport(&models.Report{SessionID: 1, ReporterID: 3, ReportedID: 4, Reason: models.ReportSpam}); err != nil {
+		t.Fatalf("CreateReport: %v", err)
+	}
+	err := s.RunInTx(func(tx store.Tx) error {
+		expired := time.Now().Add(-time.Minute)
+		if err := tx.BanUser(&models.Ban{UserID: 5, Kind: models.BanTemporary, ExpiresAt: &expired}); err != nil {
+			return err
+		}
+		if err := tx.BanUser(&models.Ban{UserID: 1, Kind: models.BanShadow}); err != nil {
+			return err
+		}
+		return tx.BanUser(&models.Ban{UserID: 2, Kind: models.BanPermanent})
+	})
+	if err != nil {
+		t.Fatalf("BanUser: %v", err)
+	}
+
+	stats, err := s.GetStats(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("GetStats: %v", err)
+	}
+	want := models.Stats{
+		Users:             5,
+		OnlineUsers:       4,
+		ChattingUsers:     2,
+		WaitingUsers:      2,
+		ChatsStarted:      1,
+		PendingReports:    1,
+		BannedUsers:       1,
+		ShadowbannedUsers: 1,
+	}
+	if *stats != want {
+		t.Errorf("GetStats = %+v, want %+v", *stats, want)
+	}
+
+	stats, err = s.GetStats(time.Now().Add(time.Hour))
+	if err != nil || stats.ChatsStarted != 0 {
+		t.Errorf("GetStats(later) = %+v, %v, want no chats started", stats, err)
+	}
+}
+
+func testRunInTx(t *testing.T, s store.Store) {
+	saveUser(t, s, 1, -1)
+	saveUser(t, s, 2, -1)
+
+	errRollback := errors.New("rollback")
+	hookRan := false
+
+	err := s.RunInTx(func(tx store.Tx) error {
+		state, err := tx.GetUserState(1)
+		if err != nil {
+			return err
+		}
+		state.Settings.Profile.Country = "DE"
+		if err := tx.SaveUserState(state); err != nil {
+			return err
+		}
+
+		if paired, err := tx.PairUsers(1, 2); err != nil || !paired {
+			t.Errorf("PairUsers in tx = %v, %v, want true", paired, err)
+		}
+		if _, err := tx.InsertOutbox(models.QueuedMessage{ChatID: 1, Text: "lost"}); err != nil {
+			return err
+		}
+
+		tx.AfterCommit(func() { hookRan = true })
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("RunInTx = %v, want the function's error", err)
+	}
+	if hookRan {
+		t.Error("AfterCommit hook ran after a rollback")
+	}
+
+	rolledBack := getUser(t, s, 1)
+	if rolledBack.Settings.Profile.Country != "" || rolledBack.CurrentChat != 0 {
+		t.Errorf("user after rollback = %+v, want unchanged", rolledBack)
+	}
+	if pending, _ := s.GetPendingOutbox(); len(pending) != 0 {
+		t.Errorf("outbox after rollback = %+v, want empty", pending)
+	}
+	if session, _ := s.GetCurrentChatSession(1); session != nil {
+		t.Errorf("session after rollback = %+v, want none", session)
+	}
+
+	err = s.RunInTx(func(tx store.Tx) error {
+		if paired, err := tx.PairUsers(1, 2); err != nil || !paired {
+			t.Errorf("PairUsers in tx = %v, %v, want true", paired, err)
+		}
+		if _, err := tx.InsertOutbox(models.QueuedMessage{ChatID: 1, Text: "kept"}); err != nil {
+			return err
+		}
+
+		tx.AfterCommit(func() {
+			hookRan = true
+
+			// Hooks run once the changes are visible
+			if chat := getUser(t, s, 1).CurrentChat; chat != 2 {
+				t.Errorf("CurrentChat in AfterCommit hook = %d, want 2", chat)
+			}
+		})
+
+		// The transaction sees its own changes
+		state, err := tx.GetUserState(2)
+		if err != nil {
+			return err
+		}
+		if state.CurrentChat != 1 {
+			t.Errorf("CurrentChat in tx = %d, want 1", state.CurrentChat)
+		}
+
+		partnerID, ended, err := tx.EndChat(2, models.EndReasonUser)
+		if err != nil || !ended || partnerID != 1 {
+			t.Errorf("EndChat in tx = (%d, %v, %v), want (1, true, nil)", partnerID, ended, err)
+		}
+
+		paired, err := tx.PairUsers(2, 1)
+		if err != nil || !paired {
+			t.Errorf("PairUsers in tx after EndChat = %v, %v, want true", paired, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunInTx: %v", err)
+	}
+	if !hookRan {
+		t.Error("AfterCommit hook didn't run after a commit")
+	}
+
+	if pending, _ := s.GetPendingOutbox(); len(pending) != 1 || pending[0].Message.Text != "kept" {
+		t.Errorf("outbox after commit = %+v, want the kept message", pending)
+	}
+
+	sessions, err := s.GetChatSessions(1, 10)
+	if err != nil {
+		t.Fatalf("GetChatSessions: %v", err)
+	}
+	if len(sessions) != 2 || !sessions[0].IsOpen() || sessions[1].IsOpen() {
+		t.Errorf("sessions after commit = %+v, want one open and one ended", sessions)
+	}
+}
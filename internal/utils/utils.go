@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
@@ -28,3 +31,31 @@ func FormatTimestamp(t time.Time) string {
 func ParseTimestamp(timestamp string) (time.Time, error) {
 	return time.Parse(time.RFC3339, timestamp)
 }
+
+// ParseDuration parses a duration like time.ParseDuration, also accepting
+// whole days ("7d") and weeks ("2w")
+func ParseDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+
+	for suffix, unit := range units {
+		if !strings.HasSuffix(value, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * unit, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	return d, nil
+}
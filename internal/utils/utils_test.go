@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/regiwitanto/tele-anonymous-chat/internal/models"
+)
+
+func TestCheckMatchTimeout(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		started := time.Now().Add(-d)
+		return &started
+	}
+
+	tests := []struct {
+		name    string
+		started *time.Time
+		want    bool
+	}{
+		{"not searching", nil, false},
+		{"just started", ago(0), false},
+		{"within the timeout", ago(time.Minute), false},
+		{"past the timeout", ago(3 * time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := models.NewUserState(1)
+			state.MatchStartTime = tt.started
+			if got := CheckMatchTimeout(state, 2*time.Minute); got != tt.want {
+				t.Errorf("CheckMatchTimeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		// Go units
+		{"90s", 90 * time.Second, false},
+		{"30m", 30 * time.Minute, false},
+		{"2h", 2 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+
+		// Days and weeks
+		{"1d", 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+
+		// Bare numbers have no unit
+		{"30", 0, true},
+		{"0", 0, true},
+
+		// Durations must be positive
+		{"-1h", 0, true},
+		{"-3d", 0, true},
+		{"0d", 0, true},
+		{"0s", 0, true},
+
+		// Garbage
+		{"", 0, true},
+		{"forever", 0, true},
+		{"d", 0, true},
+		{"1.5d", 0, true},
+		{"7x", 0, true},
+		{"2 w", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseDuration(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseDuration(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
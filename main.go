@@ -2,21 +2,34 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/regiwitanto/tele-anonymous-chat/internal/bot"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/config"
 	"github.com/regiwitanto/tele-anonymous-chat/internal/database"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store"
+	"github.com/regiwitanto/tele-anonymous-chat/internal/store/pgstore"
 )
 
 func main() {
 	// Parse command line flags
-	dbPath := flag.String("db", "database.db", "Path to SQLite database file")
+	dbPath := flag.String("db", "database.db", "Path to SQLite database file (sqlite storage backend)")
+	databaseURL := flag.String("database-url", "", "PostgreSQL connection string; migrate manages this database instead of the SQLite file")
 	flag.Parse()
 
+	// Schema maintenance doesn't need the bot
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(*dbPath, *databaseURL, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize logging
 	log.SetOutput(os.Stdout)
 	log.Println("Starting Telegram Anonymous P2P Chat Bot...")
@@ -24,13 +37,13 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
-	// Initialize database
-	db, err := database.NewDB(*dbPath)
+	// Initialize storage
+	db, err := bot.OpenStore(cfg, *dbPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to initialize %s storage: %v", cfg.StorageBackend, err)
 	}
 	defer db.Close()
-	log.Println("Database initialized")
+	log.Printf("Storage initialized (%s)", cfg.StorageBackend)
 
 	// Create bot instance
 	telegramBot, err := bot.NewBot(cfg, db)
@@ -57,3 +70,73 @@ func main() {
 	telegramBot.Stop()
 	log.Println("Bot stopped successfully")
 }
+
+// runMigrate handles the migrate subcommand: status, up, or down <version>.
+// It manages the PostgreSQL database at databaseURL if set, and the SQLite
+// file at dbPath otherwise.
+func runMigrate(dbPath string, databaseURL string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status | up | down <version>")
+	}
+
+	db, err := openMigrator(dbPath, databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "status":
+	case "up":
+		if err := db.Migrate(); err != nil {
+			return err
+		}
+	case "down":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate down <version>")
+		}
+
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		if err := db.MigrateTo(version); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		applied := "pending"
+		if status.Applied {
+			applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, applied)
+	}
+
+	return nil
+}
+
+// openMigrator opens the database the migrate subcommand manages
+func openMigrator(dbPath string, databaseURL string) (store.Migrator, error) {
+	if databaseURL != "" {
+		s, err := pgstore.Open(databaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	db, err := database.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}